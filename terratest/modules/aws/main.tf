@@ -9,10 +9,21 @@ terraform {
 }
 
 provider "aws" {
-  region = "us-east-2"
+  region = var.aws_region
+
+  # Ownership and cost-allocation tags on every taggable resource
+  default_tags {
+    tags = var.default_tags
+  }
 }
 
 # Variables - only declare what we need at root level
+variable "aws_region" {
+  type        = string
+  description = "AWS region the environment is deployed to"
+  default     = "us-east-2"
+}
+
 variable "total_rancher_instances" {
   type        = number
   description = "Total number of Rancher instances (host + tenants)"
@@ -82,6 +93,28 @@ variable "aws_ec2_instance_type" {
   default     = "m5.large"
 }
 
+variable "aws_node_addressing" {
+  type        = string
+  description = "How nodes are addressed: public_ip, elastic_ip or route53"
+  default     = "public_ip"
+}
+
+variable "default_tags" {
+  type        = map(string)
+  description = "Tags applied to every resource through the provider"
+  default     = {}
+}
+
+variable "instance_overrides" {
+  type = map(object({
+    aws_ec2_instance_type       = optional(string)
+    aws_ami                     = optional(string)
+    aws_rds_snapshot_identifier = optional(string)
+  }))
+  description = "Per-instance overrides keyed by instance index (1 = host)"
+  default     = {}
+}
+
 # Module configuration
 locals {
   rancher_instances = {
@@ -102,38 +135,53 @@ module "high-availability-infrastructure" {
   aws_subnet_a          = var.aws_subnet_a
   aws_subnet_b          = var.aws_subnet_b
   aws_subnet_c          = var.aws_subnet_c
-  aws_ami               = var.aws_ami
+  aws_ami               = coalesce(try(var.instance_overrides[each.key].aws_ami, null), var.aws_ami)
   aws_subnet_id         = var.aws_subnet_id
   aws_security_group_id = var.aws_security_group_id
   aws_pem_key_name      = var.aws_pem_key_name
   aws_rds_password      = var.aws_rds_password
   aws_route53_fqdn      = var.aws_route53_fqdn
-  aws_ec2_instance_type = var.aws_ec2_instance_type
+  aws_ec2_instance_type = coalesce(try(var.instance_overrides[each.key].aws_ec2_instance_type, null), var.aws_ec2_instance_type)
+  aws_node_addressing   = var.aws_node_addressing
+  resource_tags         = var.default_tags
+
+  aws_rds_snapshot_identifier = try(var.instance_overrides[each.key].aws_rds_snapshot_identifier, null)
 }
 
 # Outputs - following the same pattern as ha-rancher-rke2 repo
 output "rancher_details" {
   value = {
     for idx, instance in module.high-availability-infrastructure : "infra_${idx}" => {
-      server1_ip     = instance.server1_ip
-      server2_ip     = instance.server2_ip
-      mysql_endpoint = instance.mysql_endpoint
-      mysql_password = instance.mysql_password
-      rancher_url    = instance.rancher_url
+      server1_ip          = instance.server1_ip
+      server2_ip          = instance.server2_ip
+      server1_instance_id = instance.server1_instance_id
+      server2_instance_id = instance.server2_instance_id
+      server1_address     = instance.server1_address
+      server2_address     = instance.server2_address
+      mysql_endpoint      = instance.mysql_endpoint
+      mysql_password      = instance.mysql_password
+      rancher_url         = instance.rancher_url
     }
   }
   sensitive = true
 }
 
-output "flat_outputs" {
-  value = merge([
-    for idx, instance in module.high-availability-infrastructure : {
-      (format("infra%d_server1_ip", idx))     = instance.server1_ip
-      (format("infra%d_server2_ip", idx))     = instance.server2_ip
-      (format("infra%d_mysql_endpoint", idx)) = instance.mysql_endpoint
-      (format("infra%d_mysql_password", idx)) = instance.mysql_password
-      (format("infra%d_rancher_url", idx))    = instance.rancher_url
+# One typed object per Rancher instance, ordered host first. The Go side
+# decodes this into ClusterInfra.
+output "clusters" {
+  value = [
+    for i in range(1, var.total_rancher_instances + 1) : {
+      index            = i
+      nodes            = module.high-availability-infrastructure[i].nodes
+      mysql_endpoint   = module.high-availability-infrastructure[i].mysql_endpoint
+      mysql_password   = module.high-availability-infrastructure[i].mysql_password
+      rancher_url      = module.high-availability-infrastructure[i].rancher_url
+      rds_cluster_id   = module.high-availability-infrastructure[i].rds_cluster_id
+      rds_instance_ids = module.high-availability-infrastructure[i].rds_instance_ids
+      alb_arn          = module.high-availability-infrastructure[i].alb_arn
+      route53_zone_id  = module.high-availability-infrastructure[i].route53_zone_id
+      route53_record   = module.high-availability-infrastructure[i].route53_record
     }
-  ]...)
+  ]
   sensitive = true
 }
@@ -75,13 +75,14 @@ resource "aws_instance" "aws_instance" {
     fi
   EOF
 
+  # Provider default_tags do not reach volumes created through root_block_device
   root_block_device {
     volume_size = 200
-    tags = {
+    tags = merge(var.resource_tags, {
       Name        = "${random_pet.random_pet.keepers.aws_prefix}-${random_pet.random_pet.id}"
       DoNotDelete = "True"
       Owner       = "${var.aws_prefix}-terraform"
-    }
+    })
   }
 
   tags = {
@@ -91,6 +92,29 @@ resource "aws_instance" "aws_instance" {
   }
 }
 
+# Elastic IPs keep node addresses stable across EC2 stop/start
+resource "aws_eip" "node" {
+  count    = var.aws_node_addressing == "elastic_ip" ? length(aws_instance.aws_instance) : 0
+  domain   = "vpc"
+  instance = aws_instance.aws_instance[count.index].id
+
+  tags = {
+    Name        = "${random_pet.random_pet.keepers.aws_prefix}-${random_pet.random_pet.id}-node${count.index + 1}"
+    DoNotDelete = "True"
+    Owner       = "${var.aws_prefix}-terraform"
+  }
+}
+
+# Per-node DNS names; the A records follow the public IP on every apply
+resource "aws_route53_record" "node" {
+  count   = var.aws_node_addressing == "route53" ? length(aws_instance.aws_instance) : 0
+  zone_id = data.aws_route53_zone.zone.zone_id
+  name    = "${var.aws_prefix}-${random_pet.random_pet.id}-node${count.index + 1}"
+  type    = "A"
+  ttl     = "60"
+  records = [aws_instance.aws_instance[count.index].public_ip]
+}
+
 resource "aws_lb_target_group" "aws_lb_target_group_80" {
   name        = "${var.aws_prefix}-80-${random_pet.random_pet.id}"
   port        = 80
@@ -155,6 +179,11 @@ resource "aws_lb_listener" "aws_lb_listener_80" {
   }
 }
 
+# Aurora spreads across the first three AZs of the provider region
+data "aws_availability_zones" "available" {
+  state = "available"
+}
+
 resource "aws_rds_cluster" "aws_rds_cluster" {
   cluster_identifier      = "${var.aws_prefix}-${random_pet.random_pet_rds.id}"
   engine                  = "aurora-mysql"
@@ -165,13 +194,16 @@ resource "aws_rds_cluster" "aws_rds_cluster" {
   # Keeps things moving if a previous QA environment wasn't fully cleaned up
   allow_major_version_upgrade = true
 
-  availability_zones      = ["us-east-2a", "us-east-2b", "us-east-2c"]
+  availability_zones      = slice(data.aws_availability_zones.available.names, 0, min(3, length(data.aws_availability_zones.available.names)))
   database_name           = "db${random_pet.random_pet_rds.id}"
   master_username         = "tfadmin"
   master_password         = var.aws_rds_password
   backup_retention_period = 5
   preferred_backup_window = "07:00-09:00"
   skip_final_snapshot     = true
+
+  # Starts the cluster from a datastore snapshot instead of an empty database
+  snapshot_identifier = var.aws_rds_snapshot_identifier
 }
 
 resource "aws_rds_cluster_instance" "aws_rds_cluster_instance" {
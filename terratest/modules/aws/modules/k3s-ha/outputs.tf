@@ -1,9 +1,36 @@
+locals {
+  node_public_ips = [
+    for i, instance in aws_instance.aws_instance :
+    var.aws_node_addressing == "elastic_ip" ? aws_eip.node[i].public_ip : instance.public_ip
+  ]
+  node_addresses = [
+    for i, ip in local.node_public_ips :
+    var.aws_node_addressing == "route53" ? aws_route53_record.node[i].fqdn : ip
+  ]
+}
+
 output "server1_ip" {
-  value = aws_instance.aws_instance[0].public_ip
+  value = local.node_public_ips[0]
 }
 
 output "server2_ip" {
-  value = aws_instance.aws_instance[1].public_ip
+  value = local.node_public_ips[1]
+}
+
+output "server1_instance_id" {
+  value = aws_instance.aws_instance[0].id
+}
+
+output "server2_instance_id" {
+  value = aws_instance.aws_instance[1].id
+}
+
+output "server1_address" {
+  value = local.node_addresses[0]
+}
+
+output "server2_address" {
+  value = local.node_addresses[1]
 }
 
 output "mysql_password" {
@@ -18,3 +45,33 @@ output "mysql_endpoint" {
 output "rancher_url" {
   value = aws_route53_record.aws_route53_record.fqdn
 }
+
+output "nodes" {
+  value = [
+    for i, instance in aws_instance.aws_instance : {
+      instance_id = instance.id
+      public_ip   = local.node_public_ips[i]
+      address     = local.node_addresses[i]
+    }
+  ]
+}
+
+output "rds_cluster_id" {
+  value = aws_rds_cluster.aws_rds_cluster.id
+}
+
+output "rds_instance_ids" {
+  value = aws_rds_cluster_instance.aws_rds_cluster_instance[*].identifier
+}
+
+output "alb_arn" {
+  value = aws_lb.aws_lb.arn
+}
+
+output "route53_zone_id" {
+  value = data.aws_route53_zone.zone.zone_id
+}
+
+output "route53_record" {
+  value = aws_route53_record.aws_route53_record.fqdn
+}
@@ -54,7 +54,30 @@ variable "aws_rds_password" {
   description = "Password for the Amazon Aurora MySQL database."
 }
 
+variable "aws_rds_snapshot_identifier" {
+  type        = string
+  description = "Optional RDS cluster snapshot to create the Aurora cluster from."
+  default     = null
+}
+
 variable "aws_ec2_instance_type" {
   type        = string
   description = "AWS EC2 instance type to use."
 }
+
+variable "aws_node_addressing" {
+  type        = string
+  description = "How nodes are addressed: public_ip, elastic_ip or route53."
+  default     = "public_ip"
+
+  validation {
+    condition     = contains(["public_ip", "elastic_ip", "route53"], var.aws_node_addressing)
+    error_message = "aws_node_addressing must be one of public_ip, elastic_ip or route53."
+  }
+}
+
+variable "resource_tags" {
+  type        = map(string)
+  description = "Tags the provider default_tags cannot apply, such as root volume tags"
+  default     = {}
+}
@@ -0,0 +1,452 @@
+package test
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	toolkit "github.com/brudnak/hosted-tenant-rancher/tools"
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultAirgapSourceRegistry    = "docker.io"
+	defaultAirgapMirrorConcurrency = 4
+
+	airgapK3SArtifactPrefix = "k3s-artifacts"
+	// Presigned artifact URLs must outlive a full TestHosted or TestUpgradeK3S run.
+	airgapK3SArtifactURLLifetime = 12 * time.Hour
+)
+
+var (
+	rancherImageValuePattern    = regexp.MustCompile(`--set rancherImage=([^'"\s\\]+)`)
+	rancherImageTagValuePattern = regexp.MustCompile(`--set rancherImageTag=([^'"\s\\]+)`)
+)
+
+// applyAirgapDefaults turns on the settings airgap mode depends on: the K3s
+// image bundle is preloaded and the mirror registry becomes the system default
+// registry for K3s and Rancher.
+func applyAirgapDefaults() error {
+	if !toolkit.AirgapEnabled() {
+		return nil
+	}
+
+	registry := toolkit.AirgapRegistry()
+	if registry == "" {
+		return fmt.Errorf("airgap.registry must be set when airgap.enabled is true")
+	}
+	if strings.Contains(registry, "://") {
+		return fmt.Errorf("airgap.registry must be a registry host such as registry.example.com:5000, not a URL")
+	}
+
+	viper.Set("k3s.preload_images", true)
+	if current := toolkit.SystemDefaultRegistry(); current == "" {
+		viper.Set("registries.system_default_registry", registry)
+	} else if current != registry {
+		return fmt.Errorf("registries.system_default_registry (%s) must match airgap.registry (%s)", current, registry)
+	}
+
+	log.Printf("[airgap] Installing from the airgap bundle with images from %s", registry)
+	return nil
+}
+
+// collectAirgapImages builds the image list for every instance: the Rancher
+// release list for its chart version, the K3s release list for its K3s
+// version and any image overrides in the helm command.
+func collectAirgapImages(plans []*RancherResolvedPlan, helmCommands, k3sVersions []string) ([]string, error) {
+	if listFile := strings.TrimSpace(viper.GetString("airgap.image_list_file")); listFile != "" {
+		if !filepath.IsAbs(listFile) && viper.ConfigFileUsed() != "" {
+			listFile = filepath.Join(filepath.Dir(viper.ConfigFileUsed()), listFile)
+		}
+		content, err := os.ReadFile(listFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read airgap.image_list_file: %w", err)
+		}
+		log.Printf("[airgap] Using image list from %s", listFile)
+		return parseImageList(string(content)), nil
+	}
+
+	seen := map[string]bool{}
+	var images []string
+	addImages := func(list []string) {
+		for _, image := range list {
+			if !seen[image] {
+				seen[image] = true
+				images = append(images, image)
+			}
+		}
+	}
+
+	for i, helmCommand := range helmCommands {
+		chartVersion := extractHelmChartVersion(helmCommand)
+		if i < len(plans) && plans[i] != nil && plans[i].ChartVersion != "" {
+			chartVersion = plans[i].ChartVersion
+		}
+		if chartVersion == "" {
+			return nil, fmt.Errorf("could not determine the Rancher chart version for instance %d; set airgap.image_list_file", i+1)
+		}
+
+		body, err := fetchURLBody(buildRancherImageListURL(chartVersion))
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch rancher-images.txt for %s (set airgap.image_list_file for unreleased versions): %w", chartVersion, err)
+		}
+		addImages(parseImageList(body))
+		addImages(helmOverrideImages(helmCommand))
+	}
+
+	for _, k3sVersion := range k3sVersions {
+		body, err := fetchURLBody(buildK3SImageListURL(k3sVersion))
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch k3s-images.txt for %s: %w", k3sVersion, err)
+		}
+		addImages(parseImageList(body))
+	}
+
+	sort.Strings(images)
+	return images, nil
+}
+
+// mirrorAirgapImages copies every image into airgap.registry with skopeo,
+// keeping the repository path so systemDefaultRegistry resolves them.
+func mirrorAirgapImages(images []string) error {
+	registry := toolkit.AirgapRegistry()
+	if viper.GetBool("airgap.skip_mirror") {
+		log.Printf("[airgap] airgap.skip_mirror is set; expecting %d image(s) to already be in %s", len(images), registry)
+		return nil
+	}
+
+	skopeoArgs, cleanup, err := airgapSkopeoArgs(registry)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	concurrency := viper.GetInt("airgap.mirror_concurrency")
+	if concurrency <= 0 {
+		concurrency = defaultAirgapMirrorConcurrency
+	}
+	log.Printf("[airgap] Mirroring %d image(s) to %s with %d worker(s)...", len(images), registry, concurrency)
+
+	jobs := make(chan string)
+	var (
+		mu       sync.Mutex
+		failures []string
+		copied   int
+		wg       sync.WaitGroup
+	)
+	for worker := 0; worker < concurrency; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for image := range jobs {
+				source, destination := airgapImageReferences(image, registry)
+				args := append([]string{"copy", "--all", "--retry-times", "3"}, skopeoArgs...)
+				args = append(args, "docker://"+source, "docker://"+destination)
+
+				output, err := exec.Command("skopeo", args...).CombinedOutput()
+
+				mu.Lock()
+				if err != nil {
+					failures = append(failures, fmt.Sprintf("%s: %v (%s)", image, err, strings.TrimSpace(string(output))))
+				} else {
+					copied++
+					if copied%25 == 0 {
+						log.Printf("[airgap] Mirrored %d/%d image(s)", copied, len(images))
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, image := range images {
+		jobs <- image
+	}
+	close(jobs)
+	wg.Wait()
+
+	if len(failures) > 0 {
+		sort.Strings(failures)
+		return fmt.Errorf("failed to mirror %d of %d image(s):\n%s", len(failures), len(images), strings.Join(failures, "\n"))
+	}
+	log.Printf("[airgap] Mirrored %d image(s) to %s", copied, registry)
+	return nil
+}
+
+// stageAirgapK3SArtifacts copies the K3s installer, binary and image bundle for
+// each version into s3.bucket and points the node installs at presigned URLs
+// for them, so airgapped nodes only need S3 and the mirror registry. Each
+// artifact is checked against its pinned SHA256 before it is uploaded.
+func stageAirgapK3SArtifacts(versions []string) error {
+	svc, bucket, err := newRunMetadataS3Client()
+	if err != nil {
+		return err
+	}
+
+	seen := map[string]bool{}
+	for _, version := range versions {
+		if version == "" || seen[version] {
+			continue
+		}
+		seen[version] = true
+
+		for _, asset := range toolkit.K3SArtifactAssets {
+			checksum, err := toolkit.K3SArtifactSHA256(version, asset)
+			if err != nil {
+				return err
+			}
+			key := path.Join(airgapK3SArtifactPrefix, version, asset)
+			if err := stageAirgapK3SArtifact(svc, bucket, key, toolkit.K3SArtifactSourceURL(version, asset), checksum); err != nil {
+				return err
+			}
+
+			request, _ := svc.GetObjectRequest(&s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+			url, err := request.Presign(airgapK3SArtifactURLLifetime)
+			if err != nil {
+				return fmt.Errorf("failed to presign s3://%s/%s: %w", bucket, key, err)
+			}
+			toolkit.SetStagedK3SArtifactURL(version, asset, url)
+		}
+	}
+	return nil
+}
+
+// stageAirgapK3SArtifact uploads sourceURL to key unless the object there
+// already carries checksum from an earlier run.
+func stageAirgapK3SArtifact(svc *s3.S3, bucket, key, sourceURL, checksum string) error {
+	head, err := svc.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err == nil && strings.EqualFold(s3MetadataValue(head.Metadata, "sha256"), checksum) {
+		log.Printf("[airgap] s3://%s/%s is already staged", bucket, key)
+		return nil
+	}
+	var aErr awserr.Error
+	if err != nil && (!errors.As(err, &aErr) || aErr.Code() != "NotFound") {
+		return fmt.Errorf("failed to check s3://%s/%s: %w", bucket, key, err)
+	}
+
+	log.Printf("[airgap] Staging %s in s3://%s/%s...", sourceURL, bucket, key)
+	file, err := os.CreateTemp("", "k3s-artifact-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file for %s: %w", sourceURL, err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	resp, err := http.Get(sourceURL)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %w", sourceURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected HTTP status %d downloading %s", resp.StatusCode, sourceURL)
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(file, hash), resp.Body); err != nil {
+		return fmt.Errorf("failed to download %s: %w", sourceURL, err)
+	}
+	if actual := hex.EncodeToString(hash.Sum(nil)); !strings.EqualFold(actual, checksum) {
+		return fmt.Errorf("SHA256 of %s is %s, expected %s", sourceURL, actual, checksum)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind %s: %w", file.Name(), err)
+	}
+
+	_, err = svc.PutObject(&s3.PutObjectInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(key),
+		Body:     file,
+		Metadata: map[string]*string{"sha256": aws.String(strings.ToLower(checksum))},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload s3://%s/%s: %w", bucket, key, err)
+	}
+	return nil
+}
+
+// s3MetadataValue looks up name in S3 user metadata, whose keys come back
+// with their case changed.
+func s3MetadataValue(metadata map[string]*string, name string) string {
+	for key, value := range metadata {
+		if strings.EqualFold(key, name) {
+			return aws.StringValue(value)
+		}
+	}
+	return ""
+}
+
+// airgapSkopeoArgs builds the skopeo flags for copying into registry. Every
+// registries.configs entry with a username, including the Docker Hub
+// credentials folded in there, goes into a private auth file rather than
+// argv, where other local users could read it. TLS settings for the mirror
+// come from its own entry, the same one the nodes use to pull.
+func airgapSkopeoArgs(registry string) ([]string, func(), error) {
+	registries, err := toolkit.ConfiguredRegistries()
+	if err != nil {
+		return nil, func() {}, err
+	}
+
+	tempDir, err := os.MkdirTemp("", "airgap-skopeo-")
+	if err != nil {
+		return nil, func() {}, err
+	}
+	cleanup := func() { os.RemoveAll(tempDir) }
+
+	var args []string
+	authFile := filepath.Join(tempDir, "auth.json")
+	wrote, err := writeSkopeoAuthFile(authFile, registries.Configs)
+	if err != nil {
+		cleanup()
+		return nil, func() {}, err
+	}
+	if wrote {
+		args = append(args, "--authfile", authFile)
+	}
+
+	config := registries.Configs[registry]
+	switch {
+	case config.InsecureSkipVerify:
+		args = append(args, "--dest-tls-verify=false")
+	case config.CAFile != "":
+		caContent, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			cleanup()
+			return nil, func() {}, fmt.Errorf("failed reading CA for registry %s: %w", registry, err)
+		}
+		certDir := filepath.Join(tempDir, "certs")
+		if err := os.Mkdir(certDir, 0o700); err != nil {
+			cleanup()
+			return nil, func() {}, err
+		}
+		if err := os.WriteFile(filepath.Join(certDir, "ca.crt"), caContent, 0o600); err != nil {
+			cleanup()
+			return nil, func() {}, err
+		}
+		args = append(args, "--dest-cert-dir", certDir)
+	}
+	return args, cleanup, nil
+}
+
+// writeSkopeoAuthFile writes the credentials in configs to path in the
+// containers-auth.json format, readable only by the current user. It reports
+// whether there were any.
+func writeSkopeoAuthFile(path string, configs map[string]toolkit.RegistryConfig) (bool, error) {
+	auths := map[string]map[string]string{}
+	for host, config := range configs {
+		if config.Username == "" {
+			continue
+		}
+		credentials := config.Username + ":" + config.ResolvedPassword()
+		auths[host] = map[string]string{"auth": base64.StdEncoding.EncodeToString([]byte(credentials))}
+	}
+	if len(auths) == 0 {
+		return false, nil
+	}
+
+	content, err := json.Marshal(map[string]interface{}{"auths": auths})
+	if err != nil {
+		return false, fmt.Errorf("failed to serialize registry credentials: %w", err)
+	}
+	if err := os.WriteFile(path, content, 0o600); err != nil {
+		return false, fmt.Errorf("failed to write registry auth file: %w", err)
+	}
+	return true, nil
+}
+
+// airgapImageReferences returns the upstream and mirror references for image.
+// Images without a registry host come from airgap.source_registry.
+func airgapImageReferences(image, registry string) (string, string) {
+	sourceRegistry := strings.TrimSuffix(strings.TrimSpace(viper.GetString("airgap.source_registry")), "/")
+	if sourceRegistry == "" {
+		sourceRegistry = defaultAirgapSourceRegistry
+	}
+
+	host, repository := splitImageRegistry(image)
+	if host == "" {
+		host = sourceRegistry
+	}
+	return host + "/" + repository, registry + "/" + repository
+}
+
+// splitImageRegistry splits off the registry host, which is the first path
+// component when it contains a dot or a port, or is localhost.
+func splitImageRegistry(image string) (string, string) {
+	first, rest, found := strings.Cut(image, "/")
+	if found && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		return first, rest
+	}
+	return "", image
+}
+
+func parseImageList(content string) []string {
+	seen := map[string]bool{}
+	var images []string
+	for _, line := range strings.Split(content, "\n") {
+		image := strings.TrimSpace(line)
+		if image == "" || strings.HasPrefix(image, "#") || seen[image] {
+			continue
+		}
+		seen[image] = true
+		images = append(images, image)
+	}
+	return images
+}
+
+// helmOverrideImages returns the rancher and agent images a helm command
+// overrides, which are not part of the release image list.
+func helmOverrideImages(helmCommand string) []string {
+	var images []string
+	if match := rancherImageValuePattern.FindStringSubmatch(helmCommand); match != nil {
+		tag := ""
+		if tagMatch := rancherImageTagValuePattern.FindStringSubmatch(helmCommand); tagMatch != nil {
+			tag = tagMatch[1]
+		}
+		if tag == "" {
+			tag = "v" + strings.TrimPrefix(extractHelmChartVersion(helmCommand), "v")
+		}
+		images = append(images, match[1]+":"+tag)
+	}
+	if agentIndexes := agentImageEnvIndexes(helmCommand); len(agentIndexes) > 0 {
+		for _, match := range extraEnvValuePattern.FindAllStringSubmatch(helmCommand, -1) {
+			if agentIndexes[match[2]] {
+				images = append(images, match[3])
+			}
+		}
+	}
+	return images
+}
+
+// applyAirgapHelmSettings makes Rancher use the system charts bundled in its
+// image, since the nodes are not expected to reach the charts repository.
+func applyAirgapHelmSettings(helmCommand string) string {
+	if !toolkit.AirgapEnabled() || strings.Contains(helmCommand, "useBundledSystemChart=") {
+		return helmCommand
+	}
+	helmCommand = strings.TrimRight(helmCommand, " \\\n")
+	return helmCommand + " \\\n  --set useBundledSystemChart=true"
+}
+
+func buildRancherImageListURL(chartVersion string) string {
+	return fmt.Sprintf("https://github.com/rancher/rancher/releases/download/v%s/rancher-images.txt", strings.TrimPrefix(chartVersion, "v"))
+}
+
+func buildK3SImageListURL(version string) string {
+	return fmt.Sprintf("https://github.com/k3s-io/k3s/releases/download/%s/k3s-images.txt", strings.ReplaceAll(version, "+", "%2B"))
+}
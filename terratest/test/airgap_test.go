@@ -0,0 +1,140 @@
+package test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	toolkit "github.com/brudnak/hosted-tenant-rancher/tools"
+	"github.com/spf13/viper"
+)
+
+func TestParseImageListSkipsBlanksCommentsAndDuplicates(t *testing.T) {
+	images := parseImageList("rancher/rancher:v2.13.5\n\n# comment\nrancher/fleet:v0.13.0\r\nrancher/rancher:v2.13.5\n")
+	expected := []string{"rancher/rancher:v2.13.5", "rancher/fleet:v0.13.0"}
+	if !reflect.DeepEqual(images, expected) {
+		t.Fatalf("expected %v, got %v", expected, images)
+	}
+}
+
+func TestAirgapImageReferencesKeepRepositoryPath(t *testing.T) {
+	viper.Set("airgap.source_registry", "")
+	t.Cleanup(func() { viper.Set("airgap.source_registry", nil) })
+
+	cases := map[string][2]string{
+		"rancher/rancher:v2.13.5":                   {"docker.io/rancher/rancher:v2.13.5", "registry.local:5000/rancher/rancher:v2.13.5"},
+		"stgregistry.suse.com/rancher/rancher:v2.1": {"stgregistry.suse.com/rancher/rancher:v2.1", "registry.local:5000/rancher/rancher:v2.1"},
+		"localhost/rancher/shell:v0.1":              {"localhost/rancher/shell:v0.1", "registry.local:5000/rancher/shell:v0.1"},
+	}
+	for image, expected := range cases {
+		source, destination := airgapImageReferences(image, "registry.local:5000")
+		if source != expected[0] || destination != expected[1] {
+			t.Fatalf("%s: expected %s -> %s, got %s -> %s", image, expected[0], expected[1], source, destination)
+		}
+	}
+}
+
+func TestAirgapHelmCommandUsesMirrorAndBundledCharts(t *testing.T) {
+	viper.Set("airgap.enabled", true)
+	t.Cleanup(func() { viper.Set("airgap.enabled", nil) })
+
+	command := buildAutoHelmCommands(1, "rancher-prime", "2.13.5", "admin", "stgregistry.suse.com/rancher/rancher", "v2.13.5", "stgregistry.suse.com/rancher/rancher-agent:v2.13.5")[0]
+	if images := helmOverrideImages(command); !reflect.DeepEqual(images, []string{"stgregistry.suse.com/rancher/rancher:v2.13.5", "stgregistry.suse.com/rancher/rancher-agent:v2.13.5"}) {
+		t.Fatalf("unexpected override images %v", images)
+	}
+
+	updated := applyAirgapHelmSettings(applySystemDefaultRegistry(command, "registry.local:5000"))
+	for _, expected := range []string{
+		"--set rancherImage=rancher/rancher ",
+		"'extraEnv[0].value=registry.local:5000/rancher/rancher-agent:v2.13.5'",
+		"--set systemDefaultRegistry=registry.local:5000 \\\n  --set useBundledSystemChart=true",
+	} {
+		if !strings.Contains(updated, expected) {
+			t.Fatalf("expected %q in helm command:\n%s", expected, updated)
+		}
+	}
+	if strings.Contains(updated, "stgregistry.suse.com") {
+		t.Fatalf("expected upstream registry host to be dropped:\n%s", updated)
+	}
+}
+
+func TestWriteSkopeoAuthFileKeepsCredentialsPrivate(t *testing.T) {
+	t.Setenv("MIRROR_PASSWORD", "mirror-secret")
+	path := filepath.Join(t.TempDir(), "auth.json")
+
+	wrote, err := writeSkopeoAuthFile(path, map[string]toolkit.RegistryConfig{
+		"docker.io":           {Username: "hub", Password: "hub-secret"},
+		"registry.local:5000": {Username: "mirror", PasswordEnv: "MIRROR_PASSWORD"},
+		"ca-only.example.com": {CAFile: "ca.pem"},
+	})
+	if err != nil || !wrote {
+		t.Fatalf("expected an auth file, got %v, %v", wrote, err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Fatalf("expected the auth file to be private, got %v", info.Mode().Perm())
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parsed struct {
+		Auths map[string]struct {
+			Auth string `json:"auth"`
+		} `json:"auths"`
+	}
+	if err := json.Unmarshal(content, &parsed); err != nil {
+		t.Fatalf("auth file is not JSON: %v", err)
+	}
+	expected := map[string]string{
+		"docker.io":           "aHViOmh1Yi1zZWNyZXQ=",
+		"registry.local:5000": "bWlycm9yOm1pcnJvci1zZWNyZXQ=",
+	}
+	if len(parsed.Auths) != len(expected) {
+		t.Fatalf("expected only registries with credentials, got %v", parsed.Auths)
+	}
+	for host, auth := range expected {
+		if parsed.Auths[host].Auth != auth {
+			t.Fatalf("%s: expected auth %q, got %q", host, auth, parsed.Auths[host].Auth)
+		}
+	}
+
+	if wrote, err := writeSkopeoAuthFile(filepath.Join(t.TempDir(), "none.json"), nil); wrote || err != nil {
+		t.Fatalf("expected no auth file without credentials, got %v, %v", wrote, err)
+	}
+}
+
+func TestParseK3SReleaseChecksum(t *testing.T) {
+	content := "AAA111  k3s\nBBB222  k3s-airgap-images-amd64.tar\nCCC333 *k3s-airgap-images-amd64.tar.zst\n\n"
+	cases := map[string]string{
+		k3sBinaryAsset:                "aaa111",
+		k3sAirgapImageAsset:           "ccc333",
+		"k3s-airgap-images-amd64.tar": "bbb222",
+		"k3s-arm64":                   "",
+	}
+	for asset, want := range cases {
+		if got := parseK3SReleaseChecksum(content, asset); got != want {
+			t.Fatalf("%s: expected %q, got %q", asset, want, got)
+		}
+	}
+}
+
+func TestHelmOverrideImagesSkipsOtherExtraEnvValues(t *testing.T) {
+	command := `helm install rancher rancher-latest/rancher --version 2.13.5 \
+  --set 'extraEnv[0].name=CATTLE_FEATURES' \
+  --set 'extraEnv[0].value=true' \
+  --set 'extraEnv[1].name=CATTLE_AGENT_IMAGE' \
+  --set 'extraEnv[1].value=rancher/rancher-agent:v2.13.5'`
+
+	if images := helmOverrideImages(command); !reflect.DeepEqual(images, []string{"rancher/rancher-agent:v2.13.5"}) {
+		t.Fatalf("expected only the agent image, got %v", images)
+	}
+}
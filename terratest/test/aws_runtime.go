@@ -12,6 +12,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	toolkit "github.com/brudnak/hosted-tenant-rancher/tools"
 	"github.com/brudnak/hosted-tenant-rancher/tools/hcl"
 	"github.com/spf13/viper"
 )
@@ -22,26 +23,38 @@ var s3UploadExcludedNames = map[string]struct{}{
 	"terraform.tfstate.backup": {},
 }
 
-func createAWSVar() {
+// terraformModuleDir is relative to the test package, like TerraformDir.
+const terraformModuleDir = "../modules/aws"
+
+// legacyTFVarsKeys are accepted in tf_vars for backwards compatibility but
+// are not Terraform variables.
+var legacyTFVarsKeys = []string{"aws_access_key", "aws_secret_key"}
+
+// createAWSVar writes the whole tf_vars config tree to terraform.tfvars,
+// checked against the variables declared by the root module. tags become the
+// provider default_tags.
+func createAWSVar(tags map[string]string) error {
 	if err := ensureConfigLoaded(); err != nil {
-		log.Println("error reading config:", err)
-		return
+		return fmt.Errorf("error reading config: %w", err)
 	}
 
-	hcl.GenAwsVar(
-		viper.GetString("tf_vars.aws_prefix"),
-		viper.GetString("tf_vars.aws_vpc"),
-		viper.GetString("tf_vars.aws_subnet_a"),
-		viper.GetString("tf_vars.aws_subnet_b"),
-		viper.GetString("tf_vars.aws_subnet_c"),
-		viper.GetString("tf_vars.aws_ami"),
-		viper.GetString("tf_vars.aws_subnet_id"),
-		viper.GetString("tf_vars.aws_security_group_id"),
-		viper.GetString("tf_vars.aws_pem_key_name"),
-		viper.GetString("tf_vars.aws_rds_password"),
-		viper.GetString("tf_vars.aws_route53_fqdn"),
-		viper.GetString("tf_vars.aws_ec2_instance_type"),
-	)
+	values := tfVarsFromConfig()
+	values["default_tags"] = tags
+	return hcl.WriteTFVars(values, hcl.TFVarsOptions{ModuleDir: terraformModuleDir})
+}
+
+func tfVarsFromConfig() map[string]interface{} {
+	values := map[string]interface{}{}
+	for key, value := range viper.GetStringMap("tf_vars") {
+		values[key] = value
+	}
+	for _, key := range legacyTFVarsKeys {
+		delete(values, key)
+	}
+
+	values["aws_region"] = toolkit.AWSRegion()
+	values["total_rancher_instances"] = viper.GetInt("total_rancher_instances")
+	return values
 }
 
 func checkS3ObjectExists(item string) error {
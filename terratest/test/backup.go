@@ -0,0 +1,460 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	toolkit "github.com/brudnak/hosted-tenant-rancher/tools"
+	"github.com/spf13/viper"
+)
+
+const (
+	backupNamespace        = "cattle-resources-system"
+	backupCredentialSecret = "hosted-tenant-backup-s3"
+	rancherChartsRepoURL   = "https://charts.rancher.io"
+)
+
+// backupRecord is kept in run metadata so status lists the backups and
+// restore can find the latest one for an instance.
+type backupRecord struct {
+	Index      int        `json:"index"`
+	Name       string     `json:"name"`
+	Filename   string     `json:"filename"`
+	Bucket     string     `json:"bucket"`
+	Folder     string     `json:"folder"`
+	Endpoint   string     `json:"endpoint,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	RestoredAt *time.Time `json:"restoredAt,omitempty"`
+}
+
+// backupStorage is the S3 location rancher-backup writes to. Endpoint can
+// point at MinIO or any other S3-compatible store.
+type backupStorage struct {
+	Bucket                string
+	Folder                string
+	Region                string
+	Endpoint              string
+	EndpointCAFile        string
+	InsecureTLSSkipVerify bool
+	AccessKey             string
+	SecretKey             string
+}
+
+type kubeCondition struct {
+	Type    string `json:"type"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+type backupResourceStatus struct {
+	Status struct {
+		Filename   string          `json:"filename"`
+		Conditions []kubeCondition `json:"conditions"`
+	} `json:"status"`
+}
+
+// configuredBackupStorage defaults to a per-instance prefix of the run's S3
+// bucket, using the AWS credentials from the environment.
+func configuredBackupStorage(instanceIndex int) (backupStorage, error) {
+	storage := backupStorage{
+		Bucket:                strings.TrimSpace(viper.GetString("backup.s3.bucket")),
+		Folder:                strings.Trim(strings.TrimSpace(viper.GetString("backup.s3.folder")), "/"),
+		Region:                strings.TrimSpace(viper.GetString("backup.s3.region")),
+		Endpoint:              strings.TrimSpace(viper.GetString("backup.s3.endpoint")),
+		EndpointCAFile:        strings.TrimSpace(viper.GetString("backup.s3.endpoint_ca_file")),
+		InsecureTLSSkipVerify: viper.GetBool("backup.s3.insecure_tls_skip_verify"),
+	}
+	if storage.Bucket == "" {
+		storage.Bucket = strings.TrimSpace(viper.GetString("s3.bucket"))
+	}
+	if storage.Folder == "" {
+		storage.Folder = fmt.Sprintf("rancher-backups/instance-%d", instanceIndex+1)
+	}
+	if storage.Region == "" {
+		storage.Region = strings.TrimSpace(viper.GetString("s3.region"))
+	}
+	if storage.Endpoint == "" {
+		storage.Endpoint = fmt.Sprintf("s3.%s.amazonaws.com", storage.Region)
+	}
+	storage.Endpoint = strings.TrimPrefix(strings.TrimPrefix(storage.Endpoint, "https://"), "http://")
+	if storage.EndpointCAFile != "" && !filepath.IsAbs(storage.EndpointCAFile) && viper.ConfigFileUsed() != "" {
+		storage.EndpointCAFile = filepath.Join(filepath.Dir(viper.ConfigFileUsed()), storage.EndpointCAFile)
+	}
+
+	accessKeyEnv := strings.TrimSpace(viper.GetString("backup.s3.access_key_env"))
+	if accessKeyEnv == "" {
+		accessKeyEnv = "AWS_ACCESS_KEY_ID"
+	}
+	secretKeyEnv := strings.TrimSpace(viper.GetString("backup.s3.secret_key_env"))
+	if secretKeyEnv == "" {
+		secretKeyEnv = "AWS_SECRET_ACCESS_KEY"
+	}
+	storage.AccessKey = strings.TrimSpace(os.Getenv(accessKeyEnv))
+	storage.SecretKey = strings.TrimSpace(os.Getenv(secretKeyEnv))
+
+	switch {
+	case storage.Bucket == "":
+		return backupStorage{}, fmt.Errorf("backup.s3.bucket or s3.bucket must be set")
+	case storage.AccessKey == "" || storage.SecretKey == "":
+		return backupStorage{}, fmt.Errorf("%s and %s must be set for the backup S3 credentials", accessKeyEnv, secretKeyEnv)
+	}
+	return storage, nil
+}
+
+// backupRancherEnvironment backs up the instance selected by backup.instance
+// and records the backup in run metadata.
+func backupRancherEnvironment(clusters []ClusterInfra) (*backupRecord, error) {
+	metadata, err := loadActiveRunMetadata(clusters)
+	if err != nil {
+		return nil, err
+	}
+	instanceIndex, kubeconfig, storage, err := prepareBackupOperator(clusters)
+	if err != nil {
+		return nil, err
+	}
+
+	record := backupRecord{
+		Index:     instanceIndex + 1,
+		Name:      newBackupName(instanceIndex, time.Now()),
+		Bucket:    storage.Bucket,
+		Folder:    storage.Folder,
+		Endpoint:  storage.Endpoint,
+		CreatedAt: time.Now().UTC(),
+	}
+	if record.Filename, err = createRancherBackup(kubeconfig, storage, record.Name); err != nil {
+		return nil, fmt.Errorf("instance %d: %w", instanceIndex+1, err)
+	}
+
+	metadata.Backups = append(metadata.Backups, record)
+	if err := saveRunMetadata(metadata); err != nil {
+		log.Printf("[backup] Could not record backup: %v", err)
+	}
+	log.Printf("[backup] Instance %d: backup %s written to s3://%s/%s/%s", record.Index, record.Name, record.Bucket, record.Folder, record.Filename)
+	return &record, nil
+}
+
+// restoreRancherEnvironment restores backup.name, or the latest recorded
+// backup of backup.instance, then waits for Rancher and the tenants.
+func restoreRancherEnvironment(clusters []ClusterInfra) error {
+	metadata, err := loadActiveRunMetadata(clusters)
+	if err != nil {
+		return err
+	}
+	instanceIndex, err := configuredInstanceIndex("backup.instance", len(clusters))
+	if err != nil {
+		return err
+	}
+	record, err := findBackupRecord(metadata, instanceIndex, strings.TrimSpace(viper.GetString("backup.name")))
+	if err != nil {
+		return err
+	}
+	if record.Index != instanceIndex+1 {
+		return fmt.Errorf("backup %s belongs to instance %d, not backup.instance %d", record.Name, record.Index, instanceIndex+1)
+	}
+
+	instanceIndex, kubeconfig, storage, err := prepareBackupOperator(clusters)
+	if err != nil {
+		return err
+	}
+	// Restore from where the backup was written, even if the configured
+	// location has changed since.
+	storage.Bucket, storage.Folder = record.Bucket, record.Folder
+	if record.Endpoint != "" {
+		storage.Endpoint = record.Endpoint
+	}
+
+	if err := restoreRancherBackup(kubeconfig, storage, record.Filename); err != nil {
+		return fmt.Errorf("instance %d: %w", instanceIndex+1, err)
+	}
+	if err := waitForRancherReady(readinessPhaseRestore, clusters[instanceIndex].RancherURL, kubeconfig, 15*time.Minute); err != nil {
+		return fmt.Errorf("instance %d Rancher failed to become ready after restore: %w", instanceIndex+1, err)
+	}
+	if err := verifyTenantsActive(clusters[0].RancherURL, len(clusters)); err != nil {
+		return fmt.Errorf("after restoring instance %d: %w", instanceIndex+1, err)
+	}
+
+	restoredAt := time.Now().UTC()
+	record.RestoredAt = &restoredAt
+	if err := saveRunMetadata(metadata); err != nil {
+		log.Printf("[restore] Could not record restore: %v", err)
+	}
+	log.Printf("[restore] Instance %d: restored %s", instanceIndex+1, record.Filename)
+	return nil
+}
+
+// prepareBackupOperator resolves the instance and storage, then makes sure the
+// operator and the S3 credential secret are in place on that instance.
+func prepareBackupOperator(clusters []ClusterInfra) (int, string, backupStorage, error) {
+	instanceIndex, err := configuredInstanceIndex("backup.instance", len(clusters))
+	if err != nil {
+		return 0, "", backupStorage{}, err
+	}
+	storage, err := configuredBackupStorage(instanceIndex)
+	if err != nil {
+		return 0, "", backupStorage{}, err
+	}
+	kubeconfig, err := refreshInstanceKubeconfig(instanceIndex, clusters[instanceIndex])
+	if err != nil {
+		return 0, "", backupStorage{}, err
+	}
+	if err := installBackupOperator(kubeconfig); err != nil {
+		return 0, "", backupStorage{}, fmt.Errorf("instance %d: %w", instanceIndex+1, err)
+	}
+	if err := applyBackupCredentialSecret(kubeconfig, storage); err != nil {
+		return 0, "", backupStorage{}, fmt.Errorf("instance %d: %w", instanceIndex+1, err)
+	}
+	return instanceIndex, kubeconfig, storage, nil
+}
+
+// installBackupOperator installs or upgrades the rancher-backup CRD and
+// operator charts straight from the Rancher charts repository.
+func installBackupOperator(kubeconfig string) error {
+	chartVersion := strings.TrimSpace(viper.GetString("backup.chart_version"))
+	for _, chart := range []string{"rancher-backup-crd", "rancher-backup"} {
+		args := []string{
+			"upgrade", "--install", chart, chart,
+			"--repo", rancherChartsRepoURL,
+			"--namespace", backupNamespace,
+			"--create-namespace",
+			"--wait",
+			"--timeout", "10m",
+			"--kubeconfig", kubeconfig,
+		}
+		if chartVersion != "" {
+			args = append(args, "--version", chartVersion)
+		}
+		if registry := toolkit.SystemDefaultRegistry(); registry != "" && chart == "rancher-backup" {
+			args = append(args, "--set", "global.cattle.systemDefaultRegistry="+registry)
+		}
+
+		log.Printf("[backup] Installing %s...", chart)
+		if output, err := exec.Command("helm", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to install %s: %w (%s)", chart, err, strings.TrimSpace(string(output)))
+		}
+	}
+	return nil
+}
+
+func applyBackupCredentialSecret(kubeconfig string, storage backupStorage) error {
+	secret := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"metadata":   map[string]interface{}{"name": backupCredentialSecret, "namespace": backupNamespace},
+		"type":       "Opaque",
+		"stringData": map[string]string{"accessKey": storage.AccessKey, "secretKey": storage.SecretKey},
+	}
+	return kubectlApply(kubeconfig, secret)
+}
+
+// createRancherBackup creates a Backup CR and waits for the operator to upload
+// it. It returns the file name written to the bucket.
+func createRancherBackup(kubeconfig string, storage backupStorage, name string) (string, error) {
+	resourceSet, err := backupResourceSetName(kubeconfig)
+	if err != nil {
+		return "", err
+	}
+	location, err := backupStorageLocation(storage)
+	if err != nil {
+		return "", err
+	}
+
+	backup := map[string]interface{}{
+		"apiVersion": "resources.cattle.io/v1",
+		"kind":       "Backup",
+		"metadata":   map[string]interface{}{"name": name},
+		"spec": map[string]interface{}{
+			"resourceSetName": resourceSet,
+			"storageLocation": location,
+		},
+	}
+	log.Printf("[backup] Creating Backup %s (resource set %s) to s3://%s/%s...", name, resourceSet, storage.Bucket, storage.Folder)
+	if err := kubectlApply(kubeconfig, backup); err != nil {
+		return "", err
+	}
+
+	status, err := waitForBackupResourceReady(kubeconfig, "backups.resources.cattle.io", name, 20*time.Minute)
+	if err != nil {
+		return "", err
+	}
+	if status.Status.Filename == "" {
+		return "", fmt.Errorf("backup %s completed without a file name", name)
+	}
+	return status.Status.Filename, nil
+}
+
+// restoreRancherBackup creates a Restore CR for filename and waits for it.
+// The operator scales Rancher down while it restores and back up afterwards.
+func restoreRancherBackup(kubeconfig string, storage backupStorage, filename string) error {
+	location, err := backupStorageLocation(storage)
+	if err != nil {
+		return err
+	}
+
+	name := "restore-" + time.Now().UTC().Format("20060102-150405")
+	restore := map[string]interface{}{
+		"apiVersion": "resources.cattle.io/v1",
+		"kind":       "Restore",
+		"metadata":   map[string]interface{}{"name": name},
+		"spec": map[string]interface{}{
+			"backupFilename":  filename,
+			"prune":           true,
+			"storageLocation": location,
+		},
+	}
+	log.Printf("[restore] Creating Restore %s from %s...", name, filename)
+	if err := kubectlApply(kubeconfig, restore); err != nil {
+		return err
+	}
+
+	_, err = waitForBackupResourceReady(kubeconfig, "restores.resources.cattle.io", name, 30*time.Minute)
+	return err
+}
+
+func backupStorageLocation(storage backupStorage) (map[string]interface{}, error) {
+	s3 := map[string]interface{}{
+		"credentialSecretName":      backupCredentialSecret,
+		"credentialSecretNamespace": backupNamespace,
+		"bucketName":                storage.Bucket,
+		"folder":                    storage.Folder,
+		"region":                    storage.Region,
+		"endpoint":                  storage.Endpoint,
+	}
+	if storage.InsecureTLSSkipVerify {
+		s3["insecureTLSSkipVerify"] = true
+	}
+	if storage.EndpointCAFile != "" {
+		ca, err := os.ReadFile(storage.EndpointCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading backup.s3.endpoint_ca_file: %w", err)
+		}
+		s3["endpointCA"] = base64.StdEncoding.EncodeToString(ca)
+	}
+	return map[string]interface{}{"s3": s3}, nil
+}
+
+// backupResourceSetName uses backup.resource_set when set. Otherwise it
+// prefers the basic resource set of newer operators over the legacy one.
+func backupResourceSetName(kubeconfig string) (string, error) {
+	if configured := strings.TrimSpace(viper.GetString("backup.resource_set")); configured != "" {
+		return configured, nil
+	}
+
+	output, err := kubectl(kubeconfig, nil, "get", "resourcesets.resources.cattle.io", "-o", "name")
+	if err != nil {
+		return "", err
+	}
+	for _, name := range []string{"rancher-resource-set-basic", "rancher-resource-set"} {
+		if strings.Contains(output, "/"+name+"\n") || strings.HasSuffix(strings.TrimSpace(output), "/"+name) {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("no rancher resource set found; set backup.resource_set")
+}
+
+func waitForBackupResourceReady(kubeconfig, resource, name string, timeout time.Duration) (*backupResourceStatus, error) {
+	var ready backupResourceStatus
+	err := waitFor(context.Background(), waitOptions{
+		Description:     fmt.Sprintf("%s %s to be Ready", resource, name),
+		Timeout:         timeout,
+		InitialInterval: 5 * time.Second,
+		MaxInterval:     15 * time.Second,
+		LogPrefix:       "[backup]",
+	}, func(ctx context.Context) (bool, string, error) {
+		output, err := kubectl(kubeconfig, nil, "get", resource, name, "-o", "json")
+		if err != nil {
+			return false, "", err
+		}
+		var status backupResourceStatus
+		if err := json.Unmarshal([]byte(output), &status); err != nil {
+			return false, "", stopWaiting(fmt.Errorf("failed to parse %s %s: %w", resource, name, err))
+		}
+		for _, condition := range status.Status.Conditions {
+			if condition.Type != "Ready" {
+				continue
+			}
+			if condition.Status == "True" {
+				ready = status
+				return true, "", nil
+			}
+			if condition.Message != "" {
+				return false, condition.Message, nil
+			}
+		}
+		return false, "no Ready condition yet", nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[backup] %s %s is Ready", resource, name)
+	return &ready, nil
+}
+
+// findBackupRecord returns the backup named by backup.name, matched against
+// the record name or file name, or the latest backup of the instance.
+func findBackupRecord(metadata *runMetadata, instanceIndex int, name string) (*backupRecord, error) {
+	if metadata == nil || len(metadata.Backups) == 0 {
+		return nil, fmt.Errorf("no backups are recorded in run metadata")
+	}
+
+	var latest *backupRecord
+	for i := range metadata.Backups {
+		record := &metadata.Backups[i]
+		if name != "" {
+			if record.Name == name || record.Filename == name {
+				return record, nil
+			}
+			continue
+		}
+		if record.Index == instanceIndex+1 && (latest == nil || record.CreatedAt.After(latest.CreatedAt)) {
+			latest = record
+		}
+	}
+	if name != "" {
+		return nil, fmt.Errorf("no recorded backup named %s", name)
+	}
+	if latest == nil {
+		return nil, fmt.Errorf("no backups are recorded for instance %d", instanceIndex+1)
+	}
+	return latest, nil
+}
+
+func newBackupName(instanceIndex int, now time.Time) string {
+	return fmt.Sprintf("hosted-instance-%d-%s", instanceIndex+1, now.UTC().Format("20060102-150405"))
+}
+
+func kubectlApply(kubeconfig string, manifest map[string]interface{}) error {
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("failed to serialize %v manifest: %w", manifest["kind"], err)
+	}
+	_, err = kubectl(kubeconfig, content, "apply", "-f", "-")
+	return err
+}
+
+// kubectl runs the local kubectl against kubeconfig. Deployments do not need
+// kubectl, so it is checked here rather than in the tooling preflight.
+func kubectl(kubeconfig string, stdin []byte, args ...string) (string, error) {
+	if _, err := exec.LookPath("kubectl"); err != nil {
+		return "", fmt.Errorf("kubectl is required locally for this command but was not found in PATH")
+	}
+	cmd := exec.Command("kubectl", append([]string{"--kubeconfig", kubeconfig}, args...)...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("kubectl %s failed: %w (%s)", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return string(output), nil
+}
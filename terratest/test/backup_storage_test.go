@@ -0,0 +1,71 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestConfiguredBackupStorageDefaultsToRunBucket(t *testing.T) {
+	t.Cleanup(func() {
+		viper.Set("s3.bucket", nil)
+		viper.Set("s3.region", nil)
+		viper.Set("backup.s3.endpoint", nil)
+	})
+	viper.Set("s3.bucket", "run-bucket")
+	viper.Set("s3.region", "us-east-2")
+	t.Setenv("AWS_ACCESS_KEY_ID", "access")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	storage, err := configuredBackupStorage(1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if storage.Bucket != "run-bucket" || storage.Folder != "rancher-backups/instance-2" || storage.Endpoint != "s3.us-east-2.amazonaws.com" {
+		t.Fatalf("unexpected defaults: %+v", storage)
+	}
+
+	viper.Set("backup.s3.endpoint", "https://minio.example.com:9000")
+	storage, err = configuredBackupStorage(0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if storage.Endpoint != "minio.example.com:9000" {
+		t.Fatalf("expected scheme to be stripped from the endpoint, got %q", storage.Endpoint)
+	}
+}
+
+func TestConfiguredBackupStorageRequiresCredentials(t *testing.T) {
+	t.Cleanup(func() { viper.Set("s3.bucket", nil) })
+	viper.Set("s3.bucket", "run-bucket")
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+
+	if _, err := configuredBackupStorage(0); err == nil {
+		t.Fatalf("expected missing credentials to be rejected")
+	}
+}
+
+func TestFindBackupRecordPicksLatestForInstance(t *testing.T) {
+	now := time.Now()
+	metadata := &runMetadata{Backups: []backupRecord{
+		{Index: 1, Name: "host-old", Filename: "host-old.tar.gz", CreatedAt: now.Add(-2 * time.Hour)},
+		{Index: 1, Name: "host-new", Filename: "host-new.tar.gz", CreatedAt: now.Add(-time.Hour)},
+		{Index: 2, Name: "tenant", Filename: "tenant.tar.gz", CreatedAt: now},
+	}}
+
+	record, err := findBackupRecord(metadata, 0, "")
+	if err != nil || record.Name != "host-new" {
+		t.Fatalf("expected latest host backup, got %+v (%v)", record, err)
+	}
+
+	record, err = findBackupRecord(metadata, 0, "host-old.tar.gz")
+	if err != nil || record.Name != "host-old" {
+		t.Fatalf("expected lookup by file name, got %+v (%v)", record, err)
+	}
+
+	if _, err := findBackupRecord(metadata, 2, ""); err == nil {
+		t.Fatalf("expected an error for an instance without backups")
+	}
+}
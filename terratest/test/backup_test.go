@@ -0,0 +1,55 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/gruntwork-io/terratest/modules/terraform"
+)
+
+func TestBackup(t *testing.T) {
+	setupConfig(t)
+	if err := validateSecretEnvironment(); err != nil {
+		t.Fatalf("secret environment preflight failed: %v", err)
+	}
+	if err := validateLocalToolingPreflight(nil); err != nil {
+		t.Fatalf("local tooling preflight failed: %v", err)
+	}
+
+	terraformOptions := terraform.WithDefaultRetryableErrors(t, &terraform.Options{
+		TerraformDir: "../modules/aws",
+		NoColor:      true,
+	})
+
+	clusters, err := loadClusterInfra(t, terraformOptions, getTotalRancherInstances())
+	if err != nil {
+		t.Fatalf("Failed to load cluster infrastructure: %v", err)
+	}
+
+	if _, err := backupRancherEnvironment(clusters); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	setupConfig(t)
+	if err := validateSecretEnvironment(); err != nil {
+		t.Fatalf("secret environment preflight failed: %v", err)
+	}
+	if err := validateLocalToolingPreflight(nil); err != nil {
+		t.Fatalf("local tooling preflight failed: %v", err)
+	}
+
+	terraformOptions := terraform.WithDefaultRetryableErrors(t, &terraform.Options{
+		TerraformDir: "../modules/aws",
+		NoColor:      true,
+	})
+
+	clusters, err := loadClusterInfra(t, terraformOptions, getTotalRancherInstances())
+	if err != nil {
+		t.Fatalf("Failed to load cluster infrastructure: %v", err)
+	}
+
+	if err := restoreRancherEnvironment(clusters); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+}
@@ -17,7 +17,7 @@ import (
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/pricing"
 	"github.com/aws/aws-sdk-go/service/rds"
-	"github.com/spf13/viper"
+	toolkit "github.com/brudnak/hosted-tenant-rancher/tools"
 )
 
 type cleanupCostEstimate struct {
@@ -25,12 +25,18 @@ type cleanupCostEstimate struct {
 	EstimatedEC2CostUSD   float64
 	EstimatedEBSCostUSD   float64
 	EstimatedRDSCostUSD   float64
+	EstimatedUsageCostUSD float64
 	EC2Lines              []cleanupEC2Line
 	EBSLines              []cleanupEBSLine
 	RDSLines              []cleanupRDSLine
+	UsageLines            []cleanupUsageLine
 	RDSStorageNotIncluded bool
 }
 
+func (e *cleanupCostEstimate) totalUSD() float64 {
+	return e.EstimatedEC2CostUSD + e.EstimatedEBSCostUSD + e.EstimatedRDSCostUSD + e.EstimatedUsageCostUSD
+}
+
 type cleanupEC2Line struct {
 	InstanceType      string
 	Count             int
@@ -57,33 +63,33 @@ type cleanupRDSLine struct {
 	EstimatedCostUSD  float64
 }
 
-func estimateCurrentRunCost(totalInstances int, outputs map[string]string) (*cleanupCostEstimate, error) {
+func estimateCurrentRunCost(clusters []ClusterInfra) (*cleanupCostEstimate, error) {
 	sess, region, err := newCleanupCostSession()
 	if err != nil {
 		return nil, err
 	}
 
-	instances, err := resolveCleanupEC2Instances(sess, totalInstances, outputs)
+	instances, err := resolveCleanupEC2Instances(sess, clusters)
+	if err != nil {
+		return nil, err
+	}
+
+	rdsInstances, err := resolveCleanupRDSInstances(sess, clusters)
 	if err != nil {
 		return nil, err
 	}
 
-	rdsInstances, err := resolveCleanupRDSInstances(sess, totalInstances, outputs)
+	estimate, err := buildCleanupCostEstimate(sess, region, instances, rdsInstances)
 	if err != nil {
 		return nil, err
 	}
 
-	return buildCleanupCostEstimate(sess, region, instances, rdsInstances)
+	addUsageBasedCostLines(sess, region, estimate, clusters, instances, rdsInstances)
+	return estimate, nil
 }
 
 func newCleanupCostSession() (*session.Session, string, error) {
-	region := strings.TrimSpace(viper.GetString("tf_vars.aws_region"))
-	if region == "" {
-		region = strings.TrimSpace(viper.GetString("s3.region"))
-	}
-	if region == "" {
-		region = "us-east-2"
-	}
+	region := toolkit.AWSRegion()
 
 	cfg := aws.NewConfig().WithRegion(region)
 	accessKey := strings.TrimSpace(os.Getenv("AWS_ACCESS_KEY_ID"))
@@ -100,54 +106,29 @@ func newCleanupCostSession() (*session.Session, string, error) {
 	return sess, region, nil
 }
 
-func resolveCleanupEC2Instances(sess *session.Session, totalInstances int, outputs map[string]string) ([]*ec2.Instance, error) {
-	ec2Client := ec2.New(sess)
-	seenIPs := map[string]bool{}
-	instances := make([]*ec2.Instance, 0, totalInstances*2)
-
-	for i := 0; i < totalInstances; i++ {
-		for _, ip := range []string{
-			outputs[fmt.Sprintf("infra%d_server1_ip", i+1)],
-			outputs[fmt.Sprintf("infra%d_server2_ip", i+1)],
-		} {
-			ip = strings.TrimSpace(ip)
-			if ip == "" || seenIPs[ip] {
-				continue
-			}
-			seenIPs[ip] = true
-
-			output, err := ec2Client.DescribeInstances(&ec2.DescribeInstancesInput{
-				Filters: []*ec2.Filter{
-					{
-						Name:   aws.String("ip-address"),
-						Values: []*string{aws.String(ip)},
-					},
-					{
-						Name: aws.String("instance-state-name"),
-						Values: []*string{
-							aws.String(ec2.InstanceStateNamePending),
-							aws.String(ec2.InstanceStateNameRunning),
-							aws.String(ec2.InstanceStateNameStopping),
-							aws.String(ec2.InstanceStateNameStopped),
-						},
-					},
-				},
-			})
-			if err != nil {
-				return nil, fmt.Errorf("failed to describe EC2 instance for IP %s: %w", ip, err)
-			}
+func resolveCleanupEC2Instances(sess *session.Session, clusters []ClusterInfra) ([]*ec2.Instance, error) {
+	var instanceIDs []*string
+	for _, cluster := range clusters {
+		instanceIDs = append(instanceIDs, aws.StringSlice(cluster.InstanceIDs())...)
+	}
+	if len(instanceIDs) == 0 {
+		return nil, fmt.Errorf("no EC2 instances found for cleanup estimate")
+	}
 
-			found := false
-			for _, reservation := range output.Reservations {
-				for _, instance := range reservation.Instances {
-					instances = append(instances, instance)
-					found = true
+	instances := make([]*ec2.Instance, 0, len(instanceIDs))
+	err := ec2.New(sess).DescribeInstancesPages(&ec2.DescribeInstancesInput{InstanceIds: instanceIDs}, func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+		for _, reservation := range page.Reservations {
+			for _, instance := range reservation.Instances {
+				if aws.StringValue(instance.State.Name) == ec2.InstanceStateNameTerminated {
+					continue
 				}
-			}
-			if !found {
-				return nil, fmt.Errorf("no EC2 instance found for public IP %s", ip)
+				instances = append(instances, instance)
 			}
 		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe EC2 instances for cleanup estimate: %w", err)
 	}
 
 	if len(instances) == 0 {
@@ -157,42 +138,17 @@ func resolveCleanupEC2Instances(sess *session.Session, totalInstances int, outpu
 	return instances, nil
 }
 
-func resolveCleanupRDSInstances(sess *session.Session, totalInstances int, outputs map[string]string) ([]*rds.DBInstance, error) {
+func resolveCleanupRDSInstances(sess *session.Session, clusters []ClusterInfra) ([]*rds.DBInstance, error) {
 	rdsClient := rds.New(sess)
-	expectedHosts := map[string]bool{}
-	for i := 0; i < totalInstances; i++ {
-		endpoint := strings.TrimSpace(outputs[fmt.Sprintf("infra%d_mysql_endpoint", i+1)])
-		if endpoint == "" {
-			continue
-		}
-		host := strings.Split(endpoint, ":")[0]
-		expectedHosts[host] = true
-		expectedHosts[endpoint] = true
-	}
-
-	if len(expectedHosts) == 0 {
-		return nil, nil
-	}
-
 	found := []*rds.DBInstance{}
-	err := rdsClient.DescribeDBInstancesPages(&rds.DescribeDBInstancesInput{}, func(page *rds.DescribeDBInstancesOutput, lastPage bool) bool {
-		for _, dbInstance := range page.DBInstances {
-			if dbInstance == nil || dbInstance.Endpoint == nil {
-				continue
-			}
-			address := strings.TrimSpace(aws.StringValue(dbInstance.Endpoint.Address))
-			hostPort := address
-			if address != "" && dbInstance.Endpoint.Port != nil {
-				hostPort = fmt.Sprintf("%s:%d", address, aws.Int64Value(dbInstance.Endpoint.Port))
-			}
-			if expectedHosts[address] || expectedHosts[hostPort] {
-				found = append(found, dbInstance)
+	for _, cluster := range clusters {
+		for _, identifier := range cluster.RDSInstanceIDs {
+			output, err := rdsClient.DescribeDBInstances(&rds.DescribeDBInstancesInput{DBInstanceIdentifier: aws.String(identifier)})
+			if err != nil {
+				return nil, fmt.Errorf("failed to describe RDS instance %s for cleanup estimate: %w", identifier, err)
 			}
+			found = append(found, output.DBInstances...)
 		}
-		return true
-	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to describe RDS instances for cleanup estimate: %w", err)
 	}
 
 	if len(found) == 0 {
@@ -492,14 +448,42 @@ func extractUSDPriceFromPricingResult(priceList []aws.JSONValue) (float64, error
 	return bestPrice, nil
 }
 
+// awsPricingLocations maps region codes to the location names the Pricing API
+// filters on.
+var awsPricingLocations = map[string]string{
+	"us-east-1":      "US East (N. Virginia)",
+	"us-east-2":      "US East (Ohio)",
+	"us-west-1":      "US West (N. California)",
+	"us-west-2":      "US West (Oregon)",
+	"ca-central-1":   "Canada (Central)",
+	"ca-west-1":      "Canada West (Calgary)",
+	"sa-east-1":      "South America (Sao Paulo)",
+	"eu-central-1":   "EU (Frankfurt)",
+	"eu-central-2":   "EU (Zurich)",
+	"eu-west-1":      "EU (Ireland)",
+	"eu-west-2":      "EU (London)",
+	"eu-west-3":      "EU (Paris)",
+	"eu-north-1":     "EU (Stockholm)",
+	"eu-south-1":     "EU (Milan)",
+	"eu-south-2":     "EU (Spain)",
+	"ap-south-1":     "Asia Pacific (Mumbai)",
+	"ap-south-2":     "Asia Pacific (Hyderabad)",
+	"ap-northeast-1": "Asia Pacific (Tokyo)",
+	"ap-northeast-2": "Asia Pacific (Seoul)",
+	"ap-northeast-3": "Asia Pacific (Osaka)",
+	"ap-southeast-1": "Asia Pacific (Singapore)",
+	"ap-southeast-2": "Asia Pacific (Sydney)",
+	"ap-southeast-3": "Asia Pacific (Jakarta)",
+	"ap-southeast-4": "Asia Pacific (Melbourne)",
+	"ap-east-1":      "Asia Pacific (Hong Kong)",
+	"me-south-1":     "Middle East (Bahrain)",
+	"me-central-1":   "Middle East (UAE)",
+	"il-central-1":   "Israel (Tel Aviv)",
+	"af-south-1":     "Africa (Cape Town)",
+}
+
 func awsPricingLocation(region string) (string, error) {
-	locations := map[string]string{
-		"us-east-1": "US East (N. Virginia)",
-		"us-east-2": "US East (Ohio)",
-		"us-west-1": "US West (N. California)",
-		"us-west-2": "US West (Oregon)",
-	}
-	location := locations[region]
+	location := awsPricingLocations[region]
 	if location == "" {
 		return "", fmt.Errorf("no AWS pricing location mapping configured for region %s", region)
 	}
@@ -511,33 +495,42 @@ func logCleanupCostEstimate(estimate *cleanupCostEstimate) {
 }
 
 func logCleanupCostEstimateWithPrefix(estimate *cleanupCostEstimate, prefix string) {
-	totalEstimatedUSD := estimate.EstimatedEC2CostUSD + estimate.EstimatedEBSCostUSD + estimate.EstimatedRDSCostUSD
-	log.Printf("%s Estimated AWS cost for this run (live pricing):", prefix)
+	log.Printf("%s Estimated AWS cost for this run:", prefix)
 	log.Printf("%s Region: %s", prefix, estimate.Region)
 
 	for _, line := range estimate.EC2Lines {
-		log.Printf("%s EC2: %d x %s over %.2f total hours at $%.4f/hour -> $%.2f estimated",
+		log.Printf("%s EC2: %d x %s over %.2f total hours at $%.4f/hour -> $%.2f estimated (live pricing)",
 			prefix,
 			line.Count, line.InstanceType, line.TotalRuntimeHours, line.HourlyRateUSD, line.EstimatedCostUSD)
 	}
 
 	for _, line := range estimate.EBSLines {
-		log.Printf("%s EBS: %d x %d GiB %s over %.2f total hours at $%.4f/GiB-month -> $%.2f estimated",
+		log.Printf("%s EBS: %d x %d GiB %s over %.2f total hours at $%.4f/GiB-month -> $%.2f estimated (live pricing)",
 			prefix,
 			line.VolumeCount, line.VolumeSizeGiB, line.VolumeType, line.TotalRuntimeHours, line.MonthlyRateUSD, line.EstimatedCostUSD)
 	}
 
 	for _, line := range estimate.RDSLines {
-		log.Printf("%s RDS: %d x %s (%s) over %.2f total hours at $%.4f/hour -> $%.2f estimated",
+		log.Printf("%s RDS: %d x %s (%s) over %.2f total hours at $%.4f/hour -> $%.2f estimated (live pricing)",
 			prefix,
 			line.Count, line.DBClass, line.Engine, line.TotalRuntimeHours, line.HourlyRateUSD, line.EstimatedCostUSD)
 	}
 
+	for _, line := range estimate.UsageLines {
+		log.Printf("%s %s: %s, %.2f %s at $%.4f/%s -> $%.2f estimated (%s)",
+			prefix,
+			line.Category, line.Description, line.Quantity, line.Unit, line.RateUSD, line.Unit, line.EstimatedCostUSD, line.pricingLabel())
+		if line.Note != "" {
+			log.Printf("%s   Note: %s", prefix, line.Note)
+		}
+	}
+
 	if estimate.RDSStorageNotIncluded {
-		log.Printf("%s Note: Aurora storage is usage-based and is not included in this estimate.", prefix)
+		log.Printf("%s Note: Aurora storage and I/O could not be read from CloudWatch and are not included in this estimate.", prefix)
 	}
+	log.Printf("%s Note: Route53 queries and ACM public certificates are not included (ACM public certificates are free; query charges are negligible at test volumes).", prefix)
 
-	log.Printf("%s Estimated total (EC2 + EBS + RDS instance-hours): $%.2f", prefix, totalEstimatedUSD)
+	log.Printf("%s Estimated total (EC2 + EBS + RDS + ALB + Aurora storage/I/O + public IPv4 + data transfer): $%.2f", prefix, estimate.totalUSD())
 }
 
 func normalizeRDSEngine(engine string) string {
@@ -0,0 +1,453 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/pricing"
+	"github.com/aws/aws-sdk-go/service/rds"
+)
+
+// Published us-east list prices, used only when the Pricing API has no match.
+const (
+	approxALBHourlyUSD            = 0.0225
+	approxALBLCUHourlyUSD         = 0.008
+	approxAuroraStorageGiBMonthly = 0.10
+	approxAuroraIOPerMillionUSD   = 0.20
+	approxPublicIPv4HourlyUSD     = 0.005
+	approxDataTransferOutPerGiB   = 0.09
+)
+
+type cleanupUsageLine struct {
+	Category         string
+	Description      string
+	Quantity         float64
+	Unit             string
+	RateUSD          float64
+	EstimatedCostUSD float64
+	LivePriced       bool
+	Note             string
+}
+
+// usageRate is a unit price and whether it came from the Pricing API.
+type usageRate struct {
+	USD  float64
+	Live bool
+}
+
+func (l cleanupUsageLine) pricingLabel() string {
+	if l.LivePriced {
+		return "live pricing"
+	}
+	return "approximation"
+}
+
+func addUsageBasedCostLines(sess *session.Session, region string, estimate *cleanupCostEstimate, clusters []ClusterInfra, instances []*ec2.Instance, rdsInstances []*rds.DBInstance) {
+	now := time.Now()
+
+	loadBalancers, err := resolveCleanupLoadBalancers(sess, clusters)
+	if err != nil {
+		log.Printf("[cleanup] Could not resolve load balancers for cost estimate: %v", err)
+	} else {
+		lines, err := buildALBCostLines(sess, region, loadBalancers, now)
+		if err != nil {
+			log.Printf("[cleanup] Could not estimate ALB cost: %v", err)
+		}
+		estimate.UsageLines = append(estimate.UsageLines, lines...)
+	}
+
+	auroraLines, err := buildAuroraStorageCostLines(sess, region, rdsInstances, now)
+	if err != nil {
+		log.Printf("[cleanup] Could not estimate Aurora storage and I/O cost: %v", err)
+	}
+	estimate.UsageLines = append(estimate.UsageLines, auroraLines...)
+	estimate.RDSStorageNotIncluded = len(rdsInstances) > 0 && len(auroraLines) == 0
+
+	estimate.UsageLines = append(estimate.UsageLines, buildPublicIPv4CostLines(sess, region, instances, loadBalancers, now)...)
+
+	if line, err := buildDataTransferCostLine(sess, instances, now); err != nil {
+		log.Printf("[cleanup] Could not estimate data transfer cost: %v", err)
+	} else if line != nil {
+		estimate.UsageLines = append(estimate.UsageLines, *line)
+	}
+
+	for _, line := range estimate.UsageLines {
+		estimate.EstimatedUsageCostUSD += line.EstimatedCostUSD
+	}
+}
+
+func resolveCleanupLoadBalancers(sess *session.Session, clusters []ClusterInfra) ([]*elbv2.LoadBalancer, error) {
+	var arns []*string
+	for _, cluster := range clusters {
+		if cluster.ALBArn != "" {
+			arns = append(arns, aws.String(cluster.ALBArn))
+		}
+	}
+
+	if len(arns) == 0 {
+		return nil, nil
+	}
+
+	output, err := elbv2.New(sess).DescribeLoadBalancers(&elbv2.DescribeLoadBalancersInput{LoadBalancerArns: arns})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe load balancers: %w", err)
+	}
+
+	return output.LoadBalancers, nil
+}
+
+func buildALBCostLines(sess *session.Session, region string, loadBalancers []*elbv2.LoadBalancer, now time.Time) ([]cleanupUsageLine, error) {
+	if len(loadBalancers) == 0 {
+		return nil, nil
+	}
+
+	hourly := lookupUsageRate(sess, region, "AWSELB", "LoadBalancerUsage", approxALBHourlyUSD,
+		pricingTermFilter("productFamily", "Load Balancer-Application"))
+	lcu := lookupUsageRate(sess, region, "AWSELB", "LCUUsage", approxALBLCUHourlyUSD,
+		pricingTermFilter("productFamily", "Load Balancer-Application"))
+
+	cloudWatchClient := cloudwatch.New(sess)
+	runtimeHours := 0.0
+	lcuHours := 0.0
+	var lastErr error
+	for _, lb := range loadBalancers {
+		createdAt := aws.TimeValue(lb.CreatedTime)
+		if createdAt.IsZero() {
+			continue
+		}
+		runtimeHours += now.Sub(createdAt).Hours()
+
+		consumed, err := sumHourlyMetricAverages(cloudWatchClient, "AWS/ApplicationELB", "ConsumedLCUs", "LoadBalancer", loadBalancerMetricDimension(aws.StringValue(lb.LoadBalancerArn)), createdAt, now)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		lcuHours += consumed
+	}
+
+	return albUsageLines(len(loadBalancers), runtimeHours, lcuHours, hourly, lcu, lastErr), nil
+}
+
+// albUsageLines prices the load balancer hours and the consumed LCU-hours.
+// metricsErr marks the LCU line as partial when some metrics were missing.
+func albUsageLines(loadBalancers int, runtimeHours, lcuHours float64, hourly, lcu usageRate, metricsErr error) []cleanupUsageLine {
+	lines := []cleanupUsageLine{
+		{
+			Category:         "ALB",
+			Description:      fmt.Sprintf("%d x application load balancer", loadBalancers),
+			Quantity:         runtimeHours,
+			Unit:             "hour",
+			RateUSD:          hourly.USD,
+			EstimatedCostUSD: hourly.USD * runtimeHours,
+			LivePriced:       hourly.Live,
+		},
+	}
+
+	lcuLine := cleanupUsageLine{
+		Category:         "ALB",
+		Description:      "consumed LCUs (CloudWatch ConsumedLCUs)",
+		Quantity:         lcuHours,
+		Unit:             "LCU-hour",
+		RateUSD:          lcu.USD,
+		EstimatedCostUSD: lcu.USD * lcuHours,
+		LivePriced:       lcu.Live,
+	}
+	if metricsErr != nil {
+		lcuLine.LivePriced = false
+		lcuLine.Note = fmt.Sprintf("some ConsumedLCUs metrics were unavailable: %v", metricsErr)
+	}
+	return append(lines, lcuLine)
+}
+
+func buildAuroraStorageCostLines(sess *session.Session, region string, rdsInstances []*rds.DBInstance, now time.Time) ([]cleanupUsageLine, error) {
+	clusterIDs := map[string]bool{}
+	for _, dbInstance := range rdsInstances {
+		if dbInstance == nil {
+			continue
+		}
+		if clusterID := strings.TrimSpace(aws.StringValue(dbInstance.DBClusterIdentifier)); clusterID != "" {
+			clusterIDs[clusterID] = true
+		}
+	}
+	if len(clusterIDs) == 0 {
+		return nil, nil
+	}
+
+	storage := lookupUsageRate(sess, region, "AmazonRDS", "Aurora:StorageUsage", approxAuroraStorageGiBMonthly,
+		pricingTermFilter("productFamily", "Database Storage"),
+		pricingTermFilter("databaseEngine", "Aurora MySQL"))
+	io := lookupUsageRate(sess, region, "AmazonRDS", "Aurora:StorageIOUsage", approxAuroraIOPerMillionUSD/1e6,
+		pricingTermFilter("productFamily", "System Operation"),
+		pricingTermFilter("databaseEngine", "Aurora MySQL"))
+
+	rdsClient := rds.New(sess)
+	cloudWatchClient := cloudwatch.New(sess)
+
+	storageGiBHours := 0.0
+	ioRequests := 0.0
+	for _, clusterID := range sortedKeys(clusterIDs) {
+		clusters, err := rdsClient.DescribeDBClusters(&rds.DescribeDBClustersInput{DBClusterIdentifier: aws.String(clusterID)})
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe RDS cluster %s: %w", clusterID, err)
+		}
+		if len(clusters.DBClusters) == 0 || clusters.DBClusters[0].ClusterCreateTime == nil {
+			continue
+		}
+		createdAt := aws.TimeValue(clusters.DBClusters[0].ClusterCreateTime)
+
+		averageBytesHours, err := sumHourlyMetricAverages(cloudWatchClient, "AWS/RDS", "VolumeBytesUsed", "DBClusterIdentifier", clusterID, createdAt, now)
+		if err != nil {
+			return nil, err
+		}
+		storageGiBHours += averageBytesHours / (1 << 30)
+
+		for _, metricName := range []string{"VolumeReadIOPs", "VolumeWriteIOPs"} {
+			total, err := sumMetric(cloudWatchClient, "AWS/RDS", metricName, "DBClusterIdentifier", clusterID, createdAt, now)
+			if err != nil {
+				return nil, err
+			}
+			ioRequests += total
+		}
+	}
+
+	return auroraUsageLines(len(clusterIDs), storageGiBHours, ioRequests, storage, io), nil
+}
+
+// auroraUsageLines turns GiB-hours of cluster volume into GiB-months (730
+// hours) and prices I/O per million requests. The io rate is per request, as
+// the Pricing API lists it.
+func auroraUsageLines(clusters int, storageGiBHours, ioRequests float64, storage, io usageRate) []cleanupUsageLine {
+	return []cleanupUsageLine{
+		{
+			Category:         "Aurora",
+			Description:      fmt.Sprintf("%d x cluster volume storage (CloudWatch VolumeBytesUsed)", clusters),
+			Quantity:         storageGiBHours / 730.0,
+			Unit:             "GiB-month",
+			RateUSD:          storage.USD,
+			EstimatedCostUSD: storage.USD * storageGiBHours / 730.0,
+			LivePriced:       storage.Live,
+		},
+		{
+			Category:         "Aurora",
+			Description:      "billed I/O requests (CloudWatch VolumeReadIOPs + VolumeWriteIOPs)",
+			Quantity:         ioRequests / 1e6,
+			Unit:             "million requests",
+			RateUSD:          io.USD * 1e6,
+			EstimatedCostUSD: io.USD * ioRequests,
+			LivePriced:       io.Live,
+		},
+	}
+}
+
+func buildPublicIPv4CostLines(sess *session.Session, region string, instances []*ec2.Instance, loadBalancers []*elbv2.LoadBalancer, now time.Time) []cleanupUsageLine {
+	rate := lookupUsageRate(sess, region, "AmazonVPC", "PublicIPv4:InUseAddress", approxPublicIPv4HourlyUSD)
+	return publicIPv4UsageLines(instances, loadBalancers, now, rate)
+}
+
+// publicIPv4UsageLines counts an address for every EC2 instance with a public
+// IP since launch, and one per enabled zone for every ALB since creation.
+func publicIPv4UsageLines(instances []*ec2.Instance, loadBalancers []*elbv2.LoadBalancer, now time.Time, rate usageRate) []cleanupUsageLine {
+	var lines []cleanupUsageLine
+
+	ec2Addresses := 0
+	ec2AddressHours := 0.0
+	for _, instance := range instances {
+		if aws.StringValue(instance.PublicIpAddress) == "" || instance.LaunchTime == nil {
+			continue
+		}
+		ec2Addresses++
+		ec2AddressHours += now.Sub(aws.TimeValue(instance.LaunchTime)).Hours()
+	}
+	if ec2Addresses > 0 {
+		lines = append(lines, cleanupUsageLine{
+			Category:         "Public IPv4",
+			Description:      fmt.Sprintf("%d x EC2 public address", ec2Addresses),
+			Quantity:         ec2AddressHours,
+			Unit:             "address-hour",
+			RateUSD:          rate.USD,
+			EstimatedCostUSD: rate.USD * ec2AddressHours,
+			LivePriced:       rate.Live,
+		})
+	}
+
+	albAddresses := 0
+	albAddressHours := 0.0
+	for _, lb := range loadBalancers {
+		if lb.CreatedTime == nil {
+			continue
+		}
+		zones := len(lb.AvailabilityZones)
+		albAddresses += zones
+		albAddressHours += float64(zones) * now.Sub(aws.TimeValue(lb.CreatedTime)).Hours()
+	}
+	if albAddresses > 0 {
+		lines = append(lines, cleanupUsageLine{
+			Category:         "Public IPv4",
+			Description:      fmt.Sprintf("%d x ALB public address (one per enabled zone)", albAddresses),
+			Quantity:         albAddressHours,
+			Unit:             "address-hour",
+			RateUSD:          rate.USD,
+			EstimatedCostUSD: rate.USD * albAddressHours,
+			LivePriced:       false,
+			Note:             "ALB nodes can scale beyond one address per zone",
+		})
+	}
+
+	return lines
+}
+
+func buildDataTransferCostLine(sess *session.Session, instances []*ec2.Instance, now time.Time) (*cleanupUsageLine, error) {
+	cloudWatchClient := cloudwatch.New(sess)
+	totalBytes := 0.0
+	for _, instance := range instances {
+		if instance.LaunchTime == nil {
+			continue
+		}
+		networkOut, err := sumMetric(cloudWatchClient, "AWS/EC2", "NetworkOut", "InstanceId", aws.StringValue(instance.InstanceId), aws.TimeValue(instance.LaunchTime), now)
+		if err != nil {
+			return nil, err
+		}
+		totalBytes += networkOut
+	}
+	return dataTransferUsageLine(totalBytes), nil
+}
+
+// dataTransferUsageLine prices NetworkOut bytes as internet egress, or
+// returns nil when nothing was sent.
+func dataTransferUsageLine(totalBytes float64) *cleanupUsageLine {
+	if totalBytes == 0 {
+		return nil
+	}
+
+	gib := totalBytes / (1 << 30)
+	return &cleanupUsageLine{
+		Category:         "Data transfer",
+		Description:      "EC2 NetworkOut (CloudWatch), treated as internet egress",
+		Quantity:         gib,
+		Unit:             "GiB",
+		RateUSD:          approxDataTransferOutPerGiB,
+		EstimatedCostUSD: approxDataTransferOutPerGiB * gib,
+		LivePriced:       false,
+		Note:             "includes intra-VPC traffic and ignores the free tier",
+	}
+}
+
+func loadBalancerMetricDimension(loadBalancerARN string) string {
+	_, suffix, found := strings.Cut(loadBalancerARN, ":loadbalancer/")
+	if !found {
+		return loadBalancerARN
+	}
+	return suffix
+}
+
+// sumHourlyMetricAverages adds up hourly averages, which turns a gauge such as
+// VolumeBytesUsed or ConsumedLCUs into unit-hours.
+func sumHourlyMetricAverages(client *cloudwatch.CloudWatch, namespace, metricName, dimensionName, dimensionValue string, start, end time.Time) (float64, error) {
+	return sumMetricStatistic(client, namespace, metricName, dimensionName, dimensionValue, start, end, cloudwatch.StatisticAverage)
+}
+
+func sumMetric(client *cloudwatch.CloudWatch, namespace, metricName, dimensionName, dimensionValue string, start, end time.Time) (float64, error) {
+	return sumMetricStatistic(client, namespace, metricName, dimensionName, dimensionValue, start, end, cloudwatch.StatisticSum)
+}
+
+func sumMetricStatistic(client *cloudwatch.CloudWatch, namespace, metricName, dimensionName, dimensionValue string, start, end time.Time, statistic string) (float64, error) {
+	// GetMetricStatistics returns at most 1440 datapoints, so walk the range in 60-day windows.
+	const window = 1440 * time.Hour
+	total := 0.0
+	for windowStart := start.Truncate(time.Hour); windowStart.Before(end); windowStart = windowStart.Add(window) {
+		windowEnd := windowStart.Add(window)
+		if windowEnd.After(end) {
+			windowEnd = end
+		}
+
+		output, err := client.GetMetricStatistics(&cloudwatch.GetMetricStatisticsInput{
+			Namespace:  aws.String(namespace),
+			MetricName: aws.String(metricName),
+			Dimensions: []*cloudwatch.Dimension{
+				{Name: aws.String(dimensionName), Value: aws.String(dimensionValue)},
+			},
+			StartTime:  aws.Time(windowStart),
+			EndTime:    aws.Time(windowEnd),
+			Period:     aws.Int64(3600),
+			Statistics: []*string{aws.String(statistic)},
+		})
+		if err != nil {
+			return 0, fmt.Errorf("failed to read CloudWatch %s/%s for %s: %w", namespace, metricName, dimensionValue, err)
+		}
+
+		for _, datapoint := range output.Datapoints {
+			if statistic == cloudwatch.StatisticAverage {
+				total += aws.Float64Value(datapoint.Average)
+			} else {
+				total += aws.Float64Value(datapoint.Sum)
+			}
+		}
+	}
+	return total, nil
+}
+
+func pricingTermFilter(field, value string) *pricing.Filter {
+	return &pricing.Filter{Type: aws.String(pricing.FilterTypeTermMatch), Field: aws.String(field), Value: aws.String(value)}
+}
+
+// lookupUsageRate returns the live on-demand price for the product whose
+// usagetype ends with usageTypeSuffix, or the fallback when there is no match.
+func lookupUsageRate(sess *session.Session, region, serviceCode, usageTypeSuffix string, fallbackUSD float64, filters ...*pricing.Filter) usageRate {
+	fallback := usageRate{USD: fallbackUSD}
+	location, err := awsPricingLocation(region)
+	if err != nil {
+		return fallback
+	}
+
+	pricingClient := pricing.New(sess, aws.NewConfig().WithRegion("us-east-1"))
+	var matching []aws.JSONValue
+	err = pricingClient.GetProductsPages(&pricing.GetProductsInput{
+		ServiceCode: aws.String(serviceCode),
+		MaxResults:  aws.Int64(100),
+		Filters:     append([]*pricing.Filter{pricingTermFilter("location", location)}, filters...),
+	}, func(page *pricing.GetProductsOutput, lastPage bool) bool {
+		for _, item := range page.PriceList {
+			if strings.HasSuffix(pricingUsageType(item), usageTypeSuffix) {
+				matching = append(matching, item)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		log.Printf("[cleanup] %s pricing lookup for %s failed, using approximation: %v", serviceCode, usageTypeSuffix, err)
+		return fallback
+	}
+
+	price, err := extractUSDPriceFromPricingResult(matching)
+	if err != nil {
+		return fallback
+	}
+	return usageRate{USD: price, Live: true}
+}
+
+func pricingUsageType(item aws.JSONValue) string {
+	raw, err := json.Marshal(item)
+	if err != nil {
+		return ""
+	}
+
+	var doc struct {
+		Product struct {
+			Attributes struct {
+				UsageType string `json:"usagetype"`
+			} `json:"attributes"`
+		} `json:"product"`
+	}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return ""
+	}
+	return doc.Product.Attributes.UsageType
+}
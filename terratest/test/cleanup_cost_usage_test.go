@@ -0,0 +1,131 @@
+package test
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+)
+
+func assertCost(t *testing.T, name string, got, want float64) {
+	t.Helper()
+	if math.Abs(got-want) > 1e-9 {
+		t.Fatalf("%s: expected %v, got %v", name, want, got)
+	}
+}
+
+func TestLoadBalancerMetricDimension(t *testing.T) {
+	cases := []struct {
+		arn  string
+		want string
+	}{
+		{"arn:aws:elasticloadbalancing:us-east-2:123456789012:loadbalancer/app/xyz-alb/50dc6c495c0c9188", "app/xyz-alb/50dc6c495c0c9188"},
+		{"app/xyz-alb/50dc6c495c0c9188", "app/xyz-alb/50dc6c495c0c9188"},
+		{"", ""},
+	}
+	for _, tc := range cases {
+		if got := loadBalancerMetricDimension(tc.arn); got != tc.want {
+			t.Fatalf("%q: expected %q, got %q", tc.arn, tc.want, got)
+		}
+	}
+}
+
+func TestPricingUsageType(t *testing.T) {
+	cases := []struct {
+		name string
+		item aws.JSONValue
+		want string
+	}{
+		{"usage type", aws.JSONValue{"product": map[string]interface{}{"attributes": map[string]interface{}{"usagetype": "USE2-LCUUsage"}}}, "USE2-LCUUsage"},
+		{"no attributes", aws.JSONValue{"product": map[string]interface{}{}}, ""},
+		{"wrong type", aws.JSONValue{"product": "not an object"}, ""},
+	}
+	for _, tc := range cases {
+		if got := pricingUsageType(tc.item); got != tc.want {
+			t.Fatalf("%s: expected %q, got %q", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestALBUsageLines(t *testing.T) {
+	lines := albUsageLines(2, 10, 4, usageRate{USD: 0.0225, Live: true}, usageRate{USD: 0.008, Live: true}, nil)
+	if len(lines) != 2 {
+		t.Fatalf("expected an hours and an LCU line, got %+v", lines)
+	}
+	if !strings.HasPrefix(lines[0].Description, "2 x") || lines[0].Unit != "hour" {
+		t.Fatalf("unexpected hours line: %+v", lines[0])
+	}
+	assertCost(t, "ALB hours", lines[0].EstimatedCostUSD, 0.225)
+	assertCost(t, "LCU hours", lines[1].EstimatedCostUSD, 0.032)
+	if !lines[1].LivePriced || lines[1].Note != "" {
+		t.Fatalf("expected a live LCU line without a note, got %+v", lines[1])
+	}
+
+	partial := albUsageLines(1, 1, 1, usageRate{USD: 0.0225, Live: true}, usageRate{USD: 0.008, Live: true}, errors.New("throttled"))
+	if partial[1].LivePriced || !strings.Contains(partial[1].Note, "throttled") {
+		t.Fatalf("expected missing metrics to mark the LCU line, got %+v", partial[1])
+	}
+}
+
+func TestAuroraUsageLines(t *testing.T) {
+	// 20 GiB for 73 hours is 2 GiB-months; 3M requests at $0.20 per million.
+	lines := auroraUsageLines(1, 20*73, 3e6, usageRate{USD: 0.10}, usageRate{USD: 0.20 / 1e6, Live: true})
+	if len(lines) != 2 {
+		t.Fatalf("expected a storage and an I/O line, got %+v", lines)
+	}
+	assertCost(t, "storage quantity", lines[0].Quantity, 2)
+	assertCost(t, "storage cost", lines[0].EstimatedCostUSD, 0.20)
+	assertCost(t, "I/O quantity", lines[1].Quantity, 3)
+	assertCost(t, "I/O rate", lines[1].RateUSD, 0.20)
+	assertCost(t, "I/O cost", lines[1].EstimatedCostUSD, 0.60)
+	if lines[0].LivePriced || !lines[1].LivePriced {
+		t.Fatalf("expected the rates' pricing source on each line, got %+v", lines)
+	}
+}
+
+func TestPublicIPv4UsageLines(t *testing.T) {
+	now := time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC)
+	tenHoursAgo := now.Add(-10 * time.Hour)
+	instances := []*ec2.Instance{
+		{PublicIpAddress: aws.String("3.1.1.1"), LaunchTime: aws.Time(tenHoursAgo)},
+		{PublicIpAddress: aws.String(""), LaunchTime: aws.Time(tenHoursAgo)},
+		{PublicIpAddress: aws.String("3.1.1.2")},
+	}
+	loadBalancers := []*elbv2.LoadBalancer{
+		{CreatedTime: aws.Time(tenHoursAgo), AvailabilityZones: []*elbv2.AvailabilityZone{{}, {}, {}}},
+	}
+
+	lines := publicIPv4UsageLines(instances, loadBalancers, now, usageRate{USD: 0.005, Live: true})
+	if len(lines) != 2 {
+		t.Fatalf("expected an EC2 and an ALB line, got %+v", lines)
+	}
+	if !strings.HasPrefix(lines[0].Description, "1 x") || !lines[0].LivePriced {
+		t.Fatalf("expected only the launched instance with an address, got %+v", lines[0])
+	}
+	assertCost(t, "EC2 addresses", lines[0].EstimatedCostUSD, 0.05)
+	if !strings.HasPrefix(lines[1].Description, "3 x") || lines[1].LivePriced {
+		t.Fatalf("expected one approximate ALB address per zone, got %+v", lines[1])
+	}
+	assertCost(t, "ALB addresses", lines[1].EstimatedCostUSD, 0.15)
+
+	if lines := publicIPv4UsageLines(nil, nil, now, usageRate{USD: 0.005}); len(lines) != 0 {
+		t.Fatalf("expected no lines without addresses, got %+v", lines)
+	}
+}
+
+func TestDataTransferUsageLine(t *testing.T) {
+	if line := dataTransferUsageLine(0); line != nil {
+		t.Fatalf("expected no line without traffic, got %+v", line)
+	}
+	line := dataTransferUsageLine(5 * (1 << 30))
+	assertCost(t, "egress GiB", line.Quantity, 5)
+	assertCost(t, "egress cost", line.EstimatedCostUSD, 5*approxDataTransferOutPerGiB)
+	if line.LivePriced {
+		t.Fatal("expected egress to be an approximation")
+	}
+}
@@ -0,0 +1,123 @@
+package test
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	toolkit "github.com/brudnak/hosted-tenant-rancher/tools"
+	"github.com/gruntwork-io/terratest/modules/terraform"
+	"github.com/gruntwork-io/terratest/modules/testing"
+	"github.com/spf13/viper"
+)
+
+// ClusterInfra is one entry of the terraform "clusters" output: everything the
+// k3s-ha module created for a single Rancher instance.
+type ClusterInfra struct {
+	Index          int               `json:"index"`
+	Nodes          []toolkit.K3SNode `json:"nodes"`
+	MySQLEndpoint  string            `json:"mysql_endpoint"`
+	MySQLPassword  string            `json:"mysql_password"`
+	RancherURL     string            `json:"rancher_url"`
+	RDSClusterID   string            `json:"rds_cluster_id"`
+	RDSInstanceIDs []string          `json:"rds_instance_ids"`
+	ALBArn         string            `json:"alb_arn"`
+	Route53ZoneID  string            `json:"route53_zone_id"`
+	Route53Record  string            `json:"route53_record"`
+}
+
+func (c ClusterInfra) K3SConfig() toolkit.K3SConfig {
+	config := toolkit.K3SConfig{
+		DBPassword: c.MySQLPassword,
+		DBEndpoint: c.MySQLEndpoint,
+		RancherURL: c.RancherURL,
+	}
+	if len(c.Nodes) > 0 {
+		config.Node1 = c.Nodes[0]
+	}
+	if len(c.Nodes) > 1 {
+		config.Node2 = c.Nodes[1]
+	}
+	return config
+}
+
+func (c ClusterInfra) InstanceIDs() []string {
+	ids := make([]string, 0, len(c.Nodes))
+	for _, node := range c.Nodes {
+		ids = append(ids, node.InstanceID)
+	}
+	return ids
+}
+
+func (c ClusterInfra) PublicIPs() []string {
+	ips := make([]string, 0, len(c.Nodes))
+	for _, node := range c.Nodes {
+		ips = append(ips, node.PublicIP)
+	}
+	return ips
+}
+
+// loadClusterInfra decodes the "clusters" output and checks it covers
+// totalInstances clusters, each with two addressable nodes.
+func loadClusterInfra(t testing.TestingT, terraformOptions *terraform.Options, totalInstances int) ([]ClusterInfra, error) {
+	var clusters []ClusterInfra
+	if err := terraform.OutputStructE(t, terraformOptions, "clusters", &clusters); err != nil {
+		return nil, fmt.Errorf("failed to read terraform output clusters: %w", err)
+	}
+
+	sort.Slice(clusters, func(i, j int) bool { return clusters[i].Index < clusters[j].Index })
+	if err := validateClusterInfra(clusters, totalInstances); err != nil {
+		return nil, err
+	}
+	return clusters, nil
+}
+
+func validateClusterInfra(clusters []ClusterInfra, totalInstances int) error {
+	if len(clusters) != totalInstances {
+		return fmt.Errorf("terraform output clusters has %d entries, expected %d", len(clusters), totalInstances)
+	}
+
+	for i, cluster := range clusters {
+		if cluster.Index != i+1 {
+			return fmt.Errorf("terraform output clusters is missing instance %d", i+1)
+		}
+		if len(cluster.Nodes) != plannedEC2PerCluster {
+			return fmt.Errorf("instance %d has %d nodes, expected %d", cluster.Index, len(cluster.Nodes), plannedEC2PerCluster)
+		}
+		for n, node := range cluster.Nodes {
+			if strings.TrimSpace(node.InstanceID) == "" {
+				return fmt.Errorf("instance %d node %d has no instance ID", cluster.Index, n+1)
+			}
+			if strings.TrimSpace(node.Host()) == "" {
+				return fmt.Errorf("instance %d node %d has no address", cluster.Index, n+1)
+			}
+		}
+		if strings.TrimSpace(cluster.RancherURL) == "" {
+			return fmt.Errorf("instance %d has no rancher_url", cluster.Index)
+		}
+	}
+	return nil
+}
+
+// configuredInstanceIndex returns the zero-based instance from key, which
+// counts from 1 for the host and defaults to the host.
+func configuredInstanceIndex(key string, totalInstances int) (int, error) {
+	instance := 1
+	if viper.IsSet(key) {
+		instance = viper.GetInt(key)
+	}
+	if instance < 1 || instance > totalInstances {
+		return 0, fmt.Errorf("%s must be between 1 and %d, got %d", key, totalInstances, instance)
+	}
+	return instance - 1, nil
+}
+
+// configuredTenantIndex reads a tenant number from key. Tenants count from 1,
+// so the value is also the tenant's instance index.
+func configuredTenantIndex(key string, totalInstances int) (int, error) {
+	tenant := viper.GetInt(key)
+	if tenant < 1 || tenant >= totalInstances {
+		return 0, fmt.Errorf("%s must be a tenant number between 1 and %d, got %d", key, totalInstances-1, tenant)
+	}
+	return tenant, nil
+}
@@ -0,0 +1,70 @@
+package test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const clustersOutputFixture = `[
+  {
+    "index": 1,
+    "nodes": [
+      {"instance_id": "i-0aaa", "public_ip": "3.1.1.1", "address": "3.1.1.1"},
+      {"instance_id": "i-0bbb", "public_ip": "3.1.1.2", "address": "3.1.1.2"}
+    ],
+    "mysql_endpoint": "db-1.cluster.us-east-2.rds.amazonaws.com",
+    "mysql_password": "secret",
+    "rancher_url": "host.example.com",
+    "rds_cluster_id": "prefix-1-db",
+    "rds_instance_ids": ["prefix-1-db-0"],
+    "alb_arn": "arn:aws:elasticloadbalancing:us-east-2:123:loadbalancer/app/prefix-1/abc",
+    "route53_zone_id": "Z123",
+    "route53_record": "host.example.com"
+  }
+]`
+
+func TestClusterInfraDecodesTerraformOutput(t *testing.T) {
+	var clusters []ClusterInfra
+	if err := json.Unmarshal([]byte(clustersOutputFixture), &clusters); err != nil {
+		t.Fatalf("failed to decode fixture: %v", err)
+	}
+	if err := validateClusterInfra(clusters, 1); err != nil {
+		t.Fatalf("expected fixture to validate, got %v", err)
+	}
+
+	config := clusters[0].K3SConfig()
+	if config.Node1.InstanceID != "i-0aaa" || config.Node2.InstanceID != "i-0bbb" {
+		t.Fatalf("unexpected node instance IDs: %s, %s", config.Node1.InstanceID, config.Node2.InstanceID)
+	}
+	if config.RancherURL != "host.example.com" || config.DBPassword != "secret" {
+		t.Fatalf("unexpected K3s config: %+v", config)
+	}
+	if got := strings.Join(clusters[0].InstanceIDs(), ","); got != "i-0aaa,i-0bbb" {
+		t.Fatalf("unexpected instance IDs: %s", got)
+	}
+}
+
+func TestValidateClusterInfraRejectsMissingInstanceID(t *testing.T) {
+	var clusters []ClusterInfra
+	if err := json.Unmarshal([]byte(clustersOutputFixture), &clusters); err != nil {
+		t.Fatalf("failed to decode fixture: %v", err)
+	}
+	clusters[0].Nodes[1].InstanceID = ""
+
+	err := validateClusterInfra(clusters, 1)
+	if err == nil || !strings.Contains(err.Error(), "no instance ID") {
+		t.Fatalf("expected missing instance ID error, got %v", err)
+	}
+}
+
+func TestValidateClusterInfraRejectsWrongClusterCount(t *testing.T) {
+	var clusters []ClusterInfra
+	if err := json.Unmarshal([]byte(clustersOutputFixture), &clusters); err != nil {
+		t.Fatalf("failed to decode fixture: %v", err)
+	}
+
+	if err := validateClusterInfra(clusters, 2); err == nil {
+		t.Fatal("expected an error when terraform reports fewer clusters than configured")
+	}
+}
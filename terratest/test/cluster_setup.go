@@ -1,21 +1,33 @@
 package test
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
-	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"time"
+
+	toolkit "github.com/brudnak/hosted-tenant-rancher/tools"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
 )
 
+var tools toolkit.Tools
+
 func CreateRancherInstallScript(helmCommand, rancherURL, scriptDir string) {
 	updatedCommand := strings.Replace(helmCommand, "--set hostname=placeholder",
 		fmt.Sprintf("--set hostname=%s", rancherURL), 1)
+	updatedCommand = applySystemDefaultRegistry(updatedCommand, toolkit.SystemDefaultRegistry())
+	updatedCommand = applyAirgapHelmSettings(updatedCommand)
 
 	installScript := fmt.Sprintf(`#!/bin/bash
 set -e
@@ -23,18 +35,6 @@ set -e
 # Set kubeconfig to use our local file
 export KUBECONFIG=kube_config.yaml
 
-# Verify kubectl connection
-echo "Verifying connection to Kubernetes cluster..."
-kubectl cluster-info
-if [ $? -ne 0 ]; then
-  echo "ERROR: Unable to connect to Kubernetes cluster"
-  exit 1
-fi
-
-# Create namespace
-echo "Creating cattle-system namespace..."
-kubectl create namespace cattle-system --dry-run=client -o yaml | kubectl apply -f -
-
 # Install Rancher
 echo "Installing Rancher..."
 %s
@@ -78,6 +78,11 @@ func executeInstallScript(scriptDir string) error {
 	if _, err := os.Stat(kubeconfigPath); os.IsNotExist(err) {
 		return fmt.Errorf("kubeconfig not found: %s", kubeconfigPath)
 	}
+	// The cattle-system namespace is created here rather than in the script,
+	// so the script only needs helm.
+	if err := ensureNamespace(kubeconfigPath, "cattle-system"); err != nil {
+		return err
+	}
 
 	err = os.Chmod(scriptPath, 0755)
 	if err != nil {
@@ -101,38 +106,55 @@ func executeInstallScript(scriptDir string) error {
 	return nil
 }
 
-func executeImportScript(scriptDir string) error {
-	currentDir, err := os.Getwd()
-	if err != nil {
-		return fmt.Errorf("failed to get current directory: %w", err)
-	}
-
-	absScriptDir := filepath.Join(currentDir, scriptDir)
-	scriptPath := filepath.Join(absScriptDir, "import.sh")
-	kubeconfigPath := filepath.Join(absScriptDir, "kube_config.yaml")
+var (
+	agentImageNamePattern = regexp.MustCompile(`extraEnv\[(\d+)\]\.name=['"]?CATTLE_AGENT_IMAGE\b`)
+	extraEnvValuePattern  = regexp.MustCompile(`(extraEnv\[(\d+)\]\.value=)([^'"\s\\]+)`)
+)
 
-	if _, err := os.Stat(scriptPath); os.IsNotExist(err) {
-		return fmt.Errorf("import script not found: %s", scriptPath)
-	}
-	if _, err := os.Stat(kubeconfigPath); os.IsNotExist(err) {
-		return fmt.Errorf("kubeconfig not found: %s", kubeconfigPath)
+// agentImageEnvIndexes returns the extraEnv indexes whose name is
+// CATTLE_AGENT_IMAGE. Other extraEnv values are not images.
+func agentImageEnvIndexes(helmCommand string) map[string]bool {
+	indexes := map[string]bool{}
+	for _, match := range agentImageNamePattern.FindAllStringSubmatch(helmCommand, -1) {
+		indexes[match[1]] = true
 	}
+	return indexes
+}
 
-	cmd := exec.Command("bash", scriptPath)
-	cmd.Dir = absScriptDir
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+// applySystemDefaultRegistry points the chart at registry and prefixes the
+// CATTLE_AGENT_IMAGE override with it. Images that name another registry,
+// such as a private staging registry, are left to pull from there, except in
+// airgap mode: every image is then mirrored, so the registry host is dropped
+// from rancherImage (the chart prefixes it) and replaced on the agent image.
+func applySystemDefaultRegistry(helmCommand, registry string) string {
+	if registry == "" || strings.Contains(helmCommand, "systemDefaultRegistry=") {
+		return helmCommand
+	}
+	airgap := toolkit.AirgapEnabled()
 
-	log.Printf("Executing import script: bash %s", scriptPath)
-	log.Printf("Working directory: %s", absScriptDir)
+	if airgap {
+		helmCommand = rancherImageValuePattern.ReplaceAllStringFunc(helmCommand, func(match string) string {
+			_, repository := splitImageRegistry(rancherImageValuePattern.FindStringSubmatch(match)[1])
+			return "--set rancherImage=" + repository
+		})
+	}
 
-	err = cmd.Run()
-	if err != nil {
-		return fmt.Errorf("failed to execute import script: %w", err)
+	if agentIndexes := agentImageEnvIndexes(helmCommand); len(agentIndexes) > 0 {
+		helmCommand = extraEnvValuePattern.ReplaceAllStringFunc(helmCommand, func(match string) string {
+			parts := extraEnvValuePattern.FindStringSubmatch(match)
+			if !agentIndexes[parts[2]] {
+				return match
+			}
+			host, repository := splitImageRegistry(parts[3])
+			if host == registry || (host != "" && !airgap) {
+				return match
+			}
+			return parts[1] + registry + "/" + repository
+		})
 	}
 
-	log.Printf("Successfully executed import script in %s", absScriptDir)
-	return nil
+	helmCommand = strings.TrimRight(helmCommand, " \\\n")
+	return helmCommand + " \\\n  --set systemDefaultRegistry=" + registry
 }
 
 func extractBootstrapPassword(helmCommand string) string {
@@ -151,181 +173,154 @@ func extractBootstrapPassword(helmCommand string) string {
 	return ""
 }
 
-func waitForRancherStable(rancherURL string, timeout time.Duration) error {
-	maxRetries := int(timeout.Seconds() / 20)
-	totalMaxTime := 30*time.Second + timeout
+func rancherResponseStatus(ctx context.Context, client *http.Client, url string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
 
-	log.Printf("Waiting for Rancher at https://%s to become stable...", rancherURL)
-	log.Printf("Will check every 20s for up to %d attempts over %v total", maxRetries, totalMaxTime)
+// waitForClusterActive waits for the imported-tenant-N provisioning cluster
+// to be ready. The host's cluster watch wakes the wait as soon as the object
+// changes, and each check reports the cluster's last condition message.
+func waitForClusterActive(hostURL, adminToken string, tenantIndex int, timeout time.Duration) error {
+	clusterName := fmt.Sprintf("imported-tenant-%d", tenantIndex)
+	log.Printf("Waiting for %s cluster to be Active in host Rancher...", clusterName)
 
-	time.Sleep(30 * time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	client := &http.Client{
-		Timeout: 15 * time.Second,
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		},
+	var trigger <-chan struct{}
+	if watchClient, err := dynamic.NewForConfig(hostRESTConfig(hostURL, adminToken)); err == nil {
+		clusters := watchClient.Resource(provisioningClusterResource).Namespace("fleet-default")
+		trigger = watchTrigger(ctx, "[import]", func(ctx context.Context) (watch.Interface, error) {
+			return clusters.Watch(ctx, metav1.ListOptions{FieldSelector: "metadata.name=" + clusterName})
+		})
 	}
 
+	client := newRancherAPIClient(hostURL, adminToken)
+	path := "/v1/provisioning.cattle.io.clusters/fleet-default/" + clusterName
 	start := time.Now()
+	err := waitFor(ctx, waitOptions{
+		Description: fmt.Sprintf("cluster %s to be Active", clusterName),
+		Timeout:     timeout,
+		MaxInterval: 15 * time.Second,
+		Trigger:     trigger,
+		LogPrefix:   "[import]",
+	}, func(ctx context.Context) (bool, string, error) {
+		var cluster map[string]interface{}
+		status, err := client.do(http.MethodGet, path, &cluster)
+		if err != nil {
+			return false, "", err
+		}
+		if status == http.StatusNotFound {
+			return false, "cluster is not created yet", nil
+		}
+		return provisioningClusterActive(cluster)
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Cluster %s is Active after %v", clusterName, time.Since(start).Round(time.Second))
+	return nil
+}
 
-	for i := 0; i < maxRetries; i++ {
-		resp, err := client.Get(fmt.Sprintf("https://%s", rancherURL))
-		if err == nil {
-			validCodes := []int{200, 302, 401, 403, 404}
-			isValidCode := false
-			for _, code := range validCodes {
-				if resp.StatusCode == code {
-					isValidCode = true
-					break
-				}
-			}
+// provisioningClusterActive checks a provisioning cluster object for
+// status.ready, and otherwise explains what it is waiting on.
+func provisioningClusterActive(cluster map[string]interface{}) (bool, string, error) {
+	ready, _, _ := unstructured.NestedBool(cluster, "status", "ready")
+	phase, _, _ := unstructured.NestedString(cluster, "status", "phase")
+	if ready || phase == "Active" {
+		return true, "", nil
+	}
+	if status := objectConditionStatus(cluster); status != "" {
+		return false, status, nil
+	}
+	return false, "status.ready is not true yet", nil
+}
 
-			if isValidCode {
-				resp.Body.Close()
-
-				apiResp, apiErr := client.Get(fmt.Sprintf("https://%s/v3", rancherURL))
-				if apiErr == nil {
-					apiValidCode := false
-					for _, code := range validCodes {
-						if apiResp.StatusCode == code {
-							apiValidCode = true
-							break
-						}
-					}
-
-					if apiValidCode {
-						apiResp.Body.Close()
-						elapsed := time.Since(start)
-						log.Printf("Rancher is responding to HTTP requests after %v (status: %d, api status: %d)",
-							elapsed, resp.StatusCode, apiResp.StatusCode)
-
-						log.Println("Waiting additional 30s for internal services to stabilize...")
-						time.Sleep(30 * time.Second)
-						return nil
-					}
-				}
-				if apiResp != nil {
-					apiResp.Body.Close()
-				}
-			}
-		}
+func writeFile(path string, data []byte) {
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		log.Printf("Failed to write file %s: %v", path, err)
+	}
+}
 
-		if resp != nil {
-			resp.Body.Close()
-		}
+func saveK3SKubeconfig(node toolkit.K3SNode, scriptDir string) error {
+	serverKubeConfig, err := tools.RunCommand("sudo cat /etc/rancher/k3s/k3s.yaml", node)
+	if err != nil {
+		return fmt.Errorf("failed to get kubeconfig from node %s: %w", node, err)
+	}
 
-		if i%3 == 0 {
-			elapsed := time.Since(start)
-			if err != nil {
-				log.Printf("Rancher not ready yet after %v (attempt %d/%d, connection error: %v), continuing to wait...", elapsed, i+1, maxRetries, err)
-			} else if resp != nil {
-				log.Printf("Rancher not ready yet after %v (attempt %d/%d, HTTP %d), continuing to wait...", elapsed, i+1, maxRetries, resp.StatusCode)
-			} else {
-				log.Printf("Rancher not ready yet after %v (attempt %d/%d), continuing to wait...", elapsed, i+1, maxRetries)
-			}
-		}
+	configIP := fmt.Sprintf("https://%s:6443", node.Host())
+	kubeConf := []byte(serverKubeConfig)
+	output := bytes.Replace(kubeConf, []byte("https://127.0.0.1:6443"), []byte(configIP), -1)
 
-		time.Sleep(20 * time.Second)
+	currentDir, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("failed to get current directory: %w", err)
 	}
 
-	return fmt.Errorf("timeout waiting for Rancher to become stable after %v (%d attempts)", timeout, maxRetries)
+	absScriptDir := filepath.Join(currentDir, scriptDir)
+	err = os.MkdirAll(absScriptDir, os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("failed to create script directory: %w", err)
+	}
+
+	kubeconfigPath := filepath.Join(absScriptDir, "kube_config.yaml")
+	err = os.WriteFile(kubeconfigPath, output, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write kubeconfig: %w", err)
+	}
+
+	log.Printf("Saved kubeconfig to: %s", kubeconfigPath)
+	return nil
 }
 
-func waitForClusterActive(hostURL, adminToken string, tenantIndex int, timeout time.Duration) error {
-	log.Printf("Waiting for tenant-%d cluster to be Active in host Rancher...", tenantIndex)
+// waitForRancherAPIReady waits for the local auth provider to answer, then
+// checks the admin password with a single login whose token is revoked again,
+// so a slow start does not leave a trail of tokens behind.
+func waitForRancherAPIReady(rancherURL, adminPassword string, timeout time.Duration) error {
+	log.Printf("Waiting for Rancher API to be ready for authentication...")
 
 	client := &http.Client{
-		Timeout: 30 * time.Second,
+		Timeout: 15 * time.Second,
 		Transport: &http.Transport{
 			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
 		},
 	}
 
-	clusterName := fmt.Sprintf("imported-tenant-%d", tenantIndex)
 	start := time.Now()
-	maxRetries := int(timeout.Seconds() / 15)
-
-	for i := 0; i < maxRetries; i++ {
-		clustersURL := fmt.Sprintf("https://%s/v1/provisioning.cattle.io.clusters", hostURL)
-		req, err := http.NewRequest("GET", clustersURL, nil)
+	err := waitFor(context.Background(), waitOptions{
+		Description: fmt.Sprintf("Rancher API at https://%s to accept logins", rancherURL),
+		Timeout:     timeout,
+		MaxInterval: 15 * time.Second,
+	}, func(ctx context.Context) (bool, string, error) {
+		status, err := rancherResponseStatus(ctx, client, fmt.Sprintf("https://%s/v3-public/localProviders/local", rancherURL))
 		if err != nil {
-			log.Printf("Error creating request: %v", err)
-			time.Sleep(15 * time.Second)
-			continue
+			return false, "", err
 		}
-
-		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", adminToken))
-		resp, err := client.Do(req)
-		if err != nil {
-			if i%4 == 0 {
-				elapsed := time.Since(start)
-				log.Printf("Error checking cluster status after %v: %v", elapsed, err)
-			}
-			time.Sleep(15 * time.Second)
-			continue
+		if status != http.StatusOK {
+			return false, fmt.Sprintf("local auth provider returned HTTP %d", status), nil
 		}
 
-		if resp.StatusCode != 200 {
-			resp.Body.Close()
-			if i%4 == 0 {
-				elapsed := time.Since(start)
-				log.Printf("API returned status %d after %v", resp.StatusCode, elapsed)
-			}
-			time.Sleep(15 * time.Second)
-			continue
-		}
-
-		var clusterResponse struct {
-			Data []struct {
-				Metadata struct {
-					Name string `json:"name"`
-				} `json:"metadata"`
-				Status struct {
-					Phase string `json:"phase"`
-					Ready bool   `json:"ready"`
-				} `json:"status"`
-			} `json:"data"`
-		}
-
-		err = json.NewDecoder(resp.Body).Decode(&clusterResponse)
-		resp.Body.Close()
-
+		token, err := tools.Login(rancherURL, adminPassword)
 		if err != nil {
-			if i%4 == 0 {
-				elapsed := time.Since(start)
-				log.Printf("Error parsing cluster response after %v: %v", elapsed, err)
-			}
-			time.Sleep(15 * time.Second)
-			continue
+			return false, "", fmt.Errorf("admin login failed: %w", err)
 		}
-
-		for _, cluster := range clusterResponse.Data {
-			if cluster.Metadata.Name == clusterName {
-				log.Printf("Found cluster %s with phase: %s, ready: %t", clusterName, cluster.Status.Phase, cluster.Status.Ready)
-
-				if cluster.Status.Phase == "Active" || cluster.Status.Ready {
-					elapsed := time.Since(start)
-					log.Printf("Cluster %s is Active after %v", clusterName, elapsed)
-					return nil
-				}
-
-				if i%4 == 0 {
-					elapsed := time.Since(start)
-					log.Printf("Cluster %s not ready yet after %v (phase: %s, ready: %t)", clusterName, elapsed, cluster.Status.Phase, cluster.Status.Ready)
-				}
-				break
-			}
+		if err := tools.Logout(rancherURL, token); err != nil {
+			log.Printf("Could not revoke the readiness login token: %v", err)
 		}
-
-		time.Sleep(15 * time.Second)
-	}
-
-	return fmt.Errorf("timeout waiting for cluster %s to become Active after %v", clusterName, timeout)
-}
-
-func writeFile(path string, data []byte) {
-	if err := os.WriteFile(path, data, 0644); err != nil {
-		log.Printf("Failed to write file %s: %v", path, err)
+		return true, "", nil
+	})
+	if err != nil {
+		return err
 	}
+	log.Printf("Rancher API is fully ready for authentication after %v", time.Since(start).Round(time.Second))
+	return nil
 }
@@ -0,0 +1,201 @@
+package test
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/spf13/viper"
+)
+
+// These mirror the per-cluster topology in modules/aws/modules/k3s-ha. The module
+// leaves the root volume type to the AMI default, so gp3 is assumed here.
+const (
+	plannedEC2PerCluster      = 2
+	plannedRootVolumeSizeGiB  = 200
+	plannedRootVolumeType     = "gp3"
+	plannedRDSPerCluster      = 1
+	plannedRDSInstanceClass   = "db.r5.large"
+	plannedRDSEngine          = "aurora-mysql"
+	defaultPlannedEC2Instance = "m5.large"
+)
+
+type costForecast struct {
+	Region             string
+	TotalInstances     int
+	EC2HourlyUSD       float64
+	EBSHourlyUSD       float64
+	RDSHourlyUSD       float64
+	EstimatedHourlyUSD float64
+	EstimatedDailyUSD  float64
+	Lines              []string
+}
+
+type budgetLimits struct {
+	MaxHourlyUSD float64
+	MaxDailyUSD  float64
+	Override     bool
+}
+
+func forecastPlannedRunCost(totalInstances int) (*costForecast, error) {
+	sess, region, err := newCleanupCostSession()
+	if err != nil {
+		return nil, err
+	}
+
+	return buildCostForecast(sess, region, totalInstances)
+}
+
+func buildCostForecast(sess *session.Session, region string, totalInstances int) (*costForecast, error) {
+	forecast := &costForecast{Region: region, TotalInstances: totalInstances}
+
+	ec2Count := totalInstances * plannedEC2PerCluster
+	instanceCounts := plannedEC2InstanceTypes(totalInstances)
+	instanceTypes := make([]string, 0, len(instanceCounts))
+	for instanceType := range instanceCounts {
+		instanceTypes = append(instanceTypes, instanceType)
+	}
+	sort.Strings(instanceTypes)
+	for _, instanceType := range instanceTypes {
+		count := instanceCounts[instanceType]
+		ec2HourlyRateUSD, err := lookupEC2OnDemandHourlyPriceUSD(sess, region, instanceType)
+		if err != nil {
+			return nil, err
+		}
+		lineHourlyUSD := ec2HourlyRateUSD * float64(count)
+		forecast.EC2HourlyUSD += lineHourlyUSD
+		forecast.Lines = append(forecast.Lines, fmt.Sprintf("EC2: %d x %s at $%.4f/hour -> $%.4f/hour",
+			count, instanceType, ec2HourlyRateUSD, lineHourlyUSD))
+	}
+
+	ebsMonthlyRateUSD, err := lookupEBSMonthlyPricePerGiBUSD(sess, region, plannedRootVolumeType)
+	if err != nil {
+		return nil, err
+	}
+	forecast.EBSHourlyUSD = ebsMonthlyRateUSD * float64(plannedRootVolumeSizeGiB*ec2Count) / 730.0
+	forecast.Lines = append(forecast.Lines, fmt.Sprintf("EBS: %d x %d GiB %s at $%.4f/GiB-month -> $%.4f/hour",
+		ec2Count, plannedRootVolumeSizeGiB, plannedRootVolumeType, ebsMonthlyRateUSD, forecast.EBSHourlyUSD))
+
+	rdsCount := totalInstances * plannedRDSPerCluster
+	rdsEngine := normalizeRDSEngine(plannedRDSEngine)
+	rdsHourlyRateUSD, err := lookupRDSOnDemandHourlyPriceUSD(sess, region, plannedRDSInstanceClass, rdsEngine)
+	if err != nil {
+		return nil, err
+	}
+	forecast.RDSHourlyUSD = rdsHourlyRateUSD * float64(rdsCount)
+	forecast.Lines = append(forecast.Lines, fmt.Sprintf("RDS: %d x %s (%s) at $%.4f/hour -> $%.4f/hour",
+		rdsCount, plannedRDSInstanceClass, rdsEngine, rdsHourlyRateUSD, forecast.RDSHourlyUSD))
+
+	forecast.EstimatedHourlyUSD = forecast.EC2HourlyUSD + forecast.EBSHourlyUSD + forecast.RDSHourlyUSD
+	forecast.EstimatedDailyUSD = forecast.EstimatedHourlyUSD * 24
+	return forecast, nil
+}
+
+// plannedEC2InstanceTypes counts nodes per instance type, applying
+// tf_vars.instance_overrides the same way the root module does.
+func plannedEC2InstanceTypes(totalInstances int) map[string]int {
+	defaultType := strings.TrimSpace(viper.GetString("tf_vars.aws_ec2_instance_type"))
+	if defaultType == "" {
+		defaultType = defaultPlannedEC2Instance
+	}
+
+	counts := map[string]int{}
+	for i := 1; i <= totalInstances; i++ {
+		instanceType := strings.TrimSpace(viper.GetString(fmt.Sprintf("tf_vars.instance_overrides.%d.aws_ec2_instance_type", i)))
+		if instanceType == "" {
+			instanceType = defaultType
+		}
+		counts[instanceType] += plannedEC2PerCluster
+	}
+	return counts
+}
+
+func configuredBudgetLimits() budgetLimits {
+	return budgetLimits{
+		MaxHourlyUSD: viper.GetFloat64("budget.max_hourly_usd"),
+		MaxDailyUSD:  viper.GetFloat64("budget.max_daily_usd"),
+		Override:     viper.GetBool("budget.override"),
+	}
+}
+
+func (b budgetLimits) configured() bool {
+	return b.MaxHourlyUSD > 0 || b.MaxDailyUSD > 0
+}
+
+// budgetViolations lists every configured limit the forecast exceeds, ignoring
+// the override flag so callers can still surface what was overridden.
+func budgetViolations(forecast *costForecast, limits budgetLimits) []string {
+	if forecast == nil {
+		return nil
+	}
+
+	var violations []string
+	if limits.MaxHourlyUSD > 0 && forecast.EstimatedHourlyUSD > limits.MaxHourlyUSD {
+		violations = append(violations, fmt.Sprintf("forecast $%.2f/hour exceeds budget.max_hourly_usd $%.2f", forecast.EstimatedHourlyUSD, limits.MaxHourlyUSD))
+	}
+	if limits.MaxDailyUSD > 0 && forecast.EstimatedDailyUSD > limits.MaxDailyUSD {
+		violations = append(violations, fmt.Sprintf("forecast $%.2f/day exceeds budget.max_daily_usd $%.2f", forecast.EstimatedDailyUSD, limits.MaxDailyUSD))
+	}
+	return violations
+}
+
+func checkBudgetGuardrail(forecast *costForecast, forecastErr error, limits budgetLimits) error {
+	if !limits.configured() {
+		return nil
+	}
+
+	if forecastErr != nil {
+		if limits.Override {
+			log.Printf("[budget] Could not forecast cost, continuing because budget.override is true: %v", forecastErr)
+			return nil
+		}
+		return fmt.Errorf("a budget is configured but the cost forecast failed (set budget.override: true to apply anyway): %w", forecastErr)
+	}
+
+	violations := budgetViolations(forecast, limits)
+	if len(violations) == 0 {
+		return nil
+	}
+	if limits.Override {
+		log.Printf("[budget] Continuing over budget because budget.override is true: %s", strings.Join(violations, "; "))
+		return nil
+	}
+	return fmt.Errorf("refusing to apply: %s (set budget.override: true to apply anyway)", strings.Join(violations, "; "))
+}
+
+func buildCostForecastDialogSection(forecast *costForecast, forecastErr error, limits budgetLimits) string {
+	section := []string{"Cost forecast"}
+	if forecastErr != nil {
+		section = append(section, "Forecast unavailable: "+forecastErr.Error())
+	} else if forecast != nil {
+		section = append(section, "Region: "+forecast.Region)
+		section = append(section, forecast.Lines...)
+		section = append(section, fmt.Sprintf("Estimated total: $%.2f/hour, $%.2f/day (on-demand, excludes Aurora storage)", forecast.EstimatedHourlyUSD, forecast.EstimatedDailyUSD))
+	}
+
+	if limits.MaxHourlyUSD > 0 {
+		section = append(section, fmt.Sprintf("Budget max hourly: $%.2f", limits.MaxHourlyUSD))
+	}
+	if limits.MaxDailyUSD > 0 {
+		section = append(section, fmt.Sprintf("Budget max daily: $%.2f", limits.MaxDailyUSD))
+	}
+	for _, violation := range budgetViolations(forecast, limits) {
+		if limits.Override {
+			section = append(section, "OVER BUDGET (overridden): "+violation)
+		} else {
+			section = append(section, "OVER BUDGET: "+violation+". Apply will be refused unless budget.override is true.")
+		}
+	}
+
+	return strings.Join(section, "\n")
+}
+
+func logCostForecast(forecast *costForecast) {
+	log.Printf("[budget] Forecast AWS cost for %d instance(s) in %s (live pricing):", forecast.TotalInstances, forecast.Region)
+	for _, line := range forecast.Lines {
+		log.Printf("[budget] %s", line)
+	}
+	log.Printf("[budget] Estimated total: $%.2f/hour, $%.2f/day (on-demand, excludes Aurora storage)", forecast.EstimatedHourlyUSD, forecast.EstimatedDailyUSD)
+}
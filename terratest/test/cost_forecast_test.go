@@ -0,0 +1,52 @@
+package test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCheckBudgetGuardrailAllowsWhenNoBudgetConfigured(t *testing.T) {
+	forecast := &costForecast{EstimatedHourlyUSD: 50, EstimatedDailyUSD: 1200}
+	if err := checkBudgetGuardrail(forecast, nil, budgetLimits{}); err != nil {
+		t.Fatalf("expected no error without a budget, got %v", err)
+	}
+}
+
+func TestCheckBudgetGuardrailRefusesOverHourlyBudget(t *testing.T) {
+	forecast := &costForecast{EstimatedHourlyUSD: 3.5, EstimatedDailyUSD: 84}
+	err := checkBudgetGuardrail(forecast, nil, budgetLimits{MaxHourlyUSD: 2})
+	if err == nil {
+		t.Fatal("expected hourly budget violation to refuse apply")
+	}
+	if !strings.Contains(err.Error(), "budget.max_hourly_usd") {
+		t.Fatalf("expected error to name budget.max_hourly_usd, got %v", err)
+	}
+}
+
+func TestCheckBudgetGuardrailRefusesOverDailyBudget(t *testing.T) {
+	forecast := &costForecast{EstimatedHourlyUSD: 3.5, EstimatedDailyUSD: 84}
+	err := checkBudgetGuardrail(forecast, nil, budgetLimits{MaxHourlyUSD: 10, MaxDailyUSD: 50})
+	if err == nil {
+		t.Fatal("expected daily budget violation to refuse apply")
+	}
+	if strings.Contains(err.Error(), "budget.max_hourly_usd") {
+		t.Fatalf("expected only the daily limit to be reported, got %v", err)
+	}
+}
+
+func TestCheckBudgetGuardrailHonorsOverride(t *testing.T) {
+	forecast := &costForecast{EstimatedHourlyUSD: 3.5, EstimatedDailyUSD: 84}
+	if err := checkBudgetGuardrail(forecast, nil, budgetLimits{MaxHourlyUSD: 1, Override: true}); err != nil {
+		t.Fatalf("expected override to allow apply, got %v", err)
+	}
+	if err := checkBudgetGuardrail(nil, errors.New("pricing unavailable"), budgetLimits{MaxDailyUSD: 1, Override: true}); err != nil {
+		t.Fatalf("expected override to allow apply when the forecast fails, got %v", err)
+	}
+}
+
+func TestCheckBudgetGuardrailRefusesWhenForecastFailsWithBudget(t *testing.T) {
+	if err := checkBudgetGuardrail(nil, errors.New("pricing unavailable"), budgetLimits{MaxDailyUSD: 100}); err == nil {
+		t.Fatal("expected a failed forecast to refuse apply when a budget is configured")
+	}
+}
@@ -0,0 +1,531 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/rds"
+	"github.com/aws/aws-sdk-go/service/s3"
+	toolkit "github.com/brudnak/hosted-tenant-rancher/tools"
+	"github.com/spf13/viper"
+)
+
+const (
+	datastoreMethodRDSSnapshot = "rds_snapshot"
+	datastoreMethodMySQLDump   = "mysqldump"
+)
+
+// datastoreSnapshotRecord is kept in run metadata. Identifier is the RDS
+// cluster snapshot for rds_snapshot and the S3 key in s3.bucket for mysqldump.
+type datastoreSnapshotRecord struct {
+	Index        int        `json:"index"`
+	Method       string     `json:"method"`
+	Identifier   string     `json:"identifier"`
+	RDSClusterID string     `json:"rdsClusterId,omitempty"`
+	CreatedAt    time.Time  `json:"createdAt"`
+	RestoredAt   *time.Time `json:"restoredAt,omitempty"`
+}
+
+// configuredDatastoreMethod resolves datastore.method. auto takes an RDS
+// cluster snapshot for Aurora and falls back to mysqldump otherwise.
+func configuredDatastoreMethod(cluster ClusterInfra) (string, error) {
+	method := strings.ToLower(strings.TrimSpace(viper.GetString("datastore.method")))
+	switch method {
+	case "", "auto":
+		if cluster.RDSClusterID != "" {
+			return datastoreMethodRDSSnapshot, nil
+		}
+		return datastoreMethodMySQLDump, nil
+	case datastoreMethodRDSSnapshot:
+		if cluster.RDSClusterID == "" {
+			return "", fmt.Errorf("datastore.method rds_snapshot needs an Aurora cluster, but instance %d has none", cluster.Index)
+		}
+		return method, nil
+	case datastoreMethodMySQLDump:
+		return method, nil
+	}
+	return "", fmt.Errorf("datastore.method must be auto, %s or %s, got %q", datastoreMethodRDSSnapshot, datastoreMethodMySQLDump, method)
+}
+
+// snapshotDatastore captures the datastore of the instance selected by
+// datastore.instance and records it in run metadata.
+func snapshotDatastore(clusters []ClusterInfra) (*datastoreSnapshotRecord, error) {
+	metadata, err := loadActiveRunMetadata(clusters)
+	if err != nil {
+		return nil, err
+	}
+	instanceIndex, err := configuredInstanceIndex("datastore.instance", len(clusters))
+	if err != nil {
+		return nil, err
+	}
+	cluster := clusters[instanceIndex]
+	method, err := configuredDatastoreMethod(cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	record := datastoreSnapshotRecord{Index: instanceIndex + 1, Method: method, CreatedAt: now}
+	switch method {
+	case datastoreMethodRDSSnapshot:
+		record.RDSClusterID = cluster.RDSClusterID
+		record.Identifier = newDatastoreSnapshotName(cluster.RDSClusterID, now)
+		if err := createDatastoreRDSSnapshot(cluster.RDSClusterID, record.Identifier, metadata.Tags); err != nil {
+			return nil, fmt.Errorf("instance %d: %w", instanceIndex+1, err)
+		}
+	case datastoreMethodMySQLDump:
+		record.Identifier = fmt.Sprintf("datastore-dumps/instance-%d/%s.sql.gz", instanceIndex+1, now.Format("20060102-150405"))
+		uploadURL, err := presignDatastoreDump(record.Identifier, true)
+		if err != nil {
+			return nil, err
+		}
+		if err := tools.DumpK3SDatastore(cluster.K3SConfig(), uploadURL); err != nil {
+			return nil, fmt.Errorf("instance %d: %w", instanceIndex+1, err)
+		}
+	}
+
+	metadata.DatastoreSnapshots = append(metadata.DatastoreSnapshots, record)
+	if err := saveRunMetadata(metadata); err != nil {
+		log.Printf("[datastore] Could not record snapshot: %v", err)
+	}
+	log.Printf("[datastore] Instance %d: %s snapshot %s is ready", record.Index, record.Method, record.Identifier)
+	return &record, nil
+}
+
+// restoreDatastore restores datastore.snapshot, or the latest recorded
+// snapshot of datastore.instance. K3s is stopped on both nodes while the
+// datastore is replaced.
+func restoreDatastore(clusters []ClusterInfra) error {
+	metadata, err := loadActiveRunMetadata(clusters)
+	if err != nil {
+		return err
+	}
+	instanceIndex, err := configuredInstanceIndex("datastore.instance", len(clusters))
+	if err != nil {
+		return err
+	}
+	record, err := findDatastoreSnapshotRecord(metadata, instanceIndex, strings.TrimSpace(viper.GetString("datastore.snapshot")))
+	if err != nil {
+		return err
+	}
+	if record.Index != instanceIndex+1 {
+		return fmt.Errorf("snapshot %s belongs to instance %d, not datastore.instance %d", record.Identifier, record.Index, instanceIndex+1)
+	}
+
+	cluster := clusters[instanceIndex]
+	config := cluster.K3SConfig()
+	nodes := []toolkit.K3SNode{config.Node1, config.Node2}
+
+	var downloadURL string
+	if record.Method == datastoreMethodMySQLDump {
+		if downloadURL, err = presignDatastoreDump(record.Identifier, false); err != nil {
+			return err
+		}
+	}
+
+	if record.Method == datastoreMethodRDSSnapshot {
+		// The renamed cluster leaves Terraform's state, so it is recorded
+		// before the rename for TestCleanup to delete if the restore stops.
+		metadata.trackReplacedDatastore(replacedDatastoreName(cluster.RDSClusterID))
+		if err := saveRunMetadata(metadata); err != nil {
+			return fmt.Errorf("failed to record the Aurora cluster being replaced: %w", err)
+		}
+	}
+
+	for _, node := range nodes {
+		if err := tools.StopK3S(node); err != nil {
+			return fmt.Errorf("instance %d: %w", instanceIndex+1, err)
+		}
+	}
+
+	var replacedClusterID string
+	switch record.Method {
+	case datastoreMethodRDSSnapshot:
+		replacedClusterID, err = replaceDatastoreFromRDSSnapshot(cluster.RDSClusterID, record.Identifier)
+	case datastoreMethodMySQLDump:
+		err = tools.RestoreK3SDatastore(config, downloadURL)
+	default:
+		err = fmt.Errorf("unknown datastore snapshot method %q", record.Method)
+	}
+	if err != nil {
+		return fmt.Errorf("instance %d: %w (K3s is stopped; start it with 'sudo systemctl start k3s' once the datastore is usable)", instanceIndex+1, err)
+	}
+
+	for _, node := range nodes {
+		if err := tools.StartK3S(node); err != nil {
+			return fmt.Errorf("instance %d: %w", instanceIndex+1, err)
+		}
+	}
+	kubeconfig, err := refreshInstanceKubeconfig(instanceIndex, cluster)
+	if err != nil {
+		return err
+	}
+	if err := waitForRancherReady(readinessPhaseDatastoreRestore, cluster.RancherURL, kubeconfig, 15*time.Minute); err != nil {
+		return fmt.Errorf("instance %d Rancher failed to become ready after datastore restore: %w", instanceIndex+1, err)
+	}
+	if err := verifyTenantsActive(clusters[0].RancherURL, len(clusters)); err != nil {
+		return fmt.Errorf("after restoring the datastore of instance %d: %w", instanceIndex+1, err)
+	}
+
+	if replacedClusterID != "" {
+		if err := deleteReplacedDatastore(replacedClusterID); err != nil {
+			log.Printf("[datastore] Could not delete replaced Aurora cluster %s; TestCleanup will retry: %v", replacedClusterID, err)
+		} else {
+			metadata.untrackReplacedDatastore(replacedClusterID)
+		}
+	}
+
+	restoredAt := time.Now().UTC()
+	record.RestoredAt = &restoredAt
+	if err := saveRunMetadata(metadata); err != nil {
+		log.Printf("[datastore] Could not record restore: %v", err)
+	}
+	log.Printf("[datastore] Instance %d: restored datastore from %s", instanceIndex+1, record.Identifier)
+	return nil
+}
+
+func createDatastoreRDSSnapshot(clusterID, snapshotID string, tags map[string]string) error {
+	sess, _, err := newCleanupCostSession()
+	if err != nil {
+		return err
+	}
+	rdsClient := rds.New(sess)
+
+	log.Printf("[datastore] Creating snapshot %s of Aurora cluster %s...", snapshotID, clusterID)
+	if _, err := rdsClient.CreateDBClusterSnapshot(&rds.CreateDBClusterSnapshotInput{
+		DBClusterIdentifier:         aws.String(clusterID),
+		DBClusterSnapshotIdentifier: aws.String(snapshotID),
+		Tags:                        rdsTags(tags),
+	}); err != nil {
+		return fmt.Errorf("failed to create snapshot of Aurora cluster %s: %w", clusterID, err)
+	}
+	if err := rdsClient.WaitUntilDBClusterSnapshotAvailable(&rds.DescribeDBClusterSnapshotsInput{
+		DBClusterSnapshotIdentifier: aws.String(snapshotID),
+	}); err != nil {
+		return fmt.Errorf("failed waiting for snapshot %s: %w", snapshotID, err)
+	}
+	return nil
+}
+
+// replaceDatastoreFromRDSSnapshot swaps the Aurora cluster for one restored
+// from snapshotID. Aurora cannot restore in place, so the current cluster and
+// its instances are renamed out of the way and the restored ones take over
+// their identifiers. Endpoints, the K3s datastore-endpoint and the Terraform
+// state keep pointing at the same names. It returns the renamed cluster.
+func replaceDatastoreFromRDSSnapshot(clusterID, snapshotID string) (string, error) {
+	sess, _, err := newCleanupCostSession()
+	if err != nil {
+		return "", err
+	}
+	rdsClient := rds.New(sess)
+
+	described, err := rdsClient.DescribeDBClusters(&rds.DescribeDBClustersInput{DBClusterIdentifier: aws.String(clusterID)})
+	if err != nil || len(described.DBClusters) == 0 {
+		return "", fmt.Errorf("failed to describe Aurora cluster %s: %w", clusterID, err)
+	}
+	current := described.DBClusters[0]
+
+	type memberInstance struct{ id, class string }
+	var members []memberInstance
+	for _, member := range current.DBClusterMembers {
+		id := aws.StringValue(member.DBInstanceIdentifier)
+		instances, err := rdsClient.DescribeDBInstances(&rds.DescribeDBInstancesInput{DBInstanceIdentifier: aws.String(id)})
+		if err != nil || len(instances.DBInstances) == 0 {
+			return "", fmt.Errorf("failed to describe Aurora instance %s: %w", id, err)
+		}
+		members = append(members, memberInstance{id: id, class: aws.StringValue(instances.DBInstances[0].DBInstanceClass)})
+	}
+
+	replacedClusterID := replacedDatastoreName(clusterID)
+	for _, member := range members {
+		log.Printf("[datastore] Renaming Aurora instance %s to %s...", member.id, replacedDatastoreName(member.id))
+		if _, err := rdsClient.ModifyDBInstance(&rds.ModifyDBInstanceInput{
+			DBInstanceIdentifier:    aws.String(member.id),
+			NewDBInstanceIdentifier: aws.String(replacedDatastoreName(member.id)),
+			ApplyImmediately:        aws.Bool(true),
+		}); err != nil {
+			return "", fmt.Errorf("failed to rename Aurora instance %s: %w", member.id, err)
+		}
+	}
+	log.Printf("[datastore] Renaming Aurora cluster %s to %s...", clusterID, replacedClusterID)
+	if _, err := rdsClient.ModifyDBCluster(&rds.ModifyDBClusterInput{
+		DBClusterIdentifier:    aws.String(clusterID),
+		NewDBClusterIdentifier: aws.String(replacedClusterID),
+		ApplyImmediately:       aws.Bool(true),
+	}); err != nil {
+		return "", fmt.Errorf("failed to rename Aurora cluster %s: %w", clusterID, err)
+	}
+	if err := waitForDBClusterStatus(rdsClient, replacedClusterID, "available", 30*time.Minute); err != nil {
+		return "", err
+	}
+	for _, member := range members {
+		if err := waitForDBInstanceStatus(rdsClient, replacedDatastoreName(member.id), "available", 30*time.Minute); err != nil {
+			return "", err
+		}
+	}
+
+	var securityGroupIDs []*string
+	for _, group := range current.VpcSecurityGroups {
+		securityGroupIDs = append(securityGroupIDs, group.VpcSecurityGroupId)
+	}
+	log.Printf("[datastore] Restoring Aurora cluster %s from snapshot %s...", clusterID, snapshotID)
+	if _, err := rdsClient.RestoreDBClusterFromSnapshot(&rds.RestoreDBClusterFromSnapshotInput{
+		DBClusterIdentifier: aws.String(clusterID),
+		SnapshotIdentifier:  aws.String(snapshotID),
+		Engine:              current.Engine,
+		EngineVersion:       current.EngineVersion,
+		DBSubnetGroupName:   current.DBSubnetGroup,
+		VpcSecurityGroupIds: securityGroupIDs,
+		Port:                current.Port,
+		Tags:                current.TagList,
+	}); err != nil {
+		return "", fmt.Errorf("failed to restore snapshot %s (the previous cluster is kept as %s): %w", snapshotID, replacedClusterID, err)
+	}
+	for _, member := range members {
+		if _, err := rdsClient.CreateDBInstance(&rds.CreateDBInstanceInput{
+			DBInstanceIdentifier: aws.String(member.id),
+			DBClusterIdentifier:  aws.String(clusterID),
+			DBInstanceClass:      aws.String(member.class),
+			Engine:               current.Engine,
+			Tags:                 current.TagList,
+		}); err != nil {
+			return "", fmt.Errorf("failed to create Aurora instance %s (the previous cluster is kept as %s): %w", member.id, replacedClusterID, err)
+		}
+	}
+
+	if err := waitForDBClusterStatus(rdsClient, clusterID, "available", 45*time.Minute); err != nil {
+		return "", err
+	}
+	for _, member := range members {
+		if err := waitForDBInstanceStatus(rdsClient, member.id, "available", 45*time.Minute); err != nil {
+			return "", err
+		}
+	}
+	return replacedClusterID, nil
+}
+
+// deleteReplacedDatastore deletes a cluster renamed by
+// replaceDatastoreFromRDSSnapshot once the restored one is in use.
+func deleteReplacedDatastore(clusterID string) error {
+	sess, _, err := newCleanupCostSession()
+	if err != nil {
+		return err
+	}
+	rdsClient := rds.New(sess)
+
+	described, err := rdsClient.DescribeDBClusters(&rds.DescribeDBClustersInput{DBClusterIdentifier: aws.String(clusterID)})
+	if err != nil || len(described.DBClusters) == 0 {
+		return fmt.Errorf("failed to describe Aurora cluster %s: %w", clusterID, err)
+	}
+	for _, member := range described.DBClusters[0].DBClusterMembers {
+		log.Printf("[datastore] Deleting replaced Aurora instance %s...", aws.StringValue(member.DBInstanceIdentifier))
+		if _, err := rdsClient.DeleteDBInstance(&rds.DeleteDBInstanceInput{DBInstanceIdentifier: member.DBInstanceIdentifier}); err != nil {
+			return fmt.Errorf("failed to delete Aurora instance %s: %w", aws.StringValue(member.DBInstanceIdentifier), err)
+		}
+	}
+	log.Printf("[datastore] Deleting replaced Aurora cluster %s...", clusterID)
+	if _, err := rdsClient.DeleteDBCluster(&rds.DeleteDBClusterInput{
+		DBClusterIdentifier: aws.String(clusterID),
+		SkipFinalSnapshot:   aws.Bool(true),
+	}); err != nil {
+		return fmt.Errorf("failed to delete Aurora cluster %s: %w", clusterID, err)
+	}
+	return nil
+}
+
+// trackReplacedDatastore records a cluster renamed out of Terraform's state.
+func (m *runMetadata) trackReplacedDatastore(clusterID string) {
+	if !slices.Contains(m.ReplacedDatastores, clusterID) {
+		m.ReplacedDatastores = append(m.ReplacedDatastores, clusterID)
+	}
+}
+
+func (m *runMetadata) untrackReplacedDatastore(clusterID string) {
+	m.ReplacedDatastores = slices.DeleteFunc(m.ReplacedDatastores, func(id string) bool { return id == clusterID })
+}
+
+// deleteRecordedReplacedDatastores deletes the Aurora clusters a datastore
+// restore renamed but did not get to delete. They share the subnet group and
+// security group Terraform manages, so this runs before terraform destroy.
+func deleteRecordedReplacedDatastores() {
+	metadata, err := loadRunMetadata()
+	if err != nil || metadata == nil || len(metadata.ReplacedDatastores) == 0 {
+		return
+	}
+
+	sess, _, err := newCleanupCostSession()
+	if err != nil {
+		log.Printf("[cleanup] Could not delete replaced Aurora clusters: %v", err)
+		return
+	}
+	rdsClient := rds.New(sess)
+	for _, clusterID := range slices.Clone(metadata.ReplacedDatastores) {
+		if err := deleteReplacedDatastore(clusterID); err != nil {
+			var aErr awserr.Error
+			if !errors.As(err, &aErr) || aErr.Code() != rds.ErrCodeDBClusterNotFoundFault {
+				log.Printf("[cleanup] Could not delete replaced Aurora cluster %s; delete it manually: %v", clusterID, err)
+				continue
+			}
+		}
+		log.Printf("[cleanup] Waiting for replaced Aurora cluster %s to be deleted...", clusterID)
+		if err := rdsClient.WaitUntilDBClusterDeleted(&rds.DescribeDBClustersInput{DBClusterIdentifier: aws.String(clusterID)}); err != nil {
+			log.Printf("[cleanup] Replaced Aurora cluster %s is still being deleted: %v", clusterID, err)
+			continue
+		}
+		metadata.untrackReplacedDatastore(clusterID)
+	}
+	if err := saveRunMetadata(metadata); err != nil {
+		log.Printf("[cleanup] Could not update run metadata: %v", err)
+	}
+}
+
+// deleteRecordedDatastoreSnapshots removes the RDS snapshots a run created,
+// which would otherwise outlive the environment. datastore.keep_snapshots
+// keeps them, for example to start a new environment from one.
+func deleteRecordedDatastoreSnapshots() {
+	if viper.GetBool("datastore.keep_snapshots") {
+		return
+	}
+	metadata, err := loadRunMetadata()
+	if err != nil || metadata == nil {
+		return
+	}
+
+	var snapshotIDs []string
+	for _, record := range metadata.DatastoreSnapshots {
+		if record.Method == datastoreMethodRDSSnapshot {
+			snapshotIDs = append(snapshotIDs, record.Identifier)
+		}
+	}
+	if len(snapshotIDs) == 0 {
+		return
+	}
+
+	sess, _, err := newCleanupCostSession()
+	if err != nil {
+		log.Printf("[cleanup] Could not delete datastore snapshots: %v", err)
+		return
+	}
+	rdsClient := rds.New(sess)
+	for _, snapshotID := range snapshotIDs {
+		log.Printf("[cleanup] Deleting datastore snapshot %s...", snapshotID)
+		if _, err := rdsClient.DeleteDBClusterSnapshot(&rds.DeleteDBClusterSnapshotInput{
+			DBClusterSnapshotIdentifier: aws.String(snapshotID),
+		}); err != nil {
+			log.Printf("[cleanup] Could not delete datastore snapshot %s: %v", snapshotID, err)
+		}
+	}
+}
+
+// waitForDBInstanceStatus reports the instance's current status, or the
+// describe error, while it waits. Like waitForDBClusterStatus, a missing
+// instance is not final because renamed instances take a moment to resolve.
+func waitForDBInstanceStatus(rdsClient *rds.RDS, instanceID, status string, timeout time.Duration) error {
+	err := waitFor(context.Background(), waitOptions{
+		Description:     fmt.Sprintf("Aurora instance %s to be %s", instanceID, status),
+		Timeout:         timeout,
+		InitialInterval: 10 * time.Second,
+		LogPrefix:       "[datastore]",
+	}, func(ctx context.Context) (bool, string, error) {
+		output, err := rdsClient.DescribeDBInstances(&rds.DescribeDBInstancesInput{DBInstanceIdentifier: aws.String(instanceID)})
+		if err != nil {
+			return false, "", fmt.Errorf("failed to describe Aurora instance %s: %w", instanceID, err)
+		}
+		if len(output.DBInstances) == 0 {
+			return false, "not found", nil
+		}
+		current := aws.StringValue(output.DBInstances[0].DBInstanceStatus)
+		return current == status, "currently " + current, nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("[datastore] Aurora instance %s is %s", instanceID, status)
+	return nil
+}
+
+// presignDatastoreDump returns a presigned URL for key in s3.bucket, so the
+// node can transfer the dump without AWS credentials of its own.
+func presignDatastoreDump(key string, upload bool) (string, error) {
+	svc, bucket, err := newRunMetadataS3Client()
+	if err != nil {
+		return "", err
+	}
+
+	var url string
+	if upload {
+		request, _ := svc.PutObjectRequest(&s3.PutObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+		url, err = request.Presign(time.Hour)
+	} else {
+		request, _ := svc.GetObjectRequest(&s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+		url, err = request.Presign(time.Hour)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to presign s3://%s/%s: %w", bucket, key, err)
+	}
+	return url, nil
+}
+
+// findDatastoreSnapshotRecord returns the snapshot named by
+// datastore.snapshot, or the latest snapshot of the instance.
+func findDatastoreSnapshotRecord(metadata *runMetadata, instanceIndex int, identifier string) (*datastoreSnapshotRecord, error) {
+	if metadata == nil || len(metadata.DatastoreSnapshots) == 0 {
+		return nil, fmt.Errorf("no datastore snapshots are recorded in run metadata")
+	}
+
+	var latest *datastoreSnapshotRecord
+	for i := range metadata.DatastoreSnapshots {
+		record := &metadata.DatastoreSnapshots[i]
+		if identifier != "" {
+			if record.Identifier == identifier {
+				return record, nil
+			}
+			continue
+		}
+		if record.Index == instanceIndex+1 && (latest == nil || record.CreatedAt.After(latest.CreatedAt)) {
+			latest = record
+		}
+	}
+	if identifier != "" {
+		return nil, fmt.Errorf("no recorded datastore snapshot %s", identifier)
+	}
+	if latest == nil {
+		return nil, fmt.Errorf("no datastore snapshots are recorded for instance %d", instanceIndex+1)
+	}
+	return latest, nil
+}
+
+func newDatastoreSnapshotName(clusterID string, now time.Time) string {
+	return fmt.Sprintf("%s-%s", clusterID, now.UTC().Format("20060102-150405"))
+}
+
+// replacedDatastoreName stays within the 63 character RDS identifier limit.
+func replacedDatastoreName(identifier string) string {
+	const suffix = "-replaced"
+	if len(identifier)+len(suffix) > 63 {
+		identifier = strings.TrimRight(identifier[:63-len(suffix)], "-")
+	}
+	return identifier + suffix
+}
+
+func rdsTags(tags map[string]string) []*rds.Tag {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var rdsTags []*rds.Tag
+	for _, key := range keys {
+		rdsTags = append(rdsTags, &rds.Tag{Key: aws.String(key), Value: aws.String(tags[key])})
+	}
+	return rdsTags
+}
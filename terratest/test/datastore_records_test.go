@@ -0,0 +1,71 @@
+package test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestConfiguredDatastoreMethodFallsBackToMySQLDump(t *testing.T) {
+	t.Cleanup(func() { viper.Set("datastore.method", nil) })
+
+	method, err := configuredDatastoreMethod(ClusterInfra{Index: 1, RDSClusterID: "abc-1-cluster"})
+	if err != nil || method != datastoreMethodRDSSnapshot {
+		t.Fatalf("expected rds_snapshot for Aurora, got %q (%v)", method, err)
+	}
+
+	method, err = configuredDatastoreMethod(ClusterInfra{Index: 2})
+	if err != nil || method != datastoreMethodMySQLDump {
+		t.Fatalf("expected mysqldump without an Aurora cluster, got %q (%v)", method, err)
+	}
+
+	viper.Set("datastore.method", "rds_snapshot")
+	if _, err := configuredDatastoreMethod(ClusterInfra{Index: 2}); err == nil {
+		t.Fatalf("expected rds_snapshot without an Aurora cluster to be rejected")
+	}
+}
+
+func TestFindDatastoreSnapshotRecordPicksLatestForInstance(t *testing.T) {
+	now := time.Now()
+	metadata := &runMetadata{DatastoreSnapshots: []datastoreSnapshotRecord{
+		{Index: 2, Identifier: "tenant-old", CreatedAt: now.Add(-time.Hour)},
+		{Index: 2, Identifier: "tenant-new", CreatedAt: now},
+		{Index: 1, Identifier: "host", CreatedAt: now.Add(time.Hour)},
+	}}
+
+	record, err := findDatastoreSnapshotRecord(metadata, 1, "")
+	if err != nil || record.Identifier != "tenant-new" {
+		t.Fatalf("expected latest tenant snapshot, got %+v (%v)", record, err)
+	}
+	if _, err := findDatastoreSnapshotRecord(metadata, 1, "missing"); err == nil {
+		t.Fatalf("expected unknown snapshot to be rejected")
+	}
+}
+
+func TestReplacedDatastoreNameStaysWithinRDSLimit(t *testing.T) {
+	name := replacedDatastoreName(strings.Repeat("a", 58) + "-bbbb")
+	if len(name) > 63 || !strings.HasSuffix(name, "-replaced") {
+		t.Fatalf("unexpected replaced name %q (%d chars)", name, len(name))
+	}
+	if got := replacedDatastoreName("xyz-1-happy-cat"); got != "xyz-1-happy-cat-replaced" {
+		t.Fatalf("unexpected replaced name %q", got)
+	}
+}
+
+func TestReplacedDatastoreTrackingIgnoresDuplicates(t *testing.T) {
+	metadata := &runMetadata{}
+	metadata.trackReplacedDatastore("xyz-1-cluster-replaced")
+	metadata.trackReplacedDatastore("xyz-2-cluster-replaced")
+	metadata.trackReplacedDatastore("xyz-1-cluster-replaced")
+	if len(metadata.ReplacedDatastores) != 2 {
+		t.Fatalf("expected each cluster to be recorded once, got %v", metadata.ReplacedDatastores)
+	}
+
+	metadata.untrackReplacedDatastore("xyz-1-cluster-replaced")
+	metadata.untrackReplacedDatastore("missing")
+	if len(metadata.ReplacedDatastores) != 1 || metadata.ReplacedDatastores[0] != "xyz-2-cluster-replaced" {
+		t.Fatalf("expected only the second cluster to remain, got %v", metadata.ReplacedDatastores)
+	}
+}
@@ -0,0 +1,49 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/gruntwork-io/terratest/modules/terraform"
+)
+
+func TestDatastoreSnapshot(t *testing.T) {
+	setupConfig(t)
+	if err := validateSecretEnvironment(); err != nil {
+		t.Fatalf("secret environment preflight failed: %v", err)
+	}
+
+	terraformOptions := terraform.WithDefaultRetryableErrors(t, &terraform.Options{
+		TerraformDir: "../modules/aws",
+		NoColor:      true,
+	})
+
+	clusters, err := loadClusterInfra(t, terraformOptions, getTotalRancherInstances())
+	if err != nil {
+		t.Fatalf("Failed to load cluster infrastructure: %v", err)
+	}
+
+	if _, err := snapshotDatastore(clusters); err != nil {
+		t.Fatalf("Datastore snapshot failed: %v", err)
+	}
+}
+
+func TestDatastoreRestore(t *testing.T) {
+	setupConfig(t)
+	if err := validateSecretEnvironment(); err != nil {
+		t.Fatalf("secret environment preflight failed: %v", err)
+	}
+
+	terraformOptions := terraform.WithDefaultRetryableErrors(t, &terraform.Options{
+		TerraformDir: "../modules/aws",
+		NoColor:      true,
+	})
+
+	clusters, err := loadClusterInfra(t, terraformOptions, getTotalRancherInstances())
+	if err != nil {
+		t.Fatalf("Failed to load cluster infrastructure: %v", err)
+	}
+
+	if err := restoreDatastore(clusters); err != nil {
+		t.Fatalf("Datastore restore failed: %v", err)
+	}
+}
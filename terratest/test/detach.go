@@ -0,0 +1,222 @@
+package test
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// detachTenantFromHost deletes the imported-tenant-N provisioning cluster and
+// waits until Rancher has run its finalizers and removed the management
+// cluster as well. Run cleanupTenantAgents afterwards to make the tenant
+// importable into another host.
+func detachTenantFromHost(hostURL, token string, tenantIndex int, timeout time.Duration) error {
+	client := newRancherAPIClient(hostURL, token)
+	clusterName := fmt.Sprintf("imported-tenant-%d", tenantIndex)
+	provisioningPath := "/v1/provisioning.cattle.io.clusters/fleet-default/" + clusterName
+
+	var cluster struct {
+		Status struct {
+			ClusterName string `json:"clusterName"`
+		} `json:"status"`
+	}
+	status, err := client.do(http.MethodGet, provisioningPath, &cluster)
+	if err != nil {
+		return fmt.Errorf("failed to read cluster %s: %w", clusterName, err)
+	}
+	if status == http.StatusNotFound {
+		log.Printf("[detach] Cluster %s is not in the host", clusterName)
+		return nil
+	}
+
+	log.Printf("[detach] Deleting cluster %s (%s) from the host...", clusterName, cluster.Status.ClusterName)
+	if _, err := client.do(http.MethodDelete, provisioningPath, nil); err != nil {
+		return fmt.Errorf("failed to delete cluster %s: %w", clusterName, err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	if err := client.waitForNotFound(provisioningPath, deadline); err != nil {
+		return fmt.Errorf("cluster %s: %w", clusterName, err)
+	}
+	if cluster.Status.ClusterName != "" {
+		if err := client.waitForNotFound("/v1/management.cattle.io.clusters/"+cluster.Status.ClusterName, deadline); err != nil {
+			return fmt.Errorf("management cluster %s: %w", cluster.Status.ClusterName, err)
+		}
+	}
+	log.Printf("[detach] Cluster %s was removed from the host", clusterName)
+	return nil
+}
+
+// detachTenantsBeforeDestroy deletes every tenant's imported cluster from the
+// host it is imported into, for cleanup.detach_tenants. A tenant re-imported
+// into another Rancher would otherwise stay there as a disconnected cluster.
+// The tenants themselves are destroyed next, so their agents are left alone,
+// and failures are only logged.
+func detachTenantsBeforeDestroy(clusters []ClusterInfra) {
+	metadata, err := loadRunMetadata()
+	if err != nil {
+		log.Printf("[cleanup] Could not read tenant moves, assuming every tenant is in the host: %v", err)
+	}
+	environmentHost := clusters[0].RancherURL
+	for tenantIndex := 1; tenantIndex < len(clusters); tenantIndex++ {
+		currentHost := tenantHost(metadata, tenantIndex, environmentHost)
+		if currentHost == "" {
+			continue
+		}
+		if currentHost == environmentHost && metadata != nil && metadata.hibernated() {
+			log.Printf("[cleanup] Not detaching tenant %d: the host is %s", tenantIndex, metadata.State)
+			continue
+		}
+		token, err := currentHostToken(currentHost, environmentHost)
+		if err != nil {
+			log.Printf("[cleanup] Could not detach tenant %d from %s: %v", tenantIndex, currentHost, err)
+			continue
+		}
+		log.Printf("[cleanup] Detaching tenant %d from %s...", tenantIndex, currentHost)
+		if err := detachTenantFromHost(currentHost, token, tenantIndex, 15*time.Minute); err != nil {
+			log.Printf("[cleanup] Could not detach tenant %d from %s: %v", tenantIndex, currentHost, err)
+			continue
+		}
+		recordTenantMove(tenantIndex, currentHost, "")
+	}
+}
+
+// cleanupTenantAgents removes what a host import installs on the tenant: the
+// cluster agent, its credentials and RBAC, and the host's fleet agent. The
+// tenant runs its own Rancher, whose fleet-controller shares
+// cattle-fleet-system, so only the fleet-agent objects are deleted there.
+func cleanupTenantAgents(tenantIndex int, tenant ClusterInfra) error {
+	kubeconfig, err := refreshInstanceKubeconfig(tenantIndex, tenant)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[detach] Removing host import agents from tenant %d...", tenantIndex)
+	secrets, err := kubectl(kubeconfig, nil, "get", "secrets", "--namespace", "cattle-system", "-o", "name")
+	if err != nil {
+		return err
+	}
+	credentialSecrets := secretsWithPrefix(secrets, "cattle-credentials-")
+	fleetSecrets, err := kubectl(kubeconfig, nil, "get", "secrets", "--namespace", "cattle-fleet-system", "-o", "name", "--ignore-not-found")
+	if err != nil {
+		return err
+	}
+	fleetAgentSecrets := secretsWithPrefix(fleetSecrets, "fleet-agent")
+
+	commands := [][]string{
+		{"delete", "deployment,service", "cattle-cluster-agent", "--namespace", "cattle-system", "--ignore-not-found"},
+		{"delete", "clusterrolebinding", "cattle-admin-binding", "--ignore-not-found"},
+		{"delete", "clusterrole", "cattle-admin", "--ignore-not-found"},
+		{"delete", "serviceaccount", "cattle", "--namespace", "cattle-system", "--ignore-not-found"},
+		// Newer fleet releases run the agent as a statefulset.
+		{"delete", "deployment,statefulset,serviceaccount,configmap", "fleet-agent", "--namespace", "cattle-fleet-system", "--ignore-not-found"},
+	}
+	if len(credentialSecrets) > 0 {
+		commands = append(commands, append([]string{"delete", "--namespace", "cattle-system", "--ignore-not-found"}, credentialSecrets...))
+	}
+	if len(fleetAgentSecrets) > 0 {
+		commands = append(commands, append([]string{"delete", "--namespace", "cattle-fleet-system", "--ignore-not-found"}, fleetAgentSecrets...))
+	}
+	for _, args := range commands {
+		if _, err := kubectl(kubeconfig, nil, args...); err != nil {
+			return fmt.Errorf("tenant %d agent cleanup: %w", tenantIndex, err)
+		}
+	}
+	return nil
+}
+
+// secretsWithPrefix picks the secrets whose name starts with prefix out of
+// "kubectl get secrets -o name" output.
+func secretsWithPrefix(output, prefix string) []string {
+	var secrets []string
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "secret/"+prefix) {
+			secrets = append(secrets, line)
+		}
+	}
+	return secrets
+}
+
+type rancherAPIClient struct {
+	hostURL string
+	token   string
+	client  *http.Client
+}
+
+func newRancherAPIClient(hostURL, token string) *rancherAPIClient {
+	return &rancherAPIClient{
+		hostURL: hostURL,
+		token:   token,
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+		},
+	}
+}
+
+// do sends a request and decodes a successful response into out. A 404 is
+// returned as a status, not an error.
+func (c *rancherAPIClient) do(method, path string, out interface{}) (int, error) {
+	req, err := http.NewRequest(method, "https://"+c.hostURL+path, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.token))
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return resp.StatusCode, nil
+	}
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return resp.StatusCode, fmt.Errorf("%s %s returned status %d: %s", method, path, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, fmt.Errorf("failed to parse %s response: %w", path, err)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// waitForNotFound waits until path returns 404, which for Kubernetes objects
+// means every finalizer has run. It reports the finalizers still pending.
+func (c *rancherAPIClient) waitForNotFound(path string, deadline time.Time) error {
+	return waitFor(context.Background(), waitOptions{
+		Description: fmt.Sprintf("%s to be removed", path),
+		Timeout:     time.Until(deadline),
+		MaxInterval: 15 * time.Second,
+		LogPrefix:   "[detach]",
+	}, func(ctx context.Context) (bool, string, error) {
+		var object struct {
+			Metadata struct {
+				Finalizers []string `json:"finalizers"`
+			} `json:"metadata"`
+		}
+		status, err := c.do(http.MethodGet, path, &object)
+		if err != nil {
+			return false, "", err
+		}
+		if status == http.StatusNotFound {
+			return true, "", nil
+		}
+		if len(object.Metadata.Finalizers) == 0 {
+			return false, "being deleted", nil
+		}
+		return false, "finalizers: " + strings.Join(object.Metadata.Finalizers, ", "), nil
+	})
+}
@@ -0,0 +1,39 @@
+package test
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSecretsWithPrefixOnlyPicksImportSecrets(t *testing.T) {
+	cases := []struct {
+		name     string
+		output   string
+		prefix   string
+		expected []string
+	}{
+		{
+			name:     "import credentials",
+			output:   "secret/bootstrap-secret\nsecret/cattle-credentials-3f9a2c1\nsecret/tls-rancher\nsecret/cattle-credentials-77b01de\n",
+			prefix:   "cattle-credentials-",
+			expected: []string{"secret/cattle-credentials-3f9a2c1", "secret/cattle-credentials-77b01de"},
+		},
+		{
+			// The tenant's own fleet-controller keeps its secrets here too.
+			name:     "host fleet agent",
+			output:   "secret/fleet-agent-bootstrap\nsecret/fleet-controller-bootstrap-token\nsecret/gitjob-webhook\nsecret/fleet-agent\n",
+			prefix:   "fleet-agent",
+			expected: []string{"secret/fleet-agent-bootstrap", "secret/fleet-agent"},
+		},
+		{
+			name:   "none",
+			output: "",
+			prefix: "fleet-agent",
+		},
+	}
+	for _, tc := range cases {
+		if got := secretsWithPrefix(tc.output, tc.prefix); !reflect.DeepEqual(got, tc.expected) {
+			t.Fatalf("%s: expected %v, got %v", tc.name, tc.expected, got)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event statuses. A phase emits started, then succeeded or failed; log lines
+// written through the log package while events are captured arrive as log.
+const (
+	eventStarted   = "started"
+	eventSucceeded = "succeeded"
+	eventFailed    = "failed"
+	eventLog       = "log"
+)
+
+// runEvent is one line of the event stream. Instance is 1-based like the rest
+// of the tool's output; 0 means the run as a whole.
+type runEvent struct {
+	Time            time.Time `json:"time"`
+	Instance        int       `json:"instance,omitempty"`
+	Phase           string    `json:"phase,omitempty"`
+	Status          string    `json:"status"`
+	Message         string    `json:"message,omitempty"`
+	DurationSeconds float64   `json:"durationSeconds,omitempty"`
+	Error           string    `json:"error,omitempty"`
+}
+
+// String renders an event for people, as the interactive page shows it.
+func (e runEvent) String() string {
+	if e.Status == eventLog {
+		return e.Message
+	}
+	subject := e.Phase
+	if e.Instance > 0 {
+		subject = fmt.Sprintf("%s (instance %d)", e.Phase, e.Instance)
+	}
+	switch e.Status {
+	case eventStarted:
+		return fmt.Sprintf("[event] %s started", subject)
+	case eventSucceeded:
+		return fmt.Sprintf("[event] %s succeeded in %v", subject, secondsDuration(e.DurationSeconds))
+	case eventFailed:
+		return fmt.Sprintf("[event] %s failed after %v: %s", subject, secondsDuration(e.DurationSeconds), e.Error)
+	}
+	return fmt.Sprintf("[event] %s %s %s", subject, e.Status, e.Message)
+}
+
+func secondsDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second)).Round(time.Second)
+}
+
+// eventBus fans events out to the JSON lines file and to subscribers such as
+// the interactive page and the run report.
+type eventBus struct {
+	mu          sync.Mutex
+	file        *os.File
+	subscribers map[int]func(runEvent)
+	nextID      int
+
+	// captureMu is separate from mu: log.SetOutput waits for log writes in
+	// flight, and those emit events under mu.
+	captureMu     sync.Mutex
+	captureDepth  int
+	restoreWriter io.Writer
+}
+
+var runEvents = &eventBus{subscribers: map[int]func(runEvent){}}
+
+func (b *eventBus) emit(event runEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	b.mu.Lock()
+	file := b.file
+	subscribers := make([]func(runEvent), 0, len(b.subscribers))
+	for _, subscriber := range b.subscribers {
+		subscribers = append(subscribers, subscriber)
+	}
+	if file != nil {
+		if line, err := json.Marshal(event); err == nil {
+			_, _ = file.Write(append(line, '\n'))
+		}
+	}
+	b.mu.Unlock()
+
+	for _, subscriber := range subscribers {
+		subscriber(event)
+	}
+}
+
+// subscribe calls fn for every event until the returned function is called.
+// fn must not block.
+func (b *eventBus) subscribe(fn func(runEvent)) func() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := b.nextID
+	b.nextID++
+	b.subscribers[id] = fn
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subscribers, id)
+	}
+}
+
+// openFile appends every following event to path as JSON lines.
+func (b *eventBus) openFile(path string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open event log %s: %w", path, err)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.file != nil {
+		b.file.Close()
+	}
+	b.file = file
+	return nil
+}
+
+func (b *eventBus) closeFile() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.file != nil {
+		b.file.Close()
+		b.file = nil
+	}
+}
+
+// captureLogs turns every log line into a log event until the returned
+// function is called. Nested captures share one writer.
+func (b *eventBus) captureLogs() func() {
+	b.captureMu.Lock()
+	defer b.captureMu.Unlock()
+	b.captureDepth++
+	if b.captureDepth == 1 {
+		b.restoreWriter = log.Writer()
+		writer := &lineWriter{onLine: func(line string) {
+			b.emit(runEvent{Status: eventLog, Message: line})
+		}}
+		log.SetOutput(io.MultiWriter(b.restoreWriter, writer))
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.captureMu.Lock()
+			defer b.captureMu.Unlock()
+			b.captureDepth--
+			if b.captureDepth == 0 {
+				log.SetOutput(b.restoreWriter)
+				b.restoreWriter = nil
+			}
+		})
+	}
+}
+
+// phaseSpan times one phase of one instance.
+type phaseSpan struct {
+	instance int
+	phase    string
+	started  time.Time
+}
+
+// startPhase emits the started event of a phase.
+func startPhase(instance int, phase string) *phaseSpan {
+	span := &phaseSpan{instance: instance, phase: phase, started: time.Now()}
+	runEvents.emit(runEvent{Instance: instance, Phase: phase, Status: eventStarted})
+	return span
+}
+
+// end emits succeeded or failed with the phase's duration, and returns err so
+// callers can end a phase and report its error in one step.
+func (s *phaseSpan) end(err error) error {
+	event := runEvent{
+		Instance:        s.instance,
+		Phase:           s.phase,
+		Status:          eventSucceeded,
+		DurationSeconds: time.Since(s.started).Seconds(),
+	}
+	if err != nil {
+		event.Status = eventFailed
+		event.Error = err.Error()
+	}
+	runEvents.emit(event)
+	return err
+}
+
+// runPhase runs fn as one phase of one instance. Once the deployment is
+// canceled, phases fail without running.
+func runPhase(instance int, phase string, fn func() error) error {
+	span := startPhase(instance, phase)
+	if deployCancel.canceled() {
+		return span.end(errDeploymentCanceled)
+	}
+	return span.end(fn())
+}
+
+// lineWriter calls onLine for every complete, non-blank line written to it.
+type lineWriter struct {
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	onLine func(string)
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	var lines []string
+	n, err := w.buf.Write(p)
+	for {
+		data := w.buf.Bytes()
+		idx := bytes.IndexByte(data, '\n')
+		if idx < 0 {
+			break
+		}
+		line := string(data[:idx])
+		w.buf.Next(idx + 1)
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	w.mu.Unlock()
+
+	for _, line := range lines {
+		w.onLine(line)
+	}
+	return n, err
+}
@@ -0,0 +1,327 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/rds"
+	toolkit "github.com/brudnak/hosted-tenant-rancher/tools"
+	"github.com/spf13/viper"
+)
+
+// recordRunMetadata is best effort: a missing record only means hibernate has
+// to take the clusters from terraform outputs itself.
+func recordRunMetadata(clusters []ClusterInfra, tags map[string]string) {
+	metadata := &runMetadata{State: runStateRunning, Tags: tags, Clusters: runClustersFromInfra(clusters)}
+	if err := saveRunMetadata(metadata); err != nil {
+		log.Printf("[metadata] Could not record run metadata: %v", err)
+	}
+}
+
+func hibernateEnvironment(clusters []ClusterInfra) error {
+	metadata, err := loadRunMetadata()
+	if err != nil {
+		return err
+	}
+	if metadata != nil && metadata.State == runStateHibernated {
+		return fmt.Errorf("environment is already hibernated since %s; run TestResume first", metadata.HibernatedAt.Format(time.RFC3339))
+	}
+	if metadata == nil {
+		metadata = &runMetadata{}
+	}
+
+	sess, _, err := newCleanupCostSession()
+	if err != nil {
+		return err
+	}
+
+	// Record the clusters before stopping anything: resume needs them, and a
+	// failed hibernate is then finished by running it again.
+	metadata.Clusters = runClustersFromInfra(clusters)
+	metadata.State = runStateHibernating
+	if err := saveRunMetadata(metadata); err != nil {
+		return err
+	}
+
+	var instanceIDs []*string
+	for _, cluster := range clusters {
+		instanceIDs = append(instanceIDs, aws.StringSlice(cluster.InstanceIDs())...)
+	}
+
+	ec2Client := ec2.New(sess)
+	log.Printf("[hibernate] Stopping %d EC2 instance(s)...", len(instanceIDs))
+	if _, err := ec2Client.StopInstances(&ec2.StopInstancesInput{InstanceIds: instanceIDs}); err != nil {
+		return fmt.Errorf("failed to stop EC2 instances: %w", err)
+	}
+	if err := ec2Client.WaitUntilInstanceStopped(&ec2.DescribeInstancesInput{InstanceIds: instanceIDs}); err != nil {
+		return fmt.Errorf("failed waiting for EC2 instances to stop: %w", err)
+	}
+
+	rdsClient := rds.New(sess)
+	for _, cluster := range clusters {
+		if cluster.RDSClusterID == "" {
+			continue
+		}
+		if err := stopDBCluster(rdsClient, cluster.RDSClusterID, cluster.Index); err != nil {
+			return err
+		}
+	}
+	for _, cluster := range clusters {
+		if cluster.RDSClusterID == "" {
+			continue
+		}
+		if err := waitForDBClusterStatus(rdsClient, cluster.RDSClusterID, "stopped", 30*time.Minute); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now().UTC()
+	metadata.State = runStateHibernated
+	metadata.HibernatedAt = &now
+	if err := saveRunMetadata(metadata); err != nil {
+		return err
+	}
+
+	log.Printf("[hibernate] Environment hibernated. AWS restarts stopped Aurora clusters automatically after 7 days.")
+	return nil
+}
+
+// startHibernatedEnvironment starts the Aurora clusters first so K3s finds its
+// datastore as soon as the nodes boot.
+func startHibernatedEnvironment(metadata *runMetadata) error {
+	sess, _, err := newCleanupCostSession()
+	if err != nil {
+		return err
+	}
+
+	metadata.State = runStateResuming
+	if err := saveRunMetadata(metadata); err != nil {
+		return err
+	}
+
+	rdsClient := rds.New(sess)
+	for _, cluster := range metadata.Clusters {
+		if cluster.RDSClusterID == "" {
+			continue
+		}
+		if err := startDBCluster(rdsClient, cluster.RDSClusterID, cluster.Index); err != nil {
+			return err
+		}
+	}
+	for _, cluster := range metadata.Clusters {
+		if cluster.RDSClusterID == "" {
+			continue
+		}
+		if err := waitForDBClusterStatus(rdsClient, cluster.RDSClusterID, "available", 30*time.Minute); err != nil {
+			return err
+		}
+	}
+
+	var instanceIDs []*string
+	for _, cluster := range metadata.Clusters {
+		for _, instanceID := range cluster.InstanceIDs {
+			instanceIDs = append(instanceIDs, aws.String(instanceID))
+		}
+	}
+
+	ec2Client := ec2.New(sess)
+	log.Printf("[resume] Starting %d EC2 instance(s)...", len(instanceIDs))
+	if _, err := ec2Client.StartInstances(&ec2.StartInstancesInput{InstanceIds: instanceIDs}); err != nil {
+		return fmt.Errorf("failed to start EC2 instances: %w", err)
+	}
+	if err := ec2Client.WaitUntilInstanceRunning(&ec2.DescribeInstancesInput{InstanceIds: instanceIDs}); err != nil {
+		return fmt.Errorf("failed waiting for EC2 instances to run: %w", err)
+	}
+
+	return nil
+}
+
+// resumeClusterNodes re-points every cluster at its new public IPs and
+// refreshes the saved kubeconfigs, then verifies Rancher and the tenant imports.
+func resumeClusterNodes(metadata *runMetadata, clusters []ClusterInfra) error {
+	var configs []toolkit.K3SConfig
+	for i, cluster := range clusters {
+		config := cluster.K3SConfig()
+		configs = append(configs, config)
+
+		log.Printf("[resume] Instance %d: waiting for SSM and K3s on %s and %s...", i+1, config.Node1, config.Node2)
+		for _, node := range []toolkit.K3SNode{config.Node1, config.Node2} {
+			if err := tools.WaitForNodeReady(node); err != nil {
+				return fmt.Errorf("instance %d node %s did not become ready: %w", i+1, node, err)
+			}
+		}
+
+		// Elastic IPs and Route53 names survive a stop/start, so the K3s
+		// config written at install time is still valid.
+		if nodeAddressesAreStable() {
+			log.Printf("[resume] Instance %d: node addresses are stable (%s), skipping K3s address refresh", i+1, configuredNodeAddressing())
+		} else {
+			log.Printf("[resume] Instance %d: refreshing K3s tls-san and node-external-ip...", i+1)
+			if err := tools.RefreshK3SNodeAddresses(config); err != nil {
+				return fmt.Errorf("instance %d: %w", i+1, err)
+			}
+		}
+
+		if err := saveK3SKubeconfig(config.Node1, rancherScriptDir(i)); err != nil {
+			return fmt.Errorf("instance %d: failed to refresh kubeconfig: %w", i+1, err)
+		}
+
+		if recorded := metadata.cluster(cluster.Index); recorded != nil {
+			recorded.NodeIPs = cluster.PublicIPs()
+		}
+	}
+
+	for i, config := range configs {
+		log.Printf("[resume] Waiting for Rancher instance %d to be ready...", i+1)
+		kubeconfig := filepath.Join(rancherScriptDir(i), "kube_config.yaml")
+		if err := waitForRancherReady(readinessPhaseResume, config.RancherURL, kubeconfig, 10*time.Minute); err != nil {
+			return fmt.Errorf("instance %d Rancher failed to become ready: %w", i+1, err)
+		}
+	}
+
+	hostURL := configs[0].RancherURL
+	password := configuredAdminPassword()
+	if err := waitForRancherAPIReady(hostURL, password, 10*time.Minute); err != nil {
+		return err
+	}
+	token, err := tools.CreateToken(hostURL, password)
+	if err != nil {
+		return fmt.Errorf("failed to create host admin token: %w", err)
+	}
+
+	for tenantIndex := 1; tenantIndex < len(clusters); tenantIndex++ {
+		if err := waitForClusterActive(hostURL, token, tenantIndex, 10*time.Minute); err != nil {
+			return fmt.Errorf("tenant %d did not return to Active: %w", tenantIndex, err)
+		}
+	}
+
+	return nil
+}
+
+func runClustersFromInfra(clusters []ClusterInfra) []runClusterMetadata {
+	recorded := make([]runClusterMetadata, 0, len(clusters))
+	for _, cluster := range clusters {
+		recorded = append(recorded, runClusterMetadata{
+			Index:        cluster.Index,
+			RancherURL:   cluster.RancherURL,
+			InstanceIDs:  cluster.InstanceIDs(),
+			NodeIPs:      cluster.PublicIPs(),
+			RDSClusterID: cluster.RDSClusterID,
+		})
+	}
+	return recorded
+}
+
+// stopDBCluster stops an Aurora cluster unless it is already stopping or
+// stopped, so hibernate can be repeated after a partial run.
+func stopDBCluster(rdsClient *rds.RDS, clusterID string, instance int) error {
+	status, err := dbClusterStatus(rdsClient, clusterID)
+	if err != nil {
+		return err
+	}
+	if slices.Contains([]string{"stopping", "stopped"}, status) {
+		log.Printf("[hibernate] Aurora cluster %s for instance %d is already %s", clusterID, instance, status)
+		return nil
+	}
+
+	log.Printf("[hibernate] Stopping Aurora cluster %s for instance %d...", clusterID, instance)
+	if _, err := rdsClient.StopDBCluster(&rds.StopDBClusterInput{DBClusterIdentifier: aws.String(clusterID)}); err != nil {
+		return fmt.Errorf("failed to stop Aurora cluster %s (status %s): %w", clusterID, status, err)
+	}
+	return nil
+}
+
+// startDBCluster starts an Aurora cluster unless it is already starting or
+// available, so resume can be repeated after a partial run.
+func startDBCluster(rdsClient *rds.RDS, clusterID string, instance int) error {
+	status, err := dbClusterStatus(rdsClient, clusterID)
+	if err != nil {
+		return err
+	}
+	if slices.Contains([]string{"starting", "available"}, status) {
+		log.Printf("[resume] Aurora cluster %s for instance %d is already %s", clusterID, instance, status)
+		return nil
+	}
+
+	log.Printf("[resume] Starting Aurora cluster %s for instance %d...", clusterID, instance)
+	if _, err := rdsClient.StartDBCluster(&rds.StartDBClusterInput{DBClusterIdentifier: aws.String(clusterID)}); err != nil {
+		return fmt.Errorf("failed to start Aurora cluster %s (status %s): %w", clusterID, status, err)
+	}
+	return nil
+}
+
+func dbClusterStatus(rdsClient *rds.RDS, clusterID string) (string, error) {
+	output, err := rdsClient.DescribeDBClusters(&rds.DescribeDBClustersInput{DBClusterIdentifier: aws.String(clusterID)})
+	if err != nil {
+		return "", fmt.Errorf("failed to describe Aurora cluster %s: %w", clusterID, err)
+	}
+	if len(output.DBClusters) == 0 {
+		return "", fmt.Errorf("Aurora cluster %s not found", clusterID)
+	}
+	return aws.StringValue(output.DBClusters[0].Status), nil
+}
+
+// waitForDBClusterStatus reports the cluster's current status, or the describe
+// error, while it waits. A missing cluster is not final: right after a rename
+// the new identifier can take a moment to resolve.
+func waitForDBClusterStatus(rdsClient *rds.RDS, clusterID, status string, timeout time.Duration) error {
+	err := waitFor(context.Background(), waitOptions{
+		Description:     fmt.Sprintf("Aurora cluster %s to be %s", clusterID, status),
+		Timeout:         timeout,
+		InitialInterval: 10 * time.Second,
+	}, func(ctx context.Context) (bool, string, error) {
+		current, err := dbClusterStatus(rdsClient, clusterID)
+		if err != nil {
+			return false, "", err
+		}
+		return current == status, "currently " + current, nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Aurora cluster %s is %s", clusterID, status)
+	return nil
+}
+
+func rancherScriptDir(instanceIndex int) string {
+	if instanceIndex == 0 {
+		return "host-rancher"
+	}
+	return fmt.Sprintf("tenant-%d-rancher", instanceIndex)
+}
+
+func configuredAdminPassword() string {
+	helmCommands := viper.GetStringSlice("rancher.helm_commands")
+	if len(helmCommands) > 0 {
+		if password := extractBootstrapPassword(helmCommands[0]); password != "" {
+			return password
+		}
+	}
+	if password := strings.TrimSpace(viper.GetString("rancher.bootstrap_password")); password != "" {
+		return password
+	}
+	return "admin"
+}
+
+func configuredNodeAddressing() string {
+	addressing := strings.TrimSpace(viper.GetString("tf_vars.aws_node_addressing"))
+	if addressing == "" {
+		return "public_ip"
+	}
+	return addressing
+}
+
+func nodeAddressesAreStable() bool {
+	switch configuredNodeAddressing() {
+	case "elastic_ip", "route53":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gruntwork-io/terratest/modules/terraform"
+)
+
+func TestHibernate(t *testing.T) {
+	setupConfig(t)
+	if err := validateSecretEnvironment(); err != nil {
+		t.Fatalf("secret environment preflight failed: %v", err)
+	}
+
+	terraformOptions := terraform.WithDefaultRetryableErrors(t, &terraform.Options{
+		TerraformDir: "../modules/aws",
+		NoColor:      true,
+	})
+
+	clusters, err := loadClusterInfra(t, terraformOptions, getTotalRancherInstances())
+	if err != nil {
+		t.Fatalf("Failed to load cluster infrastructure: %v", err)
+	}
+
+	if err := hibernateEnvironment(clusters); err != nil {
+		t.Fatalf("Hibernate failed: %v", err)
+	}
+}
+
+func TestResume(t *testing.T) {
+	setupConfig(t)
+	if err := validateSecretEnvironment(); err != nil {
+		t.Fatalf("secret environment preflight failed: %v", err)
+	}
+
+	metadata, err := loadRunMetadata()
+	if err != nil {
+		t.Fatalf("Failed to load run metadata: %v", err)
+	}
+	if metadata == nil || !metadata.hibernated() {
+		t.Fatal("Environment is not hibernated; nothing to resume")
+	}
+
+	if err := startHibernatedEnvironment(metadata); err != nil {
+		t.Fatalf("Failed to start hibernated environment: %v", err)
+	}
+
+	terraformOptions := terraform.WithDefaultRetryableErrors(t, &terraform.Options{
+		TerraformDir: "../modules/aws",
+		NoColor:      true,
+		Vars: map[string]interface{}{
+			"total_rancher_instances": getTotalRancherInstances(),
+		},
+	})
+
+	if err := createAWSVar(recordedResourceTags()); err != nil {
+		t.Fatalf("Failed to write terraform.tfvars: %v", err)
+	}
+
+	// Stop/start assigns new public IPs, so refresh state before reading outputs.
+	// Route53 node records follow the instance public IP and need a real apply.
+	if configuredNodeAddressing() == "route53" {
+		terraform.RunTerraformCommand(t, terraformOptions, "apply", "-auto-approve", "-input=false")
+	} else {
+		terraform.RunTerraformCommand(t, terraformOptions, "apply", "-refresh-only", "-auto-approve", "-input=false")
+	}
+	clusters, err := loadClusterInfra(t, terraformOptions, getTotalRancherInstances())
+	if err != nil {
+		t.Fatalf("Failed to load cluster infrastructure: %v", err)
+	}
+
+	if err := resumeClusterNodes(metadata, clusters); err != nil {
+		t.Fatalf("Resume failed: %v", err)
+	}
+
+	now := time.Now().UTC()
+	metadata.State = runStateRunning
+	metadata.ResumedAt = &now
+	if err := saveRunMetadata(metadata); err != nil {
+		t.Fatalf("Failed to save run metadata: %v", err)
+	}
+}
@@ -1,11 +1,11 @@
 package test
 
 import (
-	"bytes"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -20,7 +20,6 @@ var currentTenantIndex int
 var hostUrl string
 var adminPassword string
 var configIps []string
-var tools toolkit.Tools
 
 const (
 	tfVars        = "terraform.tfvars"
@@ -30,8 +29,28 @@ const (
 
 func TestHosted(t *testing.T) {
 	setupConfig(t)
+	report := startRunReport("deploy")
+	var page *deployPage
+	applyStarted := false
+	defer func() {
+		canceled := deployCancel.canceled()
+		if canceled && applyStarted {
+			log.Printf("[deploy] Deployment canceled, tearing the environment down...")
+			// Not runPhase: it refuses to start phases once canceled.
+			if err := startPhase(0, "teardown").end(tearDownEnvironment(t)); err != nil {
+				log.Printf("[deploy] Teardown after cancel failed, run TestCleanup: %v", err)
+			}
+		}
+		failed := t.Failed() || canceled
+		report.finish(failed)
+		page.finish(failed)
+	}()
+
+	if err := applyAirgapDefaults(); err != nil {
+		t.Fatalf("airgap configuration failed: %v", err)
+	}
 
-	resolvedPlans, err := resolveRancherSetup()
+	resolvedPlans, page, err := resolveRancherDeployment()
 	if err != nil {
 		t.Fatalf("Rancher setup canceled or failed: %v", err)
 	}
@@ -43,15 +62,51 @@ func TestHosted(t *testing.T) {
 
 	helmCommands := viper.GetStringSlice("rancher.helm_commands")
 	k3sVersions := viper.GetStringSlice("k3s.versions")
+	report.setPlans(resolvedPlans, helmCommands, k3sVersions)
 
+	preflight := startPhase(0, "preflight")
 	if err := validateLocalToolingPreflight(helmCommands); err != nil {
-		t.Fatalf("local tooling preflight failed: %v", err)
+		t.Fatalf("local tooling preflight failed: %v", preflight.end(err))
 	}
 	if err := validateSecretEnvironment(); err != nil {
-		t.Fatalf("secret environment preflight failed: %v", err)
+		t.Fatalf("secret environment preflight failed: %v", preflight.end(err))
 	}
 	if err := validateHostedConfiguration(totalInstances, helmCommands, resolvedPlans); err != nil {
-		t.Fatalf("configuration validation failed: %v", err)
+		t.Fatalf("configuration validation failed: %v", preflight.end(err))
+	}
+	if err := validateAWSRegionPreflight(); err != nil {
+		t.Fatalf("AWS region preflight failed: %v", preflight.end(err))
+	}
+
+	forecast, forecastErr := forecastPlannedRunCost(totalInstances)
+	if forecastErr != nil {
+		log.Printf("[budget] Could not forecast AWS cost before apply: %v", forecastErr)
+	} else {
+		logCostForecast(forecast)
+		report.setCostForecast(forecast)
+	}
+	if err := checkBudgetGuardrail(forecast, forecastErr, configuredBudgetLimits()); err != nil {
+		t.Fatalf("budget guardrail failed: %v", preflight.end(err))
+	}
+	preflight.end(nil)
+
+	if toolkit.AirgapEnabled() {
+		err := runPhase(0, "airgap_mirror", func() error {
+			images, err := collectAirgapImages(resolvedPlans, helmCommands, k3sVersions)
+			if err != nil {
+				return fmt.Errorf("failed to build airgap image list: %w", err)
+			}
+			if err := mirrorAirgapImages(images); err != nil {
+				return fmt.Errorf("failed to mirror airgap images: %w", err)
+			}
+			if err := stageAirgapK3SArtifacts(k3sVersions); err != nil {
+				return fmt.Errorf("failed to stage K3s artifacts: %w", err)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
 	}
 
 	err = checkS3ObjectExists(tfState)
@@ -59,7 +114,11 @@ func TestHosted(t *testing.T) {
 		log.Fatal("Error checking if tfstate exists in s3: ", err)
 	}
 
-	createAWSVar()
+	resourceTags := buildResourceTags(time.Now(), requestedRancherVersionsForTags(resolvedPlans, helmCommands))
+	log.Printf("[tags] Tagging AWS resources: %s", strings.Join(formatResourceTags(resourceTags), ", "))
+	if err := createAWSVar(resourceTags); err != nil {
+		t.Fatalf("Failed to write terraform.tfvars: %v", err)
+	}
 
 	terraformOptions := &terraform.Options{
 		TerraformDir: "../modules/aws",
@@ -74,61 +133,69 @@ func TestHosted(t *testing.T) {
 		},
 	}
 
-	terraform.InitAndApply(t, terraformOptions)
+	applyStarted = true
+	err = runPhase(0, "terraform_apply", func() error {
+		_, err := terraform.InitAndApplyE(t, terraformOptions)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("terraform apply failed: %v", err)
+	}
 
-	flatOutputs := terraform.OutputMap(t, terraformOptions, "flat_outputs")
+	clusters, err := loadClusterInfra(t, terraformOptions, totalInstances)
+	if err != nil {
+		t.Fatalf("Failed to load cluster infrastructure: %v", err)
+	}
+	recordRunMetadata(clusters, resourceTags)
+	var urls []string
+	for _, cluster := range clusters {
+		urls = append(urls, cluster.RancherURL)
+	}
+	report.setURLs(urls)
+	page.setInstances(urls)
 
 	var hostConfig toolkit.K3SConfig
 	var tenantConfigs []toolkit.K3SConfig
 
-	for i := 0; i < totalInstances; i++ {
-		infraServer1IPAddress := flatOutputs[fmt.Sprintf("infra%d_server1_ip", i+1)]
-		infraServer2IPAddress := flatOutputs[fmt.Sprintf("infra%d_server2_ip", i+1)]
-		infraMysqlEndpoint := flatOutputs[fmt.Sprintf("infra%d_mysql_endpoint", i+1)]
-		infraMysqlPassword := flatOutputs[fmt.Sprintf("infra%d_mysql_password", i+1)]
-		infraRancherURL := flatOutputs[fmt.Sprintf("infra%d_rancher_url", i+1)]
-
+	for i, cluster := range clusters {
+		config := cluster.K3SConfig()
 		if i == 0 {
-			hostUrl = infraRancherURL
-			hostConfig = toolkit.K3SConfig{
-				DBPassword: infraMysqlPassword,
-				DBEndpoint: infraMysqlEndpoint,
-				RancherURL: infraRancherURL,
-				Node1IP:    infraServer1IPAddress,
-				Node2IP:    infraServer2IPAddress,
-			}
+			hostUrl = config.RancherURL
+			hostConfig = config
 		} else {
-			tenantConfig := toolkit.K3SConfig{
-				DBPassword: infraMysqlPassword,
-				DBEndpoint: infraMysqlEndpoint,
-				RancherURL: infraRancherURL,
-				Node1IP:    infraServer1IPAddress,
-				Node2IP:    infraServer2IPAddress,
-			}
-			tenantConfigs = append(tenantConfigs, tenantConfig)
+			tenantConfigs = append(tenantConfigs, config)
 		}
 	}
 
-	log.Printf("Installing K3S on host with version: %s", k3sVersions[0])
-	viper.Set("k3s.version", k3sVersions[0])
-	tools.K3SHostInstall(hostConfig)
-
-	hostScriptDir := "host-rancher"
-	CreateRancherInstallScript(helmCommands[0], hostConfig.RancherURL, hostScriptDir)
-
-	err = saveK3SKubeconfig(hostConfig.Node1IP, hostScriptDir)
+	err = runPhase(1, "k3s_install", func() error {
+		log.Printf("Installing K3S on host with version: %s", k3sVersions[0])
+		viper.Set("k3s.version", k3sVersions[0])
+		return tools.K3SHostInstall(hostConfig)
+	})
 	if err != nil {
-		t.Fatalf("Failed to save host kubeconfig: %v", err)
+		t.Fatalf("K3s install on host failed: %v", err)
 	}
 
-	log.Println("Installing host Rancher...")
-	err = executeInstallScript(hostScriptDir)
+	hostScriptDir := "host-rancher"
+	err = runPhase(1, "rancher_install", func() error {
+		CreateRancherInstallScript(helmCommands[0], hostConfig.RancherURL, hostScriptDir)
+		if err := saveK3SKubeconfig(hostConfig.Node1, hostScriptDir); err != nil {
+			return fmt.Errorf("failed to save host kubeconfig: %w", err)
+		}
+		log.Println("Installing host Rancher...")
+		if err := executeInstallScript(hostScriptDir); err != nil {
+			return fmt.Errorf("failed to execute host install script: %w", err)
+		}
+		return nil
+	})
 	if err != nil {
-		t.Fatalf("Failed to execute host install script: %v", err)
+		t.Fatalf("Host Rancher install failed: %v", err)
 	}
 
-	log.Println("Waiting for host Rancher to be stable...")
-	err = waitForRancherStable(hostConfig.RancherURL, 10*time.Minute)
+	log.Println("Waiting for host Rancher to be ready...")
+	err = runPhase(1, "readiness", func() error {
+		return waitForRancherReady(readinessPhaseInstall, hostConfig.RancherURL, filepath.Join(hostScriptDir, "kube_config.yaml"), 10*time.Minute)
+	})
 	if err != nil {
 		t.Fatalf("Host Rancher failed to become stable: %v", err)
 	}
@@ -139,16 +206,24 @@ func TestHosted(t *testing.T) {
 	}
 
 	log.Println("Waiting for Rancher API to be ready for authentication...")
-	err = waitForRancherAPIReady(hostUrl, adminPassword, 10*time.Minute)
+	err = runPhase(1, "api_ready", func() error {
+		if err := waitForRancherAPIReady(hostUrl, adminPassword, 10*time.Minute); err != nil {
+			return err
+		}
+		token, err := tools.CreateToken(hostUrl, adminPassword)
+		if err != nil {
+			return fmt.Errorf("error creating token: %w", err)
+		}
+		adminToken = token
+		if err := saveHostAdminToken(hostUrl, token); err != nil {
+			log.Printf("Could not persist the host admin token: %v", err)
+		}
+		return nil
+	})
 	if err != nil {
 		t.Fatalf("Rancher API failed to become ready: %v", err)
 	}
 
-	adminToken, err = tools.CreateToken(hostUrl, adminPassword)
-	if err != nil {
-		log.Fatal("error creating token:", err)
-	}
-
 	err = tools.CallBashScript(hostUrl, adminToken)
 	if err != nil {
 		log.Println("error calling bash script", err)
@@ -214,31 +289,51 @@ func TestHosted(t *testing.T) {
 }
 
 func setupTenantPhase1(t *testing.T, tenantIndex, k3sVersionIndex int, tenantConfig toolkit.K3SConfig, k3sVersions []string, configIpsMutex *sync.Mutex) error {
-	log.Printf("Installing K3S on tenant %d with version: %s", tenantIndex, k3sVersions[k3sVersionIndex])
-	viper.Set("k3s.version", k3sVersions[k3sVersionIndex])
-	tenantIp := tools.K3STenantInstall(tenantConfig)
+	err := runPhase(tenantIndex+1, "k3s_install", func() error {
+		log.Printf("Installing K3S on tenant %d with version: %s", tenantIndex, k3sVersions[k3sVersionIndex])
+		viper.Set("k3s.version", k3sVersions[k3sVersionIndex])
+		tenantIp, err := tools.K3STenantInstall(tenantConfig)
+		if err != nil {
+			return err
+		}
 
-	configIpsMutex.Lock()
-	for len(configIps) < tenantIndex {
-		configIps = append(configIps, "")
+		configIpsMutex.Lock()
+		for len(configIps) < tenantIndex {
+			configIps = append(configIps, "")
+		}
+		configIps[tenantIndex-1] = tenantIp
+		configIpsMutex.Unlock()
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("K3s install on tenant %d failed: %w", tenantIndex, err)
 	}
-	configIps[tenantIndex-1] = tenantIp
-	configIpsMutex.Unlock()
 
 	currentTenantIndex = tenantIndex
+	return runPhase(tenantIndex+1, "import", func() error {
+		return importTenant(tenantIndex, tenantConfig)
+	})
+}
+
+// importTenant imports tenant N into the host Rancher and waits for it to be
+// Active there.
+func importTenant(tenantIndex int, tenantConfig toolkit.K3SConfig) error {
 	log.Printf("Importing tenant %d into host Rancher...", tenantIndex)
 
-	tools.SetupImport(hostUrl, adminToken, tenantIndex)
+	manifestURL, err := tools.SetupImport(hostUrl, adminToken, tenantIndex)
+	if err != nil {
+		return fmt.Errorf("failed to set up import of tenant %d: %w", tenantIndex, err)
+	}
 
 	scriptDir := fmt.Sprintf("tenant-%d-rancher", tenantIndex)
-	err := saveK3SKubeconfig(tenantConfig.Node1IP, scriptDir)
+	err = saveK3SKubeconfig(tenantConfig.Node1, scriptDir)
 	if err != nil {
 		return fmt.Errorf("failed to save tenant kubeconfig for import: %w", err)
 	}
 
-	err = executeImportScript(scriptDir)
+	err = importTenantManifest(scriptDir, manifestURL)
 	if err != nil {
-		return fmt.Errorf("failed to execute import script: %w", err)
+		return fmt.Errorf("failed to apply import manifest: %w", err)
 	}
 
 	log.Printf("Waiting for tenant %d cluster to be Active in host Rancher...", tenantIndex)
@@ -253,21 +348,25 @@ func setupTenantPhase1(t *testing.T, tenantIndex, k3sVersionIndex int, tenantCon
 
 func setupTenantPhase2(t *testing.T, tenantIndex, helmCommandIndex int, tenantConfig toolkit.K3SConfig, helmCommands []string) error {
 	tenantScriptDir := fmt.Sprintf("tenant-%d-rancher", tenantIndex)
-	CreateRancherInstallScript(helmCommands[helmCommandIndex], tenantConfig.RancherURL, tenantScriptDir)
-
-	err := saveK3SKubeconfig(tenantConfig.Node1IP, tenantScriptDir)
-	if err != nil {
-		return fmt.Errorf("failed to save tenant kubeconfig: %w", err)
-	}
-
-	log.Printf("Installing tenant %d Rancher on Active cluster using Helm command %d...", tenantIndex, helmCommandIndex)
-	err = executeInstallScript(tenantScriptDir)
+	err := runPhase(tenantIndex+1, "rancher_install", func() error {
+		CreateRancherInstallScript(helmCommands[helmCommandIndex], tenantConfig.RancherURL, tenantScriptDir)
+		if err := saveK3SKubeconfig(tenantConfig.Node1, tenantScriptDir); err != nil {
+			return fmt.Errorf("failed to save tenant kubeconfig: %w", err)
+		}
+		log.Printf("Installing tenant %d Rancher on Active cluster using Helm command %d...", tenantIndex, helmCommandIndex)
+		if err := executeInstallScript(tenantScriptDir); err != nil {
+			return fmt.Errorf("failed to execute tenant install script: %w", err)
+		}
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("failed to execute tenant install script: %w", err)
+		return err
 	}
 
-	log.Printf("Waiting for tenant %d Rancher to be stable...", tenantIndex)
-	err = waitForRancherStable(tenantConfig.RancherURL, 8*time.Minute)
+	log.Printf("Waiting for tenant %d Rancher to be ready...", tenantIndex)
+	err = runPhase(tenantIndex+1, "readiness", func() error {
+		return waitForRancherReady(readinessPhaseInstall, tenantConfig.RancherURL, filepath.Join(tenantScriptDir, "kube_config.yaml"), 8*time.Minute)
+	})
 	if err != nil {
 		return fmt.Errorf("tenant %d Rancher failed to become stable: %w", tenantIndex, err)
 	}
@@ -282,18 +381,31 @@ func TestCleanup(t *testing.T) {
 		t.Fatalf("secret environment preflight failed: %v", err)
 	}
 
+	if err := tearDownEnvironment(t); err != nil {
+		t.Fatalf("cleanup failed: %v", err)
+	}
+}
+
+// tearDownEnvironment destroys the infrastructure and clears the local and
+// S3 state of a run. TestCleanup runs it, and so does a deployment canceled
+// from the interactive page.
+func tearDownEnvironment(t *testing.T) error {
 	terraformOptions := terraform.WithDefaultRetryableErrors(t, &terraform.Options{
 		TerraformDir: "../modules/aws",
 		NoColor:      true,
 	})
 
-	createAWSVar()
+	if err := createAWSVar(recordedResourceTags()); err != nil {
+		return fmt.Errorf("failed to write terraform.tfvars: %w", err)
+	}
 
 	var cleanupEstimate *cleanupCostEstimate
-	totalInstances := getTotalRancherInstances()
-	if outputs, err := terraform.OutputMapE(t, terraformOptions, "flat_outputs"); err == nil {
-		if estimate, estimateErr := estimateCurrentRunCost(totalInstances, outputs); estimateErr != nil {
-			log.Printf("[cleanup] Could not estimate EC2/EBS/RDS cost before destroy: %v", estimateErr)
+	if clusters, err := loadClusterInfra(t, terraformOptions, getTotalRancherInstances()); err == nil {
+		if viper.GetBool("cleanup.detach_tenants") {
+			detachTenantsBeforeDestroy(clusters)
+		}
+		if estimate, estimateErr := estimateCurrentRunCost(clusters); estimateErr != nil {
+			log.Printf("[cleanup] Could not estimate run cost before destroy: %v", estimateErr)
 		} else {
 			cleanupEstimate = estimate
 			logCleanupCostEstimate(estimate)
@@ -302,7 +414,11 @@ func TestCleanup(t *testing.T) {
 		log.Printf("[cleanup] Could not load terraform outputs before destroy: %v", err)
 	}
 
-	terraform.Destroy(t, terraformOptions)
+	deleteRecordedReplacedDatastores()
+
+	if _, err := terraform.DestroyE(t, terraformOptions); err != nil {
+		return fmt.Errorf("terraform destroy failed: %w", err)
+	}
 
 	filePaths := []string{
 		"../modules/aws/.terraform.lock.hcl",
@@ -319,6 +435,8 @@ func TestCleanup(t *testing.T) {
 	cleanupFolders(folderPaths...)
 	cleanupRancherDirectoriesSafe()
 
+	deleteRecordedDatastoreSnapshots()
+
 	err := clearS3Bucket(viper.GetString("s3.bucket"))
 	if err != nil {
 		log.Printf("Error clearing bucket [from func clearS3Bucket]: %v", err)
@@ -328,73 +446,21 @@ func TestCleanup(t *testing.T) {
 		log.Printf("[cleanup] Cleanup finished. Final estimated run-cost summary:")
 		logCleanupCostEstimateWithPrefix(cleanupEstimate, "[cleanup-summary]")
 	}
+	return nil
 }
 
 func TestSetupImport(t *testing.T) {
 	tenantIndex := currentTenantIndex
-	tools.SetupImport(hostUrl, adminToken, tenantIndex)
-
-	scriptDir := fmt.Sprintf("tenant-%d-rancher", tenantIndex)
-	err := executeImportScript(scriptDir)
+	manifestURL, err := tools.SetupImport(hostUrl, adminToken, tenantIndex)
 	if err != nil {
-		t.Fatalf("Failed to execute import script: %v", err)
-	}
-}
-
-func saveK3SKubeconfig(nodeIP, scriptDir string) error {
-	serverKubeConfig, err := tools.RunCommand("sudo cat /etc/rancher/k3s/k3s.yaml", nodeIP)
-	if err != nil {
-		return fmt.Errorf("failed to get kubeconfig from node %s: %w", nodeIP, err)
+		t.Fatalf("Failed to set up import of tenant %d: %v", tenantIndex, err)
 	}
 
-	configIP := fmt.Sprintf("https://%s:6443", nodeIP)
-	kubeConf := []byte(serverKubeConfig)
-	output := bytes.Replace(kubeConf, []byte("https://127.0.0.1:6443"), []byte(configIP), -1)
-
-	currentDir, err := os.Getwd()
-	if err != nil {
-		return fmt.Errorf("failed to get current directory: %w", err)
-	}
-
-	absScriptDir := filepath.Join(currentDir, scriptDir)
-	err = os.MkdirAll(absScriptDir, os.ModePerm)
-	if err != nil {
-		return fmt.Errorf("failed to create script directory: %w", err)
-	}
-
-	kubeconfigPath := filepath.Join(absScriptDir, "kube_config.yaml")
-	err = os.WriteFile(kubeconfigPath, output, 0644)
+	scriptDir := fmt.Sprintf("tenant-%d-rancher", tenantIndex)
+	err = importTenantManifest(scriptDir, manifestURL)
 	if err != nil {
-		return fmt.Errorf("failed to write kubeconfig: %w", err)
+		t.Fatalf("Failed to apply import manifest: %v", err)
 	}
-
-	log.Printf("Saved kubeconfig to: %s", kubeconfigPath)
-	return nil
-}
-
-func waitForRancherAPIReady(rancherURL, adminPassword string, timeout time.Duration) error {
-	log.Printf("Waiting for Rancher API to be ready for authentication...")
-
-	start := time.Now()
-	maxRetries := int(timeout.Seconds() / 15)
-
-	for i := 0; i < maxRetries; i++ {
-		token, err := tools.CreateToken(rancherURL, adminPassword)
-		if err == nil && token != "" {
-			elapsed := time.Since(start)
-			log.Printf("Rancher API is fully ready for authentication after %v", elapsed)
-			return nil
-		}
-
-		if i%4 == 0 {
-			elapsed := time.Since(start)
-			log.Printf("Rancher API not ready for auth yet after %v: %v", elapsed, err)
-		}
-
-		time.Sleep(15 * time.Second)
-	}
-
-	return fmt.Errorf("timeout waiting for Rancher API to be ready for authentication after %v", timeout)
 }
 
 func cleanupFiles(paths ...string) {
@@ -0,0 +1,288 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// importFieldManager owns the fields this tool sets through server-side apply.
+const importFieldManager = "hosted-tenant-rancher"
+
+// appliedObject is the result of applying one document of a manifest.
+type appliedObject struct {
+	Kind      string
+	Namespace string
+	Name      string
+	Err       error
+}
+
+func (o appliedObject) String() string {
+	name := o.Name
+	if o.Namespace != "" {
+		name = o.Namespace + "/" + name
+	}
+	return fmt.Sprintf("%s %s", o.Kind, name)
+}
+
+// importTenantManifest applies the host's import manifest to the tenant with
+// server-side apply through the kubeconfig saved in scriptDir, then waits for
+// cattle-cluster-agent to roll out. No local kubectl is needed.
+func importTenantManifest(scriptDir, manifestURL string) error {
+	kubeconfigPath, err := filepath.Abs(filepath.Join(scriptDir, "kube_config.yaml"))
+	if err != nil {
+		return err
+	}
+	restConfig, err := tenantRESTConfig(kubeconfigPath)
+	if err != nil {
+		return err
+	}
+
+	manifest, err := downloadImportManifest(manifestURL)
+	if err != nil {
+		return err
+	}
+	objects, err := decodeManifest(manifest)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[import] Applying %d objects from %s...", len(objects), manifestURL)
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Minute)
+	defer cancel()
+
+	results, err := applyObjects(ctx, restConfig, objects)
+	var failed []string
+	for _, result := range results {
+		if result.Err != nil {
+			log.Printf("[import] %s: %v", result, result.Err)
+			failed = append(failed, result.String())
+			continue
+		}
+		log.Printf("[import] %s applied", result)
+	}
+	if err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to apply %s", strings.Join(failed, ", "))
+	}
+
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return fmt.Errorf("failed to create Kubernetes client: %w", err)
+	}
+	return waitForDeploymentRollout(ctx, clientset, "cattle-system", "cattle-cluster-agent")
+}
+
+// tenantRESTConfig loads a kubeconfig saved by saveK3SKubeconfig. It points at
+// the node's public IP, which the K3s serving certificate may not cover, so TLS
+// verification is skipped as kubectl --insecure-skip-tls-verify did.
+func tenantRESTConfig(kubeconfigPath string) (*rest.Config, error) {
+	restConfig, err := clientcmd.BuildConfigFromFlags("", kubeconfigPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kubeconfig %s: %w", kubeconfigPath, err)
+	}
+	restConfig.TLSClientConfig.Insecure = true
+	restConfig.TLSClientConfig.CAData = nil
+	restConfig.TLSClientConfig.CAFile = ""
+	return restConfig, nil
+}
+
+// downloadImportManifest fetches the manifest from the host. The host may use
+// a self-signed certificate, as the old import script allowed for.
+func downloadImportManifest(manifestURL string) ([]byte, error) {
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+
+	var lastErr error
+	for attempt := 1; attempt <= 5; attempt++ {
+		resp, err := client.Get(manifestURL)
+		if err == nil {
+			body, readErr := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			switch {
+			case readErr != nil:
+				err = readErr
+			case resp.StatusCode >= 300:
+				err = fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+			default:
+				return body, nil
+			}
+		}
+		lastErr = err
+		time.Sleep(time.Duration(attempt) * 5 * time.Second)
+	}
+	return nil, fmt.Errorf("failed to download import manifest %s: %w", manifestURL, lastErr)
+}
+
+// decodeManifest splits a multi-document YAML manifest into objects, skipping
+// empty documents.
+func decodeManifest(manifest []byte) ([]*unstructured.Unstructured, error) {
+	decoder := utilyaml.NewYAMLOrJSONDecoder(bytes.NewReader(manifest), 4096)
+	var objects []*unstructured.Unstructured
+	for {
+		var content map[string]interface{}
+		if err := decoder.Decode(&content); err != nil {
+			if errors.Is(err, io.EOF) {
+				return objects, nil
+			}
+			return nil, fmt.Errorf("failed to parse import manifest: %w", err)
+		}
+		if len(content) == 0 {
+			continue
+		}
+		object := &unstructured.Unstructured{Object: content}
+		if object.GetKind() == "" || object.GetName() == "" {
+			return nil, fmt.Errorf("import manifest document %d has no kind or name", len(objects)+1)
+		}
+		objects = append(objects, object)
+	}
+}
+
+// applyObjects server-side applies objects in manifest order. A failed object
+// is reported in its result and does not stop the rest.
+func applyObjects(ctx context.Context, restConfig *rest.Config, objects []*unstructured.Unstructured) ([]appliedObject, error) {
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create discovery client: %w", err)
+	}
+	mapper := restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(discoveryClient))
+	dynamicClient, err := dynamic.NewForConfig(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create dynamic client: %w", err)
+	}
+
+	results := make([]appliedObject, 0, len(objects))
+	for _, object := range objects {
+		result := appliedObject{Kind: object.GetKind(), Namespace: object.GetNamespace(), Name: object.GetName()}
+		result.Err = applyObject(ctx, dynamicClient, mapper, object)
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func applyObject(ctx context.Context, client dynamic.Interface, mapper *restmapper.DeferredDiscoveryRESTMapper, object *unstructured.Unstructured) error {
+	gvk := object.GroupVersionKind()
+	mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if meta.IsNoMatchError(err) {
+		// The kind may come from a CRD applied earlier in the manifest.
+		mapper.Reset()
+		mapping, err = mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	}
+	if err != nil {
+		return fmt.Errorf("unknown resource type %s: %w", gvk, err)
+	}
+
+	var resource dynamic.ResourceInterface = client.Resource(mapping.Resource)
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+		namespace := object.GetNamespace()
+		if namespace == "" {
+			namespace = metav1.NamespaceDefault
+		}
+		resource = client.Resource(mapping.Resource).Namespace(namespace)
+	}
+
+	_, err = resource.Apply(ctx, object.GetName(), object, metav1.ApplyOptions{FieldManager: importFieldManager, Force: true})
+	return err
+}
+
+// waitForDeploymentRollout waits until every replica of the deployment runs
+// its latest spec, woken by a watch on the deployment.
+func waitForDeploymentRollout(ctx context.Context, clientset kubernetes.Interface, namespace, name string) error {
+	log.Printf("[import] Waiting for deployment %s/%s to roll out...", namespace, name)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	deployments := clientset.AppsV1().Deployments(namespace)
+	err := waitFor(ctx, waitOptions{
+		Description: fmt.Sprintf("deployment %s/%s to roll out", namespace, name),
+		MaxInterval: 10 * time.Second,
+		LogPrefix:   "[import]",
+		Trigger: watchTrigger(ctx, "[import]", func(ctx context.Context) (watch.Interface, error) {
+			return deployments.Watch(ctx, metav1.ListOptions{FieldSelector: "metadata.name=" + name})
+		}),
+	}, func(ctx context.Context) (bool, string, error) {
+		deployment, err := deployments.Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return false, "not created yet", nil
+		}
+		if err != nil {
+			return false, "", err
+		}
+		if deploymentRolledOut(deployment) {
+			return true, "", nil
+		}
+		return false, fmt.Sprintf("%d/%d updated, %d available", deployment.Status.UpdatedReplicas, deploymentReplicas(deployment), deployment.Status.AvailableReplicas), nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("[import] Deployment %s/%s rolled out", namespace, name)
+	return nil
+}
+
+func deploymentRolledOut(deployment *appsv1.Deployment) bool {
+	replicas := deploymentReplicas(deployment)
+	status := deployment.Status
+	return status.ObservedGeneration >= deployment.Generation &&
+		status.UpdatedReplicas == replicas &&
+		status.Replicas == replicas &&
+		status.AvailableReplicas == replicas
+}
+
+func deploymentReplicas(deployment *appsv1.Deployment) int32 {
+	if deployment.Spec.Replicas == nil {
+		return 1
+	}
+	return *deployment.Spec.Replicas
+}
+
+// ensureNamespace creates namespace on the cluster in kubeconfigPath if it
+// does not exist yet.
+func ensureNamespace(kubeconfigPath, namespace string) error {
+	restConfig, err := tenantRESTConfig(kubeconfigPath)
+	if err != nil {
+		return err
+	}
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return fmt.Errorf("failed to create Kubernetes client: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	_, err = clientset.CoreV1().Namespaces().Create(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}}, metav1.CreateOptions{})
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("failed to create namespace %s: %w", namespace, err)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package test
+
+import (
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+)
+
+func TestDecodeManifestSplitsDocuments(t *testing.T) {
+	manifest := []byte(`---
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: cattle-system
+---
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: cattle-cluster-agent
+  namespace: cattle-system
+`)
+
+	objects, err := decodeManifest(manifest)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(objects) != 2 {
+		t.Fatalf("expected 2 objects, got %d", len(objects))
+	}
+	if objects[1].GetKind() != "Deployment" || objects[1].GetNamespace() != "cattle-system" {
+		t.Fatalf("unexpected second object %s %s/%s", objects[1].GetKind(), objects[1].GetNamespace(), objects[1].GetName())
+	}
+
+	if _, err := decodeManifest([]byte("apiVersion: v1\nkind: Secret\n")); err == nil {
+		t.Fatalf("expected an error for a document without a name")
+	}
+}
+
+func TestDeploymentRolledOutNeedsEveryReplica(t *testing.T) {
+	replicas := int32(2)
+	deployment := &appsv1.Deployment{}
+	deployment.Generation = 3
+	deployment.Spec.Replicas = &replicas
+	deployment.Status = appsv1.DeploymentStatus{ObservedGeneration: 3, Replicas: 2, UpdatedReplicas: 2, AvailableReplicas: 1}
+
+	if deploymentRolledOut(deployment) {
+		t.Fatalf("expected a deployment with one unavailable replica to be rolling out")
+	}
+	deployment.Status.AvailableReplicas = 2
+	if !deploymentRolledOut(deployment) {
+		t.Fatalf("expected the deployment to be rolled out")
+	}
+	deployment.Generation = 4
+	if deploymentRolledOut(deployment) {
+		t.Fatalf("expected a new generation to be rolling out")
+	}
+}
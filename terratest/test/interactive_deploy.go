@@ -0,0 +1,282 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	phaseDeploying interactivePhase = "deploying"
+	phaseFinished  interactivePhase = "finished"
+
+	// deployPageLinger is how long the page stays up after the deployment
+	// ends, so URLs and kubeconfigs can still be copied, unless Done is
+	// pressed first.
+	deployPageLinger = 10 * time.Minute
+)
+
+var errDeploymentCanceled = errors.New("deployment canceled from the interactive page")
+
+// cancelSignal is closed once when the user cancels the deployment. Phases
+// that have not started yet fail at once and waits in progress stop, so the
+// run reaches its teardown as soon as the current step returns.
+type cancelSignal struct {
+	once sync.Once
+	ch   chan struct{}
+}
+
+func newCancelSignal() *cancelSignal {
+	return &cancelSignal{ch: make(chan struct{})}
+}
+
+func (c *cancelSignal) cancel() {
+	c.once.Do(func() { close(c.ch) })
+}
+
+func (c *cancelSignal) done() <-chan struct{} {
+	return c.ch
+}
+
+func (c *cancelSignal) canceled() bool {
+	select {
+	case <-c.ch:
+		return true
+	default:
+		return false
+	}
+}
+
+var deployCancel = newCancelSignal()
+
+// deployInstance is one progress card on the page.
+type deployInstance struct {
+	Instance int    `json:"instance"`
+	Role     string `json:"role"`
+	URL      string `json:"url"`
+}
+
+// deployPage keeps the interactive setup page open after the plan is
+// approved and streams the deployment's events to it. A nil page is valid
+// and does nothing, so non-interactive runs need no special cases.
+type deployPage struct {
+	srv         *interactiveServer
+	server      *http.Server
+	unsubscribe func()
+	stopCapture func()
+	closeOnce   sync.Once
+}
+
+func newDeployPage(srv *interactiveServer, server *http.Server) *deployPage {
+	return &deployPage{
+		srv:         srv,
+		server:      server,
+		stopCapture: runEvents.captureLogs(),
+		unsubscribe: runEvents.subscribe(srv.recordDeployEvent),
+	}
+}
+
+// setInstances shows a card per instance, in terraform output order.
+func (p *deployPage) setInstances(urls []string) {
+	if p == nil {
+		return
+	}
+	instances := deployInstances(urls)
+	p.srv.mu.Lock()
+	p.srv.instances = instances
+	p.srv.mu.Unlock()
+	p.srv.broadcast(interactiveEvent{Type: "instances", Instances: instances})
+}
+
+// finish shows the result and keeps the page up until Done is pressed or
+// deployPageLinger passes, then closes it. It returns at once when no page
+// is connected.
+func (p *deployPage) finish(failed bool) {
+	if p == nil {
+		return
+	}
+	status := eventSucceeded
+	switch {
+	case deployCancel.canceled():
+		status = "canceled"
+	case failed:
+		status = eventFailed
+	}
+
+	p.srv.mu.Lock()
+	p.srv.phase = phaseFinished
+	p.srv.deployStatus = status
+	connected := len(p.srv.subscribers) > 0
+	p.srv.mu.Unlock()
+	p.srv.broadcast(interactiveEvent{Type: "phase", Phase: phaseFinished, Status: status})
+
+	if connected {
+		log.Printf("[setup] Deployment %s. The setup page stays open for %v or until you press Done", status, deployPageLinger)
+		select {
+		case <-p.srv.closeCh:
+		case <-time.After(deployPageLinger):
+		}
+	}
+	p.close()
+}
+
+// close ends the page without showing a result, e.g. when a command only
+// needed the plan approval.
+func (p *deployPage) close() {
+	if p == nil {
+		return
+	}
+	p.closeOnce.Do(func() {
+		p.unsubscribe()
+		p.stopCapture()
+		p.srv.mu.Lock()
+		p.srv.phase = phaseDone
+		p.srv.mu.Unlock()
+		p.srv.broadcast(interactiveEvent{Type: "phase", Phase: phaseDone})
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		_ = p.server.Shutdown(shutdownCtx)
+	})
+}
+
+func deployInstances(urls []string) []deployInstance {
+	instances := make([]deployInstance, 0, len(urls))
+	for i, url := range urls {
+		role := "Host"
+		if i > 0 {
+			role = fmt.Sprintf("Tenant %d", i)
+		}
+		instances = append(instances, deployInstance{Instance: i + 1, Role: role, URL: "https://" + url})
+	}
+	return instances
+}
+
+// recordDeployEvent keeps every event for pages that connect later and
+// forwards it. Log lines carry no instance, so a line is put on an
+// instance's card only while that instance is the only one with a phase
+// running; every line is also in the run log.
+func (s *interactiveServer) recordDeployEvent(event runEvent) {
+	s.mu.Lock()
+	if s.running == nil {
+		s.running = map[int]int{}
+	}
+	switch event.Status {
+	case eventStarted:
+		s.running[event.Instance]++
+	case eventSucceeded, eventFailed:
+		if s.running[event.Instance] > 0 {
+			s.running[event.Instance]--
+		}
+	case eventLog:
+		event.Instance = soleRunningInstance(s.running)
+	}
+	s.deployEvents = append(s.deployEvents, event)
+	s.mu.Unlock()
+
+	s.broadcast(interactiveEvent{Type: "event", Event: &event})
+}
+
+// soleRunningInstance returns the instance that has a phase running when
+// exactly one does, and 0 otherwise. Run-wide phases (instance 0) are
+// ignored.
+func soleRunningInstance(running map[int]int) int {
+	sole := 0
+	for instance, count := range running {
+		if instance == 0 || count == 0 {
+			continue
+		}
+		if sole != 0 {
+			return 0
+		}
+		sole = instance
+	}
+	return sole
+}
+
+// deployKubeconfigPath is where an instance's kubeconfig is saved once its
+// K3s cluster is up. Instances are 1-based, the host being 1.
+func deployKubeconfigPath(instance int) string {
+	return filepath.Join(rancherScriptDir(instance-1), "kube_config.yaml")
+}
+
+func (s *interactiveServer) registerDeployHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/cancel", func(w http.ResponseWriter, r *http.Request) {
+		if !s.authorized(r) {
+			http.Error(w, "invalid interactive setup token", http.StatusForbidden)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		s.mu.Lock()
+		deploying := s.phase == phaseDeploying
+		s.mu.Unlock()
+		if !deploying {
+			http.Error(w, "no deployment is running", http.StatusConflict)
+			return
+		}
+
+		if !deployCancel.canceled() {
+			log.Printf("[setup] Deployment canceled from the setup page; the environment will be torn down once the current step stops")
+			deployCancel.cancel()
+		}
+		s.broadcast(interactiveEvent{Type: "canceled"})
+		writeJSON(w, map[string]string{"status": "canceling"})
+	})
+
+	mux.HandleFunc("/close", func(w http.ResponseWriter, r *http.Request) {
+		if !s.authorized(r) {
+			http.Error(w, "invalid interactive setup token", http.StatusForbidden)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.closeOnce.Do(func() { close(s.closeCh) })
+		writeJSON(w, map[string]string{"status": "closing"})
+	})
+
+	mux.HandleFunc("/kubeconfig", func(w http.ResponseWriter, r *http.Request) {
+		if !s.authorized(r) {
+			http.Error(w, "invalid interactive setup token", http.StatusForbidden)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		instance, err := strconv.Atoi(r.URL.Query().Get("instance"))
+		s.mu.Lock()
+		known := err == nil && instance >= 1 && instance <= len(s.instances)
+		s.mu.Unlock()
+		if !known {
+			http.Error(w, "unknown instance", http.StatusBadRequest)
+			return
+		}
+
+		content, err := os.ReadFile(deployKubeconfigPath(instance))
+		if err != nil {
+			if os.IsNotExist(err) {
+				http.Error(w, "kubeconfig is not available yet", http.StatusNotFound)
+				return
+			}
+			http.Error(w, fmt.Sprintf("failed to read kubeconfig: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		_, _ = w.Write(content)
+	})
+}
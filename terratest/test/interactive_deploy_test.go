@@ -0,0 +1,149 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func resetDeployCancel(t *testing.T) {
+	t.Helper()
+	deployCancel = newCancelSignal()
+	t.Cleanup(func() { deployCancel = newCancelSignal() })
+}
+
+func TestRecordDeployEventAttributesLogLines(t *testing.T) {
+	srv := &interactiveServer{}
+	logLine := func() int {
+		srv.recordDeployEvent(runEvent{Status: eventLog, Message: "line"})
+		return srv.deployEvents[len(srv.deployEvents)-1].Instance
+	}
+
+	srv.recordDeployEvent(runEvent{Phase: "terraform_apply", Status: eventStarted})
+	if instance := logLine(); instance != 0 {
+		t.Fatalf("expected run-wide lines to stay in the run log, got instance %d", instance)
+	}
+	srv.recordDeployEvent(runEvent{Phase: "terraform_apply", Status: eventSucceeded})
+
+	srv.recordDeployEvent(runEvent{Instance: 2, Phase: "rancher_install", Status: eventStarted})
+	if instance := logLine(); instance != 2 {
+		t.Fatalf("expected the line on instance 2, got %d", instance)
+	}
+	srv.recordDeployEvent(runEvent{Instance: 3, Phase: "rancher_install", Status: eventStarted})
+	if instance := logLine(); instance != 0 {
+		t.Fatalf("expected no instance while two run in parallel, got %d", instance)
+	}
+	srv.recordDeployEvent(runEvent{Instance: 2, Phase: "rancher_install", Status: eventFailed})
+	if instance := logLine(); instance != 3 {
+		t.Fatalf("expected the line on instance 3, got %d", instance)
+	}
+}
+
+func TestRunPhaseFailsOnceDeploymentCanceled(t *testing.T) {
+	resetDeployCancel(t)
+	deployCancel.cancel()
+
+	ran := false
+	err := runPhase(1, "readiness", func() error {
+		ran = true
+		return nil
+	})
+	if ran {
+		t.Fatal("expected the phase not to run after cancel")
+	}
+	if !errors.Is(err, errDeploymentCanceled) {
+		t.Fatalf("expected a cancel error, got %v", err)
+	}
+}
+
+func TestWaitForStopsWhenDeploymentCanceled(t *testing.T) {
+	resetDeployCancel(t)
+	opts := fastWaitOptions()
+	checks := 0
+	err := waitFor(context.Background(), opts, func(ctx context.Context) (bool, string, error) {
+		checks++
+		if checks == 2 {
+			deployCancel.cancel()
+		}
+		return false, "still starting", nil
+	})
+	if !errors.Is(err, errDeploymentCanceled) {
+		t.Fatalf("expected a cancel error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "the thing") {
+		t.Fatalf("expected the wait description in %q", err)
+	}
+}
+
+func TestDeployInstancesRoles(t *testing.T) {
+	instances := deployInstances([]string{"host.example.com", "tenant.example.com"})
+	if len(instances) != 2 {
+		t.Fatalf("expected 2 instances, got %+v", instances)
+	}
+	if instances[0].Role != "Host" || instances[0].URL != "https://host.example.com" {
+		t.Fatalf("unexpected host card: %+v", instances[0])
+	}
+	if instances[1].Instance != 2 || instances[1].Role != "Tenant 1" {
+		t.Fatalf("unexpected tenant card: %+v", instances[1])
+	}
+}
+
+func TestKubeconfigHandler(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := os.MkdirAll("host-rancher", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join("host-rancher", "kube_config.yaml"), []byte("apiVersion: v1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &interactiveServer{token: "secret", instances: deployInstances([]string{"host", "tenant"})}
+	mux := http.NewServeMux()
+	srv.registerDeployHandlers(mux)
+
+	cases := []struct {
+		query string
+		want  int
+	}{
+		{"token=secret&instance=1", http.StatusOK},
+		{"token=secret&instance=2", http.StatusNotFound},
+		{"token=secret&instance=3", http.StatusBadRequest},
+		{"token=wrong&instance=1", http.StatusForbidden},
+	}
+	for _, tc := range cases {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/kubeconfig?"+tc.query, nil))
+		if recorder.Code != tc.want {
+			t.Fatalf("%s: expected %d, got %d", tc.query, tc.want, recorder.Code)
+		}
+		if tc.want == http.StatusOK && recorder.Body.String() != "apiVersion: v1\n" {
+			t.Fatalf("unexpected kubeconfig: %q", recorder.Body.String())
+		}
+	}
+}
+
+func TestCancelHandlerOnlyWhileDeploying(t *testing.T) {
+	resetDeployCancel(t)
+	srv := &interactiveServer{token: "secret", phase: phaseReview}
+	mux := http.NewServeMux()
+	srv.registerDeployHandlers(mux)
+
+	cancel := func() int {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/cancel?token=secret", nil))
+		return recorder.Code
+	}
+	if code := cancel(); code != http.StatusConflict || deployCancel.canceled() {
+		t.Fatalf("expected cancel to be refused before the deployment, got %d", code)
+	}
+
+	srv.phase = phaseDeploying
+	if code := cancel(); code != http.StatusOK || !deployCancel.canceled() {
+		t.Fatalf("expected the deployment to be canceled, got %d", code)
+	}
+}
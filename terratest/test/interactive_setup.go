@@ -1,7 +1,6 @@
 package test
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -11,6 +10,7 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"strings"
 	"sync"
 	"time"
@@ -33,6 +33,10 @@ type interactiveEvent struct {
 	Line  string           `json:"line,omitempty"`
 	Plan  string           `json:"plan,omitempty"`
 	Error string           `json:"error,omitempty"`
+
+	Event     *runEvent        `json:"event,omitempty"`
+	Instances []deployInstance `json:"instances,omitempty"`
+	Status    string           `json:"status,omitempty"`
 }
 
 type interactiveResult struct {
@@ -53,43 +57,72 @@ type interactiveServer struct {
 	subscribers []chan interactiveEvent
 	submitted   bool
 
-	resultCh chan interactiveResult
+	// Deployment progress, kept so a reloaded page can catch up.
+	instances    []deployInstance
+	deployEvents []runEvent
+	running      map[int]int
+	deployStatus string
+
+	resultCh  chan interactiveResult
+	closeCh   chan struct{}
+	closeOnce sync.Once
 }
 
+// resolveRancherSetup resolves the plans for commands that only need the
+// approval; the setup page closes once the plan is approved.
 func resolveRancherSetup() ([]*RancherResolvedPlan, error) {
-	mode := strings.ToLower(strings.TrimSpace(viper.GetString("rancher.mode")))
-	autoApprove := viper.GetBool("rancher.auto_approve")
+	plans, page, err := resolveRancherDeployment()
+	page.close()
+	return plans, err
+}
 
-	if mode == "auto" && !autoApprove {
-		return runInteractiveAutoModeSetup()
+// resolveRancherDeployment resolves the plans like resolveRancherSetup, but
+// in interactive mode returns the setup page so it can follow the deployment.
+// The page is nil otherwise. Callers finish or close it.
+func resolveRancherDeployment() ([]*RancherResolvedPlan, *deployPage, error) {
+	if !viper.GetBool("rancher.auto_approve") {
+		return runInteractiveSetup()
 	}
 
-	plans, err := prepareRancherConfiguration(getTotalRancherInstances())
+	var plans []*RancherResolvedPlan
+	var upgradePaths []*instanceUpgradePath
+	err := runPhase(0, "resolve", func() error {
+		var err error
+		plans, err = prepareRancherConfiguration(getTotalRancherInstances())
+		if err != nil {
+			return err
+		}
+		upgradePaths, err = resolveConfiguredUpgradePaths(plans)
+		return err
+	})
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	if pathSection := buildUpgradePathDialogSection(upgradePaths); pathSection != "" {
+		log.Printf("[resolver] %s", pathSection)
 	}
-	return plans, nil
+	return plans, nil, nil
 }
 
-func runInteractiveAutoModeSetup() ([]*RancherResolvedPlan, error) {
+func runInteractiveSetup() ([]*RancherResolvedPlan, *deployPage, error) {
 	configPath := strings.TrimSpace(viper.ConfigFileUsed())
 	if configPath == "" {
-		return nil, fmt.Errorf("failed to determine tool-config.yml path for interactive setup")
+		return nil, nil, fmt.Errorf("failed to determine tool-config.yml path for interactive setup")
 	}
 
-	versions := currentPreflightVersions()
-	for len(versions) < 2 {
-		versions = append(versions, "")
+	initialConfig, err := currentSetupEditorConfig(configPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load config for interactive setup: %w", err)
 	}
 
 	token, err := randomConfirmationToken()
 	if err != nil {
-		return nil, fmt.Errorf("failed to create interactive setup token: %w", err)
+		return nil, nil, fmt.Errorf("failed to create interactive setup token: %w", err)
 	}
 
 	listener, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
-		return nil, fmt.Errorf("failed to start interactive setup listener: %w", err)
+		return nil, nil, fmt.Errorf("failed to start interactive setup listener: %w", err)
 	}
 
 	srv := &interactiveServer{
@@ -97,10 +130,11 @@ func runInteractiveAutoModeSetup() ([]*RancherResolvedPlan, error) {
 		configPath: configPath,
 		phase:      phaseEditor,
 		resultCh:   make(chan interactiveResult, 1),
+		closeCh:    make(chan struct{}),
 	}
 
 	mux := http.NewServeMux()
-	srv.registerHandlers(mux, versions)
+	srv.registerHandlers(mux, initialConfig)
 
 	server := &http.Server{Handler: mux}
 	serverErrCh := make(chan error, 1)
@@ -109,7 +143,13 @@ func runInteractiveAutoModeSetup() ([]*RancherResolvedPlan, error) {
 			serverErrCh <- serveErr
 		}
 	}()
+	// The server outlives this function only when the plan is approved; the
+	// returned page owns it from then on.
+	keepServer := false
 	defer func() {
+		if keepServer {
+			return
+		}
 		shutdownCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 		defer cancel()
 		_ = server.Shutdown(shutdownCtx)
@@ -117,23 +157,27 @@ func runInteractiveAutoModeSetup() ([]*RancherResolvedPlan, error) {
 
 	setupURL := fmt.Sprintf("http://%s/?token=%s", listener.Addr().String(), token)
 	if err := openBrowser(setupURL); err != nil {
-		return nil, fmt.Errorf("failed to open interactive setup page: %w", err)
+		return nil, nil, fmt.Errorf("failed to open interactive setup page: %w", err)
 	}
 	log.Printf("[setup] Opened interactive setup at %s", setupURL)
 
 	select {
 	case result := <-srv.resultCh:
-		srv.broadcast(interactiveEvent{Type: "phase", Phase: phaseDone})
-		return result.plans, result.err
+		if result.err != nil {
+			srv.broadcast(interactiveEvent{Type: "phase", Phase: phaseDone})
+			return nil, nil, result.err
+		}
+		keepServer = true
+		return result.plans, newDeployPage(srv, server), nil
 	case serveErr := <-serverErrCh:
-		return nil, fmt.Errorf("interactive setup server failed: %w", serveErr)
+		return nil, nil, fmt.Errorf("interactive setup server failed: %w", serveErr)
 	case <-time.After(45 * time.Minute):
-		return nil, fmt.Errorf("timed out waiting for interactive setup response")
+		return nil, nil, fmt.Errorf("timed out waiting for interactive setup response")
 	}
 }
 
-func (s *interactiveServer) registerHandlers(mux *http.ServeMux, initialVersions []string) {
-	initialVersionsJSON, _ := json.Marshal(initialVersions)
+func (s *interactiveServer) registerHandlers(mux *http.ServeMux, initialConfig setupEditorConfig) {
+	initialConfigJSON, _ := json.Marshal(initialConfig)
 
 	pageTemplate := template.Must(template.New("interactive-setup").Parse(interactiveSetupHTML))
 
@@ -149,13 +193,13 @@ func (s *interactiveServer) registerHandlers(mux *http.ServeMux, initialVersions
 
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		_ = pageTemplate.Execute(w, struct {
-			Token               string
-			ConfigPath          string
-			InitialVersionsJSON template.JS
+			Token             string
+			ConfigPath        string
+			InitialConfigJSON template.JS
 		}{
-			Token:               s.token,
-			ConfigPath:          s.configPath,
-			InitialVersionsJSON: template.JS(string(initialVersionsJSON)),
+			Token:             s.token,
+			ConfigPath:        s.configPath,
+			InitialConfigJSON: template.JS(string(initialConfigJSON)),
 		})
 	})
 
@@ -169,22 +213,24 @@ func (s *interactiveServer) registerHandlers(mux *http.ServeMux, initialVersions
 			return
 		}
 
-		var req struct {
-			Versions []string `json:"versions"`
-		}
+		var req setupEditorConfig
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			http.Error(w, "invalid request body", http.StatusBadRequest)
 			return
 		}
 
-		normalizedVersions, err := normalizePreflightVersions(req.Versions)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+		s.mu.Lock()
+		submitted := s.submitted
+		s.mu.Unlock()
+		if submitted {
+			writeJSON(w, map[string]string{"status": "already_running"})
 			return
 		}
 
-		if err := updateAutoModeConfigFile(s.configPath, normalizedVersions); err != nil {
-			http.Error(w, fmt.Sprintf("failed to update tool-config.yml: %v", err), http.StatusInternalServerError)
+		// Validation problems are the user's to fix on the page, so every
+		// error from the update is reported as a bad request.
+		if err := updateSetupEditorConfigFile(s.configPath, req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
@@ -220,8 +266,23 @@ func (s *interactiveServer) registerHandlers(mux *http.ServeMux, initialVersions
 		}
 
 		action := r.FormValue("action")
+		if action == "continue" {
+			s.mu.Lock()
+			plans := s.plans
+			s.phase = phaseDeploying
+			s.mu.Unlock()
+
+			s.broadcast(interactiveEvent{Type: "phase", Phase: phaseDeploying})
+			select {
+			case s.resultCh <- interactiveResult{plans: plans}:
+			default:
+			}
+			// The same page follows the deployment from here.
+			http.Redirect(w, r, "/?token="+url.QueryEscape(s.token), http.StatusSeeOther)
+			return
+		}
+
 		s.mu.Lock()
-		plans := s.plans
 		s.phase = phaseDone
 		s.mu.Unlock()
 
@@ -231,12 +292,7 @@ func (s *interactiveServer) registerHandlers(mux *http.ServeMux, initialVersions
 		fmt.Fprint(w, `<!DOCTYPE html><html><head><meta charset="utf-8"><title>Setup</title><script>setTimeout(function(){window.close();},300);</script><style>body{font-family:ui-sans-serif,-apple-system,BlinkMacSystemFont,"Segoe UI",sans-serif;padding:32px;background:#f6f1e8;color:#1d1a16}</style></head><body><p>Your response was recorded. You can close this tab.</p></body></html>`)
 
 		select {
-		case s.resultCh <- func() interactiveResult {
-			if action == "continue" {
-				return interactiveResult{plans: plans, err: nil}
-			}
-			return interactiveResult{plans: nil, err: fmt.Errorf("user canceled interactive Rancher setup")}
-		}():
+		case s.resultCh <- interactiveResult{plans: nil, err: fmt.Errorf("user canceled interactive Rancher setup")}:
 		default:
 		}
 	})
@@ -263,7 +319,10 @@ func (s *interactiveServer) registerHandlers(mux *http.ServeMux, initialVersions
 		logsCopy := append([]string(nil), s.logs...)
 		planText := s.planText
 		resolveErr := s.resolveErr
-		sub := make(chan interactiveEvent, 256)
+		instances := append([]deployInstance(nil), s.instances...)
+		deployEvents := append([]runEvent(nil), s.deployEvents...)
+		deployStatus := s.deployStatus
+		sub := make(chan interactiveEvent, 1024)
 		s.subscribers = append(s.subscribers, sub)
 		s.mu.Unlock()
 		defer s.removeSubscriber(sub)
@@ -278,6 +337,18 @@ func (s *interactiveServer) registerHandlers(mux *http.ServeMux, initialVersions
 		if resolveErr != "" {
 			writeSSE(w, flusher, interactiveEvent{Type: "error", Error: resolveErr})
 		}
+		if len(instances) > 0 {
+			writeSSE(w, flusher, interactiveEvent{Type: "instances", Instances: instances})
+		}
+		for i := range deployEvents {
+			writeSSE(w, flusher, interactiveEvent{Type: "event", Event: &deployEvents[i]})
+		}
+		if deployCancel.canceled() && phase == phaseDeploying {
+			writeSSE(w, flusher, interactiveEvent{Type: "canceled"})
+		}
+		if deployStatus != "" {
+			writeSSE(w, flusher, interactiveEvent{Type: "phase", Phase: phaseFinished, Status: deployStatus})
+		}
 
 		heartbeat := time.NewTicker(15 * time.Second)
 		defer heartbeat.Stop()
@@ -301,6 +372,8 @@ func (s *interactiveServer) registerHandlers(mux *http.ServeMux, initialVersions
 			}
 		}
 	})
+
+	s.registerDeployHandlers(mux)
 }
 
 func (s *interactiveServer) authorized(r *http.Request) bool {
@@ -314,23 +387,27 @@ func (s *interactiveServer) authorized(r *http.Request) bool {
 }
 
 func (s *interactiveServer) runResolution() {
-	tap := &logTap{}
-	tap.onLine = func(line string) { s.appendLog(line) }
-
-	originalWriter := log.Writer()
-	originalFlags := log.Flags()
-	log.SetOutput(io.MultiWriter(originalWriter, tap))
+	// The page follows the event stream: phase events plus every log line
+	// written while the plan resolves.
+	stopCapture := runEvents.captureLogs()
+	unsubscribe := runEvents.subscribe(func(event runEvent) { s.appendLog(event.String()) })
 	defer func() {
-		log.SetOutput(originalWriter)
-		log.SetFlags(originalFlags)
+		unsubscribe()
+		stopCapture()
 	}()
 
-	plans, err := prepareRancherConfiguration(getTotalRancherInstances())
-	if err == nil {
+	var plans []*RancherResolvedPlan
+	var upgradePaths []*instanceUpgradePath
+	err := runPhase(0, "resolve", func() error {
+		var err error
+		plans, err = prepareRancherConfiguration(getTotalRancherInstances())
+		if err != nil {
+			return err
+		}
 		logResolvedPlans(plans)
-	}
-
-	tap.flush()
+		upgradePaths, err = resolveConfiguredUpgradePaths(plans)
+		return err
+	})
 
 	if err != nil {
 		s.mu.Lock()
@@ -344,7 +421,11 @@ func (s *interactiveServer) runResolution() {
 		return
 	}
 
-	planText := buildResolvedPlansDialogMessage(plans)
+	forecast, forecastErr := forecastPlannedRunCost(getTotalRancherInstances())
+	planText := buildResolvedPlansDialogMessage(plans) + "\n\n" + buildCostForecastDialogSection(forecast, forecastErr, configuredBudgetLimits())
+	if pathSection := buildUpgradePathDialogSection(upgradePaths); pathSection != "" {
+		planText += "\n\n" + pathSection
+	}
 
 	s.mu.Lock()
 	s.plans = plans
@@ -403,44 +484,6 @@ func writeSSE(w io.Writer, flusher http.Flusher, ev interactiveEvent) {
 	flusher.Flush()
 }
 
-type logTap struct {
-	mu     sync.Mutex
-	buf    bytes.Buffer
-	onLine func(string)
-}
-
-func (t *logTap) Write(p []byte) (int, error) {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	n, err := t.buf.Write(p)
-	for {
-		data := t.buf.Bytes()
-		idx := bytes.IndexByte(data, '\n')
-		if idx < 0 {
-			break
-		}
-		line := string(data[:idx])
-		t.buf.Next(idx + 1)
-		if strings.TrimSpace(line) != "" && t.onLine != nil {
-			t.onLine(line)
-		}
-	}
-	return n, err
-}
-
-func (t *logTap) flush() {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	if t.buf.Len() == 0 {
-		return
-	}
-	line := strings.TrimRight(t.buf.String(), "\r\n")
-	t.buf.Reset()
-	if strings.TrimSpace(line) != "" && t.onLine != nil {
-		t.onLine(line)
-	}
-}
-
 const interactiveSetupHTML = `<!DOCTYPE html>
 <html lang="en">
 <head>
@@ -526,6 +569,10 @@ const interactiveSetupHTML = `<!DOCTYPE html>
     body[data-phase="resolving"] section[data-section="resolving"] { display: block; }
     body[data-phase="review"] section[data-section="review"] { display: block; }
     body[data-phase="done"] section[data-section="done"] { display: block; }
+    body[data-phase="deploying"] section[data-section="deploy"],
+    body[data-phase="finished"] section[data-section="deploy"] { display: block; }
+    body[data-phase="finished"] .deploy-running,
+    body[data-phase="deploying"] .deploy-finished { display: none; }
 
     .panel {
       border: 1px solid var(--border);
@@ -558,7 +605,31 @@ const interactiveSetupHTML = `<!DOCTYPE html>
       color: var(--muted);
       font-weight: 400;
     }
-    input[type="text"] {
+    body[data-mode="manual"] [data-mode="auto"] { display: none; }
+    .row-header.manual, .row.manual {
+      grid-template-columns: 130px minmax(0, 1fr) 190px 100px;
+    }
+    .settings {
+      display: grid;
+      grid-template-columns: repeat(auto-fill, minmax(230px, 1fr));
+      gap: 12px;
+      align-items: end;
+    }
+    .settings label {
+      display: grid;
+      gap: 6px;
+      color: var(--muted);
+      font-size: 0.85rem;
+      min-width: 0;
+    }
+    .settings label.checkbox {
+      display: flex;
+      align-items: center;
+      gap: 8px;
+      padding-bottom: 12px;
+    }
+    details.panel summary { cursor: pointer; margin-bottom: 12px; }
+    input[type="text"], input[type="password"], select, textarea {
       width: 100%;
       border: 1px solid var(--border);
       background: transparent;
@@ -567,6 +638,10 @@ const interactiveSetupHTML = `<!DOCTYPE html>
       padding: 11px 13px;
       font: inherit;
     }
+    textarea {
+      font: 12px/1.5 ui-monospace, SFMono-Regular, Menlo, Consolas, monospace;
+      resize: vertical;
+    }
     .summary {
       margin-top: 14px;
       display: grid;
@@ -662,6 +737,34 @@ const interactiveSetupHTML = `<!DOCTYPE html>
       word-break: break-word;
     }
 
+    .cards {
+      display: grid;
+      grid-template-columns: repeat(auto-fill, minmax(280px, 1fr));
+      gap: 12px;
+      margin-bottom: 14px;
+    }
+    .card {
+      border: 1px solid var(--border);
+      border-radius: 16px;
+      background: rgba(0, 0, 0, 0.03);
+      padding: 14px;
+      display: grid;
+      gap: 8px;
+      min-width: 0;
+    }
+    .card-title { display: flex; justify-content: space-between; gap: 8px; align-items: baseline; }
+    .card-url { font-size: 0.85rem; word-break: break-all; color: var(--accent); }
+    .card-current { font-size: 0.9rem; color: var(--muted); }
+    .phase-list { margin: 0; padding: 0; list-style: none; font-size: 0.85rem; display: grid; gap: 3px; }
+    .phase-list li { display: flex; justify-content: space-between; gap: 8px; }
+    .phase-list .failed { color: var(--danger); }
+    .phase-list .started { color: var(--accent); font-weight: 700; }
+    .phase-error { color: var(--danger); font-size: 0.82rem; white-space: pre-wrap; }
+    .card .log-panel { height: 150px; font-size: 11px; padding: 10px 12px; }
+    .card button { padding: 7px 12px; font-size: 0.85rem; justify-self: start; }
+    .run-log { height: min(32vh, 320px); }
+    .danger { background: var(--danger); color: white; }
+
     @media (max-width: 760px) {
       .row-header { display: none; }
       .row { grid-template-columns: 1fr; }
@@ -675,23 +778,44 @@ const interactiveSetupHTML = `<!DOCTYPE html>
         <h1>Hosted/Tenant Rancher Setup Preflight</h1>
       </div>
       <div class="body">
-        <p class="subtitle" style="margin-top:0">Review the requested Rancher versions for this run. Instance 1 is the host; the remaining instances are tenants. The row count becomes <code>total_rancher_instances</code> automatically. Minimum 2, maximum 4.</p>
+        <p class="subtitle" style="margin-top:0">Review the settings for this run. Instance 1 is the host; the remaining instances are tenants. The row count becomes <code>total_rancher_instances</code> automatically. Minimum 2, maximum 4. Changes are checked before they are saved to the config file, and its comments are kept.</p>
         <div class="panel">
-          <div class="row-header">
-            <div>Instance</div>
-            <div>Rancher Version</div>
-            <div>Remove</div>
+          <div class="settings">
+            <label>Mode
+              <select id="modeSelect">
+                <option value="auto">auto: resolve from Rancher versions</option>
+                <option value="manual">manual: Helm commands and K3s versions</option>
+              </select>
+            </label>
+            <label data-mode="auto">Distro
+              <select id="distroSelect">
+                <option value="auto">auto</option>
+                <option value="community">community</option>
+                <option value="prime">prime</option>
+              </select>
+            </label>
+            <label data-mode="auto">Bootstrap password
+              <input type="password" id="bootstrapPasswordInput" autocomplete="off" />
+            </label>
+            <label class="checkbox"><input type="checkbox" id="preloadImagesInput" /> Preload K3s airgap images</label>
           </div>
+        </div>
+        <div class="panel" style="margin-top:14px">
+          <div class="row-header" id="rowHeader"></div>
           <div class="rows" id="rows"></div>
           <div class="summary">
             <div><strong>Total instances for this run:</strong> <span id="totalInstancesValue"></span></div>
             <div><strong>Config file:</strong> <code>{{.ConfigPath}}</code></div>
-            <div><strong>Mode:</strong> auto</div>
-            <div>After you submit, this same page will stream resolver logs and then show the full plan for approval.</div>
+            <div><strong>Mode:</strong> <span id="modeValue"></span></div>
+            <div>After you submit, this same page will stream resolver logs, show the full plan for approval, and then follow the deployment.</div>
           </div>
           <div class="error" id="editorErrorBox"></div>
           <div class="status" id="editorStatusBox"></div>
         </div>
+        <details class="panel" style="margin-top:14px">
+          <summary><strong>Terraform variables</strong> (<code>tf_vars</code>)</summary>
+          <div class="settings" id="tfVars"></div>
+        </details>
       </div>
       <div class="actions">
         <div class="left-actions">
@@ -737,21 +861,62 @@ const interactiveSetupHTML = `<!DOCTYPE html>
       </form>
     </section>
 
+    <section data-section="deploy">
+      <div class="header">
+        <div class="spinner deploy-running" aria-hidden="true"></div>
+        <div>
+          <h1 class="deploy-running">Deploying hosted/tenant Rancher</h1>
+          <h1 class="deploy-finished" id="finishedTitle">Deployment finished</h1>
+          <p class="subtitle" style="margin-top:6px" id="deploySubtitle">Terraform, K3s installs, imports and tenant Rancher installs. Each card shows its instance's phases and log.</p>
+        </div>
+      </div>
+      <div class="body">
+        <div class="cards" id="cards"></div>
+        <pre class="log-panel run-log" id="runLogPanel"><span class="log-empty">Waiting for deployment output…</span></pre>
+        <div class="error" id="deployErrorBox"></div>
+      </div>
+      <div class="actions">
+        <div class="left-actions"></div>
+        <div class="right-actions">
+          <button class="danger deploy-running" id="deployCancelBtn" type="button">Cancel and Tear Down</button>
+          <button class="continue deploy-finished" id="doneBtn" type="button">Done</button>
+        </div>
+      </div>
+    </section>
+
     <section data-section="done">
       <div class="header">
         <h1>You can close this tab</h1>
       </div>
       <div class="body">
-        <p class="subtitle" style="margin-top:0">Your response was recorded. The test run is continuing in your terminal.</p>
+        <p class="subtitle" style="margin-top:0">This page is no longer updated. Any further output is in your terminal.</p>
       </div>
     </section>
   </div>
 
   <script>
     const token = {{printf "%q" .Token}};
-    let versions = {{.InitialVersionsJSON}};
+    const initialConfig = {{.InitialConfigJSON}};
+    const config = {
+      mode: initialConfig.mode === 'manual' ? 'manual' : 'auto',
+      versions: (initialConfig.versions || []).slice(),
+      distro: initialConfig.distro || 'auto',
+      bootstrapPassword: initialConfig.bootstrapPassword || '',
+      preloadImages: !!initialConfig.preloadImages,
+      helmCommands: (initialConfig.helmCommands || []).slice(),
+      k3sVersions: (initialConfig.k3sVersions || []).slice(),
+      tfVars: (initialConfig.tfVars || []).map(tfVar => Object.assign({}, tfVar))
+    };
     let submitting = false;
 
+    const editorSectionEl = document.querySelector('section[data-section="editor"]');
+    const modeSelectEl = document.getElementById('modeSelect');
+    const distroSelectEl = document.getElementById('distroSelect');
+    const bootstrapPasswordInputEl = document.getElementById('bootstrapPasswordInput');
+    const preloadImagesInputEl = document.getElementById('preloadImagesInput');
+    const rowHeaderEl = document.getElementById('rowHeader');
+    const modeValueEl = document.getElementById('modeValue');
+    const tfVarsEl = document.getElementById('tfVars');
     const rowsEl = document.getElementById('rows');
     const totalInstancesValueEl = document.getElementById('totalInstancesValue');
     const editorErrorBoxEl = document.getElementById('editorErrorBox');
@@ -764,6 +929,17 @@ const interactiveSetupHTML = `<!DOCTYPE html>
     const planPanelEl = document.getElementById('planPanel');
     const reviewErrorBoxEl = document.getElementById('reviewErrorBox');
     const respondFormEl = document.getElementById('respondForm');
+    const cardsEl = document.getElementById('cards');
+    const runLogPanelEl = document.getElementById('runLogPanel');
+    const deployErrorBoxEl = document.getElementById('deployErrorBox');
+    const deploySubtitleEl = document.getElementById('deploySubtitle');
+    const finishedTitleEl = document.getElementById('finishedTitle');
+    const deployCancelBtnEl = document.getElementById('deployCancelBtn');
+    const doneBtnEl = document.getElementById('doneBtn');
+
+    // Deployment cards, keyed by instance (0 is the run as a whole).
+    const cards = new Map();
+    const maxCardLogLines = 200;
 
     function setPhase(phase) {
       document.body.dataset.phase = phase;
@@ -781,73 +957,125 @@ const interactiveSetupHTML = `<!DOCTYPE html>
       return index === 0 ? 'Host' : 'Tenant ' + index;
     }
 
+    function rowCount() {
+      return config.mode === 'manual' ? config.helmCommands.length : config.versions.length;
+    }
+
     function renderRows() {
-      rowsEl.innerHTML = versions.map((version, index) => {
-        const removeDisabled = versions.length <= 2 ? ' disabled' : '';
-        return (
-          '<div class="row">' +
-            '<div class="instance-label">Instance ' + (index + 1) + '<br><span class="instance-role">' + instanceRole(index) + '</span></div>' +
-            '<div><input type="text" value="' + escapeHtml(version) + '" data-index="' + index + '" placeholder="2.14.1-alpha3" /></div>' +
-            '<div><button class="secondary remove" type="button" data-remove-index="' + index + '"' + removeDisabled + '>Remove</button></div>' +
-          '</div>'
-        );
-      }).join('');
-      totalInstancesValueEl.textContent = String(versions.length);
-      addBtnEl.disabled = submitting || versions.length >= 4;
-
-      rowsEl.querySelectorAll('input[data-index]').forEach(input => {
+      const manual = config.mode === 'manual';
+      const count = rowCount();
+      document.body.dataset.mode = config.mode;
+      rowHeaderEl.className = 'row-header' + (manual ? ' manual' : '');
+      rowHeaderEl.innerHTML = manual
+        ? '<div>Instance</div><div>Helm Command</div><div>K3s Version</div><div>Remove</div>'
+        : '<div>Instance</div><div>Rancher Version</div><div>Remove</div>';
+
+      let html = '';
+      for (let index = 0; index < count; index++) {
+        const removeDisabled = count <= 2 ? ' disabled' : '';
+        const label = '<div class="instance-label">Instance ' + (index + 1) + '<br><span class="instance-role">' + instanceRole(index) + '</span></div>';
+        const remove = '<div><button class="secondary remove" type="button" data-remove-index="' + index + '"' + removeDisabled + '>Remove</button></div>';
+        if (manual) {
+          html += '<div class="row manual">' + label +
+            '<div><textarea rows="5" data-field="helmCommands" data-index="' + index + '" placeholder="helm install rancher ...">' + escapeHtml(config.helmCommands[index] || '') + '</textarea></div>' +
+            '<div><input type="text" value="' + escapeHtml(config.k3sVersions[index] || '') + '" data-field="k3sVersions" data-index="' + index + '" placeholder="v1.32.5+k3s1" /></div>' +
+            remove + '</div>';
+        } else {
+          html += '<div class="row">' + label +
+            '<div><input type="text" value="' + escapeHtml(config.versions[index] || '') + '" data-field="versions" data-index="' + index + '" placeholder="2.14.1-alpha3" /></div>' +
+            remove + '</div>';
+        }
+      }
+      rowsEl.innerHTML = html;
+      totalInstancesValueEl.textContent = String(count);
+      modeValueEl.textContent = config.mode;
+      addBtnEl.disabled = submitting || count >= 4;
+
+      rowsEl.querySelectorAll('[data-field]').forEach(input => {
         input.addEventListener('input', event => {
-          versions[Number(event.target.getAttribute('data-index'))] = event.target.value;
+          config[input.getAttribute('data-field')][Number(input.getAttribute('data-index'))] = event.target.value;
           editorErrorBoxEl.textContent = '';
         });
       });
       rowsEl.querySelectorAll('button[data-remove-index]').forEach(button => {
         button.addEventListener('click', () => {
-          if (versions.length <= 2 || submitting) return;
-          versions.splice(Number(button.getAttribute('data-remove-index')), 1);
+          if (rowCount() <= 2 || submitting) return;
+          const index = Number(button.getAttribute('data-remove-index'));
+          if (config.mode === 'manual') {
+            config.helmCommands.splice(index, 1);
+            config.k3sVersions.splice(index, 1);
+          } else {
+            config.versions.splice(index, 1);
+          }
           renderRows();
         });
       });
     }
 
-    function normalizedVersions() {
-      return versions.map(version => String(version || '').trim());
+    function renderTFVars() {
+      tfVarsEl.innerHTML = config.tfVars.map((tfVar, index) =>
+        '<label>' + escapeHtml(tfVar.key) +
+          '<input type="' + (tfVar.secret ? 'password' : 'text') + '" value="' + escapeHtml(tfVar.value) + '" data-tf-index="' + index + '" autocomplete="off" />' +
+        '</label>'
+      ).join('') || '<div class="summary">No tf_vars values in the config file.</div>';
+      tfVarsEl.querySelectorAll('input[data-tf-index]').forEach(input => {
+        input.addEventListener('input', event => {
+          config.tfVars[Number(input.getAttribute('data-tf-index'))].value = event.target.value;
+          editorErrorBoxEl.textContent = '';
+        });
+      });
     }
 
-    function validateVersions() {
-      const trimmed = normalizedVersions();
-      if (trimmed.length < 2) return 'At least 2 instances are required (1 host + 1 tenant).';
-      if (trimmed.length > 4) return 'No more than 4 instances are supported.';
-      for (let i = 0; i < trimmed.length; i++) {
-        if (!trimmed[i]) return 'Version for Instance ' + (i + 1) + ' cannot be empty.';
+    function renderSettings() {
+      modeSelectEl.value = config.mode;
+      distroSelectEl.value = config.distro;
+      bootstrapPasswordInputEl.value = config.bootstrapPassword;
+      preloadImagesInputEl.checked = config.preloadImages;
+    }
+
+    function validateConfig() {
+      const count = rowCount();
+      if (count < 2) return 'At least 2 instances are required (1 host + 1 tenant).';
+      if (count > 4) return 'No more than 4 instances are supported.';
+      for (let i = 0; i < count; i++) {
+        if (config.mode === 'manual') {
+          if (!String(config.helmCommands[i] || '').trim()) return 'Helm command for Instance ' + (i + 1) + ' cannot be empty.';
+          if (!String(config.k3sVersions[i] || '').trim()) return 'K3s version for Instance ' + (i + 1) + ' cannot be empty.';
+        } else if (!String(config.versions[i] || '').trim()) {
+          return 'Version for Instance ' + (i + 1) + ' cannot be empty.';
+        }
       }
+      if (config.mode === 'auto' && !config.bootstrapPassword.trim()) return 'Bootstrap password cannot be empty in auto mode.';
       return '';
     }
 
     function setSubmittingState(nextSubmitting) {
       submitting = nextSubmitting;
-      addBtnEl.disabled = nextSubmitting || versions.length >= 4;
+      editorSectionEl.querySelectorAll('input, textarea, select').forEach(el => {
+        el.disabled = nextSubmitting;
+      });
+      rowsEl.querySelectorAll('button[data-remove-index]').forEach(el => {
+        el.disabled = nextSubmitting || rowCount() <= 2;
+      });
+      addBtnEl.disabled = nextSubmitting || rowCount() >= 4;
       editorCancelBtnEl.disabled = nextSubmitting;
       continueBtnEl.disabled = nextSubmitting;
-      rowsEl.querySelectorAll('input, button[data-remove-index]').forEach(el => {
-        el.disabled = nextSubmitting || (el.hasAttribute('data-remove-index') && versions.length <= 2);
-      });
     }
 
-    async function submitVersions() {
-      const validationError = validateVersions();
+    async function submitConfig() {
+      const validationError = validateConfig();
       if (validationError) {
         editorErrorBoxEl.textContent = validationError;
         return;
       }
       editorErrorBoxEl.textContent = '';
-      editorStatusBoxEl.textContent = 'Saving config and kicking off plan resolution...';
+      editorStatusBoxEl.textContent = 'Checking and saving config, then kicking off plan resolution...';
       setSubmittingState(true);
 
       const response = await fetch('/submit?token=' + encodeURIComponent(token), {
         method: 'POST',
         headers: { 'Content-Type': 'application/json' },
-        body: JSON.stringify({ versions: normalizedVersions() })
+        body: JSON.stringify(config)
       });
       if (!response.ok) {
         editorErrorBoxEl.textContent = await response.text();
@@ -870,14 +1098,149 @@ const interactiveSetupHTML = `<!DOCTYPE html>
       form.submit();
     }
 
-    function appendLogLine(line) {
-      const empty = logPanelEl.querySelector('.log-empty');
+    function appendLine(panel, line, maxLines) {
+      const empty = panel.querySelector('.log-empty');
       if (empty) empty.remove();
       const span = document.createElement('span');
       span.className = 'log-line';
       span.textContent = line;
-      logPanelEl.appendChild(span);
-      logPanelEl.scrollTop = logPanelEl.scrollHeight;
+      panel.appendChild(span);
+      while (maxLines && panel.childElementCount > maxLines) panel.firstElementChild.remove();
+      panel.scrollTop = panel.scrollHeight;
+    }
+
+    function appendLogLine(line) {
+      appendLine(logPanelEl, line);
+    }
+
+    function formatSeconds(seconds) {
+      const total = Math.round(seconds || 0);
+      const minutes = Math.floor(total / 60);
+      return minutes > 0 ? minutes + 'm' + String(total % 60).padStart(2, '0') + 's' : total + 's';
+    }
+
+    function ensureCard(instance, role, url) {
+      let card = cards.get(instance);
+      if (!card) {
+        const el = document.createElement('div');
+        el.className = 'card';
+        el.innerHTML =
+          '<div class="card-title"><strong></strong><span class="instance-role"></span></div>' +
+          '<a class="card-url" target="_blank" rel="noopener"></a>' +
+          '<div class="card-current">Waiting</div>' +
+          '<ul class="phase-list"></ul>' +
+          '<div class="phase-error"></div>' +
+          '<pre class="log-panel"><span class="log-empty">No output yet…</span></pre>';
+        card = {
+          el: el,
+          current: el.querySelector('.card-current'),
+          phases: el.querySelector('.phase-list'),
+          error: el.querySelector('.phase-error'),
+          log: el.querySelector('.log-panel'),
+          items: new Map()
+        };
+        el.querySelector('strong').textContent = instance === 0 ? 'Run' : 'Instance ' + instance;
+        if (instance > 0) {
+          const copyBtn = document.createElement('button');
+          copyBtn.className = 'secondary';
+          copyBtn.type = 'button';
+          copyBtn.textContent = 'Copy kubeconfig';
+          copyBtn.addEventListener('click', () => copyKubeconfig(instance, copyBtn));
+          el.appendChild(copyBtn);
+        }
+        cards.set(instance, card);
+        const ordered = Array.from(cards.keys()).sort((a, b) => a - b);
+        const next = ordered.find(key => key > instance);
+        cardsEl.insertBefore(el, next === undefined ? null : cards.get(next).el);
+      }
+      if (role) card.el.querySelector('.instance-role').textContent = role;
+      if (url) {
+        const link = card.el.querySelector('.card-url');
+        link.href = url;
+        link.textContent = url;
+      }
+      return card;
+    }
+
+    function applyRunEvent(ev) {
+      const instance = ev.instance || 0;
+      if (ev.status === 'log') {
+        appendLine(runLogPanelEl, ev.message, 2000);
+        if (instance > 0) appendLine(ensureCard(instance).log, ev.message, maxCardLogLines);
+        return;
+      }
+      const card = ensureCard(instance);
+      let item = card.items.get(ev.phase);
+      if (!item) {
+        item = document.createElement('li');
+        item.innerHTML = '<span></span><span></span>';
+        card.items.set(ev.phase, item);
+        card.phases.appendChild(item);
+      }
+      item.className = ev.status;
+      item.firstChild.textContent = ev.phase;
+      if (ev.status === 'started') {
+        item.lastChild.textContent = 'running';
+        card.current.textContent = 'Running ' + ev.phase;
+        card.error.textContent = '';
+      } else if (ev.status === 'succeeded') {
+        item.lastChild.textContent = formatSeconds(ev.durationSeconds);
+        card.current.textContent = 'Finished ' + ev.phase;
+      } else if (ev.status === 'failed') {
+        item.lastChild.textContent = 'failed after ' + formatSeconds(ev.durationSeconds);
+        card.current.textContent = 'Failed in ' + ev.phase;
+        card.error.textContent = ev.error || '';
+      }
+    }
+
+    async function copyKubeconfig(instance, button) {
+      const response = await fetch('/kubeconfig?token=' + encodeURIComponent(token) + '&instance=' + instance);
+      const original = 'Copy kubeconfig';
+      if (!response.ok) {
+        button.textContent = (await response.text()).trim() || 'Not available';
+        setTimeout(() => { button.textContent = original; }, 2500);
+        return;
+      }
+      const content = await response.text();
+      try {
+        await navigator.clipboard.writeText(content);
+        button.textContent = 'Copied';
+      } catch (_) {
+        window.prompt('Copy the kubeconfig for instance ' + instance + ':', content);
+      }
+      setTimeout(() => { button.textContent = original; }, 2500);
+    }
+
+    async function cancelDeployment() {
+      if (!window.confirm('Cancel the deployment and tear the environment down? The current step finishes first.')) return;
+      deployCancelBtnEl.disabled = true;
+      const response = await fetch('/cancel?token=' + encodeURIComponent(token), { method: 'POST' });
+      if (!response.ok) {
+        deployErrorBoxEl.textContent = await response.text();
+        deployCancelBtnEl.disabled = false;
+      }
+    }
+
+    function showCanceling() {
+      deployCancelBtnEl.disabled = true;
+      deploySubtitleEl.textContent = 'Canceling: the current step finishes, then the environment is torn down.';
+    }
+
+    function showFinished(status) {
+      const titles = {
+        succeeded: 'Deployment succeeded',
+        failed: 'Deployment failed',
+        canceled: 'Deployment canceled'
+      };
+      finishedTitleEl.textContent = titles[status] || 'Deployment finished';
+      deploySubtitleEl.textContent = status === 'succeeded'
+        ? 'Copy URLs and kubeconfigs below. Press Done to let the test run exit.'
+        : 'See the failed phase on its card and the run report in the report directory. Press Done to let the test run exit.';
+    }
+
+    async function closePage() {
+      doneBtnEl.disabled = true;
+      await fetch('/close?token=' + encodeURIComponent(token), { method: 'POST' });
     }
 
     function connectEventStream() {
@@ -900,7 +1263,17 @@ const interactiveSetupHTML = `<!DOCTYPE html>
             resolvingErrorBoxEl.textContent = payload.error;
             reviewErrorBoxEl.textContent = payload.error;
             break;
+          case 'instances':
+            payload.instances.forEach(inst => ensureCard(inst.instance, inst.role, inst.url));
+            break;
+          case 'event':
+            applyRunEvent(payload.event);
+            break;
+          case 'canceled':
+            showCanceling();
+            break;
         }
+        if (payload.type === 'phase' && payload.phase === 'finished') showFinished(payload.status);
       };
       source.onerror = () => {
         // Keep quiet; browser will retry automatically.
@@ -908,14 +1281,31 @@ const interactiveSetupHTML = `<!DOCTYPE html>
     }
 
     addBtnEl.addEventListener('click', () => {
-      if (submitting || versions.length >= 4) return;
-      versions.push('');
+      if (submitting || rowCount() >= 4) return;
+      if (config.mode === 'manual') {
+        config.helmCommands.push('');
+        config.k3sVersions.push('');
+      } else {
+        config.versions.push('');
+      }
+      renderRows();
+    });
+    modeSelectEl.addEventListener('change', () => {
+      config.mode = modeSelectEl.value;
+      editorErrorBoxEl.textContent = '';
       renderRows();
     });
+    distroSelectEl.addEventListener('change', () => { config.distro = distroSelectEl.value; });
+    bootstrapPasswordInputEl.addEventListener('input', () => { config.bootstrapPassword = bootstrapPasswordInputEl.value; });
+    preloadImagesInputEl.addEventListener('change', () => { config.preloadImages = preloadImagesInputEl.checked; });
     editorCancelBtnEl.addEventListener('click', cancelEditor);
-    continueBtnEl.addEventListener('click', submitVersions);
+    continueBtnEl.addEventListener('click', submitConfig);
+    deployCancelBtnEl.addEventListener('click', cancelDeployment);
+    doneBtnEl.addEventListener('click', closePage);
 
+    renderSettings();
     renderRows();
+    renderTFVars();
     connectEventStream();
   </script>
 </body>
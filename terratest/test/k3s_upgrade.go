@@ -0,0 +1,365 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	toolkit "github.com/brudnak/hosted-tenant-rancher/tools"
+	goversion "github.com/hashicorp/go-version"
+	"github.com/spf13/viper"
+)
+
+var k3sMinorPattern = regexp.MustCompile(`^v1\.(\d+)\.\d+\+k3s\d+$`)
+
+// k3sUpgradeRecord is kept in run metadata next to the Rancher upgrades.
+type k3sUpgradeRecord struct {
+	Index       int       `json:"index"`
+	FromVersion string    `json:"fromVersion"`
+	ToVersion   string    `json:"toVersion"`
+	Forced      bool      `json:"forced,omitempty"`
+	Warnings    []string  `json:"warnings,omitempty"`
+	StartedAt   time.Time `json:"startedAt"`
+	CompletedAt time.Time `json:"completedAt"`
+}
+
+// k3sUpgradeStep is the checked plan for one cluster.
+type k3sUpgradeStep struct {
+	index       int
+	cluster     ClusterInfra
+	fromVersion string
+	toVersion   string
+	problems    []string
+}
+
+// getRequestedK3SUpgradeVersions reads upgrade.k3s_versions. An empty entry
+// leaves that cluster on its current K3s version.
+func getRequestedK3SUpgradeVersions(totalInstances int) ([]string, error) {
+	versions, err := readPerInstanceUpgradeVersions("upgrade.k3s_versions", totalInstances, strings.TrimSpace)
+	if err != nil {
+		return nil, err
+	}
+	for i, version := range versions {
+		if version != "" && !k3sMinorPattern.MatchString(version) {
+			return nil, fmt.Errorf("upgrade.k3s_versions[%d] %q must look like v1.32.5+k3s1", i, version)
+		}
+	}
+	return versions, nil
+}
+
+// prepareK3SUpgradeArtifacts pins the installer, image bundle and binary
+// checksums for the target versions the same way a fresh install does: from
+// the config in manual mode, computed from the release in auto mode. They are
+// merged into the k3s.*_sha256s maps the node installer reads.
+func prepareK3SUpgradeArtifacts(versions []string) error {
+	autoMode := strings.EqualFold(strings.TrimSpace(viper.GetString("rancher.mode")), "auto")
+
+	var plans []*RancherResolvedPlan
+	seen := map[string]bool{}
+	for _, version := range versions {
+		if version == "" || seen[version] {
+			continue
+		}
+		seen[version] = true
+
+		plan := &RancherResolvedPlan{RecommendedK3S: version}
+		// Release assets (asset set) take their checksum from the release's
+		// checksum file; the installer is not a release asset and is hashed.
+		artifacts := []struct {
+			mapKey, singleKey, asset string
+			enabled                  bool
+			target                   *string
+		}{
+			{"k3s.install_script_sha256s", "k3s.install_script_sha256", "", true, &plan.InstallScriptSHA256},
+			{"k3s.airgap_image_sha256s", "k3s.airgap_image_sha256", k3sAirgapImageAsset, viper.GetBool("k3s.preload_images") || toolkit.AirgapEnabled(), &plan.AirgapImageSHA256},
+			{"k3s.binary_sha256s", "k3s.binary_sha256", k3sBinaryAsset, toolkit.AirgapEnabled(), &plan.BinarySHA256},
+		}
+		for _, artifact := range artifacts {
+			if !artifact.enabled {
+				continue
+			}
+
+			var checksum string
+			var err error
+			switch {
+			case autoMode && artifact.asset != "":
+				log.Printf("[k3s-upgrade] Reading the SHA256 of %s %s from the release checksums...", version, artifact.asset)
+				checksum, err = resolveK3SReleaseSHA256(version, artifact.asset)
+			case autoMode:
+				installURL := buildK3SInstallScriptURL(version)
+				log.Printf("[k3s-upgrade] Computing SHA256 of %s...", installURL)
+				checksum, err = resolveRemoteSHA256(installURL)
+			default:
+				checksum, err = k3sChecksumForVersion(artifact.mapKey, artifact.singleKey, version)
+			}
+			if err != nil {
+				return err
+			}
+			*artifact.target = checksum
+
+			checksums := viper.GetStringMapString(artifact.mapKey)
+			checksums[version] = checksum
+			viper.Set(artifact.mapKey, checksums)
+		}
+		plans = append(plans, plan)
+	}
+
+	return validatePinnedK3SArtifacts(plans)
+}
+
+// planK3SUpgrades reads the running K3s and Rancher versions and checks every
+// requested jump before any node is touched.
+func planK3SUpgrades(clusters []ClusterInfra, versions []string) ([]k3sUpgradeStep, error) {
+	rancherVersions := make([]string, len(clusters))
+	for i, cluster := range clusters {
+		kubeconfig, err := refreshInstanceKubeconfig(i, cluster)
+		if err != nil {
+			return nil, err
+		}
+		release, err := currentRancherRelease(kubeconfig)
+		if err != nil {
+			return nil, fmt.Errorf("instance %d: %w", i+1, err)
+		}
+		rancherVersions[i] = release.chartVersion()
+	}
+
+	var steps []k3sUpgradeStep
+	for i, target := range versions {
+		if target == "" {
+			continue
+		}
+
+		fromVersion, err := tools.K3SVersion(clusters[i].K3SConfig().Node1)
+		if err != nil {
+			return nil, fmt.Errorf("instance %d: %w", i+1, err)
+		}
+		if fromVersion == target {
+			log.Printf("[k3s-upgrade] Instance %d is already on %s, skipping", i+1, target)
+			continue
+		}
+
+		// The cluster runs its own Rancher and tenants are also managed by
+		// the host, so the target has to be supported by both.
+		managingRancher := []string{rancherVersions[i]}
+		if i > 0 {
+			managingRancher = append(managingRancher, rancherVersions[0])
+		}
+
+		step := k3sUpgradeStep{index: i, cluster: clusters[i], fromVersion: fromVersion, toVersion: target}
+		step.problems = checkK3SUpgradePath(fromVersion, target)
+		for _, rancherVersion := range managingRancher {
+			lowest, highest, err := supportedK3SRangeForRancher(rancherVersion)
+			if err != nil {
+				return nil, fmt.Errorf("instance %d: %w", i+1, err)
+			}
+			if problem := checkK3SSupportRange(target, lowest, highest); problem != "" {
+				step.problems = append(step.problems, fmt.Sprintf("%s for Rancher %s", problem, rancherVersion))
+			}
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// upgradeK3SEnvironment rolls each planned cluster one node at a time, then
+// waits for its Rancher and checks that tenants are still Active in the host.
+func upgradeK3SEnvironment(clusters []ClusterInfra, steps []k3sUpgradeStep, force bool) error {
+	var refused []string
+	for _, step := range steps {
+		for _, problem := range step.problems {
+			refused = append(refused, fmt.Sprintf("instance %d %s -> %s: %s", step.index+1, step.fromVersion, step.toVersion, problem))
+		}
+	}
+	if len(refused) > 0 && !force {
+		return fmt.Errorf("refusing unsupported K3s upgrade(s); set upgrade.force to override:\n%s", strings.Join(refused, "\n"))
+	}
+	for _, line := range refused {
+		log.Printf("[k3s-upgrade] WARNING (forced): %s", line)
+	}
+
+	metadata, err := loadRunMetadata()
+	if err != nil {
+		return err
+	}
+	if metadata != nil && metadata.hibernated() {
+		return fmt.Errorf("environment is %s; run TestResume before upgrading", metadata.State)
+	}
+	if metadata == nil {
+		metadata = &runMetadata{State: runStateRunning, Clusters: runClustersFromInfra(clusters)}
+	}
+
+	hostURL := clusters[0].RancherURL
+	for _, step := range steps {
+		record := k3sUpgradeRecord{
+			Index:       step.index + 1,
+			FromVersion: step.fromVersion,
+			ToVersion:   step.toVersion,
+			Forced:      len(step.problems) > 0,
+			Warnings:    step.problems,
+			StartedAt:   time.Now().UTC(),
+		}
+
+		config := step.cluster.K3SConfig()
+		log.Printf("[k3s-upgrade] Instance %d: upgrading K3s %s -> %s", step.index+1, step.fromVersion, step.toVersion)
+		for _, node := range []toolkit.K3SNode{config.Node1, config.Node2} {
+			if err := upgradeK3SNode(&tools, node, step.toVersion); err != nil {
+				return fmt.Errorf("instance %d: %w", step.index+1, err)
+			}
+		}
+
+		kubeconfig, err := refreshInstanceKubeconfig(step.index, step.cluster)
+		if err != nil {
+			return err
+		}
+		if err := waitForRancherReady(readinessPhaseK3SUpgrade, config.RancherURL, kubeconfig, 15*time.Minute); err != nil {
+			return fmt.Errorf("instance %d Rancher failed to become ready after K3s upgrade: %w", step.index+1, err)
+		}
+		if err := verifyTenantsActive(hostURL, len(clusters)); err != nil {
+			return fmt.Errorf("after upgrading K3s on instance %d: %w", step.index+1, err)
+		}
+
+		record.CompletedAt = time.Now().UTC()
+		metadata.K3SUpgrades = append(metadata.K3SUpgrades, record)
+		if err := saveRunMetadata(metadata); err != nil {
+			log.Printf("[k3s-upgrade] Could not record upgrade: %v", err)
+		}
+		log.Printf("[k3s-upgrade] Instance %d: K3s is on %s", step.index+1, step.toVersion)
+	}
+
+	return nil
+}
+
+func supportedK3SRangeForRancher(chartVersion string) (int, int, error) {
+	buildType, minorLine, err := classifyRancherVersion(normalizeVersionInput(chartVersion))
+	if err != nil {
+		return 0, 0, err
+	}
+	compatibilityBase := normalizeVersionInput(chartVersion)
+	if buildType != "release" {
+		if compatibilityBase, err = resolveCompatibilityBaseline(minorLine); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	lowest, highest, explanation, err := resolveSupportedK3SMinorRange(buildSupportMatrixURL(compatibilityBase))
+	if err != nil {
+		return 0, 0, err
+	}
+	log.Printf("[k3s-upgrade] Rancher %s: %s", chartVersion, explanation)
+	return lowest, highest, nil
+}
+
+// checkK3SUpgradePath returns why from -> to is not a supported upgrade:
+// downgrades and skipped minors.
+// k3sNodeUpgrader runs the steps of an in-place K3s server upgrade;
+// toolkit.Tools does it over SSM.
+type k3sNodeUpgrader interface {
+	K3SNodeName(node toolkit.K3SNode) (string, error)
+	DrainK3SNode(node toolkit.K3SNode, nodeName string) error
+	InstallK3SUpgrade(node toolkit.K3SNode, version string) error
+	WaitForNodeReady(node toolkit.K3SNode) error
+	K3SNodeStatus(node toolkit.K3SNode, nodeName string) (string, bool, error)
+	UncordonK3SNode(node toolkit.K3SNode, nodeName string) error
+	LogK3SDiagnostics(node toolkit.K3SNode)
+}
+
+// upgradeK3SNode upgrades one K3s server in place: it drains the node, re-runs
+// the verified installer for version, waits for the node to report Ready on
+// the new version and uncordons it. A node that fails stays cordoned.
+func upgradeK3SNode(upgrader k3sNodeUpgrader, node toolkit.K3SNode, version string) error {
+	nodeName, err := upgrader.K3SNodeName(node)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[k3s-upgrade] Draining %s (%s)...", nodeName, node)
+	if err := upgrader.DrainK3SNode(node, nodeName); err != nil {
+		return err
+	}
+
+	log.Printf("[k3s-upgrade] Installing K3s %s on %s...", version, nodeName)
+	if err := upgrader.InstallK3SUpgrade(node, version); err != nil {
+		return err
+	}
+	if err := upgrader.WaitForNodeReady(node); err != nil {
+		upgrader.LogK3SDiagnostics(node)
+		return fmt.Errorf("K3s on %s did not come back: %w", nodeName, err)
+	}
+	if err := waitForK3SNodeVersion(upgrader, node, nodeName, version, 10*time.Minute); err != nil {
+		return err
+	}
+
+	log.Printf("[k3s-upgrade] Uncordoning %s...", nodeName)
+	return upgrader.UncordonK3SNode(node, nodeName)
+}
+
+// waitForK3SNodeVersion waits for nodeName to be Ready on version and reports
+// the version and readiness it last saw.
+func waitForK3SNodeVersion(upgrader k3sNodeUpgrader, node toolkit.K3SNode, nodeName, version string, timeout time.Duration) error {
+	err := waitFor(context.Background(), waitOptions{
+		Description:     fmt.Sprintf("%s to be Ready on %s", nodeName, version),
+		Timeout:         timeout,
+		InitialInterval: 5 * time.Second,
+		LogPrefix:       "[k3s-upgrade]",
+	}, func(ctx context.Context) (bool, string, error) {
+		current, ready, err := upgrader.K3SNodeStatus(node, nodeName)
+		if err != nil {
+			return false, "", err
+		}
+		if current == version && ready {
+			return true, "", nil
+		}
+		return false, fmt.Sprintf("on %s, Ready %t", current, ready), nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("[k3s-upgrade] %s is Ready on %s", nodeName, version)
+	return nil
+}
+
+func checkK3SUpgradePath(fromVersion, toVersion string) []string {
+	var problems []string
+
+	from, fromErr := parseK3SVersion(fromVersion)
+	to, toErr := parseK3SVersion(toVersion)
+	if fromErr == nil && toErr == nil && to.LessThan(from) {
+		problems = append(problems, "downgrades are not supported")
+	}
+
+	fromMinor, fromErr := k3sMinor(fromVersion)
+	toMinor, toErr := k3sMinor(toVersion)
+	if fromErr == nil && toErr == nil && toMinor > fromMinor+1 {
+		problems = append(problems, fmt.Sprintf("skips Kubernetes minor versions (v1.%d -> v1.%d); upgrade one minor at a time", fromMinor, toMinor))
+	}
+	return problems
+}
+
+// checkK3SSupportRange returns a problem when version is outside the support
+// matrix range, or "" when it is inside.
+func checkK3SSupportRange(version string, lowestMinor, highestMinor int) string {
+	minor, err := k3sMinor(version)
+	if err != nil {
+		return err.Error()
+	}
+	if minor < lowestMinor || minor > highestMinor {
+		return fmt.Sprintf("v1.%d is outside the supported K3s range v1.%d-v1.%d", minor, lowestMinor, highestMinor)
+	}
+	return ""
+}
+
+func parseK3SVersion(version string) (*goversion.Version, error) {
+	return goversion.NewVersion(strings.TrimPrefix(strings.Replace(version, "+k3s", "-k3s", 1), "v"))
+}
+
+func k3sMinor(version string) (int, error) {
+	matches := k3sMinorPattern.FindStringSubmatch(version)
+	if matches == nil {
+		return 0, fmt.Errorf("could not parse K3s version %q", version)
+	}
+	return strconv.Atoi(matches[1])
+}
@@ -0,0 +1,117 @@
+package test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	toolkit "github.com/brudnak/hosted-tenant-rancher/tools"
+	"github.com/spf13/viper"
+)
+
+func TestCheckK3SUpgradePathFlagsDowngradesAndSkippedMinors(t *testing.T) {
+	if problems := checkK3SUpgradePath("v1.32.5+k3s1", "v1.33.1+k3s1"); len(problems) != 0 {
+		t.Fatalf("expected a one-minor upgrade to pass, got %v", problems)
+	}
+	if problems := checkK3SUpgradePath("v1.32.5+k3s1", "v1.32.5+k3s2"); len(problems) != 0 {
+		t.Fatalf("expected a k3s revision bump to pass, got %v", problems)
+	}
+
+	problems := checkK3SUpgradePath("v1.31.9+k3s1", "v1.33.1+k3s1")
+	if len(problems) != 1 || !strings.Contains(problems[0], "skips Kubernetes minor versions") {
+		t.Fatalf("expected a skipped minor to be flagged, got %v", problems)
+	}
+
+	problems = checkK3SUpgradePath("v1.32.5+k3s1", "v1.32.4+k3s1")
+	if len(problems) != 1 || !strings.Contains(problems[0], "downgrades") {
+		t.Fatalf("expected a downgrade to be flagged, got %v", problems)
+	}
+}
+
+func TestCheckK3SSupportRange(t *testing.T) {
+	if problem := checkK3SSupportRange("v1.33.1+k3s1", 31, 33); problem != "" {
+		t.Fatalf("expected v1.33 to be inside v1.31-v1.33, got %q", problem)
+	}
+	if problem := checkK3SSupportRange("v1.34.1+k3s1", 31, 33); !strings.Contains(problem, "outside the supported K3s range v1.31-v1.33") {
+		t.Fatalf("expected v1.34 to be outside the range, got %q", problem)
+	}
+}
+
+func TestGetRequestedK3SUpgradeVersionsValidatesEntries(t *testing.T) {
+	t.Cleanup(func() { viper.Set("upgrade.k3s_versions", nil) })
+
+	viper.Set("upgrade.k3s_versions", []string{"", "v1.33.1+k3s1"})
+	versions, err := getRequestedK3SUpgradeVersions(2)
+	if err != nil || versions[0] != "" || versions[1] != "v1.33.1+k3s1" {
+		t.Fatalf("unexpected result %v, %v", versions, err)
+	}
+
+	viper.Set("upgrade.k3s_versions", []string{"", ""})
+	if _, err := getRequestedK3SUpgradeVersions(2); err == nil {
+		t.Fatal("expected an error when no cluster is upgraded")
+	}
+
+	viper.Set("upgrade.k3s_versions", []string{"1.33"})
+	if _, err := getRequestedK3SUpgradeVersions(1); err == nil {
+		t.Fatal("expected an error for a malformed K3s version")
+	}
+}
+
+// fakeK3SNodeUpgrader records the upgrade steps and fails the one named in
+// failAt.
+type fakeK3SNodeUpgrader struct {
+	steps  []string
+	failAt string
+}
+
+func (f *fakeK3SNodeUpgrader) step(name string) error {
+	f.steps = append(f.steps, name)
+	if name == f.failAt {
+		return errors.New(name + " failed")
+	}
+	return nil
+}
+
+func (f *fakeK3SNodeUpgrader) K3SNodeName(toolkit.K3SNode) (string, error) {
+	return "ip-10-0-1-5", f.step("name")
+}
+func (f *fakeK3SNodeUpgrader) DrainK3SNode(toolkit.K3SNode, string) error { return f.step("drain") }
+func (f *fakeK3SNodeUpgrader) InstallK3SUpgrade(toolkit.K3SNode, string) error {
+	return f.step("install")
+}
+func (f *fakeK3SNodeUpgrader) WaitForNodeReady(toolkit.K3SNode) error { return f.step("ready") }
+func (f *fakeK3SNodeUpgrader) K3SNodeStatus(toolkit.K3SNode, string) (string, bool, error) {
+	if err := f.step("version"); err != nil {
+		return "", false, stopWaiting(err)
+	}
+	return "v1.33.1+k3s1", true, nil
+}
+func (f *fakeK3SNodeUpgrader) UncordonK3SNode(toolkit.K3SNode, string) error {
+	return f.step("uncordon")
+}
+func (f *fakeK3SNodeUpgrader) LogK3SDiagnostics(toolkit.K3SNode) {
+	f.steps = append(f.steps, "diagnostics")
+}
+
+func TestUpgradeK3SNodeRunsStepsInOrder(t *testing.T) {
+	cases := []struct {
+		failAt string
+		want   string
+	}{
+		{"", "name drain install ready version uncordon"},
+		{"drain", "name drain"},
+		{"install", "name drain install"},
+		{"ready", "name drain install ready diagnostics"},
+		{"version", "name drain install ready version"},
+	}
+	for _, tc := range cases {
+		upgrader := &fakeK3SNodeUpgrader{failAt: tc.failAt}
+		err := upgradeK3SNode(upgrader, toolkit.K3SNode{InstanceID: "i-1"}, "v1.33.1+k3s1")
+		if (err != nil) != (tc.failAt != "") {
+			t.Fatalf("fail at %q: unexpected error %v", tc.failAt, err)
+		}
+		if got := strings.Join(upgrader.steps, " "); got != tc.want {
+			t.Fatalf("fail at %q: expected steps %q, got %q", tc.failAt, tc.want, got)
+		}
+	}
+}
@@ -2,12 +2,19 @@ package test
 
 import (
 	"fmt"
+	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"slices"
+	"sort"
+	"strconv"
 	"strings"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/route53"
+	toolkit "github.com/brudnak/hosted-tenant-rancher/tools"
 	"github.com/spf13/viper"
 )
 
@@ -24,6 +31,12 @@ func validateHostedConfiguration(totalInstances int, helmCommands []string, plan
 	if err := validateResolvedHelmCommands(helmCommands); err != nil {
 		return err
 	}
+	if _, err := toolkit.ConfiguredRegistries(); err != nil {
+		return err
+	}
+	if err := validateReadinessConfiguration(); err != nil {
+		return err
+	}
 	return validatePinnedK3SArtifacts(plans)
 }
 
@@ -47,7 +60,10 @@ func validateResolvedHelmCommands(helmCommands []string) error {
 }
 
 func validateLocalToolingPreflight(helmCommands []string) error {
-	requiredCommands := []string{"kubectl", "helm", "terraform"}
+	requiredCommands := []string{"helm", "terraform"}
+	if toolkit.AirgapEnabled() && !viper.GetBool("airgap.skip_mirror") {
+		requiredCommands = append(requiredCommands, "skopeo")
+	}
 	for _, commandName := range requiredCommands {
 		if _, err := exec.LookPath(commandName); err != nil {
 			return fmt.Errorf("%s is required locally but was not found in PATH", commandName)
@@ -177,14 +193,26 @@ func validatePinnedK3SArtifacts(plans []*RancherResolvedPlan) error {
 			}
 		}
 
-		if plan.AirgapImageSHA256 != "" {
-			airgapURL := buildK3SAirgapImageURL(plan.RecommendedK3S)
-			dedupKey = airgapURL + "|" + strings.ToLower(plan.AirgapImageSHA256)
-			if !seen[dedupKey] {
-				seen[dedupKey] = true
-				if err := validateRemoteSHA256(airgapURL, plan.AirgapImageSHA256); err != nil {
-					return err
-				}
+		// The image bundle and the binary are checked against the release's
+		// checksum file rather than downloaded here; the nodes check the bytes.
+		for _, asset := range []struct{ name, expected string }{
+			{k3sAirgapImageAsset, plan.AirgapImageSHA256},
+			{k3sBinaryAsset, plan.BinarySHA256},
+		} {
+			if asset.expected == "" {
+				continue
+			}
+			dedupKey = plan.RecommendedK3S + "/" + asset.name + "|" + strings.ToLower(asset.expected)
+			if seen[dedupKey] {
+				continue
+			}
+			seen[dedupKey] = true
+			actual, err := resolveK3SReleaseSHA256(plan.RecommendedK3S, asset.name)
+			if err != nil {
+				return err
+			}
+			if !strings.EqualFold(actual, asset.expected) {
+				return fmt.Errorf("checksum mismatch for %s: expected %s, the release lists %s", buildK3SReleaseAssetURL(plan.RecommendedK3S, asset.name), asset.expected, actual)
 			}
 		}
 	}
@@ -234,3 +262,119 @@ func findMissingHelmRepos(helmRepoListOutput string, helmCommands []string) []st
 	slices.Sort(missing)
 	return missing
 }
+
+// validateAWSRegionPreflight checks that the configured subnets, security
+// group, AMI and Route53 zone are reachable from tf_vars.aws_region before
+// anything is applied.
+func validateAWSRegionPreflight() error {
+	sess, region, err := newCleanupCostSession()
+	if err != nil {
+		return err
+	}
+	ec2Client := ec2.New(sess)
+
+	if _, err := ec2Client.DescribeRegions(&ec2.DescribeRegionsInput{RegionNames: []*string{aws.String(region)}}); err != nil {
+		return fmt.Errorf("tf_vars.aws_region %s is not an enabled region for this account: %w", region, err)
+	}
+
+	vpcID := strings.TrimSpace(viper.GetString("tf_vars.aws_vpc"))
+	subnetKeys := []string{"aws_subnet_a", "aws_subnet_b", "aws_subnet_c", "aws_subnet_id"}
+	zones := map[string]bool{}
+	for _, key := range subnetKeys {
+		subnetID := strings.TrimSpace(viper.GetString("tf_vars." + key))
+		if subnetID == "" {
+			return fmt.Errorf("tf_vars.%s must be set", key)
+		}
+		output, err := ec2Client.DescribeSubnets(&ec2.DescribeSubnetsInput{SubnetIds: []*string{aws.String(subnetID)}})
+		if err != nil {
+			return fmt.Errorf("tf_vars.%s %s was not found in %s: %w", key, subnetID, region, err)
+		}
+		if len(output.Subnets) == 0 {
+			return fmt.Errorf("tf_vars.%s %s was not found in %s", key, subnetID, region)
+		}
+		subnet := output.Subnets[0]
+		if vpcID != "" && aws.StringValue(subnet.VpcId) != vpcID {
+			return fmt.Errorf("tf_vars.%s %s belongs to %s, not tf_vars.aws_vpc %s", key, subnetID, aws.StringValue(subnet.VpcId), vpcID)
+		}
+		if key != "aws_subnet_id" {
+			zones[aws.StringValue(subnet.AvailabilityZone)] = true
+		}
+	}
+	if len(zones) < 2 {
+		return fmt.Errorf("tf_vars.aws_subnet_a/b/c must span at least two availability zones in %s for the load balancer", region)
+	}
+
+	if securityGroupID := strings.TrimSpace(viper.GetString("tf_vars.aws_security_group_id")); securityGroupID != "" {
+		output, err := ec2Client.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{GroupIds: []*string{aws.String(securityGroupID)}})
+		if err != nil {
+			return fmt.Errorf("tf_vars.aws_security_group_id %s was not found in %s: %w", securityGroupID, region, err)
+		}
+		if len(output.SecurityGroups) == 0 {
+			return fmt.Errorf("tf_vars.aws_security_group_id %s was not found in %s", securityGroupID, region)
+		}
+	}
+
+	for _, ami := range configuredAMIs() {
+		images, err := ec2Client.DescribeImages(&ec2.DescribeImagesInput{ImageIds: []*string{aws.String(ami.ID)}})
+		if err != nil {
+			return fmt.Errorf("%s %s was not found in %s (AMI IDs are region specific): %w", ami.Setting, ami.ID, region, err)
+		}
+		if len(images.Images) == 0 {
+			return fmt.Errorf("%s %s was not found in %s (AMI IDs are region specific)", ami.Setting, ami.ID, region)
+		}
+	}
+
+	fqdn := strings.TrimSuffix(strings.TrimSpace(viper.GetString("tf_vars.aws_route53_fqdn")), ".")
+	zonesOutput, err := route53.New(sess).ListHostedZonesByName(&route53.ListHostedZonesByNameInput{DNSName: aws.String(fqdn)})
+	if err != nil {
+		return fmt.Errorf("failed to look up Route53 zone %s: %w", fqdn, err)
+	}
+	zoneFound := false
+	for _, zone := range zonesOutput.HostedZones {
+		if strings.TrimSuffix(aws.StringValue(zone.Name), ".") == fqdn {
+			zoneFound = true
+			break
+		}
+	}
+	if !zoneFound {
+		return fmt.Errorf("tf_vars.aws_route53_fqdn %s has no Route53 hosted zone in this account", fqdn)
+	}
+
+	if _, err := awsPricingLocation(region); err != nil {
+		log.Printf("[preflight] %v; cost forecasts and estimates will be unavailable", err)
+	}
+
+	return nil
+}
+
+type configuredAMI struct {
+	Setting string
+	ID      string
+}
+
+// configuredAMIs lists tf_vars.aws_ami and every aws_ami in
+// tf_vars.instance_overrides, in instance order.
+func configuredAMIs() []configuredAMI {
+	amis := []configuredAMI{{Setting: "tf_vars.aws_ami", ID: strings.TrimSpace(viper.GetString("tf_vars.aws_ami"))}}
+
+	overrides := viper.GetStringMap("tf_vars.instance_overrides")
+	keys := make([]string, 0, len(overrides))
+	for key := range overrides {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		left, leftErr := strconv.Atoi(keys[i])
+		right, rightErr := strconv.Atoi(keys[j])
+		if leftErr != nil || rightErr != nil {
+			return keys[i] < keys[j]
+		}
+		return left < right
+	})
+	for _, key := range keys {
+		setting := fmt.Sprintf("tf_vars.instance_overrides.%s.aws_ami", key)
+		if amiID := strings.TrimSpace(viper.GetString(setting)); amiID != "" {
+			amis = append(amis, configuredAMI{Setting: setting, ID: amiID})
+		}
+	}
+	return amis
+}
@@ -60,34 +60,56 @@ func updateAutoModeConfigFile(configPath string, versions []string) error {
 		return err
 	}
 
+	document, root, err := readConfigDocument(configPath)
+	if err != nil {
+		return err
+	}
+
+	rancherNode := ensureMappingValue(root, "rancher")
+	setStringSequenceValue(rancherNode, "versions", normalizedVersions)
+	deleteMappingKey(rancherNode, "version")
+	setIntValue(root, "total_rancher_instances", len(normalizedVersions))
+	deleteMappingKey(root, "total_has")
+
+	if err := writeConfigDocument(configPath, document); err != nil {
+		return err
+	}
+
+	viper.Set("rancher.versions", normalizedVersions)
+	viper.Set("total_rancher_instances", len(normalizedVersions))
+	viper.Set("rancher.version", "")
+
+	return nil
+}
+
+// readConfigDocument parses the config file as a YAML node tree, so edits
+// keep its comments and key order.
+func readConfigDocument(configPath string) (*yaml.Node, *yaml.Node, error) {
 	content, err := os.ReadFile(configPath)
 	if err != nil {
-		return fmt.Errorf("failed to read config file: %w", err)
+		return nil, nil, fmt.Errorf("failed to read config file: %w", err)
 	}
 
 	var document yaml.Node
 	if err := yaml.Unmarshal(content, &document); err != nil {
-		return fmt.Errorf("failed to parse config file: %w", err)
+		return nil, nil, fmt.Errorf("failed to parse config file: %w", err)
 	}
 	if len(document.Content) == 0 {
-		return fmt.Errorf("config file is empty")
+		return nil, nil, fmt.Errorf("config file is empty")
 	}
 
 	root := document.Content[0]
 	if root.Kind != yaml.MappingNode {
-		return fmt.Errorf("config root must be a YAML mapping")
+		return nil, nil, fmt.Errorf("config root must be a YAML mapping")
 	}
+	return &document, root, nil
+}
 
-	rancherNode := ensureMappingValue(root, "rancher")
-	setStringSequenceValue(rancherNode, "versions", normalizedVersions)
-	deleteMappingKey(rancherNode, "version")
-	setIntValue(root, "total_rancher_instances", len(normalizedVersions))
-	deleteMappingKey(root, "total_has")
-
+func writeConfigDocument(configPath string, document *yaml.Node) error {
 	var output bytes.Buffer
 	encoder := yaml.NewEncoder(&output)
 	encoder.SetIndent(2)
-	if err := encoder.Encode(&document); err != nil {
+	if err := encoder.Encode(document); err != nil {
 		return fmt.Errorf("failed to serialize config file: %w", err)
 	}
 	if err := encoder.Close(); err != nil {
@@ -97,11 +119,6 @@ func updateAutoModeConfigFile(configPath string, versions []string) error {
 	if err := os.WriteFile(configPath, output.Bytes(), 0o644); err != nil {
 		return fmt.Errorf("failed to write config file: %w", err)
 	}
-
-	viper.Set("rancher.versions", normalizedVersions)
-	viper.Set("total_rancher_instances", len(normalizedVersions))
-	viper.Set("rancher.version", "")
-
 	return nil
 }
 
@@ -188,3 +205,49 @@ func setIntValue(mapping *yaml.Node, key string, value int) {
 	valueNode.Style = 0
 	valueNode.Value = fmt.Sprintf("%d", value)
 }
+
+func setStringValue(mapping *yaml.Node, key, value string) {
+	valueNode := mappingValue(mapping, key)
+	if valueNode == nil {
+		mapping.Content = append(mapping.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key},
+			&yaml.Node{},
+		)
+		valueNode = mapping.Content[len(mapping.Content)-1]
+	}
+
+	// Keep the quoting the file already uses for this value.
+	if valueNode.Kind != yaml.ScalarNode {
+		valueNode.Style = 0
+	}
+	valueNode.Kind = yaml.ScalarNode
+	valueNode.Tag = "!!str"
+	valueNode.Value = value
+	valueNode.Content = nil
+}
+
+func setBoolValue(mapping *yaml.Node, key string, value bool) {
+	valueNode := mappingValue(mapping, key)
+	if valueNode == nil {
+		mapping.Content = append(mapping.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key},
+			&yaml.Node{},
+		)
+		valueNode = mapping.Content[len(mapping.Content)-1]
+	}
+
+	valueNode.Kind = yaml.ScalarNode
+	valueNode.Tag = "!!bool"
+	valueNode.Style = 0
+	valueNode.Value = fmt.Sprintf("%t", value)
+	valueNode.Content = nil
+}
+
+// setLiteralSequenceValue writes multi-line values such as Helm commands as
+// literal blocks, the way the example configs do.
+func setLiteralSequenceValue(mapping *yaml.Node, key string, values []string) {
+	setStringSequenceValue(mapping, key, values)
+	for _, item := range mappingValue(mapping, key).Content {
+		item.Style = yaml.LiteralStyle
+	}
+}
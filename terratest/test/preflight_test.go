@@ -0,0 +1,28 @@
+package test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestConfiguredAMIsIncludesInstanceOverrides(t *testing.T) {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	viper.Set("tf_vars.aws_ami", "ami-default")
+	viper.Set("tf_vars.instance_overrides", map[string]interface{}{
+		"10": map[string]interface{}{"aws_ami": "ami-ten"},
+		"2":  map[string]interface{}{"aws_ami": " ami-two "},
+		"3":  map[string]interface{}{"aws_ec2_instance_type": "m5.xlarge"},
+	})
+
+	expected := []configuredAMI{
+		{Setting: "tf_vars.aws_ami", ID: "ami-default"},
+		{Setting: "tf_vars.instance_overrides.2.aws_ami", ID: "ami-two"},
+		{Setting: "tf_vars.instance_overrides.10.aws_ami", ID: "ami-ten"},
+	}
+	if amis := configuredAMIs(); !reflect.DeepEqual(amis, expected) {
+		t.Fatalf("expected %v, got %v", expected, amis)
+	}
+}
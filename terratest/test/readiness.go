@@ -0,0 +1,377 @@
+package test
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Readiness checks that waitForRancherReady can run, in the order it runs
+// them.
+const (
+	readinessHealthz      = "healthz"
+	readinessPing         = "ping"
+	readinessDeployments  = "deployments"
+	readinessLocalCluster = "local_cluster"
+	readinessPods         = "pods"
+)
+
+// Phases that wait for Rancher. Each can override readiness.checks,
+// readiness.deployments and the timeout under readiness.phases.<phase>.
+const (
+	readinessPhaseInstall          = "install"
+	readinessPhaseUpgrade          = "upgrade"
+	readinessPhaseK3SUpgrade       = "k3s_upgrade"
+	readinessPhaseRestore          = "restore"
+	readinessPhaseDatastoreRestore = "datastore_restore"
+	readinessPhaseResume           = "resume"
+)
+
+var (
+	allReadinessChecks = []string{readinessHealthz, readinessPing, readinessDeployments, readinessLocalCluster, readinessPods}
+	readinessPhases    = []string{
+		readinessPhaseInstall, readinessPhaseUpgrade, readinessPhaseK3SUpgrade,
+		readinessPhaseRestore, readinessPhaseDatastoreRestore, readinessPhaseResume,
+	}
+	defaultReadinessDeployments = []string{
+		"cattle-system/rancher",
+		"cattle-system/rancher-webhook",
+		"cattle-fleet-system/fleet-controller",
+	}
+
+	managementClusterResource = schema.GroupVersionResource{
+		Group:    "management.cattle.io",
+		Version:  "v3",
+		Resource: "clusters",
+	}
+)
+
+// rancherReadyChecks is how many passes of the suite in a row Rancher needs
+// before it counts as ready, so a pod that is about to restart is not missed.
+const rancherReadyChecks = 2
+
+type readinessConfig struct {
+	Checks      []string
+	Deployments []string
+	Timeout     time.Duration
+}
+
+// configuredReadiness reads the readiness suite for phase. Phase settings
+// override the readiness.* defaults, which default to every check.
+func configuredReadiness(phase string, defaultTimeout time.Duration) (readinessConfig, error) {
+	config := readinessConfig{
+		Checks:      allReadinessChecks,
+		Deployments: defaultReadinessDeployments,
+		Timeout:     defaultTimeout,
+	}
+
+	phaseKey := "readiness.phases." + phase
+	for _, key := range []string{"readiness", phaseKey} {
+		if viper.IsSet(key + ".checks") {
+			config.Checks = normalizedStrings(viper.GetStringSlice(key + ".checks"))
+		}
+		if viper.IsSet(key + ".deployments") {
+			config.Deployments = normalizedStrings(viper.GetStringSlice(key + ".deployments"))
+		}
+	}
+	if timeout := strings.TrimSpace(viper.GetString(phaseKey + ".timeout")); timeout != "" {
+		parsed, err := time.ParseDuration(timeout)
+		if err != nil || parsed <= 0 {
+			return config, fmt.Errorf("%s.timeout must be a positive duration such as 15m, got %q", phaseKey, timeout)
+		}
+		config.Timeout = parsed
+	}
+
+	for _, check := range config.Checks {
+		if !slices.Contains(allReadinessChecks, check) {
+			return config, fmt.Errorf("unknown readiness check %q; use %s", check, strings.Join(allReadinessChecks, ", "))
+		}
+	}
+	for _, deployment := range config.Deployments {
+		if _, _, ok := strings.Cut(deployment, "/"); !ok {
+			return config, fmt.Errorf("readiness deployment %q must be namespace/name", deployment)
+		}
+	}
+	return config, nil
+}
+
+// validateReadinessConfiguration checks readiness settings for every phase
+// before anything is deployed.
+func validateReadinessConfiguration() error {
+	for phase := range viper.GetStringMap("readiness.phases") {
+		if !slices.Contains(readinessPhases, phase) {
+			return fmt.Errorf("unknown readiness phase %q; use %s", phase, strings.Join(readinessPhases, ", "))
+		}
+	}
+	for _, phase := range readinessPhases {
+		if _, err := configuredReadiness(phase, time.Minute); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func normalizedStrings(values []string) []string {
+	normalized := make([]string, 0, len(values))
+	for _, value := range values {
+		if value = strings.TrimSpace(value); value != "" {
+			normalized = append(normalized, value)
+		}
+	}
+	return normalized
+}
+
+// waitForRancherReady runs the readiness suite configured for phase against
+// the Rancher at rancherURL, using kubeconfigPath for the in-cluster checks,
+// until it passes rancherReadyChecks times in a row.
+func waitForRancherReady(phase, rancherURL, kubeconfigPath string, defaultTimeout time.Duration) error {
+	config, err := configuredReadiness(phase, defaultTimeout)
+	if err != nil {
+		return err
+	}
+	if len(config.Checks) == 0 {
+		log.Printf("[readiness] No readiness checks are configured for %s; not waiting for https://%s", phase, rancherURL)
+		return nil
+	}
+	probe, err := newReadinessProbe(rancherURL, kubeconfigPath, config)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[readiness] Waiting for https://%s to be ready after %s (%s)...", rancherURL, phase, strings.Join(config.Checks, ", "))
+	start := time.Now()
+	passes := 0
+	err = waitFor(context.Background(), waitOptions{
+		Description:     fmt.Sprintf("https://%s to be ready", rancherURL),
+		Timeout:         config.Timeout,
+		InitialInterval: 5 * time.Second,
+		MaxInterval:     15 * time.Second,
+		LogPrefix:       "[readiness]",
+	}, func(ctx context.Context) (bool, string, error) {
+		if status := probe.run(ctx); status != "" {
+			passes = 0
+			return false, status, nil
+		}
+		passes++
+		if passes < rancherReadyChecks {
+			return false, fmt.Sprintf("all checks passed (%d/%d in a row)", passes, rancherReadyChecks), nil
+		}
+		return true, "", nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("[readiness] https://%s is ready after %v", rancherURL, time.Since(start).Round(time.Second))
+	return nil
+}
+
+// readinessProbe holds the clients one readiness suite needs.
+type readinessProbe struct {
+	rancherURL string
+	config     readinessConfig
+	http       *http.Client
+	clientset  kubernetes.Interface
+	dynamic    dynamic.Interface
+}
+
+func newReadinessProbe(rancherURL, kubeconfigPath string, config readinessConfig) (*readinessProbe, error) {
+	probe := &readinessProbe{
+		rancherURL: rancherURL,
+		config:     config,
+		http: &http.Client{
+			Timeout: 15 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+		},
+	}
+
+	needsKubeconfig := slices.ContainsFunc(config.Checks, func(check string) bool {
+		return check == readinessDeployments || check == readinessLocalCluster || check == readinessPods
+	})
+	if !needsKubeconfig {
+		return probe, nil
+	}
+	restConfig, err := tenantRESTConfig(kubeconfigPath)
+	if err != nil {
+		return nil, err
+	}
+	if probe.clientset, err = kubernetes.NewForConfig(restConfig); err != nil {
+		return nil, fmt.Errorf("failed to create Kubernetes client: %w", err)
+	}
+	if probe.dynamic, err = dynamic.NewForConfig(restConfig); err != nil {
+		return nil, fmt.Errorf("failed to create dynamic client: %w", err)
+	}
+	return probe, nil
+}
+
+// run runs every configured check once and returns why the first failing one
+// failed, or "" when all passed.
+func (p *readinessProbe) run(ctx context.Context) string {
+	for _, check := range allReadinessChecks {
+		if !slices.Contains(p.config.Checks, check) {
+			continue
+		}
+		var status string
+		switch check {
+		case readinessHealthz:
+			status = p.expectBody(ctx, "/healthz", "ok")
+		case readinessPing:
+			status = p.expectBody(ctx, "/ping", "pong")
+		case readinessDeployments:
+			status = p.deploymentsRolledOut(ctx)
+		case readinessLocalCluster:
+			status = p.localClusterReady(ctx)
+		case readinessPods:
+			status = p.podsRunning(ctx)
+		}
+		if status != "" {
+			return check + ": " + status
+		}
+	}
+	return ""
+}
+
+// expectBody requires a 200 with the given body, which only Rancher itself
+// answers; a load balancer's 404 or 503 does not pass.
+func (p *readinessProbe) expectBody(ctx context.Context, path, want string) string {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("https://%s%s", p.rancherURL, path), nil)
+	if err != nil {
+		return err.Error()
+	}
+	resp, err := p.http.Do(req)
+	if err != nil {
+		return err.Error()
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return expectedBodyStatus(path, resp.StatusCode, string(body), want)
+}
+
+func expectedBodyStatus(path string, status int, body, want string) string {
+	if status != http.StatusOK {
+		return fmt.Sprintf("%s returned HTTP %d", path, status)
+	}
+	if strings.TrimSpace(body) != want {
+		return fmt.Sprintf("%s returned %q, want %q", path, strings.TrimSpace(body), want)
+	}
+	return ""
+}
+
+func (p *readinessProbe) deploymentsRolledOut(ctx context.Context) string {
+	for _, deployment := range p.config.Deployments {
+		namespace, name, _ := strings.Cut(deployment, "/")
+		object, err := p.clientset.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return fmt.Sprintf("deployment %s is not created yet", deployment)
+		}
+		if err != nil {
+			return fmt.Sprintf("deployment %s: %v", deployment, err)
+		}
+		if !deploymentRolledOut(object) {
+			return fmt.Sprintf("deployment %s: %d/%d updated, %d available", deployment, object.Status.UpdatedReplicas, deploymentReplicas(object), object.Status.AvailableReplicas)
+		}
+	}
+	return ""
+}
+
+// localClusterReady checks the Ready condition of the management cluster
+// "local", which Rancher sets once it manages its own cluster.
+func (p *readinessProbe) localClusterReady(ctx context.Context) string {
+	cluster, err := p.dynamic.Resource(managementClusterResource).Get(ctx, "local", metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return "cluster local is not created yet"
+	}
+	if err != nil {
+		return fmt.Sprintf("cluster local: %v", err)
+	}
+	return conditionReadyStatus(cluster.Object, "Ready")
+}
+
+// conditionReadyStatus returns "" when the named condition is True, and
+// otherwise what the condition says.
+func conditionReadyStatus(object map[string]interface{}, conditionType string) string {
+	conditions, _, _ := unstructured.NestedSlice(object, "status", "conditions")
+	for _, item := range conditions {
+		condition, ok := item.(map[string]interface{})
+		if !ok || condition["type"] != conditionType {
+			continue
+		}
+		if condition["status"] == "True" {
+			return ""
+		}
+		if message, _ := condition["message"].(string); message != "" {
+			return fmt.Sprintf("%s=%v: %s", conditionType, condition["status"], message)
+		}
+		return fmt.Sprintf("%s=%v", conditionType, condition["status"])
+	}
+	return fmt.Sprintf("no %s condition yet", conditionType)
+}
+
+func (p *readinessProbe) podsRunning(ctx context.Context) string {
+	pods, err := p.clientset.CoreV1().Pods("cattle-system").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Sprintf("cattle-system pods: %v", err)
+	}
+	return unreadyPodsStatus(pods.Items)
+}
+
+// unreadyPodsStatus lists the pods that are neither running with every
+// container ready nor finished. Completed helm and job pods pass.
+func unreadyPodsStatus(pods []corev1.Pod) string {
+	var unready []string
+	for _, pod := range pods {
+		if pod.DeletionTimestamp != nil {
+			unready = append(unready, pod.Name+" (terminating)")
+			continue
+		}
+		switch pod.Status.Phase {
+		case corev1.PodSucceeded:
+			continue
+		case corev1.PodRunning:
+			if reason := unreadyContainer(pod); reason != "" {
+				unready = append(unready, fmt.Sprintf("%s (%s)", pod.Name, reason))
+			}
+		default:
+			reason := string(pod.Status.Phase)
+			if waiting := unreadyContainer(pod); waiting != "" {
+				reason += ", " + waiting
+			}
+			unready = append(unready, fmt.Sprintf("%s (%s)", pod.Name, reason))
+		}
+	}
+	if len(unready) == 0 {
+		return ""
+	}
+	sort.Strings(unready)
+	return "cattle-system pods not ready: " + strings.Join(unready, ", ")
+}
+
+func unreadyContainer(pod corev1.Pod) string {
+	for _, container := range pod.Status.ContainerStatuses {
+		if container.Ready {
+			continue
+		}
+		if container.State.Waiting != nil && container.State.Waiting.Reason != "" {
+			return container.Name + " " + container.State.Waiting.Reason
+		}
+		return container.Name + " not ready"
+	}
+	return ""
+}
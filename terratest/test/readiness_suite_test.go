@@ -0,0 +1,95 @@
+package test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestConfiguredReadinessPhaseOverridesDefaults(t *testing.T) {
+	t.Cleanup(func() { viper.Set("readiness", nil) })
+	viper.Set("readiness.checks", []string{"healthz", "ping", "pods"})
+	viper.Set("readiness.phases.restore.checks", []string{"healthz", "local_cluster"})
+	viper.Set("readiness.phases.restore.timeout", "25m")
+
+	restore, err := configuredReadiness(readinessPhaseRestore, 15*time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Join(restore.Checks, ",") != "healthz,local_cluster" || restore.Timeout != 25*time.Minute {
+		t.Fatalf("unexpected restore readiness: %+v", restore)
+	}
+
+	install, err := configuredReadiness(readinessPhaseInstall, 10*time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Join(install.Checks, ",") != "healthz,ping,pods" || install.Timeout != 10*time.Minute {
+		t.Fatalf("unexpected install readiness: %+v", install)
+	}
+	if len(install.Deployments) != len(defaultReadinessDeployments) {
+		t.Fatalf("expected the default deployments, got %v", install.Deployments)
+	}
+}
+
+func TestValidateReadinessConfigurationRejectsUnknownNames(t *testing.T) {
+	t.Cleanup(func() { viper.Set("readiness", nil) })
+
+	viper.Set("readiness.phases.instal.checks", []string{"healthz"})
+	if err := validateReadinessConfiguration(); err == nil || !strings.Contains(err.Error(), "instal") {
+		t.Fatalf("expected an unknown phase error, got %v", err)
+	}
+
+	viper.Set("readiness", nil)
+	viper.Set("readiness.checks", []string{"healthz", "fleet"})
+	if err := validateReadinessConfiguration(); err == nil || !strings.Contains(err.Error(), "fleet") {
+		t.Fatalf("expected an unknown check error, got %v", err)
+	}
+
+	viper.Set("readiness", nil)
+	viper.Set("readiness.deployments", []string{"rancher"})
+	if err := validateReadinessConfiguration(); err == nil {
+		t.Fatalf("expected a namespace/name error")
+	}
+}
+
+func TestExpectedBodyStatusRejectsLoadBalancerAnswers(t *testing.T) {
+	if status := expectedBodyStatus("/ping", 404, "not found", "pong"); !strings.Contains(status, "HTTP 404") {
+		t.Fatalf("expected a 404 to fail, got %q", status)
+	}
+	if status := expectedBodyStatus("/healthz", 200, "<html>", "ok"); status == "" {
+		t.Fatalf("expected an unexpected body to fail")
+	}
+	if status := expectedBodyStatus("/ping", 200, "pong\n", "pong"); status != "" {
+		t.Fatalf("expected pong to pass, got %q", status)
+	}
+}
+
+func TestUnreadyPodsStatusSkipsCompletedPods(t *testing.T) {
+	running := corev1.Pod{Status: corev1.PodStatus{
+		Phase:             corev1.PodRunning,
+		ContainerStatuses: []corev1.ContainerStatus{{Name: "rancher", Ready: true}},
+	}}
+	running.Name = "rancher-1"
+	completed := corev1.Pod{Status: corev1.PodStatus{Phase: corev1.PodSucceeded}}
+	completed.Name = "helm-operation-1"
+	if status := unreadyPodsStatus([]corev1.Pod{running, completed}); status != "" {
+		t.Fatalf("expected ready pods to pass, got %q", status)
+	}
+
+	crashing := corev1.Pod{Status: corev1.PodStatus{
+		Phase: corev1.PodRunning,
+		ContainerStatuses: []corev1.ContainerStatus{{
+			Name:  "rancher-webhook",
+			State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}},
+		}},
+	}}
+	crashing.Name = "rancher-webhook-1"
+	status := unreadyPodsStatus([]corev1.Pod{running, crashing})
+	if !strings.Contains(status, "rancher-webhook-1 (rancher-webhook CrashLoopBackOff)") {
+		t.Fatalf("unexpected status %q", status)
+	}
+}
@@ -0,0 +1,61 @@
+package test
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestApplySystemDefaultRegistryPrefixesAgentImage(t *testing.T) {
+	command := buildAutoHelmCommands(1, "rancher-latest", "2.13.5", "admin", "", "", "rancher/rancher-agent:v2.13.5")[0]
+
+	updated := applySystemDefaultRegistry(command, "harbor.example.com")
+	if !strings.HasSuffix(updated, "--set agentTLSMode=system-store \\\n  --set systemDefaultRegistry=harbor.example.com") {
+		t.Fatalf("expected systemDefaultRegistry to be appended as a continued line, got:\n%s", updated)
+	}
+	if !strings.Contains(updated, "'extraEnv[0].value=harbor.example.com/rancher/rancher-agent:v2.13.5'") {
+		t.Fatalf("expected agent image to be prefixed, got:\n%s", updated)
+	}
+}
+
+func TestApplySystemDefaultRegistryKeepsExplicitSetting(t *testing.T) {
+	command := "helm install rancher rancher-latest/rancher --set systemDefaultRegistry=other.example.com"
+	if updated := applySystemDefaultRegistry(command, "harbor.example.com"); updated != command {
+		t.Fatalf("expected explicit systemDefaultRegistry to be kept, got %s", updated)
+	}
+	if updated := applySystemDefaultRegistry("helm install x", ""); updated != "helm install x" {
+		t.Fatalf("expected no change without a registry, got %s", updated)
+	}
+}
+
+func TestApplySystemDefaultRegistryKeepsPrivateRegistryImagesWithoutAirgap(t *testing.T) {
+	command := buildAutoHelmCommands(1, "rancher-prime", "2.13.5", "admin", "stgregistry.suse.com/rancher/rancher", "v2.13.5", "stgregistry.suse.com/rancher/rancher-agent:v2.13.5")[0]
+
+	updated := applySystemDefaultRegistry(command, "harbor.example.com")
+	for _, expected := range []string{
+		"--set rancherImage=stgregistry.suse.com/rancher/rancher ",
+		"'extraEnv[0].value=stgregistry.suse.com/rancher/rancher-agent:v2.13.5'",
+		"--set systemDefaultRegistry=harbor.example.com",
+	} {
+		if !strings.Contains(updated, expected) {
+			t.Fatalf("expected %q in helm command:\n%s", expected, updated)
+		}
+	}
+}
+
+func TestApplySystemDefaultRegistryOnlyPrefixesAgentImageEnv(t *testing.T) {
+	command := `helm install rancher rancher-latest/rancher \
+  --set 'extraEnv[0].name=CATTLE_FEATURES' \
+  --set 'extraEnv[0].value=true' \
+  --set 'extraEnv[1].name=CATTLE_AGENT_IMAGE' \
+  --set 'extraEnv[1].value=rancher/rancher-agent:v2.13.5'`
+
+	updated := applySystemDefaultRegistry(command, "harbor.example.com")
+	for _, expected := range []string{
+		"'extraEnv[0].value=true'",
+		"'extraEnv[1].value=harbor.example.com/rancher/rancher-agent:v2.13.5'",
+	} {
+		if !strings.Contains(updated, expected) {
+			t.Fatalf("expected %q in helm command:\n%s", expected, updated)
+		}
+	}
+}
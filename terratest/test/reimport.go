@@ -0,0 +1,237 @@
+package test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/spf13/viper"
+)
+
+// tenantMoveRecord is kept in run metadata when a tenant leaves its host.
+// ToHost is empty for a plain detach.
+type tenantMoveRecord struct {
+	Index    int       `json:"index"`
+	FromHost string    `json:"fromHost"`
+	ToHost   string    `json:"toHost,omitempty"`
+	MovedAt  time.Time `json:"movedAt"`
+}
+
+// reimportTarget is the host Rancher a tenant is moved to.
+type reimportTarget struct {
+	URL   string
+	Token string
+}
+
+// tenantHost returns the host tenantIndex is currently imported into:
+// defaultHost unless a recorded detach or re-import moved it.
+func tenantHost(metadata *runMetadata, tenantIndex int, defaultHost string) string {
+	host := defaultHost
+	if metadata == nil {
+		return host
+	}
+	for _, move := range metadata.TenantMoves {
+		if move.Index == tenantIndex {
+			host = move.ToHost
+		}
+	}
+	return host
+}
+
+// recordTenantMove is best effort, like the other run metadata records.
+func recordTenantMove(tenantIndex int, fromHost, toHost string) {
+	metadata, err := loadRunMetadata()
+	if err != nil || metadata == nil {
+		log.Printf("[reimport] Could not record the move of tenant %d: %v", tenantIndex, err)
+		return
+	}
+	metadata.TenantMoves = append(metadata.TenantMoves, tenantMoveRecord{
+		Index:    tenantIndex,
+		FromHost: fromHost,
+		ToHost:   toHost,
+		MovedAt:  time.Now().UTC(),
+	})
+	if err := saveRunMetadata(metadata); err != nil {
+		log.Printf("[reimport] Could not record the move of tenant %d: %v", tenantIndex, err)
+	}
+}
+
+// resolveReimportTarget reads reimport.target. The host is either url, or the
+// host of the environment recorded in bucket. It logs in with the token in
+// token_env, the password in password_env, or the configured admin password.
+func resolveReimportTarget() (*reimportTarget, error) {
+	target := &reimportTarget{URL: normalizeRancherHost(viper.GetString("reimport.target.url"))}
+	if target.URL == "" {
+		bucket := strings.TrimSpace(viper.GetString("reimport.target.bucket"))
+		if bucket == "" {
+			return nil, fmt.Errorf("reimport.target.url or reimport.target.bucket must be set")
+		}
+		host, err := recordedHostURL(bucket)
+		if err != nil {
+			return nil, err
+		}
+		target.URL = host
+	}
+
+	if tokenEnv := strings.TrimSpace(viper.GetString("reimport.target.token_env")); tokenEnv != "" {
+		target.Token = strings.TrimSpace(os.Getenv(tokenEnv))
+		if target.Token == "" {
+			return nil, fmt.Errorf("%s is empty; it must hold an API token for %s", tokenEnv, target.URL)
+		}
+		return target, nil
+	}
+
+	password := configuredAdminPassword()
+	if passwordEnv := strings.TrimSpace(viper.GetString("reimport.target.password_env")); passwordEnv != "" {
+		password = os.Getenv(passwordEnv)
+		if password == "" {
+			return nil, fmt.Errorf("%s is empty; it must hold the admin password for %s", passwordEnv, target.URL)
+		}
+	}
+	if err := waitForRancherAPIReady(target.URL, password, 10*time.Minute); err != nil {
+		return nil, err
+	}
+	token, err := tools.CreateToken(target.URL, password)
+	if err != nil {
+		return nil, fmt.Errorf("failed to log in to %s: %w", target.URL, err)
+	}
+	target.Token = token
+	return target, nil
+}
+
+// recordedHostURL reads the host Rancher of the environment recorded in
+// another bucket's run metadata.
+func recordedHostURL(bucket string) (string, error) {
+	svc, _, err := newRunMetadataS3Client()
+	if err != nil {
+		return "", err
+	}
+
+	output, err := svc.GetObject(&s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(runMetadataKey)})
+	if err != nil {
+		var aErr awserr.Error
+		if errors.As(err, &aErr) && aErr.Code() == s3.ErrCodeNoSuchKey {
+			return "", fmt.Errorf("bucket %s has no %s; is an environment running from it?", bucket, runMetadataKey)
+		}
+		return "", fmt.Errorf("failed to read %s from bucket %s: %w", runMetadataKey, bucket, err)
+	}
+	defer output.Body.Close()
+
+	content, err := io.ReadAll(output.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", runMetadataKey, err)
+	}
+	var metadata runMetadata
+	if err := json.Unmarshal(content, &metadata); err != nil {
+		return "", fmt.Errorf("failed to parse %s from bucket %s: %w", runMetadataKey, bucket, err)
+	}
+	if metadata.hibernated() {
+		return "", fmt.Errorf("the environment in bucket %s is %s", bucket, metadata.State)
+	}
+	host := metadata.cluster(1)
+	if host == nil || host.RancherURL == "" {
+		return "", fmt.Errorf("run metadata in bucket %s has no host Rancher", bucket)
+	}
+	return host.RancherURL, nil
+}
+
+// reimportTenant moves tenant N from its current host to target: detach and
+// agent cleanup on the old side, the usual import on the new side, then a
+// check that only the new host lists it.
+func reimportTenant(clusters []ClusterInfra, tenantIndex int, target *reimportTarget) error {
+	metadata, err := loadActiveRunMetadata(clusters)
+	if err != nil {
+		return err
+	}
+	currentHost := tenantHost(metadata, tenantIndex, clusters[0].RancherURL)
+	if currentHost == target.URL {
+		return fmt.Errorf("tenant %d is already imported into %s", tenantIndex, target.URL)
+	}
+
+	clusterName := fmt.Sprintf("imported-tenant-%d", tenantIndex)
+	targetClient := newRancherAPIClient(target.URL, target.Token)
+	status, err := targetClient.do(http.MethodGet, "/v1/provisioning.cattle.io.clusters/fleet-default/"+clusterName, nil)
+	if err != nil {
+		return fmt.Errorf("failed to check %s on %s: %w", clusterName, target.URL, err)
+	}
+	if status != http.StatusNotFound {
+		return fmt.Errorf("%s already has a cluster named %s; detach or delete it first", target.URL, clusterName)
+	}
+
+	if currentHost != "" {
+		token, err := currentHostToken(currentHost, clusters[0].RancherURL)
+		if err != nil {
+			return err
+		}
+		log.Printf("[reimport] Detaching tenant %d from %s...", tenantIndex, currentHost)
+		if err := detachTenantFromHost(currentHost, token, tenantIndex, 15*time.Minute); err != nil {
+			return err
+		}
+		recordTenantMove(tenantIndex, currentHost, "")
+	}
+	if err := cleanupTenantAgents(tenantIndex, clusters[tenantIndex]); err != nil {
+		return err
+	}
+
+	log.Printf("[reimport] Importing tenant %d into %s...", tenantIndex, target.URL)
+	manifestURL, err := tools.SetupImport(target.URL, target.Token, tenantIndex)
+	if err != nil {
+		return fmt.Errorf("failed to set up import of tenant %d into %s: %w", tenantIndex, target.URL, err)
+	}
+	if _, err := refreshInstanceKubeconfig(tenantIndex, clusters[tenantIndex]); err != nil {
+		return err
+	}
+	if err := importTenantManifest(rancherScriptDir(tenantIndex), manifestURL); err != nil {
+		return fmt.Errorf("failed to apply import manifest: %w", err)
+	}
+	if err := waitForClusterActive(target.URL, target.Token, tenantIndex, 10*time.Minute); err != nil {
+		return fmt.Errorf("tenant %d did not become Active in %s: %w", tenantIndex, target.URL, err)
+	}
+	recordTenantMove(tenantIndex, currentHost, target.URL)
+
+	if currentHost != "" {
+		token, err := currentHostToken(currentHost, clusters[0].RancherURL)
+		if err != nil {
+			return err
+		}
+		status, err := newRancherAPIClient(currentHost, token).do(http.MethodGet, "/v1/provisioning.cattle.io.clusters/fleet-default/"+clusterName, nil)
+		if err != nil {
+			return fmt.Errorf("failed to check %s on %s: %w", clusterName, currentHost, err)
+		}
+		if status != http.StatusNotFound {
+			return fmt.Errorf("%s still lists %s after the re-import", currentHost, clusterName)
+		}
+	}
+
+	log.Printf("[reimport] Tenant %d is Active in %s", tenantIndex, target.URL)
+	return nil
+}
+
+// currentHostToken logs in to the host the tenant is leaving. This
+// environment's host takes the configured admin password. Any other host needs
+// an API token in the variable named by reimport.source.token_env.
+func currentHostToken(currentHost, environmentHost string) (string, error) {
+	if currentHost == environmentHost {
+		return hostAdminToken(currentHost)
+	}
+	tokenEnv := strings.TrimSpace(viper.GetString("reimport.source.token_env"))
+	if tokenEnv == "" || os.Getenv(tokenEnv) == "" {
+		return "", fmt.Errorf("the tenant is imported into %s; set reimport.source.token_env to an API token for it", currentHost)
+	}
+	return strings.TrimSpace(os.Getenv(tokenEnv)), nil
+}
+
+func normalizeRancherHost(url string) string {
+	url = strings.TrimSpace(url)
+	url = strings.TrimPrefix(strings.TrimPrefix(url, "https://"), "http://")
+	return strings.TrimRight(url, "/")
+}
@@ -0,0 +1,30 @@
+package test
+
+import "testing"
+
+func TestTenantHostFollowsRecordedMoves(t *testing.T) {
+	metadata := &runMetadata{TenantMoves: []tenantMoveRecord{
+		{Index: 1, FromHost: "host-a.example.com"},
+		{Index: 1, FromHost: "host-a.example.com", ToHost: "host-b.example.com"},
+		{Index: 2, FromHost: "host-a.example.com"},
+	}}
+
+	if got := tenantHost(metadata, 1, "host-a.example.com"); got != "host-b.example.com" {
+		t.Fatalf("expected tenant 1 on host-b, got %q", got)
+	}
+	if got := tenantHost(metadata, 2, "host-a.example.com"); got != "" {
+		t.Fatalf("expected tenant 2 to be detached, got %q", got)
+	}
+	if got := tenantHost(metadata, 3, "host-a.example.com"); got != "host-a.example.com" {
+		t.Fatalf("expected tenant 3 on its own host, got %q", got)
+	}
+	if got := tenantHost(nil, 1, "host-a.example.com"); got != "host-a.example.com" {
+		t.Fatalf("expected the default host without metadata, got %q", got)
+	}
+}
+
+func TestNormalizeRancherHost(t *testing.T) {
+	if got := normalizeRancherHost(" https://rancher.example.com/ "); got != "rancher.example.com" {
+		t.Fatalf("unexpected host %q", got)
+	}
+}
@@ -0,0 +1,168 @@
+package test
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	tagEnvironment     = "Environment"
+	tagCreatedBy       = "CreatedBy"
+	tagCreatedAt       = "CreatedAt"
+	tagRancherVersions = "RancherVersions"
+	tagExpiresAt       = "ExpiresAt"
+
+	defaultTagExpiryHours = 24
+	maxTagValueLength     = 256
+)
+
+// AWS accepts letters, digits, spaces and _ . : / = + - @ in tag values.
+var invalidTagValueChars = regexp.MustCompile(`[^\p{L}\p{N}\s_.:/=+\-@]`)
+
+// buildResourceTags combines the generated ownership tags with the custom
+// tags map from tool-config.yml. Custom tags win on conflicts.
+func buildResourceTags(createdAt time.Time, rancherVersions []string) map[string]string {
+	createdAt = createdAt.UTC()
+	tags := map[string]string{
+		tagEnvironment: strings.TrimSpace(viper.GetString("tf_vars.aws_prefix")),
+		tagCreatedBy:   gitUserIdentity(),
+		tagCreatedAt:   createdAt.Format(time.RFC3339),
+	}
+	if len(rancherVersions) > 0 {
+		tags[tagRancherVersions] = strings.Join(rancherVersions, " ")
+	}
+
+	expiryHours := defaultTagExpiryHours
+	if viper.IsSet("tags_expiry_hours") {
+		expiryHours = viper.GetInt("tags_expiry_hours")
+	}
+	if expiryHours > 0 {
+		tags[tagExpiresAt] = createdAt.Add(time.Duration(expiryHours) * time.Hour).Format(time.RFC3339)
+	}
+
+	custom, err := configuredCustomTags()
+	if err != nil {
+		log.Printf("[tags] Could not read custom tags: %v", err)
+	}
+	for key, value := range custom {
+		tags[key] = value
+	}
+
+	for key, value := range tags {
+		if value == "" {
+			delete(tags, key)
+			continue
+		}
+		tags[key] = sanitizeTagValue(value)
+	}
+	return tags
+}
+
+// configuredCustomTags reads the tags map straight from the config file,
+// because viper lowercases map keys and AWS tag keys are case sensitive.
+func configuredCustomTags() (map[string]string, error) {
+	configPath := strings.TrimSpace(viper.ConfigFileUsed())
+	if configPath == "" {
+		return nil, nil
+	}
+
+	content, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var parsed struct {
+		Tags map[string]string `yaml:"tags"`
+	}
+	if err := yaml.Unmarshal(content, &parsed); err != nil {
+		return nil, fmt.Errorf("failed to parse tags in %s: %w", configPath, err)
+	}
+	return parsed.Tags, nil
+}
+
+// recordedResourceTags reuses the tags stored at creation time so later
+// applies do not rewrite CreatedAt or ExpiresAt.
+func recordedResourceTags() map[string]string {
+	metadata, err := loadRunMetadata()
+	if err != nil {
+		log.Printf("[tags] Could not load recorded tags: %v", err)
+	}
+	if metadata != nil && len(metadata.Tags) > 0 {
+		return metadata.Tags
+	}
+	return buildResourceTags(time.Now(), nil)
+}
+
+func requestedRancherVersionsForTags(plans []*RancherResolvedPlan, helmCommands []string) []string {
+	var versions []string
+	for i, plan := range plans {
+		version := ""
+		if plan != nil {
+			version = plan.RequestedVersion
+			if version == "" {
+				version = plan.ChartVersion
+			}
+		}
+		if version == "" && i < len(helmCommands) {
+			version = extractHelmChartVersion(helmCommands[i])
+		}
+		if version != "" {
+			versions = append(versions, version)
+		}
+	}
+	return versions
+}
+
+func extractHelmChartVersion(helmCommand string) string {
+	fields := strings.Fields(helmCommand)
+	for i, field := range fields {
+		if field == "--version" && i+1 < len(fields) {
+			return strings.Trim(fields[i+1], `"'\`)
+		}
+		if strings.HasPrefix(field, "--version=") {
+			return strings.Trim(strings.TrimPrefix(field, "--version="), `"'\`)
+		}
+	}
+	return ""
+}
+
+func gitUserIdentity() string {
+	for _, key := range []string{"user.email", "user.name"} {
+		output, err := exec.Command("git", "config", "--get", key).Output()
+		if err == nil && strings.TrimSpace(string(output)) != "" {
+			return strings.TrimSpace(string(output))
+		}
+	}
+	return strings.TrimSpace(os.Getenv("USER"))
+}
+
+func sanitizeTagValue(value string) string {
+	value = invalidTagValueChars.ReplaceAllString(strings.TrimSpace(value), "_")
+	if len(value) > maxTagValueLength {
+		value = value[:maxTagValueLength]
+	}
+	return value
+}
+
+func formatResourceTags(tags map[string]string) []string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	lines := make([]string, 0, len(keys))
+	for _, key := range keys {
+		lines = append(lines, fmt.Sprintf("%s=%s", key, tags[key]))
+	}
+	return lines
+}
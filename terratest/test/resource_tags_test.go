@@ -0,0 +1,25 @@
+package test
+
+import "testing"
+
+func TestRequestedRancherVersionsForTagsFallsBackToHelmCommand(t *testing.T) {
+	plans := []*RancherResolvedPlan{
+		{RequestedVersion: "2.14.1-alpha3"},
+		{},
+	}
+	helmCommands := []string{
+		"helm install rancher rancher-alpha/rancher --version 2.14.1-alpha3",
+		"helm install rancher rancher-latest/rancher \\\n  --version 2.13.5 \\\n  --set hostname=x",
+	}
+
+	versions := requestedRancherVersionsForTags(plans, helmCommands)
+	if len(versions) != 2 || versions[0] != "2.14.1-alpha3" || versions[1] != "2.13.5" {
+		t.Fatalf("unexpected versions: %#v", versions)
+	}
+}
+
+func TestSanitizeTagValueReplacesUnsupportedCharacters(t *testing.T) {
+	if got := sanitizeTagValue(" jane.doe@example.com, QA#123 "); got != "jane.doe@example.com_ QA_123" {
+		t.Fatalf("unexpected sanitized value: %q", got)
+	}
+}
@@ -0,0 +1,225 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/spf13/viper"
+)
+
+// runMetadataKey sits next to the tfstate in the dedicated bucket, so
+// clearS3Bucket removes it together with the environment.
+const runMetadataKey = "run-metadata.json"
+
+// hostAdminTokenKey holds the API token TestHosted creates for the host. It
+// is kept out of run-metadata.json, which TestStatus prints.
+const hostAdminTokenKey = "host-admin-token.json"
+
+type hostAdminTokenRecord struct {
+	HostURL string `json:"hostUrl"`
+	Token   string `json:"token"`
+}
+
+// Hibernate and resume save an in-between state before touching AWS, so a
+// run that fails partway can simply be repeated.
+const (
+	runStateRunning     = "running"
+	runStateHibernating = "hibernating"
+	runStateHibernated  = "hibernated"
+	runStateResuming    = "resuming"
+)
+
+type runMetadata struct {
+	State              string                    `json:"state"`
+	UpdatedAt          time.Time                 `json:"updatedAt"`
+	HibernatedAt       *time.Time                `json:"hibernatedAt,omitempty"`
+	ResumedAt          *time.Time                `json:"resumedAt,omitempty"`
+	Tags               map[string]string         `json:"tags,omitempty"`
+	Clusters           []runClusterMetadata      `json:"clusters"`
+	Upgrades           []rancherUpgradeRecord    `json:"upgrades,omitempty"`
+	K3SUpgrades        []k3sUpgradeRecord        `json:"k3sUpgrades,omitempty"`
+	Backups            []backupRecord            `json:"backups,omitempty"`
+	DatastoreSnapshots []datastoreSnapshotRecord `json:"datastoreSnapshots,omitempty"`
+	TenantMoves        []tenantMoveRecord        `json:"tenantMoves,omitempty"`
+	ReplacedDatastores []string                  `json:"replacedDatastores,omitempty"`
+}
+
+type runClusterMetadata struct {
+	Index        int      `json:"index"`
+	RancherURL   string   `json:"rancherUrl"`
+	InstanceIDs  []string `json:"instanceIds"`
+	NodeIPs      []string `json:"nodeIps"`
+	RDSClusterID string   `json:"rdsClusterId"`
+}
+
+// hibernated reports whether the environment is, or may partly be, stopped.
+func (m *runMetadata) hibernated() bool {
+	switch m.State {
+	case runStateHibernating, runStateHibernated, runStateResuming:
+		return true
+	}
+	return false
+}
+
+func (m *runMetadata) cluster(index int) *runClusterMetadata {
+	for i := range m.Clusters {
+		if m.Clusters[i].Index == index {
+			return &m.Clusters[i]
+		}
+	}
+	return nil
+}
+
+func newRunMetadataS3Client() (*s3.S3, string, error) {
+	if err := ensureConfigLoaded(); err != nil {
+		return nil, "", fmt.Errorf("error reading config: %w", err)
+	}
+
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String(viper.GetString("s3.region")),
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("error creating AWS session: %w", err)
+	}
+
+	return s3.New(sess), viper.GetString("s3.bucket"), nil
+}
+
+// loadRunMetadata returns nil without an error when the bucket has no metadata yet.
+func loadRunMetadata() (*runMetadata, error) {
+	svc, bucket, err := newRunMetadataS3Client()
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := svc.GetObject(&s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(runMetadataKey)})
+	if err != nil {
+		var aErr awserr.Error
+		if errors.As(err, &aErr) {
+			switch aErr.Code() {
+			case s3.ErrCodeNoSuchKey, "NotFound":
+				return nil, nil
+			}
+		}
+		return nil, fmt.Errorf("failed to read %s from bucket %s: %w", runMetadataKey, bucket, err)
+	}
+	defer output.Body.Close()
+
+	content, err := io.ReadAll(output.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", runMetadataKey, err)
+	}
+
+	var metadata runMetadata
+	if err := json.Unmarshal(content, &metadata); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", runMetadataKey, err)
+	}
+	return &metadata, nil
+}
+
+func saveRunMetadata(metadata *runMetadata) error {
+	svc, bucket, err := newRunMetadataS3Client()
+	if err != nil {
+		return err
+	}
+
+	metadata.UpdatedAt = time.Now().UTC()
+	content, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to serialize run metadata: %w", err)
+	}
+
+	_, err = svc.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(runMetadataKey),
+		Body:        bytes.NewReader(content),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write %s to bucket %s: %w", runMetadataKey, bucket, err)
+	}
+
+	log.Printf("[metadata] Saved run metadata (state: %s) to %s/%s", metadata.State, bucket, runMetadataKey)
+	return nil
+}
+
+// loadActiveRunMetadata refuses hibernated environments and falls back to the
+// clusters from terraform outputs when no metadata has been recorded yet.
+func loadActiveRunMetadata(clusters []ClusterInfra) (*runMetadata, error) {
+	metadata, err := loadRunMetadata()
+	if err != nil {
+		return nil, err
+	}
+	if metadata != nil && metadata.hibernated() {
+		return nil, fmt.Errorf("environment is %s; run TestResume first", metadata.State)
+	}
+	if metadata == nil {
+		metadata = &runMetadata{State: runStateRunning, Clusters: runClustersFromInfra(clusters)}
+	}
+	return metadata, nil
+}
+
+// saveHostAdminToken persists the host admin token, so later commands reuse
+// it instead of minting a new token on every login.
+func saveHostAdminToken(hostURL, token string) error {
+	svc, bucket, err := newRunMetadataS3Client()
+	if err != nil {
+		return err
+	}
+
+	content, err := json.Marshal(hostAdminTokenRecord{HostURL: hostURL, Token: token})
+	if err != nil {
+		return fmt.Errorf("failed to serialize host admin token: %w", err)
+	}
+	_, err = svc.PutObject(&s3.PutObjectInput{
+		Bucket:               aws.String(bucket),
+		Key:                  aws.String(hostAdminTokenKey),
+		Body:                 bytes.NewReader(content),
+		ContentType:          aws.String("application/json"),
+		ServerSideEncryption: aws.String(s3.ServerSideEncryptionAes256),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write %s to bucket %s: %w", hostAdminTokenKey, bucket, err)
+	}
+	return nil
+}
+
+// loadHostAdminToken returns the persisted token for hostURL, or "" when none
+// is stored for that host.
+func loadHostAdminToken(hostURL string) (string, error) {
+	svc, bucket, err := newRunMetadataS3Client()
+	if err != nil {
+		return "", err
+	}
+
+	output, err := svc.GetObject(&s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(hostAdminTokenKey)})
+	if err != nil {
+		var aErr awserr.Error
+		if errors.As(err, &aErr) {
+			switch aErr.Code() {
+			case s3.ErrCodeNoSuchKey, "NotFound":
+				return "", nil
+			}
+		}
+		return "", fmt.Errorf("failed to read %s from bucket %s: %w", hostAdminTokenKey, bucket, err)
+	}
+	defer output.Body.Close()
+
+	var record hostAdminTokenRecord
+	if err := json.NewDecoder(output.Body).Decode(&record); err != nil {
+		return "", fmt.Errorf("failed to parse %s: %w", hostAdminTokenKey, err)
+	}
+	if record.HostURL != hostURL {
+		return "", nil
+	}
+	return record.Token, nil
+}
@@ -0,0 +1,42 @@
+package test
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunMetadataHibernatedCoversPartialRuns(t *testing.T) {
+	cases := map[string]bool{
+		runStateRunning:     false,
+		"":                  false,
+		runStateHibernating: true,
+		runStateHibernated:  true,
+		runStateResuming:    true,
+	}
+	for state, want := range cases {
+		if got := (&runMetadata{State: state}).hibernated(); got != want {
+			t.Fatalf("state %q: expected hibernated() %v, got %v", state, want, got)
+		}
+	}
+}
+
+func TestBuildRunStatusReportListsFailedUpgrades(t *testing.T) {
+	startedAt := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	report := buildRunStatusReport(&runMetadata{
+		State: runStateRunning,
+		Upgrades: []rancherUpgradeRecord{
+			{Index: 1, FromChart: "2.12.4", ToChart: "2.13.4", FromAppVersion: "v2.12.4", ToAppVersion: "v2.13.4", StartedAt: startedAt},
+			{Index: 2, FromChart: "2.12.4", ToChart: "2.13.4", FromAppVersion: "v2.12.4", StartedAt: startedAt, Error: "instance 2: helm upgrade failed"},
+		},
+	})
+
+	for _, expected := range []string{
+		"  Instance 1: v2.12.4 -> v2.13.4 (chart 2.12.4 -> 2.13.4) at 2026-03-01T09:00:00Z",
+		"  Instance 2: v2.12.4 -> chart 2.13.4 FAILED at 2026-03-01T09:00:00Z: instance 2: helm upgrade failed",
+	} {
+		if !strings.Contains(report, expected) {
+			t.Fatalf("expected %q in status:\n%s", expected, report)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package test
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultReportDir = "run-report"
+	reportEventsFile = "events.jsonl"
+	reportJSONFile   = "run-report.json"
+	reportJUnitFile  = "junit.xml"
+
+	reportPhaseRunning = "running"
+)
+
+// runReport collects one run's phases from the event stream and is written
+// as JSON and JUnit XML when the run ends, whether it passed or not.
+type runReport struct {
+	Name            string        `json:"name"`
+	Status          string        `json:"status"`
+	StartedAt       time.Time     `json:"startedAt"`
+	FinishedAt      time.Time     `json:"finishedAt"`
+	DurationSeconds float64       `json:"durationSeconds"`
+	Phases          []reportPhase `json:"phases"`
+	Plans           []reportPlan  `json:"plans,omitempty"`
+	URLs            []reportURL   `json:"urls,omitempty"`
+	CostForecast    *reportCost   `json:"costForecast,omitempty"`
+
+	mu          sync.Mutex
+	dir         string
+	unsubscribe func()
+	stopCapture func()
+}
+
+type reportPhase struct {
+	Instance        int       `json:"instance,omitempty"`
+	Phase           string    `json:"phase"`
+	Status          string    `json:"status"`
+	StartedAt       time.Time `json:"startedAt"`
+	DurationSeconds float64   `json:"durationSeconds"`
+	Error           string    `json:"error,omitempty"`
+}
+
+type reportPlan struct {
+	Instance         int    `json:"instance"`
+	RequestedVersion string `json:"requestedVersion,omitempty"`
+	ChartRepo        string `json:"chartRepo,omitempty"`
+	ChartVersion     string `json:"chartVersion,omitempty"`
+	RancherImage     string `json:"rancherImage,omitempty"`
+	RancherImageTag  string `json:"rancherImageTag,omitempty"`
+	K3SVersion       string `json:"k3sVersion,omitempty"`
+	HelmCommand      string `json:"helmCommand,omitempty"`
+}
+
+type reportURL struct {
+	Instance int    `json:"instance"`
+	Role     string `json:"role"`
+	URL      string `json:"url"`
+}
+
+type reportCost struct {
+	Region             string  `json:"region"`
+	EstimatedHourlyUSD float64 `json:"estimatedHourlyUSD"`
+	EstimatedDailyUSD  float64 `json:"estimatedDailyUSD"`
+}
+
+func configuredReportDir() string {
+	if dir := strings.TrimSpace(viper.GetString("report.dir")); dir != "" {
+		return dir
+	}
+	return defaultReportDir
+}
+
+// startRunReport starts the event stream for a run: events go to
+// report.dir/events.jsonl, log lines become log events, and phases are
+// collected for the report. Call finish when the run ends.
+func startRunReport(name string) *runReport {
+	report := &runReport{Name: name, StartedAt: time.Now().UTC(), dir: configuredReportDir()}
+	if err := os.MkdirAll(report.dir, 0755); err != nil {
+		log.Printf("[report] Could not create %s: %v", report.dir, err)
+	} else {
+		eventsPath := filepath.Join(report.dir, reportEventsFile)
+		if err := os.Remove(eventsPath); err != nil && !os.IsNotExist(err) {
+			log.Printf("[report] Could not reset %s: %v", eventsPath, err)
+		}
+		if err := runEvents.openFile(eventsPath); err != nil {
+			log.Printf("[report] %v", err)
+		}
+	}
+	report.unsubscribe = runEvents.subscribe(report.record)
+	report.stopCapture = runEvents.captureLogs()
+	return report
+}
+
+func (r *runReport) record(event runEvent) {
+	if event.Phase == "" || event.Status == eventLog {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if event.Status == eventStarted {
+		r.Phases = append(r.Phases, reportPhase{
+			Instance:  event.Instance,
+			Phase:     event.Phase,
+			Status:    reportPhaseRunning,
+			StartedAt: event.Time,
+		})
+		return
+	}
+	for i := len(r.Phases) - 1; i >= 0; i-- {
+		phase := &r.Phases[i]
+		if phase.Instance == event.Instance && phase.Phase == event.Phase && phase.Status == reportPhaseRunning {
+			phase.Status = event.Status
+			phase.DurationSeconds = event.DurationSeconds
+			phase.Error = event.Error
+			return
+		}
+	}
+}
+
+func (r *runReport) setPlans(plans []*RancherResolvedPlan, helmCommands, k3sVersions []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Plans = reportPlans(plans, helmCommands, k3sVersions)
+}
+
+func (r *runReport) setURLs(urls []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.URLs = nil
+	for i, url := range urls {
+		role := "host"
+		if i > 0 {
+			role = fmt.Sprintf("tenant %d", i)
+		}
+		r.URLs = append(r.URLs, reportURL{Instance: i + 1, Role: role, URL: "https://" + url})
+	}
+}
+
+func (r *runReport) setCostForecast(forecast *costForecast) {
+	if forecast == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.CostForecast = &reportCost{
+		Region:             forecast.Region,
+		EstimatedHourlyUSD: forecast.EstimatedHourlyUSD,
+		EstimatedDailyUSD:  forecast.EstimatedDailyUSD,
+	}
+}
+
+// reportPlans lists what each instance was set up with. Passwords are
+// redacted from Helm commands as on the review page.
+func reportPlans(plans []*RancherResolvedPlan, helmCommands, k3sVersions []string) []reportPlan {
+	count := max(len(plans), len(helmCommands))
+	reported := make([]reportPlan, 0, count)
+	for i := range count {
+		plan := reportPlan{Instance: i + 1}
+		if i < len(plans) && plans[i] != nil {
+			plan.RequestedVersion = plans[i].RequestedVersion
+			plan.ChartRepo = plans[i].ChartRepoAlias
+			plan.ChartVersion = plans[i].ChartVersion
+			plan.RancherImage = plans[i].RancherImage
+			plan.RancherImageTag = plans[i].RancherImageTag
+		}
+		if i < len(k3sVersions) {
+			plan.K3SVersion = k3sVersions[i]
+		}
+		if i < len(helmCommands) {
+			plan.HelmCommand = sanitizeHelmCommand(helmCommands[i])
+		}
+		reported = append(reported, plan)
+	}
+	return reported
+}
+
+// finish stops collecting and writes the JSON and JUnit reports. failed is
+// the run's overall result; phases still running are reported as failed.
+func (r *runReport) finish(failed bool) {
+	r.stopCapture()
+	r.unsubscribe()
+	runEvents.closeFile()
+
+	r.mu.Lock()
+	r.FinishedAt = time.Now().UTC()
+	r.DurationSeconds = r.FinishedAt.Sub(r.StartedAt).Seconds()
+	r.Status = eventSucceeded
+	for i := range r.Phases {
+		phase := &r.Phases[i]
+		if phase.Status == reportPhaseRunning {
+			phase.Status = eventFailed
+			phase.DurationSeconds = r.FinishedAt.Sub(phase.StartedAt).Seconds()
+			phase.Error = "the run ended before this phase finished"
+		}
+		if phase.Status == eventFailed {
+			failed = true
+		}
+	}
+	if failed {
+		r.Status = eventFailed
+	}
+	r.mu.Unlock()
+
+	if err := r.write(); err != nil {
+		log.Printf("[report] %v", err)
+		return
+	}
+	log.Printf("[report] Run %s: report written to %s", r.Status, r.dir)
+}
+
+func (r *runReport) write() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	content, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to serialize run report: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(r.dir, reportJSONFile), append(content, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write run report: %w", err)
+	}
+
+	junit, err := xml.MarshalIndent(r.junit(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to serialize JUnit report: %w", err)
+	}
+	junit = append([]byte(xml.Header), append(junit, '\n')...)
+	if err := os.WriteFile(filepath.Join(r.dir, reportJUnitFile), junit, 0644); err != nil {
+		return fmt.Errorf("failed to write JUnit report: %w", err)
+	}
+	return nil
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	Cases     []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// junit turns every phase into a test case named after its instance, so CI
+// shows which phase of which instance failed and how long each took.
+func (r *runReport) junit() junitTestSuites {
+	suite := junitTestSuite{
+		Name:      "hosted-tenant-rancher/" + r.Name,
+		Time:      junitSeconds(r.DurationSeconds),
+		Timestamp: r.StartedAt.Format(time.RFC3339),
+	}
+	for _, phase := range r.Phases {
+		className := "run"
+		if phase.Instance > 0 {
+			className = fmt.Sprintf("instance-%d", phase.Instance)
+		}
+		testCase := junitTestCase{ClassName: className, Name: phase.Phase, Time: junitSeconds(phase.DurationSeconds)}
+		if phase.Status == eventFailed {
+			testCase.Failure = &junitFailure{Message: phase.Error, Text: phase.Error}
+			suite.Failures++
+		}
+		suite.Cases = append(suite.Cases, testCase)
+	}
+	suite.Tests = len(suite.Cases)
+	return junitTestSuites{Suites: []junitTestSuite{suite}}
+}
+
+func junitSeconds(seconds float64) string {
+	return fmt.Sprintf("%.3f", seconds)
+}
@@ -0,0 +1,119 @@
+package test
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunReportRecordsPhasesFromEvents(t *testing.T) {
+	report := &runReport{Name: "deploy", dir: t.TempDir(), stopCapture: func() {}}
+	report.unsubscribe = runEvents.subscribe(report.record)
+
+	_ = runPhase(2, "import", func() error { return nil })
+	_ = runPhase(1, "readiness", func() error { return errors.New("pods not ready") })
+	startPhase(3, "k3s_install")
+	report.finish(false)
+
+	content, err := os.ReadFile(filepath.Join(report.dir, reportJSONFile))
+	if err != nil {
+		t.Fatalf("run report not written: %v", err)
+	}
+	var written runReport
+	if err := json.Unmarshal(content, &written); err != nil {
+		t.Fatalf("run report is not JSON: %v", err)
+	}
+	if written.Status != eventFailed {
+		t.Fatalf("expected a failed run, got %q", written.Status)
+	}
+	if len(written.Phases) != 3 {
+		t.Fatalf("expected 3 phases, got %+v", written.Phases)
+	}
+	if written.Phases[0].Status != eventSucceeded || written.Phases[0].Instance != 2 {
+		t.Fatalf("unexpected first phase: %+v", written.Phases[0])
+	}
+	if written.Phases[1].Error != "pods not ready" {
+		t.Fatalf("expected the readiness error, got %+v", written.Phases[1])
+	}
+	if written.Phases[2].Status != eventFailed {
+		t.Fatalf("expected an unfinished phase to be failed, got %+v", written.Phases[2])
+	}
+
+	junit, err := os.ReadFile(filepath.Join(report.dir, reportJUnitFile))
+	if err != nil {
+		t.Fatalf("JUnit report not written: %v", err)
+	}
+	var suites junitTestSuites
+	if err := xml.Unmarshal(junit, &suites); err != nil {
+		t.Fatalf("JUnit report is not XML: %v", err)
+	}
+	suite := suites.Suites[0]
+	if suite.Tests != 3 || suite.Failures != 2 {
+		t.Fatalf("expected 3 tests and 2 failures, got %d and %d", suite.Tests, suite.Failures)
+	}
+	if suite.Cases[0].ClassName != "instance-2" || suite.Cases[0].Name != "import" {
+		t.Fatalf("unexpected test case: %+v", suite.Cases[0])
+	}
+}
+
+func TestRunReportIgnoresEventsAfterFinish(t *testing.T) {
+	report := &runReport{Name: "deploy", dir: t.TempDir(), stopCapture: func() {}}
+	report.unsubscribe = runEvents.subscribe(report.record)
+	report.finish(false)
+
+	_ = runPhase(1, "readiness", func() error { return nil })
+	if len(report.Phases) != 0 || report.Status != eventSucceeded {
+		t.Fatalf("expected an empty successful report, got %+v", report.Phases)
+	}
+}
+
+func TestReportPlansRedactsHelmPasswords(t *testing.T) {
+	plans := reportPlans(
+		[]*RancherResolvedPlan{{RequestedVersion: "2.12.1", ChartRepoAlias: "rancher-prime"}},
+		[]string{"helm install rancher --set bootstrapPassword=secret", "helm install rancher"},
+		[]string{"v1.33.1+k3s1"},
+	)
+	if len(plans) != 2 {
+		t.Fatalf("expected a plan per instance, got %+v", plans)
+	}
+	if strings.Contains(plans[0].HelmCommand, "secret") {
+		t.Fatalf("expected the bootstrap password to be redacted: %s", plans[0].HelmCommand)
+	}
+	if plans[0].ChartRepo != "rancher-prime" || plans[0].K3SVersion != "v1.33.1+k3s1" {
+		t.Fatalf("unexpected plan: %+v", plans[0])
+	}
+	if plans[1].Instance != 2 || plans[1].K3SVersion != "" {
+		t.Fatalf("unexpected second plan: %+v", plans[1])
+	}
+}
+
+func TestRunEventString(t *testing.T) {
+	cases := []struct {
+		event runEvent
+		want  string
+	}{
+		{runEvent{Status: eventLog, Message: "plain line"}, "plain line"},
+		{runEvent{Instance: 2, Phase: "import", Status: eventStarted}, "[event] import (instance 2) started"},
+		{runEvent{Phase: "preflight", Status: eventSucceeded, DurationSeconds: 61.4}, "[event] preflight succeeded in 1m1s"},
+		{runEvent{Instance: 1, Phase: "readiness", Status: eventFailed, DurationSeconds: 5, Error: "boom"}, "[event] readiness (instance 1) failed after 5s: boom"},
+	}
+	for _, tc := range cases {
+		if got := tc.event.String(); got != tc.want {
+			t.Fatalf("expected %q, got %q", tc.want, got)
+		}
+	}
+}
+
+func TestLineWriterSplitsLines(t *testing.T) {
+	var lines []string
+	writer := &lineWriter{onLine: func(line string) { lines = append(lines, line) }}
+	_, _ = writer.Write([]byte("first\nsec"))
+	_, _ = writer.Write([]byte("ond\n\n"))
+	if strings.Join(lines, "|") != "first|second" {
+		t.Fatalf("unexpected lines: %q", lines)
+	}
+}
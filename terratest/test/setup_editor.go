@@ -0,0 +1,320 @@
+package test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	toolkit "github.com/brudnak/hosted-tenant-rancher/tools"
+	"github.com/brudnak/hosted-tenant-rancher/tools/hcl"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// setupEditorConfig is what the interactive setup page edits. Auto mode uses
+// Versions, Distro and BootstrapPassword; manual mode uses HelmCommands and
+// K3SVersions. Either way there is one entry per instance, host first.
+type setupEditorConfig struct {
+	Mode              string             `json:"mode"`
+	Versions          []string           `json:"versions"`
+	Distro            string             `json:"distro"`
+	BootstrapPassword string             `json:"bootstrapPassword"`
+	PreloadImages     bool               `json:"preloadImages"`
+	HelmCommands      []string           `json:"helmCommands"`
+	K3SVersions       []string           `json:"k3sVersions"`
+	TFVars            []setupEditorTFVar `json:"tfVars"`
+}
+
+// setupEditorTFVar is one scalar tf_vars entry, in config file order.
+// Nested values such as instance_overrides are not edited on the page.
+type setupEditorTFVar struct {
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Secret bool   `json:"secret,omitempty"`
+}
+
+var setupEditorDistros = []string{"auto", "community", "prime"}
+
+// currentSetupEditorConfig reads the editor's starting values from the loaded
+// config, and the tf_vars from the file itself to keep their order.
+func currentSetupEditorConfig(configPath string) (setupEditorConfig, error) {
+	mode := strings.ToLower(strings.TrimSpace(viper.GetString("rancher.mode")))
+	if mode == "" {
+		mode = "manual"
+	}
+	distro := strings.ToLower(strings.TrimSpace(viper.GetString("rancher.distro")))
+	if distro == "" {
+		distro = "auto"
+	}
+
+	helmCommands := viper.GetStringSlice("rancher.helm_commands")
+	k3sVersions := viper.GetStringSlice("k3s.versions")
+	if len(k3sVersions) == 0 {
+		if version := strings.TrimSpace(viper.GetString("k3s.version")); version != "" {
+			k3sVersions = []string{version}
+		}
+	}
+	rows := min(max(len(helmCommands), len(k3sVersions), 2), 4)
+
+	config := setupEditorConfig{
+		Mode:              mode,
+		Versions:          currentPreflightVersions(),
+		Distro:            distro,
+		BootstrapPassword: viper.GetString("rancher.bootstrap_password"),
+		PreloadImages:     viper.GetBool("k3s.preload_images"),
+		HelmCommands:      padStrings(helmCommands, rows),
+		K3SVersions:       padStrings(k3sVersions, rows),
+	}
+
+	_, root, err := readConfigDocument(configPath)
+	if err != nil {
+		return setupEditorConfig{}, err
+	}
+	config.TFVars = scalarTFVars(mappingValue(root, "tf_vars"))
+	return config, nil
+}
+
+func padStrings(values []string, length int) []string {
+	padded := make([]string, length)
+	copy(padded, values)
+	return padded
+}
+
+func scalarTFVars(tfVarsNode *yaml.Node) []setupEditorTFVar {
+	if tfVarsNode == nil || tfVarsNode.Kind != yaml.MappingNode {
+		return nil
+	}
+	var tfVars []setupEditorTFVar
+	for i := 0; i+1 < len(tfVarsNode.Content); i += 2 {
+		key, value := tfVarsNode.Content[i].Value, tfVarsNode.Content[i+1]
+		if value.Kind != yaml.ScalarNode || slices.Contains(legacyTFVarsKeys, key) {
+			continue
+		}
+		tfVars = append(tfVars, setupEditorTFVar{Key: key, Value: value.Value, Secret: secretTFVar(key)})
+	}
+	return tfVars
+}
+
+func secretTFVar(key string) bool {
+	key = strings.ToLower(key)
+	return strings.Contains(key, "password") || strings.Contains(key, "secret")
+}
+
+// normalizeSetupEditorConfig trims the page's input and runs the checks that
+// need nothing but the input itself.
+func normalizeSetupEditorConfig(config setupEditorConfig) (setupEditorConfig, error) {
+	config.Mode = strings.ToLower(strings.TrimSpace(config.Mode))
+	switch config.Mode {
+	case "auto":
+		versions, err := normalizePreflightVersions(config.Versions)
+		if err != nil {
+			return setupEditorConfig{}, err
+		}
+		config.Versions = versions
+
+		config.Distro = strings.ToLower(strings.TrimSpace(config.Distro))
+		if config.Distro == "" {
+			config.Distro = "auto"
+		}
+		if !slices.Contains(setupEditorDistros, config.Distro) {
+			return setupEditorConfig{}, fmt.Errorf("distro must be one of %s", strings.Join(setupEditorDistros, ", "))
+		}
+		for i, version := range versions {
+			buildType, _, err := classifyRancherVersion(version)
+			if err != nil {
+				return setupEditorConfig{}, fmt.Errorf("instance %d: %w", i+1, err)
+			}
+			if config.Distro == "prime" && buildType != "release" {
+				return setupEditorConfig{}, fmt.Errorf("instance %d: prime distro requires a released Rancher version like 2.13.4", i+1)
+			}
+		}
+
+		config.BootstrapPassword = strings.TrimSpace(config.BootstrapPassword)
+		if config.BootstrapPassword == "" {
+			return setupEditorConfig{}, fmt.Errorf("bootstrap password cannot be empty in auto mode")
+		}
+	case "manual":
+		count := len(config.HelmCommands)
+		if count < 2 {
+			return setupEditorConfig{}, fmt.Errorf("at least 2 instances are required (1 host + 1 tenant)")
+		}
+		if count > 4 {
+			return setupEditorConfig{}, fmt.Errorf("no more than 4 instances are supported")
+		}
+		if len(config.K3SVersions) != count {
+			return setupEditorConfig{}, fmt.Errorf("%d Helm commands but %d K3s versions; each instance needs both", count, len(config.K3SVersions))
+		}
+
+		helmCommands := make([]string, 0, count)
+		k3sVersions := make([]string, 0, count)
+		for i := range count {
+			helmCommand := strings.TrimSpace(config.HelmCommands[i])
+			if helmCommand == "" {
+				return setupEditorConfig{}, fmt.Errorf("helm command for instance %d cannot be empty", i+1)
+			}
+			k3sVersion := strings.TrimSpace(config.K3SVersions[i])
+			if k3sVersion == "" {
+				return setupEditorConfig{}, fmt.Errorf("k3s version for instance %d cannot be empty", i+1)
+			}
+			helmCommands = append(helmCommands, helmCommand+"\n")
+			k3sVersions = append(k3sVersions, k3sVersion)
+		}
+		if err := validateResolvedHelmCommands(helmCommands); err != nil {
+			return setupEditorConfig{}, err
+		}
+		config.HelmCommands = helmCommands
+		config.K3SVersions = k3sVersions
+	default:
+		return setupEditorConfig{}, fmt.Errorf("mode must be auto or manual")
+	}
+
+	for i := range config.TFVars {
+		config.TFVars[i].Key = strings.TrimSpace(config.TFVars[i].Key)
+		config.TFVars[i].Value = strings.TrimSpace(config.TFVars[i].Value)
+	}
+	return config, nil
+}
+
+func (c setupEditorConfig) instanceCount() int {
+	if c.Mode == "auto" {
+		return len(c.Versions)
+	}
+	return len(c.HelmCommands)
+}
+
+// validateManualK3SChecksums checks that every manual K3s version has the
+// pinned checksums the install needs, as prepareManualK3SPlans will.
+func validateManualK3SChecksums(config setupEditorConfig) error {
+	if config.Mode != "manual" {
+		return nil
+	}
+	for _, version := range config.K3SVersions {
+		if _, err := k3sChecksumForVersion("k3s.install_script_sha256s", "k3s.install_script_sha256", version); err != nil {
+			return err
+		}
+		if config.PreloadImages {
+			if _, err := k3sChecksumForVersion("k3s.airgap_image_sha256s", "k3s.airgap_image_sha256", version); err != nil {
+				return err
+			}
+		}
+		if toolkit.AirgapEnabled() {
+			if _, err := k3sChecksumForVersion("k3s.binary_sha256s", "k3s.binary_sha256", version); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validateEditorTFVars type-checks the edited tf_vars against the Terraform
+// module by writing them to a scratch terraform.tfvars.
+func validateEditorTFVars(config setupEditorConfig, moduleDir string) error {
+	values := tfVarsFromConfig()
+	for _, tfVar := range config.TFVars {
+		values[tfVar.Key] = tfVar.Value
+	}
+	if region, _ := values["aws_region"].(string); region == "" {
+		values["aws_region"] = toolkit.DefaultAWSRegion
+	}
+	values["total_rancher_instances"] = config.instanceCount()
+	values["default_tags"] = map[string]string{}
+
+	scratchDir, err := os.MkdirTemp("", "setup-editor-tfvars")
+	if err != nil {
+		return fmt.Errorf("failed to create scratch directory: %w", err)
+	}
+	defer os.RemoveAll(scratchDir)
+
+	return hcl.WriteTFVars(values, hcl.TFVarsOptions{ModuleDir: moduleDir, OutputPath: filepath.Join(scratchDir, "terraform.tfvars")})
+}
+
+// updateSetupEditorConfigFile validates the page's config and writes it back
+// to the config file, keeping its comments, then applies it to the loaded
+// config.
+func updateSetupEditorConfigFile(configPath string, config setupEditorConfig) error {
+	config, err := normalizeSetupEditorConfig(config)
+	if err != nil {
+		return err
+	}
+
+	document, root, err := readConfigDocument(configPath)
+	if err != nil {
+		return err
+	}
+	tfVarsNode := mappingValue(root, "tf_vars")
+	editable := scalarTFVars(tfVarsNode)
+	for _, tfVar := range config.TFVars {
+		if !slices.ContainsFunc(editable, func(existing setupEditorTFVar) bool { return existing.Key == tfVar.Key }) {
+			return fmt.Errorf("tf_vars.%s cannot be edited here; change it in %s", tfVar.Key, filepath.Base(configPath))
+		}
+	}
+
+	if err := validateManualK3SChecksums(config); err != nil {
+		return err
+	}
+	if err := validateEditorTFVars(config, terraformModuleDir); err != nil {
+		return err
+	}
+
+	applySetupEditorConfig(root, tfVarsNode, config)
+	if err := writeConfigDocument(configPath, document); err != nil {
+		return err
+	}
+
+	viper.Set("rancher.mode", config.Mode)
+	if config.Mode == "auto" {
+		viper.Set("rancher.versions", config.Versions)
+		viper.Set("rancher.version", "")
+		viper.Set("rancher.distro", config.Distro)
+		viper.Set("rancher.bootstrap_password", config.BootstrapPassword)
+	} else {
+		viper.Set("rancher.helm_commands", config.HelmCommands)
+		viper.Set("k3s.versions", config.K3SVersions)
+		viper.Set("k3s.version", "")
+	}
+	viper.Set("k3s.preload_images", config.PreloadImages)
+	viper.Set("total_rancher_instances", config.instanceCount())
+	for _, tfVar := range config.TFVars {
+		viper.Set("tf_vars."+tfVar.Key, tfVar.Value)
+	}
+	return nil
+}
+
+func applySetupEditorConfig(root, tfVarsNode *yaml.Node, config setupEditorConfig) {
+	rancherNode := ensureMappingValue(root, "rancher")
+	k3sNode := ensureMappingValue(root, "k3s")
+
+	setStringValue(rancherNode, "mode", config.Mode)
+	if config.Mode == "auto" {
+		setStringSequenceValue(rancherNode, "versions", config.Versions)
+		deleteMappingKey(rancherNode, "version")
+		setStringValue(rancherNode, "distro", config.Distro)
+		setStringValue(rancherNode, "bootstrap_password", config.BootstrapPassword)
+	} else {
+		setLiteralSequenceValue(rancherNode, "helm_commands", config.HelmCommands)
+		setStringSequenceValue(k3sNode, "versions", config.K3SVersions)
+		deleteMappingKey(k3sNode, "version")
+	}
+	setBoolValue(k3sNode, "preload_images", config.PreloadImages)
+	setIntValue(root, "total_rancher_instances", config.instanceCount())
+	deleteMappingKey(root, "total_has")
+
+	for _, tfVar := range config.TFVars {
+		valueNode := mappingValue(tfVarsNode, tfVar.Key)
+		if valueNode.Value == tfVar.Value {
+			continue
+		}
+		if valueNode.Tag != "!!str" {
+			// Drop the old type so the new value reads back as what it looks
+			// like, e.g. a number or a plain string.
+			valueNode.Tag = ""
+			valueNode.Style = 0
+		}
+		if tfVar.Value == "" {
+			valueNode.Tag = "!!str"
+		}
+		valueNode.Value = tfVar.Value
+	}
+}
@@ -0,0 +1,205 @@
+package test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+const setupEditorTestConfig = `rancher:
+  # keep this mode comment
+  mode: auto
+  versions:
+    - "2.13.4"
+    - "2.12.4"
+  bootstrap_password: "admin"
+
+k3s:
+  preload_images: true
+
+total_rancher_instances: 2
+
+tf_vars:
+  aws_prefix: "xyz"
+  aws_vpc: "vpc-1"
+  aws_subnet_a: "subnet-a"
+  aws_subnet_b: "subnet-b"
+  aws_subnet_c: "subnet-c"
+  aws_ami: "ami-1"
+  aws_subnet_id: "subnet-a"
+  aws_security_group_id: "sg-1"
+  aws_rds_password: "password123"
+  aws_route53_fqdn: "example.com"
+  aws_ec2_instance_type: "m5.large"
+  # Optional per-instance overrides
+  instance_overrides:
+    "2":
+      aws_ec2_instance_type: "m5.xlarge"
+`
+
+const setupEditorHelmCommand = `helm install rancher rancher-latest/rancher \
+  --namespace cattle-system \
+  --set hostname=placeholder \
+  --set bootstrapPassword=admin \
+  --set agentTLSMode=system-store \
+  --version 2.11.3`
+
+func writeSetupEditorTestConfig(t *testing.T, content string) string {
+	t.Helper()
+	configPath := filepath.Join(t.TempDir(), "tool-config.yml")
+	if err := os.WriteFile(configPath, []byte(content), 0o644); err != nil {
+		t.Fatalf("failed to write temp config: %v", err)
+	}
+	t.Cleanup(func() {
+		for _, key := range []string{
+			"rancher.mode", "rancher.versions", "rancher.version", "rancher.distro", "rancher.bootstrap_password",
+			"rancher.helm_commands", "k3s.versions", "k3s.version", "k3s.preload_images",
+			"k3s.install_script_sha256s", "total_rancher_instances", "tf_vars",
+		} {
+			viper.Set(key, nil)
+		}
+	})
+	return configPath
+}
+
+func setupEditorTFVars(t *testing.T, configPath string) []setupEditorTFVar {
+	t.Helper()
+	_, root, err := readConfigDocument(configPath)
+	if err != nil {
+		t.Fatalf("failed to read config: %v", err)
+	}
+	return scalarTFVars(mappingValue(root, "tf_vars"))
+}
+
+func TestScalarTFVarsSkipsNestedValuesAndMarksSecrets(t *testing.T) {
+	configPath := writeSetupEditorTestConfig(t, setupEditorTestConfig)
+	tfVars := setupEditorTFVars(t, configPath)
+
+	if len(tfVars) != 11 || tfVars[0].Key != "aws_prefix" || tfVars[10].Key != "aws_ec2_instance_type" {
+		t.Fatalf("expected the 11 scalar tf_vars in file order, got %+v", tfVars)
+	}
+	for _, tfVar := range tfVars {
+		if tfVar.Secret != (tfVar.Key == "aws_rds_password") {
+			t.Fatalf("unexpected secret flag on %+v", tfVar)
+		}
+	}
+}
+
+func TestUpdateSetupEditorConfigFileSwitchesToManualAndKeepsComments(t *testing.T) {
+	configPath := writeSetupEditorTestConfig(t, setupEditorTestConfig)
+	viper.Set("k3s.install_script_sha256s", map[string]string{"v1.32.5+k3s1": "abc", "v1.32.4+k3s1": "def"})
+
+	tfVars := setupEditorTFVars(t, configPath)
+	tfVars[10].Value = "m5.2xlarge"
+	err := updateSetupEditorConfigFile(configPath, setupEditorConfig{
+		Mode:         "manual",
+		HelmCommands: []string{setupEditorHelmCommand, "  " + setupEditorHelmCommand + "\n\n"},
+		K3SVersions:  []string{"v1.32.5+k3s1", " v1.32.4+k3s1 "},
+		TFVars:       tfVars,
+	})
+	if err != nil {
+		t.Fatalf("updateSetupEditorConfigFile returned error: %v", err)
+	}
+
+	content, err := os.ReadFile(configPath)
+	if err != nil {
+		t.Fatalf("failed to read updated config: %v", err)
+	}
+	written := string(content)
+	for _, expected := range []string{
+		"# keep this mode comment",
+		"# Optional per-instance overrides",
+		"mode: manual",
+		"helm_commands:\n    - |\n      helm install rancher",
+		"preload_images: false",
+		`aws_ec2_instance_type: "m5.2xlarge"`,
+		`aws_ec2_instance_type: "m5.xlarge"`,
+		"- \"v1.32.4+k3s1\"",
+	} {
+		if !strings.Contains(written, expected) {
+			t.Fatalf("expected config to contain %q, got:\n%s", expected, written)
+		}
+	}
+
+	if viper.GetString("rancher.mode") != "manual" || len(viper.GetStringSlice("rancher.helm_commands")) != 2 {
+		t.Fatal("expected the loaded config to follow the file")
+	}
+	if viper.GetString("tf_vars.aws_ec2_instance_type") != "m5.2xlarge" {
+		t.Fatalf("expected the edited tf_var in the loaded config, got %q", viper.GetString("tf_vars.aws_ec2_instance_type"))
+	}
+}
+
+func TestUpdateSetupEditorConfigFileRejectsBeforeWriting(t *testing.T) {
+	original := strings.Replace(setupEditorTestConfig, "  aws_vpc:", "  aws_vcp: \"vpc-1\"\n  aws_vpc:", 1)
+	configPath := writeSetupEditorTestConfig(t, original)
+	viper.Set("k3s.install_script_sha256s", map[string]string{"v1.32.5+k3s1": "abc"})
+
+	manual := func(tfVars []setupEditorTFVar) setupEditorConfig {
+		return setupEditorConfig{
+			Mode:         "manual",
+			HelmCommands: []string{setupEditorHelmCommand, setupEditorHelmCommand},
+			K3SVersions:  []string{"v1.32.5+k3s1", "v1.32.5+k3s1"},
+			TFVars:       tfVars,
+		}
+	}
+
+	missingChecksum := manual(setupEditorTFVars(t, configPath))
+	missingChecksum.K3SVersions[1] = "v1.33.0+k3s1"
+
+	cases := []struct {
+		name   string
+		config setupEditorConfig
+		want   string
+	}{
+		{"missing checksum", missingChecksum, "k3s.install_script_sha256s.v1.33.0+k3s1 must be set"},
+		{"undeclared tf_var", manual(setupEditorTFVars(t, configPath)), "aws_vcp is not declared"},
+		{"nested tf_var", manual([]setupEditorTFVar{{Key: "instance_overrides", Value: "x"}}), "tf_vars.instance_overrides cannot be edited here"},
+	}
+	for _, tc := range cases {
+		err := updateSetupEditorConfigFile(configPath, tc.config)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Fatalf("%s: expected error containing %q, got %v", tc.name, tc.want, err)
+		}
+	}
+
+	content, err := os.ReadFile(configPath)
+	if err != nil {
+		t.Fatalf("failed to read config: %v", err)
+	}
+	if string(content) != original {
+		t.Fatalf("expected the config file to be left alone, got:\n%s", content)
+	}
+}
+
+func TestNormalizeSetupEditorConfigRejectsInvalidInput(t *testing.T) {
+	missingFlag := strings.Replace(setupEditorHelmCommand, "--set agentTLSMode=system-store", "", 1)
+	cases := []struct {
+		name   string
+		config setupEditorConfig
+		want   string
+	}{
+		{"unknown mode", setupEditorConfig{Mode: "hybrid"}, "mode must be auto or manual"},
+		{"unknown distro", setupEditorConfig{Mode: "auto", Versions: []string{"2.13.4", "2.12.4"}, Distro: "suse", BootstrapPassword: "admin"}, "distro must be one of"},
+		{"prime prerelease", setupEditorConfig{Mode: "auto", Versions: []string{"2.13.4", "2.14.0-alpha3"}, Distro: "prime", BootstrapPassword: "admin"}, "instance 2: prime distro requires a released Rancher version"},
+		{"no password", setupEditorConfig{Mode: "auto", Versions: []string{"2.13.4", "2.12.4"}, BootstrapPassword: " "}, "bootstrap password cannot be empty"},
+		{"count mismatch", setupEditorConfig{Mode: "manual", HelmCommands: []string{setupEditorHelmCommand, setupEditorHelmCommand}, K3SVersions: []string{"v1.32.5+k3s1"}}, "2 Helm commands but 1 K3s versions"},
+		{"missing flag", setupEditorConfig{Mode: "manual", HelmCommands: []string{setupEditorHelmCommand, missingFlag}, K3SVersions: []string{"v1.32.5+k3s1", "v1.32.5+k3s1"}}, "helm command 2 is missing --set agentTLSMode=system-store"},
+	}
+	for _, tc := range cases {
+		_, err := normalizeSetupEditorConfig(tc.config)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Fatalf("%s: expected error containing %q, got %v", tc.name, tc.want, err)
+		}
+	}
+
+	normalized, err := normalizeSetupEditorConfig(setupEditorConfig{Mode: " Auto ", Versions: []string{"v2.13.4", "2.12.4"}, BootstrapPassword: "admin"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if normalized.Mode != "auto" || normalized.Distro != "auto" || normalized.Versions[0] != "2.13.4" {
+		t.Fatalf("unexpected normalized config: %+v", normalized)
+	}
+}
@@ -0,0 +1,102 @@
+package test
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// buildRunStatusReport renders run metadata for TestStatus.
+func buildRunStatusReport(metadata *runMetadata) string {
+	if metadata == nil {
+		return "No run metadata found; no environment has been recorded in the S3 bucket."
+	}
+
+	lines := []string{
+		fmt.Sprintf("State: %s (updated %s)", metadata.State, metadata.UpdatedAt.Format(time.RFC3339)),
+	}
+	if metadata.HibernatedAt != nil {
+		lines = append(lines, "Hibernated at: "+metadata.HibernatedAt.Format(time.RFC3339))
+	}
+	if metadata.ResumedAt != nil {
+		lines = append(lines, "Resumed at: "+metadata.ResumedAt.Format(time.RFC3339))
+	}
+
+	for _, cluster := range metadata.Clusters {
+		lines = append(lines, fmt.Sprintf("Instance %d: https://%s", cluster.Index, cluster.RancherURL))
+		lines = append(lines, "  EC2: "+strings.Join(cluster.InstanceIDs, ", "))
+		lines = append(lines, "  Node IPs: "+strings.Join(cluster.NodeIPs, ", "))
+		lines = append(lines, "  Aurora: "+cluster.RDSClusterID)
+	}
+
+	if len(metadata.Upgrades) > 0 {
+		lines = append(lines, "Upgrades:")
+		for _, upgrade := range metadata.Upgrades {
+			if upgrade.Error != "" {
+				lines = append(lines, fmt.Sprintf("  Instance %d: %s -> chart %s FAILED at %s: %s",
+					upgrade.Index, upgrade.FromAppVersion, upgrade.ToChart, upgrade.StartedAt.Format(time.RFC3339), upgrade.Error))
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("  Instance %d: %s -> %s (chart %s -> %s) at %s",
+				upgrade.Index, upgrade.FromAppVersion, upgrade.ToAppVersion, upgrade.FromChart, upgrade.ToChart, upgrade.StartedAt.Format(time.RFC3339)))
+		}
+	}
+
+	if len(metadata.K3SUpgrades) > 0 {
+		lines = append(lines, "K3s upgrades:")
+		for _, upgrade := range metadata.K3SUpgrades {
+			line := fmt.Sprintf("  Instance %d: %s -> %s at %s", upgrade.Index, upgrade.FromVersion, upgrade.ToVersion, upgrade.StartedAt.Format(time.RFC3339))
+			if upgrade.Forced {
+				line += " (forced: " + strings.Join(upgrade.Warnings, "; ") + ")"
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	if len(metadata.Backups) > 0 {
+		lines = append(lines, "Backups:")
+		for _, backup := range metadata.Backups {
+			line := fmt.Sprintf("  Instance %d: %s -> s3://%s/%s/%s at %s",
+				backup.Index, backup.Name, backup.Bucket, backup.Folder, backup.Filename, backup.CreatedAt.Format(time.RFC3339))
+			if backup.RestoredAt != nil {
+				line += " (restored " + backup.RestoredAt.Format(time.RFC3339) + ")"
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	if len(metadata.DatastoreSnapshots) > 0 {
+		lines = append(lines, "Datastore snapshots:")
+		for _, snapshot := range metadata.DatastoreSnapshots {
+			line := fmt.Sprintf("  Instance %d: %s %s at %s", snapshot.Index, snapshot.Method, snapshot.Identifier, snapshot.CreatedAt.Format(time.RFC3339))
+			if snapshot.RestoredAt != nil {
+				line += " (restored " + snapshot.RestoredAt.Format(time.RFC3339) + ")"
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	if len(metadata.ReplacedDatastores) > 0 {
+		lines = append(lines, "Replaced Aurora clusters awaiting deletion: "+strings.Join(metadata.ReplacedDatastores, ", "))
+	}
+
+	if len(metadata.TenantMoves) > 0 {
+		lines = append(lines, "Tenant moves:")
+		for _, move := range metadata.TenantMoves {
+			to := move.ToHost
+			if to == "" {
+				to = "(detached)"
+			}
+			lines = append(lines, fmt.Sprintf("  Tenant %d: %s -> %s at %s", move.Index, move.FromHost, to, move.MovedAt.Format(time.RFC3339)))
+		}
+	}
+
+	if len(metadata.Tags) > 0 {
+		lines = append(lines, "Tags:")
+		for _, tag := range formatResourceTags(metadata.Tags) {
+			lines = append(lines, "  "+tag)
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
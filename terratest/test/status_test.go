@@ -0,0 +1,20 @@
+package test
+
+import (
+	"log"
+	"testing"
+)
+
+func TestStatus(t *testing.T) {
+	setupConfig(t)
+	if err := validateSecretEnvironment(); err != nil {
+		t.Fatalf("secret environment preflight failed: %v", err)
+	}
+
+	metadata, err := loadRunMetadata()
+	if err != nil {
+		t.Fatalf("Failed to load run metadata: %v", err)
+	}
+
+	log.Printf("[status]\n%s", buildRunStatusReport(metadata))
+}
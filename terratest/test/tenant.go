@@ -0,0 +1,94 @@
+package test
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/gruntwork-io/terratest/modules/terraform"
+	"github.com/gruntwork-io/terratest/modules/testing"
+)
+
+// hostAdminToken returns the admin token TestHosted persisted for the host.
+// If none is stored or the host rejects it, it logs in with the configured
+// admin password and persists the new token.
+func hostAdminToken(hostURL string) (string, error) {
+	token, err := loadHostAdminToken(hostURL)
+	if err != nil {
+		log.Printf("[tenant] Could not read the persisted host admin token: %v", err)
+	}
+	if token != "" {
+		status, err := newRancherAPIClient(hostURL, token).do(http.MethodGet, "/v3/users?me=true", nil)
+		if err == nil && status == http.StatusOK {
+			return token, nil
+		}
+		log.Printf("[tenant] The persisted host admin token was not accepted (status %d: %v), logging in again", status, err)
+	}
+
+	password := configuredAdminPassword()
+	if err := waitForRancherAPIReady(hostURL, password, 10*time.Minute); err != nil {
+		return "", err
+	}
+	token, err = tools.CreateToken(hostURL, password)
+	if err != nil {
+		return "", fmt.Errorf("failed to create host admin token: %w", err)
+	}
+	if err := saveHostAdminToken(hostURL, token); err != nil {
+		log.Printf("[tenant] Could not persist the host admin token: %v", err)
+	}
+	return token, nil
+}
+
+// loadDeployedClusterInfra reads the clusters Terraform has deployed, however
+// many total_rancher_instances currently asks for.
+func loadDeployedClusterInfra(t testing.TestingT, terraformOptions *terraform.Options) ([]ClusterInfra, error) {
+	var clusters []ClusterInfra
+	if err := terraform.OutputStructE(t, terraformOptions, "clusters", &clusters); err != nil {
+		return nil, fmt.Errorf("failed to read terraform output clusters: %w", err)
+	}
+	sort.Slice(clusters, func(i, j int) bool { return clusters[i].Index < clusters[j].Index })
+	if err := validateClusterInfra(clusters, len(clusters)); err != nil {
+		return nil, err
+	}
+	return clusters, nil
+}
+
+// checkTenantCountChange checks that total_rancher_instances moves the
+// deployed environment by exactly one tenant in the given direction. Tenants
+// are indexed contiguously, so only the last one can be removed.
+func checkTenantCountChange(deployed, requested, delta int) error {
+	if requested == deployed+delta {
+		return nil
+	}
+	if delta > 0 {
+		return fmt.Errorf("%d instances are deployed; set total_rancher_instances to %d to add one tenant (got %d)", deployed, deployed+1, requested)
+	}
+	return fmt.Errorf("%d instances are deployed; only the last tenant (%d) can be removed, so set total_rancher_instances to %d (got %d)", deployed, deployed-1, deployed-1, requested)
+}
+
+// recordTenantChange replaces the recorded clusters after a tenant was added
+// or removed. Earlier records, such as upgrades, are kept.
+func recordTenantChange(clusters []ClusterInfra) {
+	metadata, err := loadRunMetadata()
+	if err != nil {
+		log.Printf("[tenant] Could not read run metadata: %v", err)
+		return
+	}
+	if metadata == nil {
+		metadata = &runMetadata{State: runStateRunning}
+	}
+	metadata.Clusters = runClustersFromInfra(clusters)
+	if err := saveRunMetadata(metadata); err != nil {
+		log.Printf("[tenant] Could not record tenant change: %v", err)
+	}
+}
+
+func removeTenantScriptDir(tenantIndex int) {
+	scriptDir := rancherScriptDir(tenantIndex)
+	if err := os.RemoveAll(scriptDir); err != nil {
+		log.Printf("[tenant] Could not remove %s: %v", scriptDir, err)
+	}
+}
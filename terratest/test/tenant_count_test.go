@@ -0,0 +1,27 @@
+package test
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckTenantCountChange(t *testing.T) {
+	if err := checkTenantCountChange(3, 4, 1); err != nil {
+		t.Fatalf("expected adding one tenant to be accepted: %v", err)
+	}
+	if err := checkTenantCountChange(3, 2, -1); err != nil {
+		t.Fatalf("expected removing one tenant to be accepted: %v", err)
+	}
+	if err := checkTenantCountChange(3, 3, 1); err == nil {
+		t.Fatalf("expected an unchanged total to be rejected")
+	}
+	if err := checkTenantCountChange(2, 4, 1); err == nil {
+		t.Fatalf("expected adding two tenants at once to be rejected")
+	}
+	if err := checkTenantCountChange(3, 4, -1); err == nil {
+		t.Fatalf("expected a growing total to be rejected for remove")
+	}
+	if err := checkTenantCountChange(4, 2, -1); err == nil || !strings.Contains(err.Error(), "only the last tenant (3) can be removed") {
+		t.Fatalf("expected the last-tenant-only limit in the error, got %v", err)
+	}
+}
@@ -0,0 +1,258 @@
+package test
+
+import (
+	"log"
+	"sync"
+	"testing"
+	"time"
+
+	toolkit "github.com/brudnak/hosted-tenant-rancher/tools"
+	"github.com/gruntwork-io/terratest/modules/terraform"
+	"github.com/spf13/viper"
+)
+
+func TestTenantAdd(t *testing.T) {
+	setupConfig(t)
+	if err := applyAirgapDefaults(); err != nil {
+		t.Fatalf("airgap configuration failed: %v", err)
+	}
+
+	terraformOptions := &terraform.Options{
+		TerraformDir: "../modules/aws",
+		NoColor:      true,
+		BackendConfig: map[string]interface{}{
+			"bucket": viper.GetString("s3.bucket"),
+			"key":    tfState,
+			"region": viper.GetString("s3.region"),
+		},
+		Vars: map[string]interface{}{
+			"total_rancher_instances": viper.GetInt("total_rancher_instances"),
+		},
+	}
+
+	deployed, err := loadDeployedClusterInfra(t, terraformOptions)
+	if err != nil {
+		t.Fatalf("Failed to load cluster infrastructure: %v", err)
+	}
+	totalInstances := getTotalRancherInstances()
+	if err := checkTenantCountChange(len(deployed), totalInstances, 1); err != nil {
+		t.Fatalf("invalid tenant add: %v", err)
+	}
+	if _, err := loadActiveRunMetadata(deployed); err != nil {
+		t.Fatalf("cannot add a tenant: %v", err)
+	}
+
+	resolvedPlans, err := resolveRancherSetup()
+	if err != nil {
+		t.Fatalf("Rancher setup canceled or failed: %v", err)
+	}
+	// The setup editor can change total_rancher_instances, so check again.
+	totalInstances = getTotalRancherInstances()
+	if err := checkTenantCountChange(len(deployed), totalInstances, 1); err != nil {
+		t.Fatalf("invalid tenant add after setup: %v", err)
+	}
+	terraformOptions.Vars["total_rancher_instances"] = totalInstances
+	tenantIndex := totalInstances - 1
+
+	helmCommands := viper.GetStringSlice("rancher.helm_commands")
+	k3sVersions := viper.GetStringSlice("k3s.versions")
+
+	if err := validateLocalToolingPreflight(helmCommands); err != nil {
+		t.Fatalf("local tooling preflight failed: %v", err)
+	}
+	if err := validateSecretEnvironment(); err != nil {
+		t.Fatalf("secret environment preflight failed: %v", err)
+	}
+	if err := validateHostedConfiguration(totalInstances, helmCommands, resolvedPlans); err != nil {
+		t.Fatalf("configuration validation failed: %v", err)
+	}
+
+	forecast, forecastErr := forecastPlannedRunCost(totalInstances)
+	if forecastErr != nil {
+		log.Printf("[budget] Could not forecast AWS cost before apply: %v", forecastErr)
+	} else {
+		logCostForecast(forecast)
+	}
+	if err := checkBudgetGuardrail(forecast, forecastErr, configuredBudgetLimits()); err != nil {
+		t.Fatalf("budget guardrail failed: %v", err)
+	}
+
+	if toolkit.AirgapEnabled() {
+		var newPlans []*RancherResolvedPlan
+		if tenantIndex < len(resolvedPlans) {
+			newPlans = resolvedPlans[tenantIndex:]
+		}
+		images, err := collectAirgapImages(newPlans, helmCommands[tenantIndex:], k3sVersions[tenantIndex:])
+		if err != nil {
+			t.Fatalf("failed to build airgap image list: %v", err)
+		}
+		if err := mirrorAirgapImages(images); err != nil {
+			t.Fatalf("failed to mirror airgap images: %v", err)
+		}
+		if err := stageAirgapK3SArtifacts(k3sVersions[tenantIndex:]); err != nil {
+			t.Fatalf("failed to stage K3s artifacts: %v", err)
+		}
+	}
+
+	if err := createAWSVar(recordedResourceTags()); err != nil {
+		t.Fatalf("Failed to write terraform.tfvars: %v", err)
+	}
+
+	log.Printf("[tenant] Adding tenant %d...", tenantIndex)
+	terraform.InitAndApply(t, terraformOptions)
+
+	clusters, err := loadClusterInfra(t, terraformOptions, totalInstances)
+	if err != nil {
+		t.Fatalf("Failed to load cluster infrastructure: %v", err)
+	}
+	recordTenantChange(clusters)
+
+	hostUrl = clusters[0].RancherURL
+	adminToken, err = hostAdminToken(hostUrl)
+	if err != nil {
+		t.Fatalf("Failed to log in to host Rancher: %v", err)
+	}
+
+	tenantConfig := clusters[tenantIndex].K3SConfig()
+	configIpsMutex := sync.Mutex{}
+	if err := setupTenantPhase1(t, tenantIndex, tenantIndex, tenantConfig, k3sVersions, &configIpsMutex); err != nil {
+		t.Fatalf("Tenant %d phase 1 setup failed: %v", tenantIndex, err)
+	}
+	if err := setupTenantPhase2(t, tenantIndex, tenantIndex, tenantConfig, helmCommands); err != nil {
+		t.Fatalf("Tenant %d phase 2 setup failed: %v", tenantIndex, err)
+	}
+
+	log.Printf("[tenant] Tenant Rancher %d https://%s was added", tenantIndex, tenantConfig.RancherURL)
+}
+
+func TestTenantRemove(t *testing.T) {
+	setupConfig(t)
+	if err := validateSecretEnvironment(); err != nil {
+		t.Fatalf("secret environment preflight failed: %v", err)
+	}
+
+	terraformOptions := &terraform.Options{
+		TerraformDir: "../modules/aws",
+		NoColor:      true,
+		BackendConfig: map[string]interface{}{
+			"bucket": viper.GetString("s3.bucket"),
+			"key":    tfState,
+			"region": viper.GetString("s3.region"),
+		},
+		Vars: map[string]interface{}{
+			"total_rancher_instances": viper.GetInt("total_rancher_instances"),
+		},
+	}
+
+	deployed, err := loadDeployedClusterInfra(t, terraformOptions)
+	if err != nil {
+		t.Fatalf("Failed to load cluster infrastructure: %v", err)
+	}
+	totalInstances := getTotalRancherInstances()
+	if err := checkTenantCountChange(len(deployed), totalInstances, -1); err != nil {
+		t.Fatalf("invalid tenant remove: %v", err)
+	}
+	if totalInstances < 2 {
+		t.Fatalf("the last tenant cannot be removed; use TestCleanup to tear the environment down")
+	}
+	if _, err := loadActiveRunMetadata(deployed); err != nil {
+		t.Fatalf("cannot remove a tenant: %v", err)
+	}
+	// Tenants are indexed contiguously, so the last one is always the one removed.
+	tenantIndex := len(deployed) - 1
+	log.Printf("[tenant] Removing tenant %d, the last deployed tenant...", tenantIndex)
+
+	token, err := hostAdminToken(deployed[0].RancherURL)
+	if err != nil {
+		t.Fatalf("Failed to log in to host Rancher: %v", err)
+	}
+	if err := detachTenantFromHost(deployed[0].RancherURL, token, tenantIndex, 15*time.Minute); err != nil {
+		t.Fatalf("Failed to remove tenant %d from the host: %v", tenantIndex, err)
+	}
+	// The tenant is destroyed next, so a failed agent cleanup is not fatal.
+	if err := cleanupTenantAgents(tenantIndex, deployed[tenantIndex]); err != nil {
+		log.Printf("[tenant] %v", err)
+	}
+
+	if err := createAWSVar(recordedResourceTags()); err != nil {
+		t.Fatalf("Failed to write terraform.tfvars: %v", err)
+	}
+
+	log.Printf("[tenant] Destroying the infrastructure of tenant %d...", tenantIndex)
+	terraform.InitAndApply(t, terraformOptions)
+
+	clusters, err := loadClusterInfra(t, terraformOptions, totalInstances)
+	if err != nil {
+		t.Fatalf("Failed to load cluster infrastructure: %v", err)
+	}
+	recordTenantChange(clusters)
+	removeTenantScriptDir(tenantIndex)
+
+	log.Printf("[tenant] Tenant %d was removed", tenantIndex)
+}
+
+func TestDetachTenant(t *testing.T) {
+	setupConfig(t)
+	if err := validateSecretEnvironment(); err != nil {
+		t.Fatalf("secret environment preflight failed: %v", err)
+	}
+
+	terraformOptions := terraform.WithDefaultRetryableErrors(t, &terraform.Options{
+		TerraformDir: "../modules/aws",
+		NoColor:      true,
+	})
+
+	clusters, err := loadClusterInfra(t, terraformOptions, getTotalRancherInstances())
+	if err != nil {
+		t.Fatalf("Failed to load cluster infrastructure: %v", err)
+	}
+	tenantIndex, err := configuredTenantIndex("detach.tenant", len(clusters))
+	if err != nil {
+		t.Fatalf("invalid detach configuration: %v", err)
+	}
+
+	token, err := hostAdminToken(clusters[0].RancherURL)
+	if err != nil {
+		t.Fatalf("Failed to log in to host Rancher: %v", err)
+	}
+	if err := detachTenantFromHost(clusters[0].RancherURL, token, tenantIndex, 15*time.Minute); err != nil {
+		t.Fatalf("Failed to detach tenant %d: %v", tenantIndex, err)
+	}
+	if err := cleanupTenantAgents(tenantIndex, clusters[tenantIndex]); err != nil {
+		t.Fatalf("Failed to clean up tenant %d: %v", tenantIndex, err)
+	}
+	recordTenantMove(tenantIndex, clusters[0].RancherURL, "")
+	log.Printf("[detach] Tenant %d is detached and can be imported into another host", tenantIndex)
+}
+
+func TestReimportTenant(t *testing.T) {
+	setupConfig(t)
+	if err := validateSecretEnvironment(); err != nil {
+		t.Fatalf("secret environment preflight failed: %v", err)
+	}
+	if err := validateLocalToolingPreflight(nil); err != nil {
+		t.Fatalf("local tooling preflight failed: %v", err)
+	}
+
+	terraformOptions := terraform.WithDefaultRetryableErrors(t, &terraform.Options{
+		TerraformDir: "../modules/aws",
+		NoColor:      true,
+	})
+
+	clusters, err := loadClusterInfra(t, terraformOptions, getTotalRancherInstances())
+	if err != nil {
+		t.Fatalf("Failed to load cluster infrastructure: %v", err)
+	}
+	tenantIndex, err := configuredTenantIndex("reimport.tenant", len(clusters))
+	if err != nil {
+		t.Fatalf("invalid reimport configuration: %v", err)
+	}
+	target, err := resolveReimportTarget()
+	if err != nil {
+		t.Fatalf("invalid reimport target: %v", err)
+	}
+
+	if err := reimportTenant(clusters, tenantIndex, target); err != nil {
+		t.Fatalf("Re-import of tenant %d failed: %v", tenantIndex, err)
+	}
+}
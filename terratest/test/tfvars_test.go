@@ -0,0 +1,19 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/brudnak/hosted-tenant-rancher/tools/hcl"
+)
+
+func TestRootModuleDeclaresConfiguredTFVars(t *testing.T) {
+	variables, err := hcl.ReadVariables(terraformModuleDir)
+	if err != nil {
+		t.Fatalf("failed to read root module variables: %v", err)
+	}
+	for _, name := range []string{"aws_region", "aws_node_addressing", "instance_overrides", "total_rancher_instances"} {
+		if _, ok := variables[name]; !ok {
+			t.Fatalf("expected root module to declare %s", name)
+		}
+	}
+}
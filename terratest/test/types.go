@@ -13,9 +13,12 @@ type RancherResolvedPlan struct {
 	AgentImage          string
 	CompatibilityBase   string
 	SupportMatrixURL    string
+	LowestK3SMinor      int
+	HighestK3SMinor     int
 	RecommendedK3S      string
 	InstallScriptSHA256 string
 	AirgapImageSHA256   string
+	BinarySHA256        string
 	HelmCommands        []string
 	Explanation         []string
 }
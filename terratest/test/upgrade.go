@@ -0,0 +1,377 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	toolkit "github.com/brudnak/hosted-tenant-rancher/tools"
+	goversion "github.com/hashicorp/go-version"
+	"github.com/spf13/viper"
+)
+
+const rancherReleaseName = "rancher"
+
+// rancherUpgradeRecord is kept in run metadata so status shows which
+// versions each instance went through. Failed attempts are kept too, with
+// Error set and no CompletedAt. Index is the 1-based instance number.
+type rancherUpgradeRecord struct {
+	Index            int       `json:"index"`
+	RequestedVersion string    `json:"requestedVersion"`
+	FromChart        string    `json:"fromChart"`
+	ToChart          string    `json:"toChart"`
+	FromAppVersion   string    `json:"fromAppVersion"`
+	ToAppVersion     string    `json:"toAppVersion"`
+	StartedAt        time.Time `json:"startedAt"`
+	CompletedAt      time.Time `json:"completedAt"`
+	Error            string    `json:"error,omitempty"`
+}
+
+type helmRelease struct {
+	Name       string `json:"name"`
+	Chart      string `json:"chart"`
+	AppVersion string `json:"app_version"`
+	Status     string `json:"status"`
+}
+
+// chartVersion strips the chart name from the helm list chart field,
+// e.g. rancher-2.13.5 becomes 2.13.5.
+func (r helmRelease) chartVersion() string {
+	return strings.TrimPrefix(r.Chart, "rancher-")
+}
+
+// getRequestedUpgradeVersions reads upgrade.rancher_versions. An empty entry
+// leaves that instance on its current version.
+func getRequestedUpgradeVersions(totalInstances int) ([]string, error) {
+	return readPerInstanceUpgradeVersions("upgrade.rancher_versions", totalInstances, normalizeVersionInput)
+}
+
+// readPerInstanceUpgradeVersions reads a list with one version per instance
+// and requires at least one non-empty entry.
+func readPerInstanceUpgradeVersions(key string, totalInstances int, normalize func(string) string) ([]string, error) {
+	requested := viper.GetStringSlice(key)
+	if len(requested) == 0 {
+		return nil, fmt.Errorf("%s must list a version (or \"\") for each of the %d instance(s)", key, totalInstances)
+	}
+	if len(requested) != totalInstances {
+		return nil, fmt.Errorf("%s has %d entries but total_rancher_instances is %d", key, len(requested), totalInstances)
+	}
+
+	versions := make([]string, 0, len(requested))
+	upgrades := 0
+	for _, version := range requested {
+		version = normalize(version)
+		if version != "" {
+			upgrades++
+		}
+		versions = append(versions, version)
+	}
+	if upgrades == 0 {
+		return nil, fmt.Errorf("%s does not request an upgrade for any instance", key)
+	}
+	return versions, nil
+}
+
+// resolveRancherUpgradePlans runs the auto-mode resolver for every instance
+// with a requested version. Instances that are not upgraded get a nil plan.
+func resolveRancherUpgradePlans(versions []string) ([]*RancherResolvedPlan, error) {
+	log.Printf("[upgrade] Refreshing Helm repo indexes...")
+	if err := refreshHelmRepoIndexes(); err != nil {
+		return nil, err
+	}
+
+	requestedDistro := strings.ToLower(strings.TrimSpace(viper.GetString("rancher.distro")))
+	if requestedDistro == "" {
+		requestedDistro = "auto"
+	}
+
+	plans := make([]*RancherResolvedPlan, len(versions))
+	for i, version := range versions {
+		if version == "" {
+			continue
+		}
+		plan, err := resolveAutoRancherPlan(i, version, requestedDistro, configuredAdminPassword())
+		if err != nil {
+			return nil, fmt.Errorf("instance %d: %w", i+1, err)
+		}
+		plans[i] = plan
+	}
+	return plans, nil
+}
+
+// upgradeRancherEnvironment upgrades each planned instance in order, host
+// first, and checks after every step that the tenants are still Active in
+// the host.
+func upgradeRancherEnvironment(clusters []ClusterInfra, plans []*RancherResolvedPlan) error {
+	metadata, err := loadRunMetadata()
+	if err != nil {
+		return err
+	}
+	if metadata != nil && metadata.hibernated() {
+		return fmt.Errorf("environment is %s; run TestResume before upgrading", metadata.State)
+	}
+	if metadata == nil {
+		metadata = &runMetadata{State: runStateRunning, Clusters: runClustersFromInfra(clusters)}
+	}
+
+	if toolkit.AirgapEnabled() {
+		var helmCommands []string
+		var upgradePlans []*RancherResolvedPlan
+		for _, plan := range plans {
+			if plan != nil {
+				upgradePlans = append(upgradePlans, plan)
+				helmCommands = append(helmCommands, plan.HelmCommands...)
+			}
+		}
+		images, err := collectAirgapImages(upgradePlans, helmCommands, nil)
+		if err != nil {
+			return fmt.Errorf("failed to build airgap image list: %w", err)
+		}
+		if err := mirrorAirgapImages(images); err != nil {
+			return fmt.Errorf("failed to mirror airgap images: %w", err)
+		}
+	}
+
+	hostURL := clusters[0].RancherURL
+	for i, plan := range plans {
+		if plan == nil {
+			continue
+		}
+
+		record, err := upgradeRancherInstance(i, clusters[i], plan)
+		if record != nil {
+			metadata.Upgrades = append(metadata.Upgrades, *record)
+			if saveErr := saveRunMetadata(metadata); saveErr != nil {
+				log.Printf("[upgrade] Could not record upgrade: %v", saveErr)
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := verifyTenantsActive(hostURL, len(clusters)); err != nil {
+			return fmt.Errorf("after upgrading instance %d: %w", i+1, err)
+		}
+	}
+
+	return nil
+}
+
+func upgradeRancherInstance(instanceIndex int, cluster ClusterInfra, plan *RancherResolvedPlan) (*rancherUpgradeRecord, error) {
+	scriptDir := rancherScriptDir(instanceIndex)
+	kubeconfig, err := refreshInstanceKubeconfig(instanceIndex, cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	before, err := currentRancherRelease(kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("instance %d: %w", instanceIndex+1, err)
+	}
+	if err := checkRancherUpgradeDirection(before.chartVersion(), plan.ChartVersion); err != nil {
+		return nil, fmt.Errorf("instance %d: %w", instanceIndex+1, err)
+	}
+
+	currentValues, err := currentRancherValues(kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("instance %d: %w", instanceIndex+1, err)
+	}
+	valuesPath, err := writeUpgradeValues(scriptDir, buildUpgradeValues(currentValues, plan))
+	if err != nil {
+		return nil, fmt.Errorf("instance %d: %w", instanceIndex+1, err)
+	}
+
+	record := &rancherUpgradeRecord{
+		Index:            instanceIndex + 1,
+		RequestedVersion: plan.RequestedVersion,
+		FromChart:        before.chartVersion(),
+		ToChart:          plan.ChartVersion,
+		FromAppVersion:   before.AppVersion,
+		StartedAt:        time.Now().UTC(),
+	}
+
+	log.Printf("[upgrade] Instance %d: upgrading Rancher from %s to %s/rancher@%s...", instanceIndex+1, before.chartVersion(), plan.ChartRepoAlias, plan.ChartVersion)
+	args := []string{
+		"upgrade", rancherReleaseName, plan.ChartRepoAlias + "/rancher",
+		"--namespace", "cattle-system",
+		"--version", plan.ChartVersion,
+		"--values", valuesPath,
+		"--kubeconfig", kubeconfig,
+	}
+	// Once helm has been run the attempt is recorded, failed or not.
+	failed := func(err error) (*rancherUpgradeRecord, error) {
+		record.Error = err.Error()
+		return record, err
+	}
+	if output, err := exec.Command("helm", args...).CombinedOutput(); err != nil {
+		return failed(fmt.Errorf("instance %d: helm upgrade failed: %w (%s)", instanceIndex+1, err, strings.TrimSpace(string(output))))
+	}
+
+	if err := waitForRancherReady(readinessPhaseUpgrade, cluster.RancherURL, kubeconfig, 15*time.Minute); err != nil {
+		return failed(fmt.Errorf("instance %d Rancher failed to become ready after upgrade: %w", instanceIndex+1, err))
+	}
+
+	after, err := currentRancherRelease(kubeconfig)
+	if err != nil {
+		return failed(fmt.Errorf("instance %d: %w", instanceIndex+1, err))
+	}
+	record.ToAppVersion = after.AppVersion
+	record.CompletedAt = time.Now().UTC()
+	log.Printf("[upgrade] Instance %d: Rancher %s -> %s (chart %s -> %s)", instanceIndex+1, record.FromAppVersion, record.ToAppVersion, record.FromChart, after.chartVersion())
+
+	return record, nil
+}
+
+// refreshInstanceKubeconfig saves a current kubeconfig for the instance and
+// returns its absolute path.
+func refreshInstanceKubeconfig(instanceIndex int, cluster ClusterInfra) (string, error) {
+	scriptDir := rancherScriptDir(instanceIndex)
+	if err := saveK3SKubeconfig(cluster.K3SConfig().Node1, scriptDir); err != nil {
+		return "", fmt.Errorf("instance %d: %w", instanceIndex+1, err)
+	}
+	return filepath.Abs(filepath.Join(scriptDir, "kube_config.yaml"))
+}
+
+func verifyTenantsActive(hostURL string, totalInstances int) error {
+	if totalInstances < 2 {
+		return nil
+	}
+
+	token, err := hostAdminToken(hostURL)
+	if err != nil {
+		return err
+	}
+	metadata, err := loadRunMetadata()
+	if err != nil {
+		return err
+	}
+
+	for tenantIndex := 1; tenantIndex < totalInstances; tenantIndex++ {
+		if current := tenantHost(metadata, tenantIndex, hostURL); current != hostURL {
+			log.Printf("[verify] Tenant %d is not imported into this host (now %q), skipping", tenantIndex, current)
+			continue
+		}
+		if err := waitForClusterActive(hostURL, token, tenantIndex, 10*time.Minute); err != nil {
+			return fmt.Errorf("tenant %d is not Active in the host: %w", tenantIndex, err)
+		}
+	}
+	return nil
+}
+
+func currentRancherRelease(kubeconfig string) (helmRelease, error) {
+	output, err := exec.Command("helm", "list", "--namespace", "cattle-system", "--filter", "^"+rancherReleaseName+"$", "--output", "json", "--kubeconfig", kubeconfig).Output()
+	if err != nil {
+		return helmRelease{}, fmt.Errorf("failed to list Helm releases: %w", err)
+	}
+
+	var releases []helmRelease
+	if err := json.Unmarshal(output, &releases); err != nil {
+		return helmRelease{}, fmt.Errorf("failed to parse helm list output: %w", err)
+	}
+	if len(releases) == 0 {
+		return helmRelease{}, fmt.Errorf("no %s Helm release found in cattle-system", rancherReleaseName)
+	}
+	return releases[0], nil
+}
+
+// currentRancherValues returns the user-supplied values of the installed
+// release, which the upgrade carries over.
+func currentRancherValues(kubeconfig string) (map[string]interface{}, error) {
+	output, err := exec.Command("helm", "get", "values", rancherReleaseName, "--namespace", "cattle-system", "--output", "json", "--kubeconfig", kubeconfig).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Helm values for %s: %w", rancherReleaseName, err)
+	}
+
+	values := map[string]interface{}{}
+	if err := json.Unmarshal(output, &values); err != nil {
+		return nil, fmt.Errorf("failed to parse Helm values: %w", err)
+	}
+	if values == nil {
+		values = map[string]interface{}{}
+	}
+	return values, nil
+}
+
+// buildUpgradeValues keeps the installed values and swaps only the image
+// settings for the ones the new plan resolved. Overrides the new plan does not
+// need are removed, so an old image tag cannot pin the upgraded release.
+func buildUpgradeValues(current map[string]interface{}, plan *RancherResolvedPlan) map[string]interface{} {
+	values := make(map[string]interface{}, len(current))
+	for key, value := range current {
+		values[key] = value
+	}
+
+	registry, _ := values["systemDefaultRegistry"].(string)
+
+	delete(values, "rancherImage")
+	delete(values, "rancherImageTag")
+	if plan.RancherImage != "" {
+		image := plan.RancherImage
+		if registry != "" {
+			_, image = splitImageRegistry(image)
+		}
+		values["rancherImage"] = image
+	}
+	if plan.RancherImageTag != "" {
+		values["rancherImageTag"] = plan.RancherImageTag
+	}
+
+	var extraEnv []interface{}
+	if existing, ok := values["extraEnv"].([]interface{}); ok {
+		for _, entry := range existing {
+			if env, ok := entry.(map[string]interface{}); ok && env["name"] == "CATTLE_AGENT_IMAGE" {
+				continue
+			}
+			extraEnv = append(extraEnv, entry)
+		}
+	}
+	if plan.AgentImage != "" {
+		agentImage := plan.AgentImage
+		if registry != "" {
+			_, repository := splitImageRegistry(agentImage)
+			agentImage = registry + "/" + repository
+		}
+		extraEnv = append(extraEnv, map[string]interface{}{"name": "CATTLE_AGENT_IMAGE", "value": agentImage})
+	}
+	delete(values, "extraEnv")
+	if len(extraEnv) > 0 {
+		values["extraEnv"] = extraEnv
+	}
+
+	return values
+}
+
+func writeUpgradeValues(scriptDir string, values map[string]interface{}) (string, error) {
+	content, err := json.MarshalIndent(values, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to serialize upgrade values: %w", err)
+	}
+
+	valuesPath, err := filepath.Abs(filepath.Join(scriptDir, "upgrade-values.json"))
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(valuesPath, content, 0o600); err != nil {
+		return "", fmt.Errorf("failed to write %s: %w", valuesPath, err)
+	}
+	return valuesPath, nil
+}
+
+// checkRancherUpgradeDirection refuses downgrades, which Rancher does not
+// support. Versions that do not parse are left to helm.
+func checkRancherUpgradeDirection(fromChart, toChart string) error {
+	from, fromErr := goversion.NewVersion(fromChart)
+	to, toErr := goversion.NewVersion(toChart)
+	if fromErr != nil || toErr != nil {
+		return nil
+	}
+	if to.LessThan(from) {
+		return fmt.Errorf("chart %s is older than the installed %s; Rancher does not support downgrades", toChart, fromChart)
+	}
+	return nil
+}
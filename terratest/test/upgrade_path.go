@@ -0,0 +1,235 @@
+package test
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// upgradePathStep is one Rancher version on an instance's upgrade path and
+// the K3s version the cluster should run at that step.
+type upgradePathStep struct {
+	Plan       *RancherResolvedPlan
+	K3SVersion string
+	// K3SBumpFirst is set when K3s has to be upgraded to K3SVersion before
+	// Rancher is upgraded to this step.
+	K3SBumpFirst bool
+	Warnings     []string
+}
+
+type instanceUpgradePath struct {
+	Index int
+	Steps []upgradePathStep
+}
+
+// configuredUpgradePaths reads rancher.upgrade_path: one list per instance,
+// starting with the version that is installed. Empty lists are allowed.
+func configuredUpgradePaths(totalInstances int) ([][]string, error) {
+	raw := viper.Get("rancher.upgrade_path")
+	if raw == nil {
+		return nil, nil
+	}
+
+	entries, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("rancher.upgrade_path must be a list with one list of versions per instance")
+	}
+	if len(entries) != totalInstances {
+		return nil, fmt.Errorf("rancher.upgrade_path has %d entries but total_rancher_instances is %d", len(entries), totalInstances)
+	}
+
+	paths := make([][]string, 0, len(entries))
+	for i, entry := range entries {
+		if entry == nil {
+			paths = append(paths, nil)
+			continue
+		}
+		steps, ok := entry.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("rancher.upgrade_path[%d] must be a list of Rancher versions", i)
+		}
+
+		var path []string
+		for j, step := range steps {
+			version := normalizeVersionInput(fmt.Sprint(step))
+			if version == "" {
+				return nil, fmt.Errorf("rancher.upgrade_path[%d][%d] must not be empty", i, j)
+			}
+			path = append(path, version)
+		}
+		if len(path) == 1 {
+			return nil, fmt.Errorf("rancher.upgrade_path[%d] needs at least two versions (the installed version and an upgrade)", i)
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// resolveConfiguredUpgradePaths resolves every step of the configured paths.
+// The first step must match the version the instance is installed with, and
+// reuses its plan when one was resolved in auto mode.
+func resolveConfiguredUpgradePaths(plans []*RancherResolvedPlan) ([]*instanceUpgradePath, error) {
+	totalInstances := getTotalRancherInstances()
+	paths, err := configuredUpgradePaths(totalInstances)
+	if err != nil || len(paths) == 0 {
+		return nil, err
+	}
+
+	installVersions := viper.GetStringSlice("rancher.versions")
+	if len(installVersions) == 0 && viper.GetString("rancher.version") != "" {
+		installVersions = []string{viper.GetString("rancher.version")}
+	}
+
+	requestedDistro := strings.ToLower(strings.TrimSpace(viper.GetString("rancher.distro")))
+	if requestedDistro == "" {
+		requestedDistro = "auto"
+	}
+	bootstrapPassword := configuredAdminPassword()
+	patchCache := map[int]string{}
+
+	var resolved []*instanceUpgradePath
+	for i, path := range paths {
+		if len(path) == 0 {
+			continue
+		}
+		if i < len(installVersions) && normalizeVersionInput(installVersions[i]) != path[0] {
+			return nil, fmt.Errorf("rancher.upgrade_path[%d] must start with the installed version %s, got %s", i, normalizeVersionInput(installVersions[i]), path[0])
+		}
+
+		log.Printf("[resolver] Instance %d: resolving upgrade path %s", i+1, strings.Join(path, " -> "))
+		instancePath := &instanceUpgradePath{Index: i}
+		for j, version := range path {
+			var plan *RancherResolvedPlan
+			if j == 0 && i < len(plans) && plans[i] != nil && plans[i].Mode == "auto" && plans[i].RequestedVersion == version {
+				plan = plans[i]
+			} else {
+				plan, err = resolveAutoRancherPlan(i, version, requestedDistro, bootstrapPassword)
+				if err != nil {
+					return nil, fmt.Errorf("upgrade path for instance %d, step %d: %w", i+1, j+1, err)
+				}
+			}
+
+			if j == 0 {
+				instancePath.Steps = append(instancePath.Steps, upgradePathStep{Plan: plan, K3SVersion: plan.RecommendedK3S})
+				continue
+			}
+
+			step, err := planUpgradePathStep(instancePath.Steps[j-1], plan, func(minor int) (string, error) {
+				if cached, ok := patchCache[minor]; ok {
+					return cached, nil
+				}
+				patch, err := resolveLatestK3SPatch(minor)
+				if err == nil {
+					patchCache[minor] = patch
+				}
+				return patch, err
+			})
+			if err != nil {
+				return nil, fmt.Errorf("upgrade path for instance %d, step %d: %w", i+1, j+1, err)
+			}
+			instancePath.Steps = append(instancePath.Steps, step)
+		}
+		resolved = append(resolved, instancePath)
+	}
+	return resolved, nil
+}
+
+// planUpgradePathStep picks the K3s version for moving from previous to plan:
+// the current K3s when the new Rancher supports it, otherwise the latest patch
+// of the highest minor both Rancher versions support, applied first.
+func planUpgradePathStep(previous upgradePathStep, plan *RancherResolvedPlan, latestPatch func(int) (string, error)) (upgradePathStep, error) {
+	step := upgradePathStep{Plan: plan, K3SVersion: previous.K3SVersion}
+	previousPlan := previous.Plan
+
+	if warning := rancherMinorSkipWarning(previousPlan.RequestedVersion, plan.RequestedVersion); warning != "" {
+		step.Warnings = append(step.Warnings, warning)
+	}
+
+	currentMinor, err := k3sMinor(previous.K3SVersion)
+	if err != nil {
+		return step, err
+	}
+	if currentMinor >= plan.LowestK3SMinor && currentMinor <= plan.HighestK3SMinor {
+		return step, nil
+	}
+
+	lowest := max(previousPlan.LowestK3SMinor, plan.LowestK3SMinor)
+	highest := min(previousPlan.HighestK3SMinor, plan.HighestK3SMinor)
+	if lowest > highest {
+		step.Warnings = append(step.Warnings, fmt.Sprintf("no K3s minor is supported by both Rancher %s (v1.%d-v1.%d) and %s (v1.%d-v1.%d)",
+			previousPlan.RequestedVersion, previousPlan.LowestK3SMinor, previousPlan.HighestK3SMinor,
+			plan.RequestedVersion, plan.LowestK3SMinor, plan.HighestK3SMinor))
+		step.K3SVersion = plan.RecommendedK3S
+		return step, nil
+	}
+
+	bump, err := latestPatch(highest)
+	if err != nil {
+		return step, err
+	}
+	step.K3SVersion = bump
+	step.K3SBumpFirst = true
+	step.Warnings = append(step.Warnings, fmt.Sprintf("needs a K3s bump from %s to %s before upgrading Rancher", previous.K3SVersion, bump))
+	step.Warnings = append(step.Warnings, checkK3SUpgradePath(previous.K3SVersion, bump)...)
+	return step, nil
+}
+
+// rancherMinorSkipWarning flags steps that skip a Rancher minor or go back.
+func rancherMinorSkipWarning(fromVersion, toVersion string) string {
+	_, fromLine, fromErr := classifyRancherVersion(fromVersion)
+	_, toLine, toErr := classifyRancherVersion(toVersion)
+	if fromErr != nil || toErr != nil {
+		return ""
+	}
+	fromMinor, fromErr := rancherMinorNumber(fromLine)
+	toMinor, toErr := rancherMinorNumber(toLine)
+	if fromErr != nil || toErr != nil {
+		return ""
+	}
+
+	switch {
+	case toMinor < fromMinor:
+		return fmt.Sprintf("goes back from Rancher %s to %s; downgrades are not supported", fromLine, toLine)
+	case toMinor > fromMinor+1:
+		return fmt.Sprintf("skips Rancher minor version(s) between %s and %s", fromLine, toLine)
+	}
+	return ""
+}
+
+func rancherMinorNumber(minorLine string) (int, error) {
+	_, minor, found := strings.Cut(minorLine, ".")
+	if !found {
+		return 0, fmt.Errorf("invalid Rancher minor line %q", minorLine)
+	}
+	return strconv.Atoi(minor)
+}
+
+func buildUpgradePathDialogSection(paths []*instanceUpgradePath) string {
+	if len(paths) == 0 {
+		return ""
+	}
+
+	lines := []string{"Upgrade paths"}
+	for _, path := range paths {
+		var versions []string
+		for _, step := range path.Steps {
+			versions = append(versions, step.Plan.RequestedVersion)
+		}
+		lines = append(lines, fmt.Sprintf("Instance %d: %s", path.Index+1, strings.Join(versions, " -> ")))
+
+		for j, step := range path.Steps {
+			line := fmt.Sprintf("  Step %d: Rancher %s (%s/rancher@%s), K3s %s", j+1, step.Plan.RequestedVersion, step.Plan.ChartRepoAlias, step.Plan.ChartVersion, step.K3SVersion)
+			if step.K3SBumpFirst {
+				line += " (upgrade K3s first)"
+			}
+			lines = append(lines, line)
+			for _, warning := range step.Warnings {
+				lines = append(lines, "    WARNING: "+warning)
+			}
+		}
+	}
+	return strings.Join(lines, "\n")
+}
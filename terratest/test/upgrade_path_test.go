@@ -0,0 +1,89 @@
+package test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestPlanUpgradePathStepKeepsSupportedK3S(t *testing.T) {
+	previous := upgradePathStep{
+		Plan:       &RancherResolvedPlan{RequestedVersion: "2.11.3", LowestK3SMinor: 30, HighestK3SMinor: 32},
+		K3SVersion: "v1.32.5+k3s1",
+	}
+	plan := &RancherResolvedPlan{RequestedVersion: "2.12.4", LowestK3SMinor: 31, HighestK3SMinor: 33}
+
+	step, err := planUpgradePathStep(previous, plan, func(int) (string, error) {
+		t.Fatal("no K3s lookup expected when the current K3s is supported")
+		return "", nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if step.K3SVersion != "v1.32.5+k3s1" || step.K3SBumpFirst || len(step.Warnings) != 0 {
+		t.Fatalf("expected K3s to stay on v1.32.5+k3s1 without warnings, got %+v", step)
+	}
+}
+
+func TestPlanUpgradePathStepFlagsK3SBumpAndMinorSkip(t *testing.T) {
+	previous := upgradePathStep{
+		Plan:       &RancherResolvedPlan{RequestedVersion: "2.11.3", LowestK3SMinor: 30, HighestK3SMinor: 32},
+		K3SVersion: "v1.30.9+k3s1",
+	}
+	plan := &RancherResolvedPlan{RequestedVersion: "2.13-head", LowestK3SMinor: 31, HighestK3SMinor: 34}
+
+	step, err := planUpgradePathStep(previous, plan, func(minor int) (string, error) {
+		if minor != 32 {
+			t.Fatalf("expected the highest common minor v1.32, got v1.%d", minor)
+		}
+		return "v1.32.9+k3s1", nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if step.K3SVersion != "v1.32.9+k3s1" || !step.K3SBumpFirst {
+		t.Fatalf("expected a K3s bump to v1.32.9+k3s1 first, got %+v", step)
+	}
+
+	warnings := strings.Join(step.Warnings, "\n")
+	for _, expected := range []string{"skips Rancher minor version(s) between 2.11 and 2.13", "needs a K3s bump from v1.30.9+k3s1 to v1.32.9+k3s1", "skips Kubernetes minor versions"} {
+		if !strings.Contains(warnings, expected) {
+			t.Fatalf("expected warning %q, got:\n%s", expected, warnings)
+		}
+	}
+}
+
+func TestPlanUpgradePathStepFlagsMissingCommonK3S(t *testing.T) {
+	previous := upgradePathStep{
+		Plan:       &RancherResolvedPlan{RequestedVersion: "2.9.3", LowestK3SMinor: 27, HighestK3SMinor: 30},
+		K3SVersion: "v1.30.9+k3s1",
+	}
+	plan := &RancherResolvedPlan{RequestedVersion: "2.10.1", LowestK3SMinor: 31, HighestK3SMinor: 32, RecommendedK3S: "v1.32.1+k3s1"}
+
+	step, err := planUpgradePathStep(previous, plan, func(int) (string, error) { return "", nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(step.Warnings) != 1 || !strings.Contains(step.Warnings[0], "no K3s minor is supported by both") {
+		t.Fatalf("expected a missing common K3s warning, got %v", step.Warnings)
+	}
+}
+
+func TestConfiguredUpgradePathsValidatesShape(t *testing.T) {
+	t.Cleanup(func() { viper.Set("rancher.upgrade_path", nil) })
+
+	viper.Set("rancher.upgrade_path", []interface{}{[]interface{}{"v2.11.3", "2.12.4"}, []interface{}{}})
+	paths, err := configuredUpgradePaths(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(paths[0], ",") != "2.11.3,2.12.4" || len(paths[1]) != 0 {
+		t.Fatalf("unexpected paths %v", paths)
+	}
+
+	viper.Set("rancher.upgrade_path", []interface{}{[]interface{}{"2.11.3"}})
+	if _, err := configuredUpgradePaths(1); err == nil {
+		t.Fatal("expected a single-version path to be rejected")
+	}
+}
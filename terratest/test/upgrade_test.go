@@ -0,0 +1,96 @@
+package test
+
+import (
+	"testing"
+
+	toolkit "github.com/brudnak/hosted-tenant-rancher/tools"
+	"github.com/gruntwork-io/terratest/modules/terraform"
+	"github.com/spf13/viper"
+)
+
+func TestUpgrade(t *testing.T) {
+	setupConfig(t)
+	if err := validateSecretEnvironment(); err != nil {
+		t.Fatalf("secret environment preflight failed: %v", err)
+	}
+
+	totalInstances := getTotalRancherInstances()
+	versions, err := getRequestedUpgradeVersions(totalInstances)
+	if err != nil {
+		t.Fatalf("invalid upgrade configuration: %v", err)
+	}
+
+	plans, err := resolveRancherUpgradePlans(versions)
+	if err != nil {
+		t.Fatalf("failed to resolve upgrade plans: %v", err)
+	}
+
+	var helmCommands []string
+	for _, plan := range plans {
+		if plan != nil {
+			helmCommands = append(helmCommands, plan.HelmCommands...)
+		}
+	}
+	if err := validateLocalToolingPreflight(helmCommands); err != nil {
+		t.Fatalf("local tooling preflight failed: %v", err)
+	}
+
+	terraformOptions := terraform.WithDefaultRetryableErrors(t, &terraform.Options{
+		TerraformDir: "../modules/aws",
+		NoColor:      true,
+	})
+
+	clusters, err := loadClusterInfra(t, terraformOptions, totalInstances)
+	if err != nil {
+		t.Fatalf("Failed to load cluster infrastructure: %v", err)
+	}
+
+	if err := upgradeRancherEnvironment(clusters, plans); err != nil {
+		t.Fatalf("Upgrade failed: %v", err)
+	}
+}
+
+func TestUpgradeK3S(t *testing.T) {
+	setupConfig(t)
+	if err := validateSecretEnvironment(); err != nil {
+		t.Fatalf("secret environment preflight failed: %v", err)
+	}
+
+	totalInstances := getTotalRancherInstances()
+	versions, err := getRequestedK3SUpgradeVersions(totalInstances)
+	if err != nil {
+		t.Fatalf("invalid K3s upgrade configuration: %v", err)
+	}
+	if err := applyAirgapDefaults(); err != nil {
+		t.Fatalf("airgap configuration failed: %v", err)
+	}
+	if err := refreshHelmRepoIndexes(); err != nil {
+		t.Fatalf("failed to refresh Helm repos: %v", err)
+	}
+	if err := prepareK3SUpgradeArtifacts(versions); err != nil {
+		t.Fatalf("failed to pin K3s artifacts: %v", err)
+	}
+	if toolkit.AirgapEnabled() {
+		if err := stageAirgapK3SArtifacts(versions); err != nil {
+			t.Fatalf("failed to stage K3s artifacts: %v", err)
+		}
+	}
+
+	terraformOptions := terraform.WithDefaultRetryableErrors(t, &terraform.Options{
+		TerraformDir: "../modules/aws",
+		NoColor:      true,
+	})
+
+	clusters, err := loadClusterInfra(t, terraformOptions, totalInstances)
+	if err != nil {
+		t.Fatalf("Failed to load cluster infrastructure: %v", err)
+	}
+
+	steps, err := planK3SUpgrades(clusters, versions)
+	if err != nil {
+		t.Fatalf("failed to plan K3s upgrades: %v", err)
+	}
+	if err := upgradeK3SEnvironment(clusters, steps, viper.GetBool("upgrade.force")); err != nil {
+		t.Fatalf("K3s upgrade failed: %v", err)
+	}
+}
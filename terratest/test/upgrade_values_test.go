@@ -0,0 +1,68 @@
+package test
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBuildUpgradeValuesSwapsImageOverrides(t *testing.T) {
+	current := map[string]interface{}{
+		"hostname":        "rancher.example.com",
+		"rancherImageTag": "v2.12-head",
+		"rancherImage":    "stgregistry.suse.com/rancher/rancher",
+		"extraEnv": []interface{}{
+			map[string]interface{}{"name": "CATTLE_AGENT_IMAGE", "value": "stgregistry.suse.com/rancher/rancher-agent:v2.12-head"},
+			map[string]interface{}{"name": "CATTLE_FEATURES", "value": "x=true"},
+		},
+	}
+
+	values := buildUpgradeValues(current, &RancherResolvedPlan{ChartVersion: "2.13.5"})
+
+	if values["hostname"] != "rancher.example.com" {
+		t.Fatalf("expected existing values to be kept, got %v", values)
+	}
+	if _, ok := values["rancherImageTag"]; ok {
+		t.Fatalf("expected stale rancherImageTag to be removed, got %v", values)
+	}
+	if _, ok := values["rancherImage"]; ok {
+		t.Fatalf("expected stale rancherImage to be removed, got %v", values)
+	}
+	expectedEnv := []interface{}{map[string]interface{}{"name": "CATTLE_FEATURES", "value": "x=true"}}
+	if !reflect.DeepEqual(values["extraEnv"], expectedEnv) {
+		t.Fatalf("expected only non-agent extraEnv to remain, got %v", values["extraEnv"])
+	}
+	if _, ok := current["extraEnv"].([]interface{}); !ok || len(current["extraEnv"].([]interface{})) != 2 {
+		t.Fatalf("expected current values to be left untouched")
+	}
+}
+
+func TestBuildUpgradeValuesPrefixesAgentImageWithSystemDefaultRegistry(t *testing.T) {
+	current := map[string]interface{}{"systemDefaultRegistry": "registry.local:5000"}
+	plan := &RancherResolvedPlan{
+		RancherImage:    "stgregistry.suse.com/rancher/rancher",
+		RancherImageTag: "v2.14-head",
+		AgentImage:      "stgregistry.suse.com/rancher/rancher-agent:v2.14-head",
+	}
+
+	values := buildUpgradeValues(current, plan)
+
+	if values["rancherImage"] != "rancher/rancher" || values["rancherImageTag"] != "v2.14-head" {
+		t.Fatalf("unexpected image values %v", values)
+	}
+	expectedEnv := []interface{}{map[string]interface{}{"name": "CATTLE_AGENT_IMAGE", "value": "registry.local:5000/rancher/rancher-agent:v2.14-head"}}
+	if !reflect.DeepEqual(values["extraEnv"], expectedEnv) {
+		t.Fatalf("unexpected extraEnv %v", values["extraEnv"])
+	}
+}
+
+func TestCheckRancherUpgradeDirectionRefusesDowngrade(t *testing.T) {
+	if err := checkRancherUpgradeDirection("2.13.5", "2.12.4"); err == nil {
+		t.Fatal("expected a downgrade to be refused")
+	}
+	if err := checkRancherUpgradeDirection("2.12.4", "2.13.5"); err != nil {
+		t.Fatalf("expected an upgrade to be allowed, got %v", err)
+	}
+	if err := checkRancherUpgradeDirection("2.13.5", "2.13.5"); err != nil {
+		t.Fatalf("expected a same-version upgrade to be allowed, got %v", err)
+	}
+}
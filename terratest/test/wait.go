@@ -0,0 +1,160 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// waitCondition checks once whether a wait is over. While it is not, status
+// says why, e.g. the last condition message on the object being waited for.
+// A returned error is treated as transient and reported as the status, unless
+// it is wrapped with stopWaiting.
+type waitCondition func(ctx context.Context) (done bool, status string, err error)
+
+// waitProgress is passed to a wait's progress callback after every check.
+type waitProgress struct {
+	Attempt int
+	Elapsed time.Duration
+	Status  string
+	Err     error
+}
+
+// waitOptions configures waitFor. Zero values take the defaults below.
+type waitOptions struct {
+	// Description completes "Waiting for ...", e.g. "cluster x to be Active".
+	Description string
+	Timeout     time.Duration
+
+	// The delay between checks starts at InitialInterval and grows by Factor
+	// up to MaxInterval.
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	Factor          float64
+
+	// Trigger, when set, re-runs the check as soon as it fires instead of at
+	// the next backoff step. Watches feed it.
+	Trigger <-chan struct{}
+
+	// Progress is called after every unsuccessful check. The default logs
+	// when the status changes, and at least once a minute.
+	Progress func(waitProgress)
+
+	// LogPrefix is used by the default progress logger, e.g. "[detach]".
+	LogPrefix string
+}
+
+const (
+	defaultWaitInitialInterval = 2 * time.Second
+	defaultWaitMaxInterval     = 30 * time.Second
+	defaultWaitFactor          = 2.0
+	waitProgressLogInterval    = time.Minute
+)
+
+type stopWaitingError struct{ err error }
+
+func (e stopWaitingError) Error() string { return e.err.Error() }
+func (e stopWaitingError) Unwrap() error { return e.err }
+
+// stopWaiting marks a condition error as final, so waitFor returns it at once.
+func stopWaiting(err error) error {
+	return stopWaitingError{err: err}
+}
+
+// waitFor checks condition with exponential backoff until it is done, it
+// returns a final error, the timeout passes, ctx is canceled, or the
+// deployment is canceled. Timeout errors carry the last status.
+func waitFor(ctx context.Context, opts waitOptions, condition waitCondition) error {
+	opts = opts.withDefaults()
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	interval := opts.InitialInterval
+	lastStatus := ""
+	for attempt := 1; ; attempt++ {
+		done, status, err := condition(ctx)
+		if done {
+			return nil
+		}
+		var stop stopWaitingError
+		if errors.As(err, &stop) {
+			return stop.err
+		}
+		if err != nil {
+			status = err.Error()
+		}
+		if status != "" {
+			lastStatus = status
+		}
+		opts.Progress(waitProgress{Attempt: attempt, Elapsed: time.Since(start), Status: status, Err: err})
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			if lastStatus == "" {
+				return fmt.Errorf("timed out after %v waiting for %s: %w", time.Since(start).Round(time.Second), opts.Description, ctx.Err())
+			}
+			return fmt.Errorf("timed out after %v waiting for %s (last status: %s): %w", time.Since(start).Round(time.Second), opts.Description, lastStatus, ctx.Err())
+		case <-deployCancel.done():
+			timer.Stop()
+			return fmt.Errorf("stopped waiting for %s: %w", opts.Description, errDeploymentCanceled)
+		case <-opts.Trigger:
+			timer.Stop()
+		case <-timer.C:
+		}
+		interval = nextWaitInterval(interval, opts)
+	}
+}
+
+func (opts waitOptions) withDefaults() waitOptions {
+	if opts.InitialInterval <= 0 {
+		opts.InitialInterval = defaultWaitInitialInterval
+	}
+	if opts.MaxInterval <= 0 {
+		opts.MaxInterval = defaultWaitMaxInterval
+	}
+	if opts.MaxInterval < opts.InitialInterval {
+		opts.MaxInterval = opts.InitialInterval
+	}
+	if opts.Factor < 1 {
+		opts.Factor = defaultWaitFactor
+	}
+	if opts.Progress == nil {
+		opts.Progress = logWaitProgress(opts.LogPrefix, opts.Description)
+	}
+	return opts
+}
+
+func nextWaitInterval(interval time.Duration, opts waitOptions) time.Duration {
+	next := time.Duration(float64(interval) * opts.Factor)
+	return min(next, opts.MaxInterval)
+}
+
+// logWaitProgress logs the first check, every status change, and otherwise
+// once a minute, so a long wait is never silent.
+func logWaitProgress(prefix, description string) func(waitProgress) {
+	if prefix != "" {
+		prefix += " "
+	}
+	lastStatus := ""
+	var lastLogged time.Duration
+	return func(progress waitProgress) {
+		if progress.Attempt > 1 && progress.Status == lastStatus && progress.Elapsed-lastLogged < waitProgressLogInterval {
+			return
+		}
+		lastStatus = progress.Status
+		lastLogged = progress.Elapsed
+		status := progress.Status
+		if status == "" {
+			status = "not ready yet"
+		}
+		log.Printf("%sWaiting for %s after %v: %s", prefix, description, progress.Elapsed.Round(time.Second), status)
+	}
+}
@@ -0,0 +1,119 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func fastWaitOptions() waitOptions {
+	return waitOptions{
+		Description:     "the thing",
+		Timeout:         time.Second,
+		InitialInterval: time.Millisecond,
+		MaxInterval:     2 * time.Millisecond,
+		Progress:        func(waitProgress) {},
+	}
+}
+
+func TestWaitForRetriesUntilDone(t *testing.T) {
+	checks := 0
+	err := waitFor(context.Background(), fastWaitOptions(), func(ctx context.Context) (bool, string, error) {
+		checks++
+		if checks == 2 {
+			return false, "", errors.New("connection refused")
+		}
+		return checks >= 3, "still starting", nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if checks != 3 {
+		t.Fatalf("expected 3 checks, got %d", checks)
+	}
+}
+
+func TestWaitForTimeoutReportsLastStatus(t *testing.T) {
+	opts := fastWaitOptions()
+	opts.Timeout = 20 * time.Millisecond
+	err := waitFor(context.Background(), opts, func(ctx context.Context) (bool, string, error) {
+		return false, "Ready: waiting for cluster agent to connect", nil
+	})
+	if err == nil || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a deadline error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "waiting for cluster agent to connect") {
+		t.Fatalf("expected the last status in %q", err)
+	}
+}
+
+func TestWaitForStopsOnFinalError(t *testing.T) {
+	final := errors.New("bad response")
+	checks := 0
+	err := waitFor(context.Background(), fastWaitOptions(), func(ctx context.Context) (bool, string, error) {
+		checks++
+		return false, "", stopWaiting(final)
+	})
+	if !errors.Is(err, final) || checks != 1 {
+		t.Fatalf("expected the final error after one check, got %v after %d checks", err, checks)
+	}
+}
+
+func TestWaitForTriggerSkipsBackoff(t *testing.T) {
+	opts := fastWaitOptions()
+	opts.InitialInterval = time.Hour
+	opts.MaxInterval = time.Hour
+	trigger := make(chan struct{}, 1)
+	opts.Trigger = trigger
+
+	checks := 0
+	err := waitFor(context.Background(), opts, func(ctx context.Context) (bool, string, error) {
+		checks++
+		if checks == 1 {
+			trigger <- struct{}{}
+		}
+		return checks == 2, "", nil
+	})
+	if err != nil {
+		t.Fatalf("expected the trigger to wake the wait, got %v", err)
+	}
+}
+
+func TestNextWaitIntervalBacksOffToMax(t *testing.T) {
+	opts := waitOptions{InitialInterval: 2 * time.Second, MaxInterval: 10 * time.Second}.withDefaults()
+	interval := opts.InitialInterval
+	var got []time.Duration
+	for range 4 {
+		interval = nextWaitInterval(interval, opts)
+		got = append(got, interval)
+	}
+	want := []time.Duration{4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("intervals = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestProvisioningClusterActiveReportsCondition(t *testing.T) {
+	cluster := map[string]interface{}{
+		"status": map[string]interface{}{
+			"ready": false,
+			"conditions": []interface{}{
+				map[string]interface{}{"type": "Created", "status": "True"},
+				map[string]interface{}{"type": "Ready", "status": "False", "message": "waiting for cluster agent to connect"},
+			},
+		},
+	}
+	done, status, err := provisioningClusterActive(cluster)
+	if done || err != nil || status != "Ready: waiting for cluster agent to connect" {
+		t.Fatalf("got done=%t status=%q err=%v", done, status, err)
+	}
+
+	cluster["status"].(map[string]interface{})["ready"] = true
+	if done, _, _ := provisioningClusterActive(cluster); !done {
+		t.Fatalf("expected a ready cluster to be Active")
+	}
+}
@@ -0,0 +1,88 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/rest"
+)
+
+var provisioningClusterResource = schema.GroupVersionResource{
+	Group:    "provisioning.cattle.io",
+	Version:  "v1",
+	Resource: "clusters",
+}
+
+// hostRESTConfig reaches the host Rancher's local cluster through Rancher's
+// Kubernetes API proxy with an API token, so watches need no kubeconfig.
+func hostRESTConfig(hostURL, token string) *rest.Config {
+	return &rest.Config{
+		Host:            fmt.Sprintf("https://%s/k8s/clusters/local", hostURL),
+		BearerToken:     token,
+		TLSClientConfig: rest.TLSClientConfig{Insecure: true},
+	}
+}
+
+// watchTrigger fires whenever the watch opened by open reports an event, for
+// use as waitOptions.Trigger. The watch is re-opened when the server closes it
+// and stops with ctx. If it cannot be opened, the wait just keeps polling.
+func watchTrigger(ctx context.Context, logPrefix string, open func(ctx context.Context) (watch.Interface, error)) <-chan struct{} {
+	trigger := make(chan struct{}, 1)
+	go func() {
+		for ctx.Err() == nil {
+			watcher, err := open(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Printf("%s Watch unavailable, polling instead: %v", logPrefix, err)
+				}
+				return
+			}
+			for range watcher.ResultChan() {
+				select {
+				case trigger <- struct{}{}:
+				default:
+				}
+			}
+			watcher.Stop()
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
+		}
+	}()
+	return trigger
+}
+
+// objectConditionStatus explains why an object is not ready yet from its
+// status.conditions: the first condition that is not True, with its message
+// when it has one.
+func objectConditionStatus(object map[string]interface{}) string {
+	conditions, _, _ := unstructured.NestedSlice(object, "status", "conditions")
+	for _, item := range conditions {
+		condition, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		conditionType, _ := condition["type"].(string)
+		status, _ := condition["status"].(string)
+		if status == "True" {
+			continue
+		}
+		message, _ := condition["message"].(string)
+		if message == "" {
+			message, _ = condition["reason"].(string)
+		}
+		if message == "" {
+			return fmt.Sprintf("%s=%s", conditionType, status)
+		}
+		return fmt.Sprintf("%s: %s", conditionType, strings.TrimSpace(message))
+	}
+	return ""
+}
@@ -0,0 +1,120 @@
+package toolkit
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// AirgapEnabled reports whether K3s and Rancher are installed from the airgap
+// bundle and a local registry instead of their upstream sources.
+func AirgapEnabled() bool {
+	return viper.GetBool("airgap.enabled")
+}
+
+// AirgapRegistry is the registry the Rancher and K3s images are mirrored to.
+func AirgapRegistry() string {
+	return strings.TrimSuffix(strings.TrimSpace(viper.GetString("airgap.registry")), "/")
+}
+
+// K3s artifacts a node downloads while installing. In airgap mode each one is
+// staged in the run bucket and nodes fetch it from there, never from GitHub.
+const (
+	K3SInstallScriptAsset = "install.sh"
+	K3SBinaryAsset        = "k3s"
+	K3SAirgapImageAsset   = "k3s-airgap-images-amd64.tar.zst"
+)
+
+// K3SArtifactAssets are the artifacts an airgap install of one K3s version needs.
+var K3SArtifactAssets = []string{K3SInstallScriptAsset, K3SBinaryAsset, K3SAirgapImageAsset}
+
+var (
+	stagedK3SArtifactsMu sync.Mutex
+	stagedK3SArtifacts   = map[string]string{}
+)
+
+// SetStagedK3SArtifactURL records where nodes download asset for version from.
+func SetStagedK3SArtifactURL(version, asset, url string) {
+	stagedK3SArtifactsMu.Lock()
+	defer stagedK3SArtifactsMu.Unlock()
+	stagedK3SArtifacts[version+"/"+asset] = url
+}
+
+// K3SArtifactSourceURL is the upstream location of asset for version.
+func K3SArtifactSourceURL(version, asset string) string {
+	escapedVersion := strings.ReplaceAll(version, "+", "%2B")
+	if asset == K3SInstallScriptAsset {
+		return fmt.Sprintf("https://raw.githubusercontent.com/k3s-io/k3s/%s/install.sh", escapedVersion)
+	}
+	return fmt.Sprintf("https://github.com/k3s-io/k3s/releases/download/%s/%s", escapedVersion, asset)
+}
+
+// K3SArtifactSHA256 returns the pinned checksum of asset for version.
+func K3SArtifactSHA256(version, asset string) (string, error) {
+	switch asset {
+	case K3SInstallScriptAsset:
+		return k3SChecksumForVersion("k3s.install_script_sha256s", version)
+	case K3SBinaryAsset:
+		return k3SChecksumForVersion("k3s.binary_sha256s", version)
+	case K3SAirgapImageAsset:
+		return k3SChecksumForVersion("k3s.airgap_image_sha256s", version)
+	}
+	return "", fmt.Errorf("unknown K3s artifact %q", asset)
+}
+
+// k3sArtifactURL is where a node downloads asset for version: the staged copy
+// when there is one, otherwise upstream. Airgap mode refuses to fall back to
+// upstream so an unstaged artifact fails instead of reaching out to GitHub.
+func k3sArtifactURL(version, asset string) (string, error) {
+	stagedK3SArtifactsMu.Lock()
+	url := stagedK3SArtifacts[version+"/"+asset]
+	stagedK3SArtifactsMu.Unlock()
+	if url != "" {
+		return url, nil
+	}
+	if AirgapEnabled() {
+		return "", fmt.Errorf("K3s %s %s has not been staged for the airgap install", version, asset)
+	}
+	return K3SArtifactSourceURL(version, asset), nil
+}
+
+// installK3SBinary downloads the staged K3s binary, checks it against
+// k3s.binary_sha256s and installs it so the installer can run with
+// INSTALL_K3S_SKIP_DOWNLOAD.
+func (t *Tools) installK3SBinary(node K3SNode, version string) error {
+	binarySHA256, err := k3SChecksumForVersion("k3s.binary_sha256s", version)
+	if err != nil {
+		return err
+	}
+
+	binaryURL, err := k3sArtifactURL(version, K3SBinaryAsset)
+	if err != nil {
+		return err
+	}
+	cmd := fmt.Sprintf(
+		`tmp_binary="$(mktemp /tmp/k3s-binary.XXXXXX)"
+trap 'rm -f "$tmp_binary"' EXIT
+
+curl -fsSL -o "$tmp_binary" %s
+
+if ! echo %s"  $tmp_binary" | sha256sum -c -; then
+  echo "############################################################" >&2
+  echo "# SECURITY ERROR: K3s binary checksum validation failed     #" >&2
+  echo "# Refusing to install the downloaded binary.                #" >&2
+  echo "# Check k3s.version and k3s.binary_sha256s.                 #" >&2
+  echo "############################################################" >&2
+  exit 1
+fi
+
+sudo install -m 0755 "$tmp_binary" /usr/local/bin/k3s`,
+		shellQuote(binaryURL),
+		shellQuote(binarySHA256),
+	)
+	if _, err := t.RunCommand(cmd, node); err != nil {
+		return fmt.Errorf("failed installing K3s %s binary: %w", version, err)
+	}
+
+	return nil
+}
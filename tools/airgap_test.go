@@ -0,0 +1,34 @@
+package toolkit
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestK3SArtifactURLUsesStagedCopyAndRefusesUpstreamInAirgap(t *testing.T) {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	t.Cleanup(func() {
+		stagedK3SArtifactsMu.Lock()
+		stagedK3SArtifacts = map[string]string{}
+		stagedK3SArtifactsMu.Unlock()
+	})
+
+	url, err := k3sArtifactURL("v1.33.1+k3s1", K3SBinaryAsset)
+	if err != nil || url != "https://github.com/k3s-io/k3s/releases/download/v1.33.1%2Bk3s1/k3s" {
+		t.Fatalf("expected the upstream binary URL, got %q, %v", url, err)
+	}
+
+	viper.Set("airgap.enabled", true)
+	if _, err := k3sArtifactURL("v1.33.1+k3s1", K3SInstallScriptAsset); err == nil || !strings.Contains(err.Error(), "has not been staged") {
+		t.Fatalf("expected an unstaged airgap artifact to fail, got %v", err)
+	}
+
+	SetStagedK3SArtifactURL("v1.33.1+k3s1", K3SInstallScriptAsset, "https://bucket.s3.amazonaws.com/install.sh?X-Amz-Signature=abc")
+	url, err = k3sArtifactURL("v1.33.1+k3s1", K3SInstallScriptAsset)
+	if err != nil || url != "https://bucket.s3.amazonaws.com/install.sh?X-Amz-Signature=abc" {
+		t.Fatalf("expected the staged installer URL, got %q, %v", url, err)
+	}
+}
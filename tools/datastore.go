@@ -0,0 +1,102 @@
+package toolkit
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// k3sDatabase is the database name in the datastore-endpoint K3s is installed with.
+const k3sDatabase = "k3s"
+
+// StopK3S stops the K3s service on node, leaving its datastore untouched.
+func (t *Tools) StopK3S(node K3SNode) error {
+	log.Printf("[datastore] Stopping K3s on %s...", node)
+	if _, err := t.RunCommand("sudo systemctl stop k3s", node); err != nil {
+		return fmt.Errorf("failed stopping K3s on %s: %w", node, err)
+	}
+	return nil
+}
+
+// StartK3S starts the K3s service on node and waits for it to be Ready.
+func (t *Tools) StartK3S(node K3SNode) error {
+	log.Printf("[datastore] Starting K3s on %s...", node)
+	if _, err := t.RunCommand("sudo systemctl start k3s", node); err != nil {
+		t.logK3SDiagnostics(node)
+		return fmt.Errorf("failed starting K3s on %s: %w", node, err)
+	}
+	if err := t.WaitForNodeReady(node); err != nil {
+		t.logK3SDiagnostics(node)
+		return fmt.Errorf("K3s on %s did not come back: %w", node, err)
+	}
+	return nil
+}
+
+// DumpK3SDatastore runs mysqldump of the K3s database from the first node,
+// which can reach the datastore, and uploads the gzipped dump to uploadURL
+// (a presigned S3 PUT URL).
+func (t *Tools) DumpK3SDatastore(config K3SConfig, uploadURL string) error {
+	host, port := datastoreHostPort(config.DBEndpoint)
+	cmd := fmt.Sprintf(`%s
+tmp_dump="$(mktemp /tmp/k3s-datastore.XXXXXX)"
+trap 'rm -f "$tmp_dump"' EXIT
+MYSQL_PWD=%s mysqldump -h %s -P %s -u tfadmin --single-transaction --set-gtid-purged=OFF --add-drop-database --databases %s | gzip > "$tmp_dump"
+curl -fsS -X PUT -T "$tmp_dump" %s`,
+		mysqlClientInstallScript,
+		shellQuote(config.DBPassword),
+		shellQuote(host),
+		shellQuote(port),
+		k3sDatabase,
+		shellQuote(uploadURL),
+	)
+
+	log.Printf("[datastore] Dumping the K3s database from %s...", config.Node1)
+	if _, err := t.RunCommand(cmd, config.Node1); err != nil {
+		return fmt.Errorf("failed dumping the K3s datastore: %w", err)
+	}
+	return nil
+}
+
+// RestoreK3SDatastore downloads a dump written by DumpK3SDatastore from
+// downloadURL and loads it, replacing the K3s database. K3s must be stopped
+// on every node first.
+func (t *Tools) RestoreK3SDatastore(config K3SConfig, downloadURL string) error {
+	host, port := datastoreHostPort(config.DBEndpoint)
+	cmd := fmt.Sprintf(`%s
+tmp_dump="$(mktemp /tmp/k3s-datastore.XXXXXX)"
+trap 'rm -f "$tmp_dump"' EXIT
+curl -fsS -o "$tmp_dump" %s
+gunzip -c "$tmp_dump" | MYSQL_PWD=%s mysql -h %s -P %s -u tfadmin`,
+		mysqlClientInstallScript,
+		shellQuote(downloadURL),
+		shellQuote(config.DBPassword),
+		shellQuote(host),
+		shellQuote(port),
+	)
+
+	log.Printf("[datastore] Loading the K3s database from a dump on %s...", config.Node1)
+	if _, err := t.RunCommand(cmd, config.Node1); err != nil {
+		return fmt.Errorf("failed restoring the K3s datastore: %w", err)
+	}
+	return nil
+}
+
+// mysqlClientInstallScript installs the MySQL client on the node when it is missing.
+const mysqlClientInstallScript = `if ! command -v mysqldump >/dev/null 2>&1; then
+  if command -v apt-get >/dev/null 2>&1; then
+    sudo apt-get update -y >/dev/null
+    sudo DEBIAN_FRONTEND=noninteractive apt-get install -y mysql-client >/dev/null
+  elif command -v dnf >/dev/null 2>&1; then
+    sudo dnf install -y mariadb105 >/dev/null
+  else
+    sudo yum install -y mysql >/dev/null
+  fi
+fi`
+
+func datastoreHostPort(endpoint string) (string, string) {
+	host, port, found := strings.Cut(endpoint, ":")
+	if !found || port == "" {
+		return host, "3306"
+	}
+	return host, port
+}
@@ -7,6 +7,7 @@ require (
 	github.com/hashicorp/hcl/v2 v2.17.0
 	github.com/spf13/viper v1.14.0
 	github.com/zclconf/go-cty v1.13.2
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -30,5 +31,4 @@ require (
 	golang.org/x/text v0.4.0 // indirect
 	gopkg.in/ini.v1 v1.67.0 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -1,56 +1,183 @@
 package hcl
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 
+	hcl2 "github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/ext/typeexpr"
+	"github.com/hashicorp/hcl/v2/hclparse"
 	"github.com/hashicorp/hcl/v2/hclwrite"
-	"github.com/spf13/viper"
 	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
 )
 
-func GenAwsVar(
-	awsPrefix,
-	awsVpc,
-	subnetA,
-	subnetB,
-	subnetC,
-	awsAmi,
-	subnetId,
-	securityGroupId,
-	pemKeyName,
-	awsRdsPassword,
-	route53Fqdn,
-	instanceTypeSize string) {
+// TFVarsOptions controls where WriteTFVars reads variable declarations from
+// and where it writes the tfvars file.
+type TFVarsOptions struct {
+	// ModuleDir holds the *.tf files whose variable blocks define the
+	// accepted names and types.
+	ModuleDir string
+	// OutputPath defaults to terraform.tfvars inside ModuleDir.
+	OutputPath string
+}
 
-	f := hclwrite.NewEmptyFile()
+// Variable is a variable block declared in a Terraform module.
+type Variable struct {
+	Name       string
+	Type       cty.Type
+	HasDefault bool
+}
+
+var variableBlockSchema = &hcl2.BodySchema{
+	Blocks: []hcl2.BlockHeaderSchema{{Type: "variable", LabelNames: []string{"name"}}},
+}
+
+var variableBodySchema = &hcl2.BodySchema{
+	Attributes: []hcl2.AttributeSchema{{Name: "type"}, {Name: "default"}},
+}
 
-	tfVarsFile, err := os.Create("../../terratest/modules/aws/terraform.tfvars")
+// WriteTFVars converts values to the types declared in the module and writes
+// them as a tfvars file. Values for undeclared variables, values that do not
+// convert to the declared type and missing required variables are errors.
+// Empty strings for variables with a default are skipped.
+func WriteTFVars(values map[string]interface{}, opts TFVarsOptions) error {
+	variables, err := ReadVariables(opts.ModuleDir)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return err
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
 	}
-	defer tfVarsFile.Close()
+	sort.Strings(names)
 
+	f := hclwrite.NewEmptyFile()
 	rootBody := f.Body()
 
-	rootBody.SetAttributeValue("aws_prefix", cty.StringVal(awsPrefix))
-	rootBody.SetAttributeValue("aws_vpc", cty.StringVal(awsVpc))
-	rootBody.SetAttributeValue("aws_subnet_a", cty.StringVal(subnetA))
-	rootBody.SetAttributeValue("aws_subnet_b", cty.StringVal(subnetB))
-	rootBody.SetAttributeValue("aws_subnet_c", cty.StringVal(subnetC))
-	rootBody.SetAttributeValue("aws_ami", cty.StringVal(awsAmi))
-	rootBody.SetAttributeValue("aws_subnet_id", cty.StringVal(subnetId))
-	rootBody.SetAttributeValue("aws_security_group_id", cty.StringVal(securityGroupId))
-	rootBody.SetAttributeValue("aws_pem_key_name", cty.StringVal(pemKeyName))
-	rootBody.SetAttributeValue("aws_rds_password", cty.StringVal(awsRdsPassword))
-	rootBody.SetAttributeValue("aws_route53_fqdn", cty.StringVal(route53Fqdn))
-	rootBody.SetAttributeValue("aws_ec2_instance_type", cty.StringVal(instanceTypeSize))
-	rootBody.SetAttributeValue("total_rancher_instances", cty.NumberIntVal(int64(viper.GetInt("total_rancher_instances"))))
-
-	_, err = tfVarsFile.Write(f.Bytes())
+	var problems []string
+	for _, name := range names {
+		variable, ok := variables[name]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s is not declared in %s", name, opts.ModuleDir))
+			continue
+		}
+		// An empty string for a variable with a default means "not set".
+		if values[name] == "" && variable.HasDefault {
+			continue
+		}
+
+		value, err := ToCtyValue(values[name], variable.Type)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+			continue
+		}
+		rootBody.SetAttributeValue(name, value)
+	}
+
+	for _, name := range sortedVariableNames(variables) {
+		if value, ok := values[name]; (!ok || value == nil) && !variables[name].HasDefault {
+			problems = append(problems, fmt.Sprintf("%s is required but has no value", name))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid tf_vars: %s", strings.Join(problems, "; "))
+	}
+
+	outputPath := opts.OutputPath
+	if outputPath == "" {
+		outputPath = filepath.Join(opts.ModuleDir, "terraform.tfvars")
+	}
+	if err := os.WriteFile(outputPath, f.Bytes(), 0o600); err != nil {
+		return fmt.Errorf("failed to write %s: %w", outputPath, err)
+	}
+
+	return nil
+}
+
+// ReadVariables parses every variable block in the *.tf files of moduleDir.
+func ReadVariables(moduleDir string) (map[string]Variable, error) {
+	files, err := filepath.Glob(filepath.Join(moduleDir, "*.tf"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no .tf files found in %s", moduleDir)
+	}
+
+	parser := hclparse.NewParser()
+	variables := map[string]Variable{}
+	for _, file := range files {
+		parsed, diags := parser.ParseHCLFile(file)
+		if diags.HasErrors() {
+			return nil, fmt.Errorf("failed to parse %s: %s", file, diags.Error())
+		}
+
+		content, _, diags := parsed.Body.PartialContent(variableBlockSchema)
+		if diags.HasErrors() {
+			return nil, fmt.Errorf("failed to read variables from %s: %s", file, diags.Error())
+		}
+
+		for _, block := range content.Blocks {
+			variable := Variable{Name: block.Labels[0], Type: cty.DynamicPseudoType}
+
+			body, _, diags := block.Body.PartialContent(variableBodySchema)
+			if diags.HasErrors() {
+				return nil, fmt.Errorf("failed to read variable %s in %s: %s", variable.Name, file, diags.Error())
+			}
+			if attr, ok := body.Attributes["type"]; ok {
+				variable.Type, _, diags = typeexpr.TypeConstraintWithDefaults(attr.Expr)
+				if diags.HasErrors() {
+					return nil, fmt.Errorf("invalid type for variable %s in %s: %s", variable.Name, file, diags.Error())
+				}
+			}
+			_, variable.HasDefault = body.Attributes["default"]
+
+			variables[variable.Name] = variable
+		}
+	}
+
+	return variables, nil
+}
+
+// ToCtyValue converts a config value (as decoded from YAML) to ty.
+func ToCtyValue(value interface{}, ty cty.Type) (cty.Value, error) {
+	if value == nil {
+		return cty.NullVal(ty), nil
+	}
+
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return cty.NilVal, fmt.Errorf("unsupported value: %w", err)
+	}
+	impliedType, err := ctyjson.ImpliedType(raw)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return cty.NilVal, err
+	}
+	implied, err := ctyjson.Unmarshal(raw, impliedType)
+	if err != nil {
+		return cty.NilVal, err
+	}
+
+	converted, err := convert.Convert(implied, ty)
+	if err != nil {
+		return cty.NilVal, fmt.Errorf("expected %s: %w", typeexpr.TypeString(ty), err)
+	}
+	return converted, nil
+}
+
+func sortedVariableNames(variables map[string]Variable) []string {
+	names := make([]string, 0, len(variables))
+	for name := range variables {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	return names
 }
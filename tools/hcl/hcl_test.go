@@ -0,0 +1,99 @@
+package hcl
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const tfVarsTestVariables = `
+variable "aws_prefix" {
+  type = string
+}
+
+variable "total_rancher_instances" {
+  type    = number
+  default = 2
+}
+
+variable "aws_node_addressing" {
+  type    = string
+  default = "public_ip"
+}
+
+variable "instance_overrides" {
+  type = map(object({
+    aws_ec2_instance_type = optional(string)
+  }))
+  default = {}
+}
+`
+
+func writeTFVarsTestModule(t *testing.T) string {
+	t.Helper()
+	moduleDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(moduleDir, "variables.tf"), []byte(tfVarsTestVariables), 0o644); err != nil {
+		t.Fatalf("failed to write variables.tf: %v", err)
+	}
+	return moduleDir
+}
+
+func TestWriteTFVarsConvertsNestedValues(t *testing.T) {
+	moduleDir := writeTFVarsTestModule(t)
+	outputPath := filepath.Join(t.TempDir(), "custom.tfvars")
+
+	err := WriteTFVars(map[string]interface{}{
+		"aws_prefix":              "abc",
+		"total_rancher_instances": "3",
+		"aws_node_addressing":     "",
+		"instance_overrides": map[string]interface{}{
+			"2": map[string]interface{}{"aws_ec2_instance_type": "m5.xlarge"},
+		},
+	}, TFVarsOptions{ModuleDir: moduleDir, OutputPath: outputPath})
+	if err != nil {
+		t.Fatalf("WriteTFVars returned error: %v", err)
+	}
+
+	content, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatalf("failed to read tfvars: %v", err)
+	}
+	written := string(content)
+	for _, expected := range []string{`aws_prefix = "abc"`, "total_rancher_instances = 3", `aws_ec2_instance_type = "m5.xlarge"`} {
+		if !strings.Contains(written, expected) {
+			t.Fatalf("expected tfvars to contain %q, got:\n%s", expected, written)
+		}
+	}
+	if strings.Contains(written, "aws_node_addressing") {
+		t.Fatalf("expected empty aws_node_addressing to fall back to its default, got:\n%s", written)
+	}
+}
+
+func TestWriteTFVarsRejectsUndeclaredAndMistypedValues(t *testing.T) {
+	moduleDir := writeTFVarsTestModule(t)
+
+	err := WriteTFVars(map[string]interface{}{
+		"aws_prefix":              "abc",
+		"total_rancher_instances": "three",
+		"aws_unknown":             "x",
+	}, TFVarsOptions{ModuleDir: moduleDir})
+	if err == nil {
+		t.Fatal("expected an error for undeclared and mistyped values")
+	}
+	if !strings.Contains(err.Error(), "aws_unknown is not declared") || !strings.Contains(err.Error(), "total_rancher_instances") {
+		t.Fatalf("expected both problems to be reported, got %v", err)
+	}
+	if _, statErr := os.Stat(filepath.Join(moduleDir, "terraform.tfvars")); !os.IsNotExist(statErr) {
+		t.Fatal("expected no tfvars file to be written on error")
+	}
+}
+
+func TestWriteTFVarsRequiresVariablesWithoutDefault(t *testing.T) {
+	moduleDir := writeTFVarsTestModule(t)
+
+	err := WriteTFVars(map[string]interface{}{}, TFVarsOptions{ModuleDir: moduleDir})
+	if err == nil || !strings.Contains(err.Error(), "aws_prefix is required") {
+		t.Fatalf("expected missing aws_prefix to be reported, got %v", err)
+	}
+}
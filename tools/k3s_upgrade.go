@@ -0,0 +1,95 @@
+package toolkit
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The steps of an in-place K3s server upgrade. The test package runs them in
+// order: drain, install, wait for Ready on the new version, uncordon.
+
+// DrainK3SNode cordons nodeName and evicts its pods.
+func (t *Tools) DrainK3SNode(node K3SNode, nodeName string) error {
+	drain := fmt.Sprintf("sudo k3s kubectl drain %s --ignore-daemonsets --delete-emptydir-data --timeout=300s", shellQuote(nodeName))
+	if _, err := t.RunCommand(drain, node); err != nil {
+		return fmt.Errorf("failed draining %s: %w", nodeName, err)
+	}
+	return nil
+}
+
+// InstallK3SUpgrade preloads the images for version when that is enabled and
+// re-runs the verified installer for version.
+func (t *Tools) InstallK3SUpgrade(node K3SNode, version string) error {
+	if err := t.preloadK3SImages(node, version); err != nil {
+		return err
+	}
+	if err := t.installK3SServer(node, version); err != nil {
+		return fmt.Errorf("failed installing K3s %s on %s: %w", version, node, err)
+	}
+	return nil
+}
+
+// UncordonK3SNode lets pods schedule on nodeName again.
+func (t *Tools) UncordonK3SNode(node K3SNode, nodeName string) error {
+	if _, err := t.RunCommand("sudo k3s kubectl uncordon "+shellQuote(nodeName), node); err != nil {
+		return fmt.Errorf("failed uncordoning %s: %w", nodeName, err)
+	}
+	return nil
+}
+
+// LogK3SDiagnostics logs the K3s service status and recent journal of node.
+func (t *Tools) LogK3SDiagnostics(node K3SNode) {
+	t.logK3SDiagnostics(node)
+}
+
+// K3SVersion returns the K3s version installed on node, e.g. v1.32.5+k3s1.
+func (t *Tools) K3SVersion(node K3SNode) (string, error) {
+	output, err := t.RunCommand("k3s --version", node)
+	if err != nil {
+		return "", fmt.Errorf("failed reading K3s version on %s: %w", node, err)
+	}
+	return parseK3SVersionOutput(output)
+}
+
+// K3SNodeName returns the Kubernetes node name of node, its hostname.
+func (t *Tools) K3SNodeName(node K3SNode) (string, error) {
+	output, err := t.RunCommand("hostname", node)
+	if err != nil {
+		return "", fmt.Errorf("failed reading hostname of %s: %w", node, err)
+	}
+	name := strings.TrimSpace(output)
+	if name == "" {
+		return "", fmt.Errorf("empty hostname on %s", node)
+	}
+	return name, nil
+}
+
+// K3SNodeStatus returns the kubelet version of nodeName and whether the node
+// is Ready. The test package polls it after an upgrade.
+func (t *Tools) K3SNodeStatus(node K3SNode, nodeName string) (string, bool, error) {
+	cmd := fmt.Sprintf(`sudo k3s kubectl get node %s -o jsonpath='{.status.nodeInfo.kubeletVersion} {.status.conditions[?(@.type=="Ready")].status}'`, shellQuote(nodeName))
+	output, err := t.RunCommand(cmd, node)
+	if err != nil {
+		return "", false, fmt.Errorf("failed reading the status of %s: %w", nodeName, err)
+	}
+	version, ready := parseK3SNodeStatus(output)
+	return version, ready, nil
+}
+
+// parseK3SNodeStatus splits "<kubeletVersion> <Ready status>" output.
+func parseK3SNodeStatus(output string) (string, bool) {
+	fields := strings.Fields(output)
+	if len(fields) == 0 {
+		return "", false
+	}
+	return fields[0], len(fields) > 1 && fields[1] == "True"
+}
+
+func parseK3SVersionOutput(output string) (string, error) {
+	for _, field := range strings.Fields(output) {
+		if strings.HasPrefix(field, "v1.") && strings.Contains(field, "+k3s") {
+			return field, nil
+		}
+	}
+	return "", fmt.Errorf("could not find a K3s version in %q", strings.TrimSpace(output))
+}
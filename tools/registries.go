@@ -0,0 +1,250 @@
+package toolkit
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// k3sRegistryCertDir holds registry CA bundles uploaded to the nodes.
+const k3sRegistryCertDir = "/etc/rancher/k3s/certs"
+
+// RegistriesConfig is the registries block of tool-config.yml. Mirrors and
+// Configs are keyed by registry host, as in the K3s registries.yaml.
+type RegistriesConfig struct {
+	Mirrors               map[string]RegistryMirror `mapstructure:"mirrors"`
+	Configs               map[string]RegistryConfig `mapstructure:"configs"`
+	SystemDefaultRegistry string                    `mapstructure:"system_default_registry"`
+}
+
+type RegistryMirror struct {
+	Endpoints []string `mapstructure:"endpoints"`
+	// Rewrites maps a repository regex to its replacement. It is read from
+	// the config file itself, see configuredRegistryRewrites.
+	Rewrites map[string]string `mapstructure:"rewrites"`
+}
+
+type RegistryConfig struct {
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	// PasswordEnv names an environment variable holding the password so it
+	// can stay out of tool-config.yml.
+	PasswordEnv string `mapstructure:"password_env"`
+	// CAFile is a local PEM file uploaded to every node.
+	CAFile             string `mapstructure:"ca_file"`
+	InsecureSkipVerify bool   `mapstructure:"insecure_skip_verify"`
+}
+
+// ConfiguredRegistries reads the registries block and folds in the Docker Hub
+// credentials, unless docker.io already has its own config.
+func ConfiguredRegistries() (RegistriesConfig, error) {
+	var registries RegistriesConfig
+	if err := viper.UnmarshalKey("registries", &registries); err != nil {
+		return RegistriesConfig{}, fmt.Errorf("invalid registries config: %w", err)
+	}
+	registries.SystemDefaultRegistry = strings.TrimSuffix(strings.TrimSpace(registries.SystemDefaultRegistry), "/")
+
+	rewrites, err := configuredRegistryRewrites()
+	if err != nil {
+		return RegistriesConfig{}, err
+	}
+	for host, mirror := range registries.Mirrors {
+		if hostRewrites, ok := rewrites[host]; ok {
+			mirror.Rewrites = hostRewrites
+			registries.Mirrors[host] = mirror
+		}
+	}
+
+	if registries.Configs == nil {
+		registries.Configs = map[string]RegistryConfig{}
+	}
+	// Relative CA paths are resolved against the directory of tool-config.yml.
+	for host, registry := range registries.Configs {
+		if registry.CAFile != "" && !filepath.IsAbs(registry.CAFile) && viper.ConfigFileUsed() != "" {
+			registry.CAFile = filepath.Join(filepath.Dir(viper.ConfigFileUsed()), registry.CAFile)
+			registries.Configs[host] = registry
+		}
+	}
+	dockerHubUser, dockerHubPassword := DockerHubCredentials()
+	if _, exists := registries.Configs["docker.io"]; !exists && dockerHubUser != "" && dockerHubPassword != "" {
+		registries.Configs["docker.io"] = RegistryConfig{Username: dockerHubUser, Password: dockerHubPassword}
+	}
+
+	if err := registries.validate(); err != nil {
+		return RegistriesConfig{}, err
+	}
+	return registries, nil
+}
+
+// configuredRegistryRewrites reads each mirror's rewrites straight from the
+// config file, because viper lowercases map keys and the keys here are
+// case-sensitive regexes. The result is keyed by lowercased host, as viper
+// keys the mirrors.
+func configuredRegistryRewrites() (map[string]map[string]string, error) {
+	configPath := strings.TrimSpace(viper.ConfigFileUsed())
+	if configPath == "" {
+		return nil, nil
+	}
+
+	content, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var parsed struct {
+		Registries struct {
+			Mirrors map[string]struct {
+				Rewrites map[string]string `yaml:"rewrites"`
+			} `yaml:"mirrors"`
+		} `yaml:"registries"`
+	}
+	if err := yaml.Unmarshal(content, &parsed); err != nil {
+		return nil, fmt.Errorf("failed to parse registries in %s: %w", configPath, err)
+	}
+
+	rewrites := map[string]map[string]string{}
+	for host, mirror := range parsed.Registries.Mirrors {
+		if len(mirror.Rewrites) > 0 {
+			rewrites[strings.ToLower(host)] = mirror.Rewrites
+		}
+	}
+	return rewrites, nil
+}
+
+// SystemDefaultRegistry is the registry prefix for Rancher and K3s system
+// images, or empty when images come from their upstream registries.
+func SystemDefaultRegistry() string {
+	return strings.TrimSuffix(strings.TrimSpace(viper.GetString("registries.system_default_registry")), "/")
+}
+
+func (r RegistriesConfig) empty() bool {
+	return len(r.Mirrors) == 0 && len(r.Configs) == 0
+}
+
+func (r RegistriesConfig) validate() error {
+	for host, mirror := range r.Mirrors {
+		if len(mirror.Endpoints) == 0 {
+			return fmt.Errorf("registries.mirrors.%s needs at least one endpoint", host)
+		}
+		for _, endpoint := range mirror.Endpoints {
+			if !strings.HasPrefix(endpoint, "https://") && !strings.HasPrefix(endpoint, "http://") {
+				return fmt.Errorf("registries.mirrors.%s endpoint %q must start with https:// or http://", host, endpoint)
+			}
+		}
+	}
+	for host, registry := range r.Configs {
+		if (registry.Username == "") != (registry.ResolvedPassword() == "") {
+			return fmt.Errorf("registries.configs.%s needs both a username and a password", host)
+		}
+		if registry.CAFile != "" {
+			if _, err := os.Stat(registry.CAFile); err != nil {
+				return fmt.Errorf("registries.configs.%s ca_file: %w", host, err)
+			}
+		}
+	}
+	return nil
+}
+
+// ResolvedPassword returns the password, reading PasswordEnv when it is set.
+func (c RegistryConfig) ResolvedPassword() string {
+	if c.PasswordEnv != "" {
+		return strings.TrimSpace(os.Getenv(c.PasswordEnv))
+	}
+	return c.Password
+}
+
+// registryCAPath is where the CA for host is written on the nodes.
+func registryCAPath(host string) string {
+	return path.Join(k3sRegistryCertDir, strings.NewReplacer(":", "_", "/", "_").Replace(host)+"-ca.pem")
+}
+
+func buildK3SRegistriesContent(registries RegistriesConfig) string {
+	var lines []string
+
+	if len(registries.Mirrors) > 0 {
+		lines = append(lines, "mirrors:")
+		for _, host := range sortedKeys(registries.Mirrors) {
+			mirror := registries.Mirrors[host]
+			lines = append(lines, fmt.Sprintf("  %s:", yamlQuote(host)), "    endpoint:")
+			for _, endpoint := range mirror.Endpoints {
+				lines = append(lines, fmt.Sprintf("      - %s", yamlQuote(endpoint)))
+			}
+			if len(mirror.Rewrites) > 0 {
+				lines = append(lines, "    rewrite:")
+				for _, pattern := range sortedKeys(mirror.Rewrites) {
+					lines = append(lines, fmt.Sprintf("      %s: %s", yamlQuote(pattern), yamlQuote(mirror.Rewrites[pattern])))
+				}
+			}
+		}
+	}
+
+	if len(registries.Configs) > 0 {
+		lines = append(lines, "configs:")
+		for _, host := range sortedKeys(registries.Configs) {
+			registry := registries.Configs[host]
+			lines = append(lines, fmt.Sprintf("  %s:", yamlQuote(host)))
+			if registry.Username != "" {
+				lines = append(lines,
+					"    auth:",
+					fmt.Sprintf("      username: %s", yamlQuote(registry.Username)),
+					fmt.Sprintf("      password: %s", yamlQuote(registry.ResolvedPassword())),
+				)
+			}
+			if registry.CAFile != "" || registry.InsecureSkipVerify {
+				lines = append(lines, "    tls:")
+				if registry.CAFile != "" {
+					lines = append(lines, fmt.Sprintf("      ca_file: %s", yamlQuote(registryCAPath(host))))
+				}
+				if registry.InsecureSkipVerify {
+					lines = append(lines, "      insecure_skip_verify: true")
+				}
+			}
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// writeK3SRegistries uploads the registry CAs and registries.yaml to node.
+func (t *Tools) writeK3SRegistries(node K3SNode, registries RegistriesConfig) error {
+	if registries.empty() {
+		return nil
+	}
+
+	for _, host := range sortedKeys(registries.Configs) {
+		caFile := registries.Configs[host].CAFile
+		if caFile == "" {
+			continue
+		}
+		caContent, err := os.ReadFile(caFile)
+		if err != nil {
+			return fmt.Errorf("failed reading CA for registry %s: %w", host, err)
+		}
+		if _, err := t.RunCommand("sudo mkdir -p "+k3sRegistryCertDir, node); err != nil {
+			return fmt.Errorf("failed creating %s: %w", k3sRegistryCertDir, err)
+		}
+		if err := t.writeRemoteFile(node, registryCAPath(host), strings.TrimSpace(string(caContent))); err != nil {
+			return fmt.Errorf("failed writing CA for registry %s: %w", host, err)
+		}
+	}
+
+	if err := t.writeRemoteFile(node, "/etc/rancher/k3s/registries.yaml", buildK3SRegistriesContent(registries)); err != nil {
+		return fmt.Errorf("failed writing registries config: %w", err)
+	}
+	return nil
+}
+
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
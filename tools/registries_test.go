@@ -0,0 +1,81 @@
+package toolkit
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func loadRegistriesTestConfig(t *testing.T, content string) {
+	t.Helper()
+	configPath := filepath.Join(t.TempDir(), "tool-config.yml")
+	if err := os.WriteFile(configPath, []byte(content), 0o644); err != nil {
+		t.Fatalf("failed to write temp config: %v", err)
+	}
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	viper.SetConfigFile(configPath)
+	if err := viper.ReadInConfig(); err != nil {
+		t.Fatalf("failed to read temp config: %v", err)
+	}
+}
+
+func TestConfiguredRegistriesKeepsRewriteCase(t *testing.T) {
+	loadRegistriesTestConfig(t, `registries:
+  mirrors:
+    Docker.io:
+      endpoints: ["https://mirror.example.com"]
+      rewrites:
+        "^Rancher/(.*)": "Mirrored/Rancher/$1"
+`)
+
+	registries, err := ConfiguredRegistries()
+	if err != nil {
+		t.Fatalf("ConfiguredRegistries returned error: %v", err)
+	}
+	rewrites := registries.Mirrors["docker.io"].Rewrites
+	if rewrites["^Rancher/(.*)"] != "Mirrored/Rancher/$1" || len(rewrites) != 1 {
+		t.Fatalf("expected the rewrite regex with its case, got %v", rewrites)
+	}
+}
+
+func TestBuildK3SRegistriesContent(t *testing.T) {
+	t.Setenv("STG_REGISTRY_PASSWORD", "from-env")
+	content := buildK3SRegistriesContent(RegistriesConfig{
+		Mirrors: map[string]RegistryMirror{
+			"docker.io": {
+				Endpoints: []string{"https://mirror.example.com"},
+				Rewrites:  map[string]string{"^Rancher/(.*)": "mirrored/$1"},
+			},
+		},
+		Configs: map[string]RegistryConfig{
+			"stgregistry.example.com": {Username: "qa", PasswordEnv: "STG_REGISTRY_PASSWORD", CAFile: "ca.pem"},
+			"mirror.example.com:5000": {InsecureSkipVerify: true},
+		},
+	})
+
+	want := strings.Join([]string{
+		`mirrors:`,
+		`  "docker.io":`,
+		`    endpoint:`,
+		`      - "https://mirror.example.com"`,
+		`    rewrite:`,
+		`      "^Rancher/(.*)": "mirrored/$1"`,
+		`configs:`,
+		`  "mirror.example.com:5000":`,
+		`    tls:`,
+		`      insecure_skip_verify: true`,
+		`  "stgregistry.example.com":`,
+		`    auth:`,
+		`      username: "qa"`,
+		`      password: "from-env"`,
+		`    tls:`,
+		`      ca_file: "/etc/rancher/k3s/certs/stgregistry.example.com-ca.pem"`,
+	}, "\n")
+	if content != want {
+		t.Fatalf("unexpected registries.yaml:\n%s\nwant:\n%s", content, want)
+	}
+}
@@ -7,11 +7,12 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	neturl "net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -19,32 +20,62 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ssm"
 	"github.com/spf13/viper"
 )
 
 const (
 	randomStringSource = "abcdefghijklmnopqrstuvwxyz"
+
+	// DefaultAWSRegion is used when tf_vars.aws_region is not set.
+	DefaultAWSRegion = "us-east-2"
+
+	importPollTimeout  = 5 * time.Minute
+	importPollInterval = 5 * time.Second
 )
 
 var (
 	awsClientsMu sync.Mutex
 	awsSession   *session.Session
-	ec2Client    *ec2.EC2
 	ssmClient    *ssm.SSM
-	instanceIDs  sync.Map
 	ssmOnline    sync.Map
 )
 
 type Tools struct{}
 
+// K3SNode identifies a node by its EC2 instance ID. The public IP and the
+// stable address (an Elastic IP or per-node DNS name) are attributes only.
+type K3SNode struct {
+	InstanceID string `json:"instance_id"`
+	PublicIP   string `json:"public_ip"`
+	Address    string `json:"address"`
+}
+
 type K3SConfig struct {
 	DBPassword string
 	DBEndpoint string
 	RancherURL string
-	Node1IP    string
-	Node2IP    string
+	Node1      K3SNode
+	Node2      K3SNode
+}
+
+// Host is the address clients should use to reach the node.
+func (n K3SNode) Host() string {
+	if n.Address != "" {
+		return n.Address
+	}
+	return n.PublicIP
+}
+
+func (n K3SNode) String() string {
+	switch {
+	case n.InstanceID != "" && n.Host() != "":
+		return fmt.Sprintf("%s (%s)", n.InstanceID, n.Host())
+	case n.InstanceID != "":
+		return n.InstanceID
+	default:
+		return n.Host()
+	}
 }
 
 func (t *Tools) RandomString(n int) string {
@@ -57,7 +88,7 @@ func (t *Tools) RandomString(n int) string {
 	return string(s)
 }
 
-func (t *Tools) WaitForNodeReady(nodeIP string) error {
+func (t *Tools) WaitForNodeReady(node K3SNode) error {
 	timeout := time.After(5 * time.Minute)
 	poll := time.Tick(10 * time.Second)
 
@@ -66,7 +97,7 @@ func (t *Tools) WaitForNodeReady(nodeIP string) error {
 		case <-timeout:
 			return fmt.Errorf("timed out waiting for node to become ready")
 		case <-poll:
-			nodeStatus, err := t.RunCommand("sudo systemctl is-active k3s || true", nodeIP)
+			nodeStatus, err := t.RunCommand("sudo systemctl is-active k3s || true", node)
 			if err != nil {
 				return fmt.Errorf("failed to check node status: %w", err)
 			}
@@ -78,15 +109,17 @@ func (t *Tools) WaitForNodeReady(nodeIP string) error {
 	}
 }
 
-func (t *Tools) K3SHostInstall(config K3SConfig) string {
-	return t.installK3SCluster(config)
+func (t *Tools) K3SHostInstall(config K3SConfig) error {
+	_, err := t.installK3SCluster(config)
+	return err
 }
 
-func (t *Tools) K3STenantInstall(config K3SConfig) string {
+func (t *Tools) K3STenantInstall(config K3SConfig) (string, error) {
 	return t.installK3SCluster(config)
 }
 
-func (t *Tools) CreateToken(url string, password string) (string, error) {
+// Login logs in to Rancher as admin and returns a short-lived login token.
+func (t *Tools) Login(url string, password string) (string, error) {
 	loginPayload := LoginPayload{
 		Description:  t.RandomString(6),
 		ResponseType: "token",
@@ -104,17 +137,55 @@ func (t *Tools) CreateToken(url string, password string) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	defer resp.Body.Close()
 
 	b, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return "", err
 	}
+	if resp.StatusCode >= 300 {
+		return "", fmt.Errorf("login returned status %d", resp.StatusCode)
+	}
 
 	var loginResp LoginResponse
 	err = json.Unmarshal(b, &loginResp)
 	if err != nil {
 		return "", err
 	}
+	if loginResp.Token == "" {
+		return "", fmt.Errorf("login returned no token")
+	}
+	return loginResp.Token, nil
+}
+
+// Logout revokes a token returned by Login.
+func (t *Tools) Logout(url string, token string) error {
+	client := &http.Client{
+		Timeout: time.Second * 10,
+	}
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("https://%s/v3/tokens?action=logout", url), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+
+	response, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("logout returned status %d", response.StatusCode)
+	}
+	return nil
+}
+
+func (t *Tools) CreateToken(url string, password string) (string, error) {
+	loginToken, err := t.Login(url, password)
+	if err != nil {
+		return "", err
+	}
 
 	client := &http.Client{
 		Timeout: time.Second * 10,
@@ -138,7 +209,7 @@ func (t *Tools) CreateToken(url string, password string) (string, error) {
 		return "", err
 	}
 
-	bearer := fmt.Sprintf("Bearer %s", loginResp.Token)
+	bearer := fmt.Sprintf("Bearer %s", loginToken)
 	req.Header.Set("Authorization", bearer)
 
 	response, err := client.Do(req)
@@ -166,19 +237,20 @@ func (t *Tools) CreateToken(url string, password string) (string, error) {
 	return tokenRes.Token, nil
 }
 
-func (t *Tools) RunCommand(cmd string, pubIP string) (string, error) {
-	instanceID, err := getInstanceIDFromIP(pubIP)
-	if err != nil {
-		return "", fmt.Errorf("failed to resolve instance for %s: %w", pubIP, err)
+// RunCommand runs cmd on the node through SSM, addressed by its instance ID.
+func (t *Tools) RunCommand(cmd string, node K3SNode) (string, error) {
+	instanceID := node.InstanceID
+	if instanceID == "" {
+		return "", fmt.Errorf("node %s has no instance ID", node)
 	}
 
 	if err := waitForSSMAgent(instanceID, 5*time.Minute); err != nil {
-		return "", fmt.Errorf("ssm agent not ready for %s (%s): %w", pubIP, instanceID, err)
+		return "", fmt.Errorf("ssm agent not ready for %s: %w", node, err)
 	}
 
 	output, err := runCommandSSM(cmd, instanceID)
 	if err != nil {
-		return "", fmt.Errorf("failed to run command via ssm on %s (%s): %w", pubIP, instanceID, err)
+		return "", fmt.Errorf("failed to run command via ssm on %s: %w", node, err)
 	}
 
 	return output, nil
@@ -188,11 +260,11 @@ func initAWSClients() error {
 	awsClientsMu.Lock()
 	defer awsClientsMu.Unlock()
 
-	if awsSession != nil && ec2Client != nil && ssmClient != nil {
+	if awsSession != nil && ssmClient != nil {
 		return nil
 	}
 
-	cfg := aws.NewConfig().WithRegion(resolveAWSRegion())
+	cfg := aws.NewConfig().WithRegion(AWSRegion())
 	accessKey := strings.TrimSpace(os.Getenv("AWS_ACCESS_KEY_ID"))
 	secretKey := strings.TrimSpace(os.Getenv("AWS_SECRET_ACCESS_KEY"))
 	if accessKey == "" {
@@ -215,74 +287,19 @@ func initAWSClients() error {
 	}
 
 	awsSession = sess
-	ec2Client = ec2.New(sess)
 	ssmClient = ssm.New(sess)
 
 	return nil
 }
 
-func resolveAWSRegion() string {
-	if region := viper.GetString("tf_vars.aws_region"); region != "" {
-		return region
-	}
-	if region := viper.GetString("s3.region"); region != "" {
+// AWSRegion is the region the environment is deployed to. It is independent
+// of s3.region, which only locates the Terraform state bucket.
+func AWSRegion() string {
+	if region := strings.TrimSpace(viper.GetString("tf_vars.aws_region")); region != "" {
 		return region
 	}
 
-	return "us-east-2"
-}
-
-func getInstanceIDFromIP(ip string) (string, error) {
-	if err := initAWSClients(); err != nil {
-		return "", err
-	}
-
-	if cached, ok := instanceIDs.Load(ip); ok {
-		return cached.(string), nil
-	}
-
-	lookupFilters := [][]*ec2.Filter{
-		{
-			{
-				Name:   aws.String("ip-address"),
-				Values: []*string{aws.String(ip)},
-			},
-			{
-				Name:   aws.String("instance-state-name"),
-				Values: []*string{aws.String(ec2.InstanceStateNamePending), aws.String(ec2.InstanceStateNameRunning)},
-			},
-		},
-		{
-			{
-				Name:   aws.String("private-ip-address"),
-				Values: []*string{aws.String(ip)},
-			},
-			{
-				Name:   aws.String("instance-state-name"),
-				Values: []*string{aws.String(ec2.InstanceStateNamePending), aws.String(ec2.InstanceStateNameRunning)},
-			},
-		},
-	}
-
-	for _, filters := range lookupFilters {
-		result, err := ec2Client.DescribeInstances(&ec2.DescribeInstancesInput{Filters: filters})
-		if err != nil {
-			return "", fmt.Errorf("failed describing ec2 instances for %s: %w", ip, err)
-		}
-
-		for _, reservation := range result.Reservations {
-			for _, instance := range reservation.Instances {
-				if instance.InstanceId == nil {
-					continue
-				}
-
-				instanceIDs.Store(ip, aws.StringValue(instance.InstanceId))
-				return aws.StringValue(instance.InstanceId), nil
-			}
-		}
-	}
-
-	return "", fmt.Errorf("no ec2 instance found for ip %s", ip)
+	return DefaultAWSRegion
 }
 
 func waitForSSMAgent(instanceID string, maxWait time.Duration) error {
@@ -400,7 +417,7 @@ func (t *Tools) CreateImport(url string, token string, tenantIndex int) error {
 			Name      string `json:"name"`
 		}{
 			Namespace: "fleet-default",
-			Name:      fmt.Sprintf("imported-tenant-%d", tenantIndex),
+			Name:      importClusterName(tenantIndex),
 		},
 		Spec: struct{}{},
 	}
@@ -432,86 +449,112 @@ func (t *Tools) CreateImport(url string, token string, tenantIndex int) error {
 			log.Println(err)
 		}
 	}(response.Body)
-	return nil
-}
 
-func (t *Tools) GetManifestUrl(url string, token string) string {
-	client := &http.Client{
-		Timeout: time.Second * 10,
+	if response.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		return fmt.Errorf("creating cluster %s returned status %d: %s", importClusterName(tenantIndex), response.StatusCode, strings.TrimSpace(string(body)))
 	}
+	return nil
+}
 
-	registrationUrl := fmt.Sprintf("https://%s/v3/clusterregistrationtokens", url)
-	req, err := http.NewRequest("GET", registrationUrl, nil)
+// ImportClusterID waits for the imported-tenant-N provisioning cluster to
+// report its management cluster ID (status.clusterName, e.g. c-m-abc12345).
+func (t *Tools) ImportClusterID(url string, token string, tenantIndex int) (string, error) {
+	path := fmt.Sprintf("/v1/provisioning.cattle.io.clusters/fleet-default/%s", importClusterName(tenantIndex))
 
-	if err != nil {
-		log.Println(err)
+	var lastErr error
+	deadline := time.Now().Add(importPollTimeout)
+	for time.Now().Before(deadline) {
+		var cluster struct {
+			Status struct {
+				ClusterName string `json:"clusterName"`
+			} `json:"status"`
+		}
+		lastErr = rancherGet(url, token, path, &cluster)
+		if lastErr == nil && cluster.Status.ClusterName != "" {
+			return cluster.Status.ClusterName, nil
+		}
+		time.Sleep(importPollInterval)
 	}
+	if lastErr != nil {
+		return "", fmt.Errorf("timed out waiting for %s to get a management cluster: %w", importClusterName(tenantIndex), lastErr)
+	}
+	return "", fmt.Errorf("timed out waiting for %s to get a management cluster", importClusterName(tenantIndex))
+}
 
-	bearer := fmt.Sprintf("Bearer %s", token)
-
-	req.Header.Set("Authorization", bearer)
+// GetManifestUrl waits for the registration token of the management cluster
+// clusterID and returns its import manifest URL. Only that cluster's tokens
+// are considered, so overlapping imports cannot pick up each other's manifest.
+func (t *Tools) GetManifestUrl(url string, token string, clusterID string) (string, error) {
+	path := fmt.Sprintf("/v3/clusterregistrationtokens?clusterId=%s", neturl.QueryEscape(clusterID))
 
-	response, err := client.Do(req)
-	if err != nil {
-		log.Println(err)
-	}
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		if err != nil {
-			log.Println(err)
+	var lastErr error
+	deadline := time.Now().Add(importPollTimeout)
+	for time.Now().Before(deadline) {
+		var regResponse RegistrationResponse
+		lastErr = rancherGet(url, token, path, &regResponse)
+		if lastErr == nil {
+			if manifestURL := clusterManifestURL(regResponse, clusterID); manifestURL != "" {
+				return manifestURL, nil
+			}
 		}
-	}(response.Body)
+		time.Sleep(importPollInterval)
+	}
+	if lastErr != nil {
+		return "", fmt.Errorf("timed out waiting for the registration token of cluster %s: %w", clusterID, lastErr)
+	}
+	return "", fmt.Errorf("timed out waiting for the registration token of cluster %s", clusterID)
+}
 
-	registrationBytes, err := io.ReadAll(response.Body)
-	if err != nil {
-		log.Println(err)
+// clusterManifestURL picks the newest token of clusterID that has a manifest
+// URL. The clusterId query already filters the list; the check here keeps a
+// Rancher that ignores the filter from handing back another cluster's token.
+func clusterManifestURL(regResponse RegistrationResponse, clusterID string) string {
+	manifestURL := ""
+	var newest int64
+	for _, item := range regResponse.Data {
+		if item.ClusterID != clusterID || item.ManifestURL == "" {
+			continue
+		}
+		if manifestURL == "" || item.CreatedTS > newest {
+			manifestURL = item.ManifestURL
+			newest = item.CreatedTS
+		}
 	}
+	return manifestURL
+}
 
-	var regResponse RegistrationResponse
-	err = json.Unmarshal(registrationBytes, &regResponse)
+// rancherGet sends an authenticated GET to the Rancher API and decodes the
+// response into out.
+func rancherGet(url string, token string, path string, out interface{}) error {
+	client := &http.Client{
+		Timeout: time.Second * 10,
+	}
 
+	req, err := http.NewRequest("GET", fmt.Sprintf("https://%s%s", url, path), nil)
 	if err != nil {
-		log.Println(err)
+		return err
 	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
 
-	err = json.Unmarshal(registrationBytes, &regResponse)
+	response, err := client.Do(req)
 	if err != nil {
-		log.Println(err)
+		return err
 	}
+	defer response.Body.Close()
 
-	// Create a new slice to store the sorted data
-	sortedData := make([]struct {
-		ID          string `json:"id"`
-		Type        string `json:"type"`
-		ManifestURL string `json:"manifestUrl"`
-		CreatedTS   int64  `json:"createdTS"`
-	}, len(regResponse.Data))
-
-	// Copy the relevant fields from regResponse.Data to sortedData
-	for i, item := range regResponse.Data {
-		sortedData[i] = struct {
-			ID          string `json:"id"`
-			Type        string `json:"type"`
-			ManifestURL string `json:"manifestUrl"`
-			CreatedTS   int64  `json:"createdTS"`
-		}{
-			ID:          item.ID,
-			Type:        item.Type,
-			ManifestURL: item.ManifestURL,
-			CreatedTS:   item.CreatedTS,
-		}
+	if response.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		return fmt.Errorf("GET %s returned status %d: %s", path, response.StatusCode, strings.TrimSpace(string(body)))
 	}
-
-	// Sort the new slice based on the CreatedTS field in descending order
-	sort.Slice(sortedData, func(i, j int) bool {
-		return sortedData[i].CreatedTS > sortedData[j].CreatedTS
-	})
-
-	if len(sortedData) > 0 {
-		return sortedData[0].ManifestURL
+	if err := json.NewDecoder(response.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to parse %s response: %w", path, err)
 	}
+	return nil
+}
 
-	return ""
+func importClusterName(tenantIndex int) string {
+	return fmt.Sprintf("imported-tenant-%d", tenantIndex)
 }
 
 func (t *Tools) CallBashScript(serverUrl, rancherToken string) error {
@@ -534,91 +577,107 @@ func (t *Tools) CallBashScript(serverUrl, rancherToken string) error {
 	return err
 }
 
-func (t *Tools) SetupImport(url string, tkn string, tenantIndex int) {
+// SetupImport creates the imported-tenant-N cluster in the host Rancher and
+// returns that cluster's import manifest URL. It also writes an import.sh for
+// applying the manifest by hand with kubectl.
+func (t *Tools) SetupImport(url string, tkn string, tenantIndex int) (string, error) {
+	if err := t.CreateImport(url, tkn, tenantIndex); err != nil {
+		return "", fmt.Errorf("error creating import: %w", err)
+	}
 
-	err := t.CreateImport(url, tkn, tenantIndex)
+	clusterID, err := t.ImportClusterID(url, tkn, tenantIndex)
 	if err != nil {
-		log.Fatalf("error creating import: %v", err)
+		return "", err
 	}
+	log.Printf("Cluster %s is management cluster %s", importClusterName(tenantIndex), clusterID)
 
-	time.Sleep(time.Second * 30)
-	manifestUrl := t.GetManifestUrl(url, tkn)
-	if manifestUrl == "" {
-		log.Fatal("error from tools.go > SetupImport > manifestUrl is empty")
+	manifestUrl, err := t.GetManifestUrl(url, tkn, clusterID)
+	if err != nil {
+		return "", err
 	}
 
-	err = t.GenerateKubectlImportScript(tenantIndex, manifestUrl)
-	if err != nil {
-		log.Fatalf("error generating import script: %v", err)
+	if err := t.GenerateKubectlImportScript(tenantIndex, manifestUrl); err != nil {
+		return "", fmt.Errorf("error generating import script: %w", err)
 	}
 
-	err = os.Setenv("MANIFEST_URL", manifestUrl)
-	if err != nil {
+	if err := os.Setenv("MANIFEST_URL", manifestUrl); err != nil {
 		log.Printf("error setting MANIFEST_URL env var: %v", err)
 	}
+	return manifestUrl, nil
 }
 
-func (t *Tools) installK3SCluster(config K3SConfig) string {
+// installK3SCluster installs K3s on both nodes of config and returns the
+// server URL of the first. It stops at the first step that fails.
+func (t *Tools) installK3SCluster(config K3SConfig) (string, error) {
 	k3sVersion := viper.GetString("k3s.version")
 
-	if err := t.prepareK3SNode(config.Node1IP, config, "SECRET", k3sVersion); err != nil {
-		log.Printf("failed preparing first K3s node %s: %v", config.Node1IP, err)
+	if err := t.prepareK3SNode(config.Node1, config, "SECRET", k3sVersion); err != nil {
+		return "", fmt.Errorf("failed preparing first K3s node %s: %w", config.Node1, err)
 	}
 
-	if err := t.installK3SServer(config.Node1IP, k3sVersion); err != nil {
-		log.Printf("failed installing K3s on first node %s: %v", config.Node1IP, err)
+	if err := t.installK3SServer(config.Node1, k3sVersion); err != nil {
+		return "", fmt.Errorf("failed installing K3s on first node %s: %w", config.Node1, err)
 	}
 
-	token, err := t.waitForK3SToken(config.Node1IP)
+	token, err := t.waitForK3SToken(config.Node1)
 	if err != nil {
-		log.Printf("failed waiting for first K3s node token on %s: %v", config.Node1IP, err)
+		return "", fmt.Errorf("failed waiting for first K3s node token on %s: %w", config.Node1, err)
 	}
 
-	if err := t.WaitForNodeReady(config.Node1IP); err != nil {
-		log.Printf("first K3s node %s is not ready: %v", config.Node1IP, err)
-		t.logK3SDiagnostics(config.Node1IP)
+	if err := t.WaitForNodeReady(config.Node1); err != nil {
+		t.logK3SDiagnostics(config.Node1)
+		return "", fmt.Errorf("first K3s node %s is not ready: %w", config.Node1, err)
 	}
 
-	if err := t.prepareK3SNode(config.Node2IP, config, token, k3sVersion); err != nil {
-		log.Printf("failed preparing second K3s node %s: %v", config.Node2IP, err)
+	if err := t.prepareK3SNode(config.Node2, config, token, k3sVersion); err != nil {
+		return "", fmt.Errorf("failed preparing second K3s node %s: %w", config.Node2, err)
 	}
 
-	if err := t.installK3SServer(config.Node2IP, k3sVersion); err != nil {
-		log.Printf("failed installing K3s on second node %s: %v", config.Node2IP, err)
+	if err := t.installK3SServer(config.Node2, k3sVersion); err != nil {
+		return "", fmt.Errorf("failed installing K3s on second node %s: %w", config.Node2, err)
 	}
 
-	if err := t.WaitForNodeReady(config.Node2IP); err != nil {
-		log.Printf("second K3s node %s is not ready: %v", config.Node2IP, err)
-		t.logK3SDiagnostics(config.Node2IP)
+	if err := t.WaitForNodeReady(config.Node2); err != nil {
+		t.logK3SDiagnostics(config.Node2)
+		return "", fmt.Errorf("second K3s node %s is not ready: %w", config.Node2, err)
 	}
 
-	return fmt.Sprintf("https://%s:6443", config.Node1IP)
+	return fmt.Sprintf("https://%s:6443", config.Node1.Host()), nil
 }
 
-func (t *Tools) prepareK3SNode(nodeIP string, config K3SConfig, token, version string) error {
-	if _, err := t.RunCommand("sudo mkdir -p /etc/rancher/k3s /var/lib/rancher/k3s/agent/images", nodeIP); err != nil {
+func (t *Tools) prepareK3SNode(node K3SNode, config K3SConfig, token, version string) error {
+	if _, err := t.RunCommand("sudo mkdir -p /etc/rancher/k3s /var/lib/rancher/k3s/agent/images", node); err != nil {
 		return fmt.Errorf("failed creating K3s directories: %w", err)
 	}
 
-	configContent := buildK3SConfigContent(config, token, nodeIP)
-	if err := t.writeRemoteFile(nodeIP, "/etc/rancher/k3s/config.yaml", configContent); err != nil {
+	configContent := buildK3SConfigContent(config, token, node)
+	if err := t.writeRemoteFile(node, "/etc/rancher/k3s/config.yaml", configContent); err != nil {
 		return fmt.Errorf("failed writing K3s config: %w", err)
 	}
 
-	dockerHubUser, dockerHubPassword := dockerHubCredentials()
-	if dockerHubUser != "" && dockerHubPassword != "" {
-		registriesContent := buildK3SRegistriesContent(dockerHubUser, dockerHubPassword)
-		if err := t.writeRemoteFile(nodeIP, "/etc/rancher/k3s/registries.yaml", registriesContent); err != nil {
-			return fmt.Errorf("failed writing registries config: %w", err)
-		}
+	registries, err := ConfiguredRegistries()
+	if err != nil {
+		return err
+	}
+	if err := t.writeK3SRegistries(node, registries); err != nil {
+		return err
 	}
 
-	if !viper.GetBool("k3s.preload_images") {
+	return t.preloadK3SImages(node, version)
+}
+
+// preloadK3SImages places the verified K3s image bundle for version in the
+// K3s image import directory when preloading or airgap mode is enabled.
+func (t *Tools) preloadK3SImages(node K3SNode, version string) error {
+	if !viper.GetBool("k3s.preload_images") && !AirgapEnabled() {
 		return nil
 	}
 
-	airgapURL := buildK3SAirgapImageURL(version)
-	airgapSHA256, err := k3SChecksumForVersion("k3s.airgap_image_sha256s", version)
+	airgapURL, err := k3sArtifactURL(version, K3SAirgapImageAsset)
+	if err != nil {
+		return err
+	}
+	airgapSHA256, err := K3SArtifactSHA256(version, K3SAirgapImageAsset)
 	if err != nil {
 		return err
 	}
@@ -643,20 +702,35 @@ trap - EXIT`,
 		shellQuote(airgapURL),
 		shellQuote(airgapSHA256),
 	)
-	if _, err := t.RunCommand(cmd, nodeIP); err != nil {
-		return fmt.Errorf("failed preloading K3s images from %s: %w", airgapURL, err)
+	if _, err := t.RunCommand(cmd, node); err != nil {
+		return fmt.Errorf("failed preloading K3s %s images: %w", version, err)
 	}
 
 	return nil
 }
 
-func (t *Tools) installK3SServer(nodeIP, version string) error {
+func (t *Tools) installK3SServer(node K3SNode, version string) error {
 	installScriptSHA256, err := k3SChecksumForVersion("k3s.install_script_sha256s", version)
 	if err != nil {
 		return err
 	}
 
-	installScriptURL := buildK3SInstallScriptURL(version)
+	installScriptURL, err := k3sArtifactURL(version, K3SInstallScriptAsset)
+	if err != nil {
+		return err
+	}
+
+	// In airgap mode the binary comes from the staged release bundle and the
+	// installer only writes the service units; it must not fetch the SELinux
+	// RPM from the Rancher package repository either.
+	installEnv := "INSTALL_K3S_VERSION=" + shellQuote(version)
+	if AirgapEnabled() {
+		if err := t.installK3SBinary(node, version); err != nil {
+			return err
+		}
+		installEnv = "INSTALL_K3S_SKIP_DOWNLOAD=true INSTALL_K3S_SKIP_SELINUX_RPM=true " + installEnv
+	}
+
 	cmd := fmt.Sprintf(
 		`tmp_script="$(mktemp /tmp/k3s-install.XXXXXX)"
 trap 'rm -f "$tmp_script"' EXIT
@@ -672,30 +746,63 @@ if ! echo %s"  $tmp_script" | sha256sum -c -; then
   exit 1
 fi
 
-sudo INSTALL_K3S_VERSION=%s sh "$tmp_script" server`,
+sudo %s sh "$tmp_script" server`,
 		shellQuote(installScriptURL),
 		shellQuote(installScriptSHA256),
-		shellQuote(version),
+		installEnv,
 	)
-	if _, err := t.RunCommand(cmd, nodeIP); err != nil {
-		t.logK3SDiagnostics(nodeIP)
+	if _, err := t.RunCommand(cmd, node); err != nil {
+		t.logK3SDiagnostics(node)
 		return err
 	}
 
 	return nil
 }
 
-func (t *Tools) waitForK3SToken(nodeIP string) (string, error) {
+// RefreshK3SNodeAddresses rewrites tls-san and node-external-ip on both nodes
+// after their public IPs change, such as after an EC2 stop/start, and restarts K3s.
+func (t *Tools) RefreshK3SNodeAddresses(config K3SConfig) error {
+	for _, node := range []K3SNode{config.Node1, config.Node2} {
+		existingConfig, err := t.RunCommand("sudo cat /etc/rancher/k3s/config.yaml", node)
+		if err != nil {
+			return fmt.Errorf("failed reading K3s config on %s: %w", node, err)
+		}
+
+		token := k3SConfigToken(existingConfig)
+		if token == "" {
+			return fmt.Errorf("no token found in K3s config on %s", node)
+		}
+
+		configContent := buildK3SConfigContent(config, token, node)
+		if err := t.writeRemoteFile(node, "/etc/rancher/k3s/config.yaml", configContent); err != nil {
+			return fmt.Errorf("failed writing K3s config on %s: %w", node, err)
+		}
+
+		if _, err := t.RunCommand("sudo systemctl restart k3s", node); err != nil {
+			t.logK3SDiagnostics(node)
+			return fmt.Errorf("failed restarting K3s on %s: %w", node, err)
+		}
+
+		if err := t.WaitForNodeReady(node); err != nil {
+			t.logK3SDiagnostics(node)
+			return fmt.Errorf("K3s node %s is not ready after address refresh: %w", node, err)
+		}
+	}
+
+	return nil
+}
+
+func (t *Tools) waitForK3SToken(node K3SNode) (string, error) {
 	timeout := time.After(5 * time.Minute)
 	poll := time.Tick(10 * time.Second)
 
 	for {
 		select {
 		case <-timeout:
-			t.logK3SDiagnostics(nodeIP)
-			return "", fmt.Errorf("timed out waiting for K3s token on %s", nodeIP)
+			t.logK3SDiagnostics(node)
+			return "", fmt.Errorf("timed out waiting for K3s token on %s", node)
 		case <-poll:
-			token, err := t.RunCommand("sudo test -s /var/lib/rancher/k3s/server/token && sudo cat /var/lib/rancher/k3s/server/token", nodeIP)
+			token, err := t.RunCommand("sudo test -s /var/lib/rancher/k3s/server/token && sudo cat /var/lib/rancher/k3s/server/token", node)
 			if err != nil {
 				continue
 			}
@@ -707,33 +814,38 @@ func (t *Tools) waitForK3SToken(nodeIP string) (string, error) {
 	}
 }
 
-func (t *Tools) writeRemoteFile(nodeIP, path, content string) error {
+func (t *Tools) writeRemoteFile(node K3SNode, path, content string) error {
 	cmd := fmt.Sprintf("cat <<'EOF' | sudo tee %s >/dev/null\n%s\nEOF", shellQuote(path), content)
-	_, err := t.RunCommand(cmd, nodeIP)
+	_, err := t.RunCommand(cmd, node)
 	return err
 }
 
-func (t *Tools) logK3SDiagnostics(nodeIP string) {
+func (t *Tools) logK3SDiagnostics(node K3SNode) {
 	commands := []string{
 		"sudo systemctl status k3s --no-pager || true",
 		"sudo journalctl -u k3s --no-pager -n 50 || true",
 	}
 
 	for _, cmd := range commands {
-		output, err := t.RunCommand(cmd, nodeIP)
+		output, err := t.RunCommand(cmd, node)
 		if err != nil {
-			log.Printf("failed collecting diagnostics on %s with %q: %v", nodeIP, cmd, err)
+			log.Printf("failed collecting diagnostics on %s with %q: %v", node, cmd, err)
 			continue
 		}
-		log.Printf("K3s diagnostics from %s:\n%s", nodeIP, output)
+		log.Printf("K3s diagnostics from %s:\n%s", node, output)
 	}
 }
 
-func buildK3SConfigContent(config K3SConfig, token, nodeIP string) string {
+func buildK3SConfigContent(config K3SConfig, token string, node K3SNode) string {
 	tlsSANs := []string{
 		config.RancherURL,
-		config.Node1IP,
-		config.Node2IP,
+		config.Node1.Host(),
+		config.Node2.Host(),
+	}
+	for _, configNode := range []K3SNode{config.Node1, config.Node2} {
+		if configNode.PublicIP != configNode.Host() {
+			tlsSANs = append(tlsSANs, configNode.PublicIP)
+		}
 	}
 
 	lines := []string{
@@ -749,29 +861,33 @@ func buildK3SConfigContent(config K3SConfig, token, nodeIP string) string {
 		lines = append(lines, fmt.Sprintf("  - %s", yamlQuote(san)))
 	}
 
-	lines = append(lines, fmt.Sprintf("node-external-ip: %s", yamlQuote(nodeIP)))
-
-	return strings.Join(lines, "\n")
-}
+	if registry := SystemDefaultRegistry(); registry != "" {
+		lines = append(lines, fmt.Sprintf("system-default-registry: %s", yamlQuote(registry)))
+	}
 
-func buildK3SRegistriesContent(username, password string) string {
-	return strings.Join([]string{
-		"configs:",
-		"  docker.io:",
-		"    auth:",
-		fmt.Sprintf("      username: %s", yamlQuote(username)),
-		fmt.Sprintf("      password: %s", yamlQuote(password)),
-	}, "\n")
-}
+	// node-external-ip only takes IPs. With per-node DNS names the public IP
+	// changes on stop/start, so it is left unset rather than pinned.
+	if net.ParseIP(node.Host()) != nil {
+		lines = append(lines, fmt.Sprintf("node-external-ip: %s", yamlQuote(node.Host())))
+	}
 
-func buildK3SAirgapImageURL(version string) string {
-	escapedVersion := strings.ReplaceAll(version, "+", "%2B")
-	return fmt.Sprintf("https://github.com/k3s-io/k3s/releases/download/%s/k3s-airgap-images-amd64.tar.zst", escapedVersion)
+	return strings.Join(lines, "\n")
 }
 
-func buildK3SInstallScriptURL(version string) string {
-	escapedVersion := strings.ReplaceAll(version, "+", "%2B")
-	return fmt.Sprintf("https://raw.githubusercontent.com/k3s-io/k3s/%s/install.sh", escapedVersion)
+func k3SConfigToken(configContent string) string {
+	for _, line := range strings.Split(configContent, "\n") {
+		value, found := strings.CutPrefix(strings.TrimSpace(line), "token:")
+		if !found {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		var unquoted string
+		if err := json.Unmarshal([]byte(value), &unquoted); err == nil {
+			return unquoted
+		}
+		return strings.Trim(value, `"'`)
+	}
+	return ""
 }
 
 func k3SChecksumForVersion(configKey, version string) (string, error) {
@@ -784,7 +900,8 @@ func k3SChecksumForVersion(configKey, version string) (string, error) {
 	return checksum, nil
 }
 
-func dockerHubCredentials() (string, string) {
+// DockerHubCredentials prefers the environment over the legacy dockerhub config block.
+func DockerHubCredentials() (string, string) {
 	username := strings.TrimSpace(os.Getenv("DOCKERHUB_USERNAME"))
 	password := strings.TrimSpace(os.Getenv("DOCKERHUB_PASSWORD"))
 	if username != "" || password != "" {
@@ -882,6 +999,7 @@ type RegistrationResponse struct {
 	Data []struct {
 		ID          string `json:"id"`
 		Type        string `json:"type"`
+		ClusterID   string `json:"clusterId"`
 		ManifestURL string `json:"manifestUrl"`
 		CreatedTS   int64  `json:"createdTS"`
 	} `json:"data"`
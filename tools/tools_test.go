@@ -0,0 +1,152 @@
+package toolkit
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestK3SConfigToken(t *testing.T) {
+	cases := []struct {
+		name   string
+		config string
+		want   string
+	}{
+		{"json quoted", "write-kubeconfig-mode: \"0644\"\ntoken: \"K10abc::server:def\"\ntls-san:\n  - \"1.2.3.4\"", "K10abc::server:def"},
+		{"single quoted", "token: 'secret'", "secret"},
+		{"bare and indented", "  token:   secret  \n", "secret"},
+		{"escaped quote", `token: "a\"b"`, `a"b`},
+		{"first token wins", "token: \"one\"\ntoken: \"two\"", "one"},
+		{"agent token is not the token", "agent-token: \"agent\"", ""},
+		{"missing", "cluster-init: true", ""},
+	}
+	for _, tc := range cases {
+		if got := k3SConfigToken(tc.config); got != tc.want {
+			t.Fatalf("%s: expected %q, got %q", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestK3SNodeHostPrefersAddress(t *testing.T) {
+	cases := []struct {
+		node K3SNode
+		want string
+	}{
+		{K3SNode{InstanceID: "i-1", PublicIP: "3.1.1.1"}, "3.1.1.1"},
+		{K3SNode{InstanceID: "i-1", PublicIP: "3.1.1.1", Address: "18.2.2.2"}, "18.2.2.2"},
+		{K3SNode{InstanceID: "i-1", PublicIP: "3.1.1.1", Address: "node1.xyz.example.com"}, "node1.xyz.example.com"},
+		{K3SNode{InstanceID: "i-1"}, ""},
+	}
+	for _, tc := range cases {
+		if got := tc.node.Host(); got != tc.want {
+			t.Fatalf("%+v: expected %q, got %q", tc.node, tc.want, got)
+		}
+	}
+}
+
+func TestBuildK3SConfigContentNodeExternalIP(t *testing.T) {
+	elasticIPs := K3SConfig{
+		RancherURL: "xyz.example.com",
+		Node1:      K3SNode{PublicIP: "3.1.1.1", Address: "18.2.2.2"},
+		Node2:      K3SNode{PublicIP: "3.1.1.2", Address: "18.2.2.3"},
+	}
+	content := buildK3SConfigContent(elasticIPs, "secret", elasticIPs.Node1)
+	if !strings.Contains(content, `node-external-ip: "18.2.2.2"`) {
+		t.Fatalf("expected the node's Elastic IP as node-external-ip, got:\n%s", content)
+	}
+	for _, san := range []string{`"18.2.2.3"`, `"3.1.1.1"`, `"3.1.1.2"`} {
+		if !strings.Contains(content, "  - "+san) {
+			t.Fatalf("expected tls-san %s, got:\n%s", san, content)
+		}
+	}
+
+	dnsNames := K3SConfig{
+		RancherURL: "xyz.example.com",
+		Node1:      K3SNode{PublicIP: "3.1.1.1", Address: "node1.xyz.example.com"},
+		Node2:      K3SNode{PublicIP: "3.1.1.2", Address: "node2.xyz.example.com"},
+	}
+	content = buildK3SConfigContent(dnsNames, "secret", dnsNames.Node1)
+	if strings.Contains(content, "node-external-ip") {
+		t.Fatalf("expected no node-external-ip for a DNS name, got:\n%s", content)
+	}
+	if !strings.Contains(content, `  - "node1.xyz.example.com"`) {
+		t.Fatalf("expected the node name in tls-san, got:\n%s", content)
+	}
+}
+
+func TestParseK3SVersionOutput(t *testing.T) {
+	cases := []struct {
+		output string
+		want   string
+	}{
+		{"k3s version v1.32.5+k3s1 (8e8f2a47)\ngo version go1.23.8\n", "v1.32.5+k3s1"},
+		{"v1.33.1+k3s2", "v1.33.1+k3s2"},
+		{"k3s version v1.32.5-rc1+k3s1 (abc)", "v1.32.5-rc1+k3s1"},
+	}
+	for _, tc := range cases {
+		got, err := parseK3SVersionOutput(tc.output)
+		if err != nil || got != tc.want {
+			t.Fatalf("%q: expected %q, got %q (%v)", tc.output, tc.want, got, err)
+		}
+	}
+
+	for _, output := range []string{"", "command not found: k3s", "kubectl version v1.32.5"} {
+		if _, err := parseK3SVersionOutput(output); err == nil {
+			t.Fatalf("%q: expected an error", output)
+		}
+	}
+}
+
+func TestParseK3SNodeStatus(t *testing.T) {
+	cases := []struct {
+		output  string
+		version string
+		ready   bool
+	}{
+		{"v1.33.1+k3s1 True", "v1.33.1+k3s1", true},
+		{"v1.33.1+k3s1 Unknown\n", "v1.33.1+k3s1", false},
+		{"v1.32.5+k3s1", "v1.32.5+k3s1", false},
+		{"", "", false},
+	}
+	for _, tc := range cases {
+		version, ready := parseK3SNodeStatus(tc.output)
+		if version != tc.version || ready != tc.ready {
+			t.Fatalf("%q: expected %q ready=%t, got %q ready=%t", tc.output, tc.version, tc.ready, version, ready)
+		}
+	}
+}
+
+func TestClusterManifestURL(t *testing.T) {
+	cases := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"newest wins", `[
+			{"clusterId": "c-1", "manifestUrl": "https://host/v3/import/old.yaml", "createdTS": 100},
+			{"clusterId": "c-1", "manifestUrl": "https://host/v3/import/new.yaml", "createdTS": 300},
+			{"clusterId": "c-1", "manifestUrl": "https://host/v3/import/mid.yaml", "createdTS": 200}
+		]`, "https://host/v3/import/new.yaml"},
+		{"foreign cluster is ignored", `[
+			{"clusterId": "c-2", "manifestUrl": "https://host/v3/import/other.yaml", "createdTS": 900},
+			{"clusterId": "c-1", "manifestUrl": "https://host/v3/import/mine.yaml", "createdTS": 100}
+		]`, "https://host/v3/import/mine.yaml"},
+		{"empty manifest URL is skipped", `[
+			{"clusterId": "c-1", "manifestUrl": "https://host/v3/import/ready.yaml", "createdTS": 100},
+			{"clusterId": "c-1", "manifestUrl": "", "createdTS": 200}
+		]`, "https://host/v3/import/ready.yaml"},
+		{"no usable token", `[
+			{"clusterId": "c-2", "manifestUrl": "https://host/v3/import/other.yaml", "createdTS": 100},
+			{"clusterId": "c-1", "manifestUrl": "", "createdTS": 200}
+		]`, ""},
+	}
+	for _, tc := range cases {
+		var response RegistrationResponse
+		if err := json.Unmarshal([]byte(`{"data": `+tc.data+`}`), &response); err != nil {
+			t.Fatalf("%s: invalid test data: %v", tc.name, err)
+		}
+		if got := clusterManifestURL(response, "c-1"); got != tc.want {
+			t.Fatalf("%s: expected %q, got %q", tc.name, tc.want, got)
+		}
+	}
+}